@@ -1,7 +1,13 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
 	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"../../utils"
 	"../../nfsbroker"
@@ -10,7 +16,9 @@ import (
 	"code.cloudfoundry.org/cflager"
 
 	"code.cloudfoundry.org/lager"
+	"github.com/gorilla/mux"
 	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/auth"
 	ioutilshim "code.cloudfoundry.org/goshims/ioutil"
 
 	"github.com/tedsuo/ifrit"
@@ -55,6 +63,162 @@ var defaultMountPath = flag.String(
 	"local director to mount within",
 )
 
+var quotaBackend = flag.String(
+	"quotaBackend",
+	"none",
+	"filesystem quota backend enforcing instance sizes on the share directories: none, xfs or ext4",
+)
+
+var snapshotBackend = flag.String(
+	"snapshotBackend",
+	"none",
+	"backend taking the snapshots of shares: none, copy, hardlink, btrfs, which creates the shares as subvolumes, or zfs",
+)
+
+var exportPath = flag.String(
+	"exportPath",
+	"",
+	"local path of the export, required by the btrfs and zfs snapshot backends which need the broker to run on the nfs server",
+)
+
+var zfsDataset = flag.String(
+	"zfsDataset",
+	"",
+	"zfs dataset of the export, required by the zfs snapshot backend",
+)
+
+var mountOptions = flag.String(
+	"mountOptions",
+	"",
+	"nfs mount options of the export, such as \"vers=4.1,hard,timeo=600\", used by the broker and passed to the cells",
+)
+
+var backendsPath = flag.String(
+	"backendsPath",
+	"",
+	"path to a JSON file listing the nfs backends shares are placed on, replaces the remoteInfo, remoteMount and version flags",
+)
+
+var placementPolicy = flag.String(
+	"placementPolicy",
+	"round-robin",
+	"how the backend of a new instance is chosen among the backends with enough capacity: round-robin or least-used",
+)
+
+var highWaterMark = flag.Float64(
+	"highWaterMark",
+	90,
+	"percentage of the filesystem of a backend in use above which no new instances are placed on it, unless the backend sets its own",
+)
+
+var capacityInterval = flag.Duration(
+	"capacityInterval",
+	time.Minute,
+	"interval between the updates of the backend capacity metrics and the checks the health endpoints report",
+)
+
+var inventoryInterval = flag.Duration(
+	"inventoryInterval",
+	5*time.Minute,
+	"interval between the updates of the instance, binding and share usage metrics, 0 to disable them",
+)
+
+var mountProbeInterval = flag.Duration(
+	"mountProbeInterval",
+	30*time.Second,
+	"interval between the probes of the mounted exports, 0 disables the supervision of the mounts",
+)
+
+var mountProbeTimeout = flag.Duration(
+	"mountProbeTimeout",
+	10*time.Second,
+	"time after which a probe hanging on a mounted export counts as failed",
+)
+
+var remountMaxBackoff = flag.Duration(
+	"remountMaxBackoff",
+	5*time.Minute,
+	"longest wait between two attempts to mount a failed export again",
+)
+
+var commandTimeout = flag.Duration(
+	"commandTimeout",
+	5*time.Minute,
+	"time after which commands such as mount, cp, kadmin and the quota tools are killed and walks of whole shares abandoned, 0 for no limit",
+)
+
+var filesystemTimeout = flag.Duration(
+	"filesystemTimeout",
+	30*time.Second,
+	"time after which a single filesystem call on an export, such as mkdir or stat, is abandoned, 0 for no limit",
+)
+
+var filesystemWorkers = flag.Int(
+	"filesystemWorkers",
+	nfsbroker.DefaultFilesystemWorkers,
+	"filesystem calls running at once per backend, a call blocked on a hung export keeps its worker",
+)
+
+var operationTimeout = flag.Duration(
+	"operationTimeout",
+	0,
+	"time after which the calls to the backends made for a request or an asynchronous operation fail, 0 leaves them bounded by the command and filesystem timeouts only",
+)
+
+var tenantLimitsPath = flag.String(
+	"tenantLimitsPath",
+	"",
+	"path to a JSON file with the instance count, reserved storage and plans allowed per organization and space guid",
+)
+
+var kdcBackend = flag.String(
+	"kdcBackend",
+	"none",
+	"kdc issuing the kerberos principals of plans with kerberos set: none, mit or fake",
+)
+
+var kerberosRealm = flag.String(
+	"kerberosRealm",
+	"",
+	"kerberos realm of the principals issued to instances and bindings",
+)
+
+var kdcAdminPrincipal = flag.String(
+	"kdcAdminPrincipal",
+	"",
+	"principal kadmin authenticates with, for the mit kdc backend",
+)
+
+var kdcAdminKeytab = flag.String(
+	"kdcAdminKeytab",
+	"",
+	"keytab of the kadmin principal, for the mit kdc backend",
+)
+
+var keytabDir = flag.String(
+	"keytabDir",
+	"",
+	"directory the keytabs of the issued principals are kept in, for the mit kdc backend",
+)
+
+var inlineKeytabs = flag.Bool(
+	"inlineKeytabs",
+	false,
+	"hand out the keytabs of the issued principals in the binding credentials instead of their paths only",
+)
+
+var servicePrincipal = flag.String(
+	"servicePrincipal",
+	"",
+	"principal the broker logs in as before mounting exports with kerberos security, empty to use the host keytab",
+)
+
+var serviceKeytab = flag.String(
+	"serviceKeytab",
+	"",
+	"keytab of the service principal",
+)
+
 var serviceName = flag.String(
 	"serviceName",
 	"nfs",
@@ -85,6 +249,66 @@ var planDesc = flag.String(
 	"description of the service plan to register with cloud controller",
 )
 
+var catalogPath = flag.String(
+	"catalogPath",
+	"",
+	"path to a JSON or YAML (.yml, .yaml) catalog file describing the service and its plans, replaces the serviceName, serviceId and plan flags",
+)
+
+var stateStore = flag.String(
+	"stateStore",
+	"file",
+	"store keeping the broker's state: file for a single JSON file or kv for a key/value store with one file per record in dataDir, sql for a database shared by several brokers",
+)
+
+var sqlDriver = flag.String(
+	"sqlDriver",
+	"mysql",
+	"database driver of the sql state store: sqlite3, mysql or postgres",
+)
+
+var sqlDataSource = flag.String(
+	"sqlDataSource",
+	"",
+	"data source name of the sql state store, such as 'user:password@tcp(host:3306)/nfsbroker' for mysql",
+)
+
+var brokerId = flag.String(
+	"brokerId",
+	"",
+	"id of this broker among the brokers sharing a sql state store, defaults to the hostname",
+)
+
+var reconcileInterval = flag.Duration(
+	"reconcileInterval",
+	10*time.Minute,
+	"interval between the comparisons of the share directories with the instances, 0 disables them",
+)
+
+var quarantineOrphans = flag.Bool(
+	"quarantineOrphans",
+	false,
+	"move share directories found without an instance by two reconciler runs in a row into the .quarantine directory of the export",
+)
+
+var trashRetention = flag.Duration(
+	"trashRetention",
+	72*time.Hour,
+	"how long the data of deleted shares is kept in the .trash directory of the export before it is purged",
+)
+
+var trashPurgeInterval = flag.Duration(
+	"trashPurgeInterval",
+	time.Hour,
+	"interval between the purges of expired shares from the .trash directory",
+)
+
+var shareNameTemplate = flag.String(
+	"shareNameTemplate",
+	"",
+	"go template naming the share directory of new instances from .InstanceID, .Platform, .OrganizationGUID, .SpaceGUID, .Namespace and .InstanceName, defaults to the instance id",
+)
+
 var dataDir = flag.String(
 	"dataDir",
 	"",
@@ -121,41 +345,186 @@ func main() {
 	logger.Info("start")
 	defer logger.Info("ends")
 
-	server := createBrokerServer(logger)
+	members := createBrokerServer(logger)
 
 	if dbgAddr := debugserver.DebugAddress(flag.CommandLine);dbgAddr != "" {
-		server = utils.ProcessRunnerFor(grouper.Members{
-			{"debug-server", debugserver.Runner(dbgAddr,logSink)},
-			{"broker-api-server", server},
-		})
+		members = append(grouper.Members{
+			{Name: "debug-server", Runner: debugserver.Runner(dbgAddr,logSink)},
+		}, members...)
 	}
-	process := ifrit.Invoke(server)
+	process := ifrit.Invoke(utils.ProcessRunnerFor(members))
 	logger.Info("started-nfs-serverbroker", lager.Data{"brokerAddress": *listenAddress})
 	utils.UntilTerminated(logger, process)
 }
 
-func createBrokerServer(logger lager.Logger) ifrit.Runner {
-	controller := nfsbroker.NewController(nfsbroker.NewNfsClient(*nfsHost, *remoteMount, *nfsVer, *defaultMountPath))
-	serviceBroker := nfsbroker.New(
+func createBrokerServer(logger lager.Logger) grouper.Members {
+	backends, err := createBackends()
+	utils.ExitOnFailure(logger, err)
+	catalog := nfsbroker.NewCatalog(*serviceName, *serviceId, *planName, *planId, *planDesc, *displayName, *imageUrl)
+	if *catalogPath != "" {
+		catalog, err = nfsbroker.LoadCatalog(&ioutilshim.IoutilShim{}, *catalogPath)
+		utils.ExitOnFailure(logger, err)
+	}
+	store, err := nfsbroker.NewStore(*stateStore, *dataDir, catalog.ServiceName, *sqlDriver, *sqlDataSource)
+	utils.ExitOnFailure(logger, err)
+	if *brokerId == "" {
+		*brokerId, err = os.Hostname()
+		utils.ExitOnFailure(logger, err)
+	}
+	shareNamer, err := nfsbroker.NewShareNamer(*shareNameTemplate)
+	utils.ExitOnFailure(logger, err)
+	var tenantLimits *nfsbroker.TenantLimits
+	if *tenantLimitsPath != "" {
+		tenantLimits, err = nfsbroker.LoadTenantLimits(&ioutilshim.IoutilShim{}, *tenantLimitsPath)
+		utils.ExitOnFailure(logger, err)
+	}
+	kdc, err := nfsbroker.NewKdcAdapter(*kdcBackend, nfsbroker.NewRealInvoker(), nfsbroker.KdcConfig{
+		Realm:          *kerberosRealm,
+		AdminPrincipal: *kdcAdminPrincipal,
+		AdminKeytab:    *kdcAdminKeytab,
+		KeytabDir:      *keytabDir,
+		InlineKeytabs:  *inlineKeytabs,
+		Timeout:        *commandTimeout,
+	})
+	utils.ExitOnFailure(logger, err)
+	serviceBroker, err := nfsbroker.New(
 		logger,
-		controller,
-		*serviceName,
-		*serviceId,
-		*planName,
-		*planId,
-		*planDesc,
-		*displayName,
-		*imageUrl,
-		*dataDir,
-		&ioutilshim.IoutilShim{},
+		backends,
+		catalog,
+		store,
+		shareNamer,
+		tenantLimits,
+		kdc,
+		*brokerId,
+		*operationTimeout,
+	)
+	utils.ExitOnFailure(logger, err)
+	metrics := nfsbroker.NewMetrics()
+	backends.Instrument(metrics)
+	reconciler := nfsbroker.NewReconciler(logger, backends, store, metrics, *reconcileInterval, *quarantineOrphans)
+	purger := nfsbroker.NewPurger(logger, backends, *trashPurgeInterval, *trashRetention)
+	capacityMonitor := nfsbroker.NewCapacityMonitor(logger, serviceBroker, metrics, *capacityInterval)
+	inventoryMonitor := nfsbroker.NewInventoryMonitor(logger, serviceBroker, metrics, *inventoryInterval)
+	mountSupervisor := nfsbroker.NewMountSupervisor(logger, backends, metrics, *mountProbeInterval, *mountProbeTimeout, *remountMaxBackoff)
+
+	router := mux.NewRouter()
+	brokerapi.AttachRoutes(router, serviceBroker, logger.Session("broker-api"))
+	nfsbroker.AttachFetchRoutes(router, serviceBroker, logger.Session("broker-api"))
+	nfsbroker.AttachReconcilerRoutes(router, reconciler, logger)
+	nfsbroker.AttachTrashRoutes(router, purger, serviceBroker, logger)
+	nfsbroker.AttachSnapshotRoutes(router, serviceBroker, logger)
+	nfsbroker.AttachBackendRoutes(router, serviceBroker, logger)
+	nfsbroker.AttachConsumptionRoutes(router, serviceBroker, logger)
+	nfsbroker.AttachMetricsRoute(router, metrics, logger)
+	// the health endpoints are reachable without credentials, every other route needs them
+	healthRouter := mux.NewRouter()
+	nfsbroker.AttachHealthRoutes(healthRouter, serviceBroker, logger)
+	healthRouter.NotFoundHandler = auth.NewWrapper(*username, *password).Wrap(
+		nfsbroker.NewRequestContextHandler(router, serviceBroker, logger.Session("request-context")),
 	)
-	credentials := brokerapi.BrokerCredentials{Username:*username, Password:*password}
-	handler := brokerapi.New(serviceBroker, logger.Session("broker-api"), credentials)
-	return http_server.New(*listenAddress, handler)
+	handler := nfsbroker.NewMetricsHandler(healthRouter, metrics)
+
+	members := grouper.Members{
+		{Name: "broker-api-server", Runner: http_server.New(*listenAddress, handler)},
+	}
+	if *mountProbeInterval > 0 {
+		members = append(members, grouper.Member{Name: "mount-supervisor", Runner: mountSupervisor})
+	}
+	members = append(members, grouper.Members{
+		{Name: "trash-purger", Runner: purger},
+		{Name: "capacity-monitor", Runner: capacityMonitor},
+	}...)
+	if *reconcileInterval > 0 {
+		members = append(members, grouper.Member{Name: "reconciler", Runner: reconciler})
+	}
+	if *inventoryInterval > 0 {
+		members = append(members, grouper.Member{Name: "inventory-monitor", Runner: inventoryMonitor})
+	}
+	return members
+}
+
+// createBackends creates the backends of the backends file, or the default backend described by the flags.
+func createBackends() (*nfsbroker.Backends, error) {
+	configs := []nfsbroker.BackendConfig{{
+		Name:         nfsbroker.DefaultBackendName,
+		RemoteInfo:   *nfsHost,
+		RemoteMount:  *remoteMount,
+		Version:      *nfsVer,
+		MountPath:    *defaultMountPath,
+		ExportPath:   *exportPath,
+		ZfsDataset:   *zfsDataset,
+		MountOptions: *mountOptions,
+	}}
+	if *backendsPath != "" {
+		var err error
+		configs, err = nfsbroker.LoadBackendConfigs(&ioutilshim.IoutilShim{}, *backendsPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var service *nfsbroker.ServiceCredentials
+	if *servicePrincipal != "" {
+		if *serviceKeytab == "" {
+			return nil, errors.New("the service principal needs a service keytab")
+		}
+		service = &nfsbroker.ServiceCredentials{Principal: *servicePrincipal, Keytab: *serviceKeytab}
+	}
+
+	timeouts := nfsbroker.ClientTimeouts{
+		Command:           *commandTimeout,
+		Filesystem:        *filesystemTimeout,
+		FilesystemWorkers: *filesystemWorkers,
+	}
+	backends := []*nfsbroker.Backend{}
+	for _, config := range configs {
+		mountPath := config.MountPath
+		if mountPath == "" {
+			mountPath = filepath.Join(*defaultMountPath, config.Name)
+		}
+		quotaDriver, err := nfsbroker.NewQuotaDriver(*quotaBackend, nfsbroker.NewRealInvoker(), mountPath)
+		if err != nil {
+			return nil, err
+		}
+		snapshotDriver, err := nfsbroker.NewSnapshotDriver(*snapshotBackend, nfsbroker.NewRealInvoker(), mountPath, config.ExportPath, config.ZfsDataset)
+		if err != nil {
+			return nil, fmt.Errorf("backend '%s': %s", config.Name, err.Error())
+		}
+		limits, err := config.Limits(*highWaterMark)
+		if err != nil {
+			return nil, err
+		}
+		options, err := config.ParsedMountOptions()
+		if err != nil {
+			return nil, err
+		}
+		client := nfsbroker.NewNfsClient(config.RemoteInfo, config.RemoteMount, config.Version, options, service, mountPath, quotaDriver, snapshotDriver, timeouts)
+		backends = append(backends, nfsbroker.NewBackend(config.Name, limits, client))
+	}
+
+	policy, err := nfsbroker.NewPlacementPolicy(*placementPolicy)
+	if err != nil {
+		return nil, err
+	}
+	return nfsbroker.NewBackends(backends, policy)
 }
 
 func parseCommandLine() {
 	cflager.AddFlags(flag.CommandLine)
 	debugserver.AddFlags(flag.CommandLine)
 	flag.Parse()
+
+	if *stateStore == nfsbroker.StoreTypeSql && !sqlDriverRegistered(*sqlDriver) {
+		fmt.Fprintf(os.Stderr, "sql driver '%s' is not linked into the broker, available drivers: %s\n", *sqlDriver, strings.Join(sql.Drivers(), ", "))
+		os.Exit(2)
+	}
+}
+
+func sqlDriverRegistered(name string) bool {
+	for _, driver := range sql.Drivers() {
+		if driver == name {
+			return true
+		}
+	}
+	return false
 }
\ No newline at end of file
@@ -0,0 +1,8 @@
+package main
+
+// The database drivers of the sql state store, registered under the names of the -sqlDriver flag.
+import (
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
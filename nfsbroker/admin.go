@@ -0,0 +1,159 @@
+package nfsbroker
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// AttachReconcilerRoutes adds the admin endpoints reporting and triggering reconciler runs.
+func AttachReconcilerRoutes(router *mux.Router, reconciler *Reconciler, logger lager.Logger) {
+	logger = logger.Session("admin-reconcile")
+	router.HandleFunc("/admin/reconcile", func(w http.ResponseWriter, req *http.Request) {
+		respond(logger, w, http.StatusOK, reconciler.LastReport())
+	}).Methods("GET")
+	router.HandleFunc("/admin/reconcile", func(w http.ResponseWriter, req *http.Request) {
+		respond(logger, w, http.StatusOK, reconciler.Reconcile())
+	}).Methods("POST")
+}
+
+func respond(logger lager.Logger, w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		logger.Error("encoding-response", err, lager.Data{"status": status})
+	}
+}
+
+// AttachTrashRoutes adds the admin endpoints listing, purging and restoring deleted shares.
+// Trash names are unique per backend, the backend query parameter of a purge defaults to the default backend.
+// A restore is accepted as an update operation of the instance, polled with the last_operation endpoint.
+func AttachTrashRoutes(router *mux.Router, purger *Purger, restorer TrashRestorer, logger lager.Logger) {
+	logger = logger.Session("admin-trash")
+	router.HandleFunc("/admin/trash", func(w http.ResponseWriter, req *http.Request) {
+		entries, err := purger.List()
+		if err != nil {
+			respondAdminError(logger, w, err)
+			return
+		}
+		respond(logger, w, http.StatusOK, entries)
+	}).Methods("GET")
+
+	router.HandleFunc("/admin/trash/{name}", func(w http.ResponseWriter, req *http.Request) {
+		if err := purger.Purge(req.URL.Query().Get("backend"), mux.Vars(req)["name"]); err != nil {
+			respondAdminError(logger, w, err)
+			return
+		}
+		respond(logger, w, http.StatusOK, brokerapi.EmptyResponse{})
+	}).Methods("DELETE")
+
+	router.HandleFunc("/admin/trash/{name}/restore", func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			InstanceID string `json:"instance_id"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.InstanceID == "" {
+			respond(logger, w, http.StatusBadRequest, brokerapi.ErrorResponse{Description: "instance_id is required"})
+			return
+		}
+		if err := restorer.RestoreTrash(mux.Vars(req)["name"], body.InstanceID); err != nil {
+			respondAdminError(logger, w, err)
+			return
+		}
+		respond(logger, w, http.StatusAccepted, brokerapi.UpdateResponse{OperationData: OperationUpdate})
+	}).Methods("POST")
+}
+
+func respondAdminError(logger lager.Logger, w http.ResponseWriter, err error) {
+	switch err {
+	case brokerapi.ErrInstanceDoesNotExist, ErrSnapshotDoesNotExist, ErrBackendDoesNotExist:
+		respond(logger, w, http.StatusNotFound, brokerapi.ErrorResponse{Description: err.Error()})
+	case ErrOperationInProgress, ErrSnapshotAlreadyExists, ErrInstanceHasBindings:
+		respond(logger, w, http.StatusConflict, brokerapi.ErrorResponse{Description: err.Error()})
+	case ErrInvalidSnapshotName:
+		respond(logger, w, http.StatusBadRequest, brokerapi.ErrorResponse{Description: err.Error()})
+	case ErrSnapshotsNotSupported:
+		respond(logger, w, http.StatusNotImplemented, brokerapi.ErrorResponse{Description: err.Error()})
+	default:
+		logger.Error("admin-request-failed", err)
+		respond(logger, w, http.StatusInternalServerError, brokerapi.ErrorResponse{Description: err.Error()})
+	}
+}
+
+// AttachSnapshotRoutes adds the admin endpoints managing the snapshots of instances. A restore is accepted
+// as an update operation of the instance, polled with the last_operation endpoint.
+func AttachSnapshotRoutes(router *mux.Router, manager SnapshotManager, logger lager.Logger) {
+	logger = logger.Session("admin-snapshots")
+	router.HandleFunc("/admin/instances/{instance_id}/snapshots", func(w http.ResponseWriter, req *http.Request) {
+		snapshots, err := manager.ListSnapshots(mux.Vars(req)["instance_id"])
+		if err != nil {
+			respondAdminError(logger, w, err)
+			return
+		}
+		respond(logger, w, http.StatusOK, snapshots)
+	}).Methods("GET")
+
+	router.HandleFunc("/admin/instances/{instance_id}/snapshots", func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			respond(logger, w, http.StatusBadRequest, brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		}
+		snapshot, err := manager.CreateSnapshot(mux.Vars(req)["instance_id"], body.Name)
+		if err != nil {
+			respondAdminError(logger, w, err)
+			return
+		}
+		respond(logger, w, http.StatusCreated, snapshot)
+	}).Methods("POST")
+
+	router.HandleFunc("/admin/instances/{instance_id}/snapshots/{name}/restore", func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		if err := manager.RestoreSnapshot(vars["instance_id"], vars["name"]); err != nil {
+			respondAdminError(logger, w, err)
+			return
+		}
+		respond(logger, w, http.StatusAccepted, brokerapi.UpdateResponse{OperationData: OperationUpdate})
+	}).Methods("POST")
+
+	router.HandleFunc("/admin/instances/{instance_id}/snapshots/{name}", func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		if err := manager.DeleteSnapshot(vars["instance_id"], vars["name"]); err != nil {
+			respondAdminError(logger, w, err)
+			return
+		}
+		respond(logger, w, http.StatusOK, brokerapi.EmptyResponse{})
+	}).Methods("DELETE")
+}
+
+// AttachBackendRoutes adds the admin endpoint reporting the usage of the backends.
+func AttachBackendRoutes(router *mux.Router, reporter UsageReporter, logger lager.Logger) {
+	logger = logger.Session("admin-backends")
+	router.HandleFunc("/admin/backends", func(w http.ResponseWriter, req *http.Request) {
+		usage, err := reporter.BackendUsage()
+		if err != nil {
+			respondAdminError(logger, w, err)
+			return
+		}
+		respond(logger, w, http.StatusOK, usage)
+	}).Methods("GET")
+}
+
+// AttachConsumptionRoutes adds the admin endpoint reporting what organizations and spaces consume.
+func AttachConsumptionRoutes(router *mux.Router, reporter ConsumptionReporter, logger lager.Logger) {
+	logger = logger.Session("admin-consumption")
+	router.HandleFunc("/admin/consumption", func(w http.ResponseWriter, req *http.Request) {
+		consumption, err := reporter.Consumption()
+		if err != nil {
+			respondAdminError(logger, w, err)
+			return
+		}
+		respond(logger, w, http.StatusOK, consumption)
+	}).Methods("GET")
+}
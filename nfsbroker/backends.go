@@ -0,0 +1,559 @@
+package nfsbroker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/goshims/ioutil"
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	// name of the backend described by the remoteInfo, remoteMount and version flags
+	DefaultBackendName = "default"
+
+	PlacementRoundRobin = "round-robin"
+	PlacementLeastUsed  = "least-used"
+)
+
+var ErrBackendDoesNotExist = errors.New("backend does not exist")
+
+// reasons for a backend not to admit an instance, reported to the platform as brokerapi.ErrInstanceLimitMet, or as
+// brokerapi.ErrPlanQuotaExceeded when the quota of the instance is what does not fit
+var (
+	errBackendFull     = errors.New("the backend takes no more instances")
+	errQuotaDoesNotFit = errors.New("the quota of the instance does not fit on the backend")
+)
+
+// prefix of the leases holding the placements of the brokers sharing a store
+const placementLeasePrefix = "placement/"
+
+// BackendConfig describes an nfs export holding shares, as read from the backends file.
+type BackendConfig struct {
+	Name        string `json:"name"`
+	RemoteInfo  string `json:"remote_info"`
+	RemoteMount string `json:"remote_mount"`
+	Version     int    `json:"version"`
+	// size, such as "10T", the quotas of the instances of the backend may add up to, empty for no limit
+	Capacity string `json:"capacity,omitempty"`
+	// number of instances the backend holds at most, 0 for no limit
+	MaxInstances int `json:"max_instances,omitempty"`
+	// percentage of the filesystem in use above which no instances are placed on the backend,
+	// 0 for the default of the broker
+	HighWaterMark float64 `json:"high_water_mark,omitempty"`
+	// directory the broker mounts the export on, defaults to a directory named after the backend
+	MountPath string `json:"mount_path,omitempty"`
+	// local path of the export on the nfs server the broker runs on, for the btrfs and zfs snapshot backends
+	ExportPath string `json:"export_path,omitempty"`
+	// zfs dataset of the export, for the zfs snapshot backend
+	ZfsDataset string `json:"zfs_dataset,omitempty"`
+	// nfs mount options, such as "vers=4.1,hard,timeo=600", of the broker's and the cells' mounts
+	MountOptions string `json:"mount_options,omitempty"`
+}
+
+// LoadBackendConfigs reads a JSON file listing the backends of the broker.
+func LoadBackendConfigs(ioutil ioutilshim.Ioutil, backendsPath string) ([]BackendConfig, error) {
+	data, err := ioutil.ReadFile(backendsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backends file '%s': %s", backendsPath, err.Error())
+	}
+	configs := []BackendConfig{}
+	if err = json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse backends file '%s': %s", backendsPath, err.Error())
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("invalid backends file '%s': at least one backend is required", backendsPath)
+	}
+	for _, config := range configs {
+		if config.Name == "" || config.RemoteInfo == "" || config.RemoteMount == "" {
+			return nil, fmt.Errorf("invalid backends file '%s': backend name, remote_info and remote_mount are required", backendsPath)
+		}
+		switch config.Version {
+		case 3, 4:
+		default:
+			return nil, fmt.Errorf("invalid backends file '%s': backend '%s' has an unsupported nfs version %d", backendsPath, config.Name, config.Version)
+		}
+		if _, err := config.Limits(100); err != nil {
+			return nil, fmt.Errorf("invalid backends file '%s': %s", backendsPath, err.Error())
+		}
+		if _, err := config.ParsedMountOptions(); err != nil {
+			return nil, fmt.Errorf("invalid backends file '%s': %s", backendsPath, err.Error())
+		}
+	}
+	return configs, nil
+}
+
+// Limits parses the limits of the backend, defaultHighWaterMark applies unless the backend has its own.
+func (c BackendConfig) Limits(defaultHighWaterMark float64) (BackendLimits, error) {
+	limits := BackendLimits{MaxInstances: c.MaxInstances, HighWaterMark: c.HighWaterMark}
+	if c.Capacity != "" {
+		capacity, err := parseSize(c.Capacity)
+		if err != nil {
+			return BackendLimits{}, fmt.Errorf("backend '%s' has an invalid capacity '%s'", c.Name, c.Capacity)
+		}
+		limits.Capacity = capacity
+	}
+	if limits.HighWaterMark == 0 {
+		limits.HighWaterMark = defaultHighWaterMark
+	}
+	if c.MaxInstances < 0 || limits.HighWaterMark <= 0 || limits.HighWaterMark > 100 {
+		return BackendLimits{}, fmt.Errorf("backend '%s' has invalid limits", c.Name)
+	}
+	return limits, nil
+}
+
+// ParsedMountOptions validates the mount options of the backend, they may only name a minor version
+// of the nfs version of the backend.
+func (c BackendConfig) ParsedMountOptions() (MountOptions, error) {
+	options, err := ParseMountOptions(c.MountOptions)
+	if err != nil {
+		return nil, fmt.Errorf("backend '%s' has invalid mount options: %s", c.Name, err.Error())
+	}
+	if version := options.MajorVersion(); version != 0 && version != c.Version {
+		return nil, fmt.Errorf("backend '%s' has mount options for nfs version %d instead of %d", c.Name, version, c.Version)
+	}
+	return options, nil
+}
+
+// BackendLimits decide whether a backend admits a new instance.
+type BackendLimits struct {
+	// bytes the quotas of the instances of the backend may add up to, 0 for no limit
+	Capacity     uint64 `json:"capacity"`
+	MaxInstances int    `json:"max_instances"`
+	// percentage of the filesystem in use above which no instances are placed on the backend
+	HighWaterMark float64 `json:"high_water_mark"`
+}
+
+// Backend is an nfs export the shares of instances are placed on.
+type Backend struct {
+	Name       string
+	Limits     BackendLimits
+	Client     Client
+	Controller Controller
+
+	// the filesystem of the export as last inspected, or why it could not be inspected
+	filesystemMutex sync.RWMutex
+	filesystem      *FilesystemStats
+	filesystemErr   string
+}
+
+func NewBackend(name string, limits BackendLimits, client Client) *Backend {
+	return &Backend{Name: name, Limits: limits, Client: client, Controller: NewController(client)}
+}
+
+// Backends is the registry of the backends of the broker. The first backend holds the instances
+// created before backends were recorded.
+type Backends struct {
+	backends []*Backend
+	byName   map[string]*Backend
+	policy   PlacementPolicy
+}
+
+func NewBackends(backends []*Backend, policy PlacementPolicy) (*Backends, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("at least one backend is required")
+	}
+	byName := map[string]*Backend{}
+	for _, backend := range backends {
+		if byName[backend.Name] != nil {
+			return nil, fmt.Errorf("backend '%s' is declared twice", backend.Name)
+		}
+		byName[backend.Name] = backend
+	}
+	return &Backends{backends: backends, byName: byName, policy: policy}, nil
+}
+
+// InspectFilesystem mounts the export unless it is mounted and records the statistics of its filesystem for
+// the placement of new instances. It may block on an unresponsive export, requests only call it for a backend
+// which was never inspected.
+func (b *Backend) InspectFilesystem(ctx context.Context, logger lager.Logger) {
+	var stats *FilesystemStats
+	var inspectErr string
+	if err := ensureMounted(ctx, logger, b.Client); err != nil {
+		inspectErr = err.Error()
+	} else if fs, err := b.Client.FilesystemStats(ctx, logger); err != nil {
+		inspectErr = err.Error()
+	} else {
+		stats = &fs
+	}
+
+	b.filesystemMutex.Lock()
+	defer b.filesystemMutex.Unlock()
+	b.filesystem, b.filesystemErr = stats, inspectErr
+}
+
+// inspectedFilesystem returns the filesystem of the export as last inspected, or why it could not be inspected.
+// A failing mount is reported as soon as the client knows about it. Both are empty until the first inspection.
+func (b *Backend) inspectedFilesystem(logger lager.Logger) (*FilesystemStats, string) {
+	if err := b.Client.MountError(logger); err != nil {
+		return nil, err.Error()
+	}
+	b.filesystemMutex.RLock()
+	defer b.filesystemMutex.RUnlock()
+	return b.filesystem, b.filesystemErr
+}
+
+// inspected tells whether the filesystem of the export was inspected at least once.
+func (b *Backend) inspected() bool {
+	b.filesystemMutex.RLock()
+	defer b.filesystemMutex.RUnlock()
+	return b.filesystem != nil || b.filesystemErr != ""
+}
+
+func (r *Backends) Default() *Backend {
+	return r.backends[0]
+}
+
+// Get returns a backend by name, the empty name is the default backend.
+func (r *Backends) Get(name string) (*Backend, error) {
+	if name == "" {
+		return r.Default(), nil
+	}
+	backend, ok := r.byName[name]
+	if !ok {
+		return nil, ErrBackendDoesNotExist
+	}
+	return backend, nil
+}
+
+func (r *Backends) All() []*Backend {
+	return r.backends
+}
+
+// Instrument counts the failed operations of the controllers of the backends.
+func (r *Backends) Instrument(metrics *Metrics) {
+	for _, backend := range r.backends {
+		backend.Controller = &instrumentedController{Controller: backend.Controller, metrics: metrics, backend: backend.Name}
+	}
+}
+
+// BackendUsage is what the instances of a backend take from it.
+type BackendUsage struct {
+	Backend   *Backend `json:"-"`
+	Name      string   `json:"name"`
+	Instances int      `json:"instances"`
+	// sum of the quotas of the instances
+	Allocated  uint64           `json:"allocated"`
+	Limits     BackendLimits    `json:"limits"`
+	Filesystem *FilesystemStats `json:"filesystem,omitempty"`
+	// why the filesystem could not be inspected, the backend admits no instances then
+	Error string `json:"error,omitempty"`
+}
+
+// admit returns nil if the backend has room for an instance with the given quota, errBackendFull
+// if it does not take any more instances and errQuotaDoesNotFit if the quota does not fit. A backend
+// whose filesystem was never inspected takes no instances.
+func (u BackendUsage) admit(quota uint64) error {
+	limits := u.Backend.Limits
+	if u.Error != "" || u.Filesystem == nil || (limits.MaxInstances > 0 && u.Instances >= limits.MaxInstances) {
+		return errBackendFull
+	}
+	if limits.Capacity > 0 && (quota > limits.Capacity || u.Allocated > limits.Capacity-quota) {
+		return errQuotaDoesNotFit
+	}
+	if fs := u.Filesystem; fs != nil && fs.Total > 0 {
+		mark := uint64(float64(fs.Total) * limits.HighWaterMark / 100)
+		used := fs.Total - fs.Free
+		if used >= mark {
+			return errBackendFull
+		}
+		if quota > mark-used {
+			return errQuotaDoesNotFit
+		}
+	}
+	return nil
+}
+
+// Place chooses the backend of a new instance with the given quota among the backends which admit it,
+// a pinned backend is chosen if it admits the instance. When no backend admits the instance,
+// brokerapi.ErrPlanQuotaExceeded is returned if the quota does not fit on a backend which takes instances,
+// brokerapi.ErrInstanceLimitMet otherwise. The reasons of the backends are logged.
+func (r *Backends) Place(logger lager.Logger, usage []BackendUsage, pinned string, quota uint64) (*Backend, error) {
+	if pinned != "" && r.byName[pinned] == nil {
+		return nil, fmt.Errorf("backend '%s' does not exist", pinned)
+	}
+	candidates := []BackendUsage{}
+	quotaDoesNotFit := false
+	for _, used := range usage {
+		if pinned != "" && used.Name != pinned {
+			continue
+		}
+		if err := used.admit(quota); err != nil {
+			quotaDoesNotFit = quotaDoesNotFit || err == errQuotaDoesNotFit
+			logger.Info("backend-rejects-instance", lager.Data{"backend": used.Name, "reason": err.Error(), "error": used.Error, "instances": used.Instances, "allocated": used.Allocated})
+			continue
+		}
+		candidates = append(candidates, used)
+	}
+	if len(candidates) == 0 {
+		if quotaDoesNotFit {
+			return nil, brokerapi.ErrPlanQuotaExceeded
+		}
+		return nil, brokerapi.ErrInstanceLimitMet
+	}
+	if len(candidates) == 1 {
+		return candidates[0].Backend, nil
+	}
+	return r.policy.Place(candidates), nil
+}
+
+// PlacementPolicy chooses among backends which all have room for a new instance.
+type PlacementPolicy interface {
+	Place(candidates []BackendUsage) *Backend
+}
+
+func NewPlacementPolicy(name string) (PlacementPolicy, error) {
+	switch name {
+	case "", PlacementRoundRobin:
+		return &roundRobinPlacement{}, nil
+	case PlacementLeastUsed:
+		return &leastUsedPlacement{}, nil
+	default:
+		return nil, fmt.Errorf("unknown placement policy '%s'", name)
+	}
+}
+
+type roundRobinPlacement struct {
+	mutex sync.Mutex
+	next  int
+}
+
+func (p *roundRobinPlacement) Place(candidates []BackendUsage) *Backend {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	backend := candidates[p.next%len(candidates)].Backend
+	p.next++
+	return backend
+}
+
+// leastUsedPlacement chooses the backend with the smallest part of its capacity allocated, backends
+// without a capacity count as empty and are told apart by their number of instances.
+type leastUsedPlacement struct{}
+
+func (p *leastUsedPlacement) Place(candidates []BackendUsage) *Backend {
+	least := candidates[0]
+	for _, candidate := range candidates[1:] {
+		if candidate.utilization() < least.utilization() ||
+			(candidate.utilization() == least.utilization() && candidate.Instances < least.Instances) {
+			least = candidate
+		}
+	}
+	return least.Backend
+}
+
+func (u BackendUsage) utilization() float64 {
+	if u.Backend.Limits.Capacity == 0 {
+		return 0
+	}
+	return float64(u.Allocated) / float64(u.Backend.Limits.Capacity)
+}
+
+// placements are the new instances placed on a backend whose instance and metadata are not stored yet, with the
+// backend and quota they were placed with. They count towards the limits of their backend until they are stored,
+// so that concurrent provisions of this broker and of the brokers sharing its store account for each other. With a
+// shared store a placement is also held as a lease of the store, releasing it releases the lease.
+type placements struct {
+	mutex     sync.Mutex
+	instances map[string]placement
+	leases    map[string]func()
+}
+
+type placement struct {
+	Backend string `json:"backend"`
+	Quota   uint64 `json:"quota"`
+}
+
+func newPlacements() *placements {
+	return &placements{instances: map[string]placement{}, leases: map[string]func(){}}
+}
+
+func (p *placements) list() map[string]placement {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	instances := map[string]placement{}
+	for instanceID, placed := range p.instances {
+		instances[instanceID] = placed
+	}
+	return instances
+}
+
+func (p *placements) release(instanceID string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.instances, instanceID)
+	if release, ok := p.leases[instanceID]; ok {
+		release()
+		delete(p.leases, instanceID)
+	}
+}
+
+// placeInstance chooses the backend of a new instance with the given quota and records it in the metadata
+// of the instance. The backend parameter and the backend of the plan pin the instance to a backend, a clone
+// is always placed on the backend of its source. The instance is placed until placements.release.
+func (b *broker) placeInstance(logger lager.Logger, instanceID string, details brokerapi.ProvisionDetails, metadata *Metadata, quota uint64) (*Backend, error) {
+	parameters, err := parseRawParameters(details.RawParameters)
+	if err != nil {
+		return nil, err
+	}
+	pinned := metadata.Backend
+	if value, ok := parameters[ParamBackend]; ok {
+		name, ok := value.(string)
+		if !ok || name == "" {
+			return nil, brokerapi.ErrRawParamsInvalid
+		}
+		if pinned != "" && pinned != name {
+			return nil, fmt.Errorf("a clone is placed on the backend '%s' of its source", pinned)
+		}
+		pinned = name
+	}
+	if pinned == "" {
+		plan, _ := b.catalog.Plan(details.PlanID)
+		pinned = plan.Settings.Backend
+	}
+
+	// the capacity monitor inspects the backends as soon as the broker starts, provisions which come first
+	// inspect the backends themselves rather than placing instances on backends not known to have room
+	for _, backend := range b.backends.All() {
+		if !backend.inspected() {
+			ctx, cancel := b.operationContext()
+			backend.InspectFilesystem(ctx, logger.WithData(lager.Data{"backend": backend.Name}))
+			cancel()
+		}
+	}
+
+	b.placements.mutex.Lock()
+	defer b.placements.mutex.Unlock()
+
+	leaser, shared := b.store.(Leaser)
+	if shared {
+		defer holdLease(logger, leaser, "placement", nil)()
+	}
+	placed, err := b.placedInstances(logger, b.placements.instances)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := b.backendUsage(logger, placed)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := b.backends.Place(logger, usage, pinned, quota)
+	if err != nil {
+		logger.Error("failed-to-place-instance", err, lager.Data{"pinned": pinned, "quota": quota})
+		return nil, err
+	}
+	if shared {
+		release, err := leaser.Lease(logger, placementLeasePrefix+instanceID, placement{Backend: backend.Name, Quota: quota})
+		if err != nil {
+			logger.Error("failed-to-place", err)
+			return nil, err
+		}
+		b.placements.leases[instanceID] = release
+	}
+	b.placements.instances[instanceID] = placement{Backend: backend.Name, Quota: quota}
+	logger.Info("instance-placed", lager.Data{"backend": backend.Name})
+	metadata.Backend = backend.Name
+	return backend, nil
+}
+
+// placedInstances adds the instances placed by the other brokers sharing the store to the placements of this broker.
+func (b *broker) placedInstances(logger lager.Logger, own map[string]placement) (map[string]placement, error) {
+	leaser, ok := b.store.(Leaser)
+	if !ok {
+		return own, nil
+	}
+	leases, err := leaser.Leases(logger, placementLeasePrefix)
+	if err != nil {
+		logger.Error("failed-to-list-placements", err)
+		return nil, err
+	}
+	placed := map[string]placement{}
+	for name, value := range leases {
+		var instance placement
+		if err := json.Unmarshal(value, &instance); err != nil {
+			logger.Error("invalid-placement", err, lager.Data{"lease": name})
+			continue
+		}
+		placed[strings.TrimPrefix(name, placementLeasePrefix)] = instance
+	}
+	for instanceID, instance := range own {
+		placed[instanceID] = instance
+	}
+	return placed, nil
+}
+
+// BackendUsage returns the usage of every backend, with the filesystems as last inspected.
+func (b *broker) BackendUsage() ([]BackendUsage, error) {
+	logger := b.logger.Session("backend-usage")
+	placed, err := b.placedInstances(logger, b.placements.list())
+	if err != nil {
+		return nil, err
+	}
+	return b.backendUsage(logger, placed)
+}
+
+// InspectBackends inspects the filesystems of all backends, mounting them as needed, and runs the health checks.
+func (b *broker) InspectBackends() {
+	logger := b.logger.Session("inspect-backends")
+	for _, backend := range b.backends.All() {
+		ctx, cancel := b.operationContext()
+		backend.InspectFilesystem(ctx, logger.WithData(lager.Data{"backend": backend.Name}))
+		cancel()
+	}
+	b.checkHealth(logger)
+}
+
+// backendUsage sums up the instances and quotas of the instances of each backend, along with its filesystem
+// as last inspected. The placed instances count with the backend and quota they were placed with. It does not
+// touch the backends, it runs in the path of requests.
+func (b *broker) backendUsage(logger lager.Logger, placed map[string]placement) ([]BackendUsage, error) {
+	instances, err := b.store.ListInstanceDetails(logger)
+	if err != nil {
+		logger.Error("failed-to-list-instances", err)
+		return nil, err
+	}
+	metadata, err := b.store.ListMetadata(logger)
+	if err != nil {
+		logger.Error("failed-to-list-metadata", err)
+		return nil, err
+	}
+
+	usage := []BackendUsage{}
+	index := map[string]int{}
+	for i, backend := range b.backends.All() {
+		used := BackendUsage{Backend: backend, Name: backend.Name, Limits: backend.Limits}
+		used.Filesystem, used.Error = backend.inspectedFilesystem(logger)
+		usage = append(usage, used)
+		index[backend.Name] = i
+	}
+	for instanceID, instance := range instances {
+		if _, ok := placed[instanceID]; ok {
+			continue
+		}
+		i, ok := index[metadata[instanceID].Backend]
+		if metadata[instanceID].Backend == "" {
+			i, ok = 0, true
+		}
+		if !ok {
+			continue
+		}
+		usage[i].Instances++
+		if options, err := b.evaluateShareOptions(logger, instance.PlanID, instance.RawParameters); err == nil {
+			usage[i].Allocated += options.Quota
+		}
+	}
+	for _, instance := range placed {
+		if i, ok := index[instance.Backend]; ok {
+			usage[i].Instances++
+			usage[i].Allocated += instance.Quota
+		}
+	}
+	return usage, nil
+}
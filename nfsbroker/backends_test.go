@@ -0,0 +1,156 @@
+package nfsbroker
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Placement", func() {
+	var (
+		store   *memoryStore
+		invoker *fakeInvoker
+		tb      testBroker
+	)
+
+	provision := func(instanceID, planID string) error {
+		_, err := tb.Provision(instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID}, false)
+		return err
+	}
+
+	BeforeEach(func() {
+		store = newMemoryStore()
+		invoker = &fakeInvoker{}
+		tb = newTestBroker(store, invoker, testCatalog())
+	})
+
+	AfterEach(func() {
+		tb.cleanup()
+	})
+
+	It("reports the filesystems as last inspected", func() {
+		usage, err := tb.BackendUsage()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(usage[0].Filesystem).To(BeNil())
+		Expect(usage[0].Error).To(BeEmpty())
+
+		tb.InspectBackends()
+		usage, err = tb.BackendUsage()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(usage[0].Filesystem).NotTo(BeNil())
+		Expect(usage[0].Filesystem.Total).NotTo(BeZero())
+	})
+
+	It("does not place instances on a backend whose mount fails, without mounting it", func() {
+		tb.client.SetMountError(tb.logger, errors.New("connection refused"))
+
+		Expect(provision("instance", "plan-id")).To(Equal(brokerapi.ErrInstanceLimitMet))
+		Expect(invoker.Calls()).To(BeEmpty())
+		Expect(store.instances).To(BeEmpty())
+	})
+
+	It("rejects an instance whose quota does not fit with an error the platform understands", func() {
+		tb.backends.Default().Limits.Capacity = 1 << 30
+
+		Expect(provision("instance", "big-plan-id")).To(Equal(brokerapi.ErrPlanQuotaExceeded))
+		Expect(provision("instance", "plan-id")).To(Succeed())
+	})
+
+	It("inspects a backend which was not inspected yet before placing an instance on it", func() {
+		Expect(provision("instance", "plan-id")).To(Succeed())
+		usage, err := tb.BackendUsage()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(usage[0].Filesystem).NotTo(BeNil())
+	})
+
+	It("does not admit instances on a backend which was never inspected", func() {
+		usage, err := tb.BackendUsage()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(usage[0].admit(0)).To(Equal(errBackendFull))
+	})
+
+	It("accounts the instances placed by concurrent provisions for each other", func() {
+		tb.store = &slowStore{memoryStore: store}
+		tb.backends.Default().Limits.Capacity = 30 << 30
+		tb.InspectBackends()
+
+		var (
+			wg       sync.WaitGroup
+			mutex    sync.Mutex
+			accepted int
+		)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				err := provision(fmt.Sprintf("instance-%d", i), "big-plan-id")
+				if err == brokerapi.ErrPlanQuotaExceeded {
+					return
+				}
+				Expect(err).NotTo(HaveOccurred())
+				mutex.Lock()
+				accepted++
+				mutex.Unlock()
+			}(i)
+		}
+		wg.Wait()
+		Expect(accepted).To(Equal(3))
+		Expect(tb.placements.list()).To(BeEmpty())
+	})
+
+	It("accounts the instances placed by brokers sharing a store for each other", func() {
+		dir, err := ioutil.TempDir("", "shared-store")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		var (
+			wg       sync.WaitGroup
+			mutex    sync.Mutex
+			accepted int
+		)
+		for b := 0; b < 2; b++ {
+			shared, err := NewSqlStore(DialectSqlite, "file:"+filepath.Join(dir, "state.db")+"?_busy_timeout=10000")
+			Expect(err).NotTo(HaveOccurred())
+			defer shared.(*sqlStore).db.Close()
+			Expect(shared.Restore(tb.logger)).To(Succeed())
+			broker := newTestBroker(&slowSqlStore{sqlStore: shared.(*sqlStore)}, &fakeInvoker{}, testCatalog())
+			defer broker.cleanup()
+			broker.backends.Default().Limits.Capacity = 30 << 30
+			broker.InspectBackends()
+
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func(instanceID string) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					_, err := broker.Provision(instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "big-plan-id"}, false)
+					if err == brokerapi.ErrPlanQuotaExceeded {
+						return
+					}
+					Expect(err).NotTo(HaveOccurred())
+					mutex.Lock()
+					accepted++
+					mutex.Unlock()
+				}(fmt.Sprintf("instance-%d-%d", b, i))
+			}
+		}
+		wg.Wait()
+		Expect(accepted).To(Equal(3))
+	})
+
+	It("rejects instances on a backend filled up to its high water mark", func() {
+		tb.backends.Default().Limits.HighWaterMark = 0.0001
+		tb.InspectBackends()
+
+		Expect(provision("instance", "plan-id")).To(Equal(brokerapi.ErrInstanceLimitMet))
+	})
+})
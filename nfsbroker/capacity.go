@@ -0,0 +1,104 @@
+package nfsbroker
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// UsageReporter reports what the instances take from each backend.
+type UsageReporter interface {
+	// BackendUsage reports the filesystems of the backends as last inspected
+	BackendUsage() ([]BackendUsage, error)
+	InspectBackends()
+}
+
+// CapacityMonitor periodically inspects the filesystems of the backends, which the placement of new instances
+// relies on, and exports the capacity and usage of the backends as gauges.
+type CapacityMonitor struct {
+	logger   lager.Logger
+	reporter UsageReporter
+	metrics  *Metrics
+	interval time.Duration
+
+	// backends whose filesystem was unavailable at the last update
+	mutex       sync.Mutex
+	unavailable map[string]bool
+}
+
+func NewCapacityMonitor(logger lager.Logger, reporter UsageReporter, metrics *Metrics, interval time.Duration) *CapacityMonitor {
+	return &CapacityMonitor{
+		logger:   logger,
+		reporter: reporter,
+		metrics:  metrics,
+		interval: interval,
+
+		unavailable: map[string]bool{},
+	}
+}
+
+func (m *CapacityMonitor) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	close(ready)
+	m.Update()
+	for {
+		select {
+		case <-ticker.C:
+			m.Update()
+		case <-signals:
+			return nil
+		}
+	}
+}
+
+// Update inspects the filesystems of the backends and sets the capacity gauges of every backend. A backend
+// becoming unavailable counts as one client failure, however many updates it stays unavailable for.
+func (m *CapacityMonitor) Update() {
+	logger := m.logger.Session("update-capacity")
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.reporter.InspectBackends()
+	usage, err := m.reporter.BackendUsage()
+	if err != nil {
+		logger.Error("failed-to-determine-usage", err)
+		return
+	}
+	for _, used := range usage {
+		backend := []string{"backend", used.Name}
+		m.metrics.SetGauge("nfsbroker_backend_instances", "Instances placed on the backend.", float64(used.Instances), backend...)
+		m.metrics.SetGauge("nfsbroker_backend_allocated_bytes", "Sum of the quotas of the instances of the backend.", float64(used.Allocated), backend...)
+		m.metrics.SetGauge("nfsbroker_backend_capacity_bytes", "Bytes the quotas of the instances of the backend may add up to, 0 for no limit.", float64(used.Limits.Capacity), backend...)
+		m.metrics.SetGauge("nfsbroker_backend_high_water_mark_ratio", "Part of the filesystem in use above which the backend takes no new instances.", used.Limits.HighWaterMark/100, backend...)
+
+		admitting := 0.0
+		if used.admit(0) == nil {
+			admitting = 1
+		}
+		m.metrics.SetGauge("nfsbroker_backend_admitting", "Whether the backend takes new instances.", admitting, backend...)
+
+		if used.Filesystem == nil {
+			logger.Info("filesystem-unavailable", lager.Data{"backend": used.Name, "error": used.Error})
+			if !m.unavailable[used.Name] {
+				m.metrics.AddCounter("nfsbroker_client_failures_total", "Failed filesystem operations of the broker by backend and operation.", 1,
+					"backend", used.Name, "operation", "filesystem_stats")
+			}
+			m.unavailable[used.Name] = true
+			m.metrics.SetGauge("nfsbroker_backend_filesystem_up", "Whether the filesystem of the backend could be inspected.", 0, backend...)
+			continue
+		}
+		m.unavailable[used.Name] = false
+		fs := used.Filesystem
+		m.metrics.SetGauge("nfsbroker_backend_filesystem_up", "Whether the filesystem of the backend could be inspected.", 1, backend...)
+		m.metrics.SetGauge("nfsbroker_backend_filesystem_size_bytes", "Size of the filesystem of the backend.", float64(fs.Total), backend...)
+		m.metrics.SetGauge("nfsbroker_backend_filesystem_free_bytes", "Free space of the filesystem of the backend.", float64(fs.Free), backend...)
+		if fs.Total > 0 {
+			m.metrics.SetGauge("nfsbroker_backend_filesystem_used_ratio", "Part of the filesystem of the backend in use.", float64(fs.Total-fs.Free)/float64(fs.Total), backend...)
+		}
+	}
+}
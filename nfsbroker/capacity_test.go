@@ -0,0 +1,64 @@
+package nfsbroker
+
+import (
+	"code.cloudfoundry.org/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Capacity monitor", func() {
+	var (
+		reporter *fakeUsageReporter
+		metrics  *Metrics
+		monitor  *CapacityMonitor
+	)
+
+	sample := func(name string) float64 {
+		for _, sample := range metrics.Samples() {
+			if sample.Name == name {
+				return sample.Value
+			}
+		}
+		return 0
+	}
+
+	BeforeEach(func() {
+		backend := NewBackend("backend-1", BackendLimits{HighWaterMark: 90}, nil)
+		reporter = &fakeUsageReporter{usage: []BackendUsage{{Backend: backend, Name: backend.Name, Limits: backend.Limits}}}
+		metrics = NewMetrics()
+		monitor = NewCapacityMonitor(lager.NewLogger("capacity-test"), reporter, metrics, 0)
+	})
+
+	It("counts a backend becoming unavailable once", func() {
+		reporter.usage[0].Error = "connection refused"
+		monitor.Update()
+		monitor.Update()
+		Expect(sample("nfsbroker_client_failures_total")).To(Equal(1.0))
+		Expect(sample("nfsbroker_backend_filesystem_up")).To(Equal(0.0))
+
+		reporter.usage[0].Error = ""
+		reporter.usage[0].Filesystem = &FilesystemStats{Total: 100, Free: 50}
+		monitor.Update()
+		Expect(sample("nfsbroker_backend_filesystem_up")).To(Equal(1.0))
+
+		reporter.usage[0].Error = "connection refused"
+		reporter.usage[0].Filesystem = nil
+		monitor.Update()
+		Expect(sample("nfsbroker_client_failures_total")).To(Equal(2.0))
+		Expect(reporter.inspections).To(Equal(4))
+	})
+})
+
+type fakeUsageReporter struct {
+	usage       []BackendUsage
+	inspections int
+}
+
+func (r *fakeUsageReporter) BackendUsage() ([]BackendUsage, error) {
+	return r.usage, nil
+}
+
+func (r *fakeUsageReporter) InspectBackends() {
+	r.inspections++
+}
@@ -0,0 +1,242 @@
+package nfsbroker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/goshims/ioutil"
+	"github.com/pivotal-cf/brokerapi"
+	"gopkg.in/yaml.v2"
+)
+
+var ErrPlanDoesNotExist = errors.New("plan does not exist in the service catalog")
+
+type serviceMetadata struct {
+	DisplayName         string `json:"displayName,omitempty"`
+	ImageUrl            string `json:"imageUrl,omitempty"`
+	LongDescription     string `json:"longDescription,omitempty"`
+	ProviderDisplayName string `json:"providerDisplayName,omitempty"`
+	DocumentationUrl    string `json:"documentationUrl,omitempty"`
+	SupportUrl          string `json:"supportUrl,omitempty"`
+}
+
+// Catalog describes the service offered by the broker and its plans.
+type Catalog struct {
+	ServiceId   string          `json:"id"`
+	ServiceName string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Tags        []string        `json:"tags,omitempty"`
+	Metadata    serviceMetadata `json:"metadata"`
+	Plans       []Plan          `json:"plans"`
+}
+
+type Plan struct {
+	Id          string                         `json:"id"`
+	Name        string                         `json:"name"`
+	Description string                         `json:"description"`
+	Free        *bool                          `json:"free,omitempty"`
+	Metadata    *brokerapi.ServicePlanMetadata `json:"metadata,omitempty"`
+	Settings    PlanSettings                   `json:"settings"`
+}
+
+// PlanSettings are the broker side settings of a plan, they are not published in the catalog.
+type PlanSettings struct {
+	// default quota of an instance, such as "10G", when no size parameter is given
+	Quota string `json:"quota,omitempty"`
+	// nfs version the cell mounts the share with, defaults to the version of the backend
+	NfsVersion int `json:"nfs_version,omitempty"`
+	// bindings of the plan are always mounted read-only
+	ReadOnly bool `json:"read_only,omitempty"`
+	// ids of the plans an instance of this plan may be updated to
+	UpdatableTo []string `json:"updatable_to,omitempty"`
+	// backend the shares of the plan are placed on, instead of the one chosen by the placement policy
+	Backend string `json:"backend,omitempty"`
+	// nfs mount options, such as "vers=4.2,sec=krb5,ro", the cell mounts the share with in addition to
+	// those of the backend
+	MountOptions string `json:"mount_options,omitempty"`
+	// owner and permissions, such as "0770", new shares are given unless the parameters give them
+	ShareUid  *int   `json:"share_uid,omitempty"`
+	ShareGid  *int   `json:"share_gid,omitempty"`
+	ShareMode string `json:"share_mode,omitempty"`
+	// the uid, gid and mode parameters of instances are rejected
+	FixedShareAttributes bool `json:"fixed_share_attributes,omitempty"`
+	// whether bindings give a uid and gid or a username and password: optional, required or none
+	BindIdentity string `json:"bind_identity,omitempty"`
+	// kerberos principals are issued per instance or per binding, empty for none
+	Kerberos string `json:"kerberos,omitempty"`
+}
+
+// mountOptions returns the mount options of the plan, they were validated with the catalog.
+func (s PlanSettings) mountOptions() MountOptions {
+	options, _ := ParseMountOptions(s.MountOptions)
+	return options
+}
+
+// NewCatalog builds a catalog with a single plan, as described by the broker's command line flags.
+func NewCatalog(serviceName, serviceId, planName, planId, planDesc, displayName, imageUrl string) Catalog {
+	return Catalog{
+		ServiceId:   serviceId,
+		ServiceName: serviceName,
+		Metadata:    serviceMetadata{displayName, imageUrl, "This is storage volume service to mount application and shared", displayName, "https://github.com/cloudfoundry-incubator/volman", "https://github.com/cloudfoundry-incubator/volman"},
+		Plans: []Plan{{
+			Id:          planId,
+			Name:        planName,
+			Description: planDesc,
+			Free:        new(bool), //not is true,is new(bool)
+		}},
+	}
+}
+
+// LoadCatalog reads a catalog file, a file ending in .yml or .yaml is read as YAML and any other file as JSON.
+// Both use the JSON field names.
+func LoadCatalog(ioutil ioutilshim.Ioutil, catalogPath string) (Catalog, error) {
+	data, err := ioutil.ReadFile(catalogPath)
+	if err != nil {
+		return Catalog{}, fmt.Errorf("failed to read catalog file '%s': %s", catalogPath, err.Error())
+	}
+	switch strings.ToLower(filepath.Ext(catalogPath)) {
+	case ".yml", ".yaml":
+		data, err = yamlToJson(data)
+	}
+	catalog := Catalog{}
+	if err == nil {
+		err = json.Unmarshal(data, &catalog)
+	}
+	if err != nil {
+		return Catalog{}, fmt.Errorf("failed to parse catalog file '%s': %s", catalogPath, err.Error())
+	}
+	if err = catalog.Validate(); err != nil {
+		return Catalog{}, fmt.Errorf("invalid catalog file '%s': %s", catalogPath, err.Error())
+	}
+	return catalog, nil
+}
+
+// yamlToJson converts a YAML document to JSON, so that a YAML catalog is decoded by the JSON field names.
+func yamlToJson(data []byte) ([]byte, error) {
+	var document interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonValue(document))
+}
+
+// jsonValue replaces the maps decoded from YAML, whose keys may be of any type, by maps with string keys.
+func jsonValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		object := map[string]interface{}{}
+		for key, v := range value {
+			object[fmt.Sprint(key)] = jsonValue(v)
+		}
+		return object
+	case []interface{}:
+		for i, v := range value {
+			value[i] = jsonValue(v)
+		}
+		return value
+	default:
+		return value
+	}
+}
+
+func (c Catalog) Validate() error {
+	if c.ServiceId == "" || c.ServiceName == "" {
+		return errors.New("service id and name are required")
+	}
+	if len(c.Plans) == 0 {
+		return errors.New("at least one plan is required")
+	}
+	ids := map[string]bool{}
+	names := map[string]bool{}
+	for _, plan := range c.Plans {
+		if plan.Id == "" || plan.Name == "" {
+			return errors.New("plan id and name are required")
+		}
+		if ids[plan.Id] || names[plan.Name] {
+			return fmt.Errorf("plan '%s' is declared twice", plan.Name)
+		}
+		ids[plan.Id] = true
+		names[plan.Name] = true
+
+		if plan.Settings.Quota != "" {
+			if _, err := parseSize(plan.Settings.Quota); err != nil {
+				return fmt.Errorf("plan '%s' has an invalid quota '%s'", plan.Name, plan.Settings.Quota)
+			}
+		}
+		switch plan.Settings.NfsVersion {
+		case 0, 3, 4:
+		default:
+			return fmt.Errorf("plan '%s' has an unsupported nfs version %d", plan.Name, plan.Settings.NfsVersion)
+		}
+		for _, id := range []*int{plan.Settings.ShareUid, plan.Settings.ShareGid} {
+			if id != nil && *id < 0 {
+				return fmt.Errorf("plan '%s' has a negative share uid or gid", plan.Name)
+			}
+		}
+		if plan.Settings.ShareMode != "" {
+			if _, err := evaluatePermissions(plan.Settings.ShareMode); err != nil {
+				return fmt.Errorf("plan '%s' has an invalid share mode '%s'", plan.Name, plan.Settings.ShareMode)
+			}
+		}
+		switch plan.Settings.BindIdentity {
+		case "", BindIdentityOptional, BindIdentityRequired, BindIdentityNone:
+		default:
+			return fmt.Errorf("plan '%s' has an unknown bind identity policy '%s'", plan.Name, plan.Settings.BindIdentity)
+		}
+		switch plan.Settings.Kerberos {
+		case "", KerberosPerInstance, KerberosPerBinding:
+		default:
+			return fmt.Errorf("plan '%s' has an unknown kerberos setting '%s'", plan.Name, plan.Settings.Kerberos)
+		}
+		options, err := ParseMountOptions(plan.Settings.MountOptions)
+		if err != nil {
+			return fmt.Errorf("plan '%s' has invalid mount options: %s", plan.Name, err.Error())
+		}
+		if version := options.MajorVersion(); version != 0 && plan.Settings.NfsVersion != 0 && version != plan.Settings.NfsVersion {
+			return fmt.Errorf("plan '%s' has mount options for nfs version %d instead of %d", plan.Name, version, plan.Settings.NfsVersion)
+		}
+	}
+	for _, plan := range c.Plans {
+		for _, planId := range plan.Settings.UpdatableTo {
+			if !ids[planId] {
+				return fmt.Errorf("plan '%s' is updatable to unknown plan '%s'", plan.Name, planId)
+			}
+		}
+	}
+	return nil
+}
+
+func (c Catalog) Plan(planId string) (Plan, bool) {
+	for _, plan := range c.Plans {
+		if plan.Id == planId {
+			return plan, true
+		}
+	}
+	return Plan{}, false
+}
+
+func (c Catalog) planUpdatable() bool {
+	for _, plan := range c.Plans {
+		if len(plan.Settings.UpdatableTo) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Catalog) description() string {
+	if c.Description != "" {
+		return c.Description
+	}
+	return fmt.Sprintf("%s service docs: https://github.com/cloudfoundry-incubator/volman", c.ServiceName)
+}
+
+func (c Catalog) tags() []string {
+	if len(c.Tags) > 0 {
+		return c.Tags
+	}
+	return []string{c.ServiceName}
+}
@@ -0,0 +1,87 @@
+package nfsbroker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/goshims/ioutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LoadCatalog", func() {
+	const jsonCatalog = `{
+  "id": "service-id",
+  "name": "nfs",
+  "tags": ["nfs"],
+  "plans": [
+    {"id": "small-id", "name": "small", "description": "small shares", "settings": {"quota": "1G"}},
+    {"id": "archive-id", "name": "archive", "description": "read-only", "metadata": {"displayName": "Archive"},
+     "settings": {"read_only": true, "nfs_version": 4, "updatable_to": ["small-id"]}}
+  ]
+}`
+	const yamlCatalog = `
+id: service-id
+name: nfs
+tags: [nfs]
+plans:
+- id: small-id
+  name: small
+  description: small shares
+  settings:
+    quota: 1G
+- id: archive-id
+  name: archive
+  description: read-only
+  metadata:
+    displayName: Archive
+  settings:
+    read_only: true
+    nfs_version: 4
+    updatable_to: [small-id]
+`
+
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "catalog")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	load := func(name, content string) (Catalog, error) {
+		path := filepath.Join(dir, name)
+		Expect(ioutil.WriteFile(path, []byte(content), 0600)).To(Succeed())
+		return LoadCatalog(&ioutilshim.IoutilShim{}, path)
+	}
+
+	It("reads a YAML file by the JSON field names", func() {
+		fromJson, err := load("catalog.json", jsonCatalog)
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, name := range []string{"catalog.yml", "catalog.YAML"} {
+			fromYaml, err := load(name, yamlCatalog)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fromYaml).To(Equal(fromJson))
+		}
+		Expect(fromJson.Plans).To(HaveLen(2))
+		Expect(fromJson.Plans[1].Settings.ReadOnly).To(BeTrue())
+		Expect(fromJson.Plans[1].Metadata.DisplayName).To(Equal("Archive"))
+	})
+
+	It("reads any other file as JSON", func() {
+		_, err := load("catalog.conf", yamlCatalog)
+		Expect(err).To(MatchError(ContainSubstring("failed to parse catalog file")))
+	})
+
+	It("rejects an invalid YAML file", func() {
+		_, err := load("catalog.yml", "plans: [")
+		Expect(err).To(MatchError(ContainSubstring("failed to parse catalog file")))
+	})
+})
@@ -1,11 +1,17 @@
 package nfsbroker
 
 import (
+	"context"
+	"errors"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"fmt"
 	"strings"
-	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/goshims/execshim"
@@ -18,51 +24,151 @@ import (
 const (
 	DefaultNfsV3 string = "port=2049,nolock,proto=tcp"
 	CellBasePath string = "/var/vcap/data/volumes"
+
+	// directory of the export holding the shares moved aside by the reconciler
+	QuarantineDir string = ".quarantine"
+	// directory of the export holding the deleted shares until they are purged
+	TrashDir string = ".trash"
 )
 
+// TrashEntry is a deleted share waiting in the trash directory to be purged.
+type TrashEntry struct {
+	Name      string    `json:"name"`
+	ShareName string    `json:"share_name"`
+	DeletedAt time.Time `json:"deleted_at"`
+	// set by the purger
+	Backend string    `json:"backend"`
+	PurgeAt time.Time `json:"purge_at"`
+}
+
+// asideName names a share moved into the trash or quarantine directory.
+func asideName(shareName string, at time.Time) string {
+	return fmt.Sprintf("%s-%d", shareName, at.Unix())
+}
+
+func parseAsideName(name string) (string, time.Time, bool) {
+	i := strings.LastIndex(name, "-")
+	if i <= 0 {
+		return "", time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(name[i+1:], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return name[:i], time.Unix(seconds, 0), true
+}
+
+// Client manages the shares of an export. The calls to the export are bounded by the deadline of their
+// context and by the timeouts of the client, a call past its deadline fails with a TimeoutError.
 type Client interface {
 	IsFilesystemMounted(lager.Logger) bool
-	MountFileSystem(lager.Logger, string) (string, error)
-	CreateShare(lager.Logger, string) (string, error)
-	DeleteShare(lager.Logger, string) error
-	GetPathForShare(lager.Logger, string) (string, string, error)
+	MountFileSystem(context.Context, lager.Logger, string) (string, error)
+	CreateShare(context.Context, lager.Logger, string) (string, error)
+	CloneShare(context.Context, lager.Logger, string, string) error
+	// DeleteShare, SetShareQuota and RestoreSnapshot take the quota project id of the share
+	DeleteShare(context.Context, lager.Logger, string, uint32) error
+	GetPathForShare(context.Context, lager.Logger, string) (string, string, error)
 	GetConfigDetails(lager.Logger) (string, int, error)
+	GetMountOptions(lager.Logger) MountOptions
+	SetShareAttributes(context.Context, lager.Logger, string, ShareAttributes) error
+	SetShareQuota(context.Context, lager.Logger, string, uint32, uint64) error
+	ListShares(context.Context, lager.Logger) ([]string, error)
+	QuarantineShare(context.Context, lager.Logger, string) (string, error)
+	ListTrash(context.Context, lager.Logger) ([]TrashEntry, error)
+	PurgeTrash(context.Context, lager.Logger, string) error
+	RestoreTrash(context.Context, lager.Logger, string, string) error
+	CreateSnapshot(context.Context, lager.Logger, string, string) error
+	RestoreSnapshot(context.Context, lager.Logger, string, string, uint32) error
+	DeleteSnapshot(context.Context, lager.Logger, string, string) error
+	FilesystemStats(context.Context, lager.Logger) (FilesystemStats, error)
+	ShareUsage(context.Context, lager.Logger, string) (uint64, error)
+	CheckWritable(context.Context, lager.Logger, string) error
+	CheckMount(context.Context, lager.Logger) (MountState, error)
+	Remount(context.Context, lager.Logger) error
+	// MountError is why the export is known to be unusable, nil while it is usable.
+	MountError(lager.Logger) error
+	SetMountError(lager.Logger, error)
+}
+
+// FilesystemStats is the size and free space of the mounted export in bytes.
+type FilesystemStats struct {
+	Total uint64 `json:"total"`
+	Free  uint64 `json:"free"`
+	// free space available to unprivileged users
+	Available uint64 `json:"available"`
+}
+
+// ShareAttributes describes the ownership and permissions of a share directory,
+// a negative Uid or Gid and a zero Mode leave the current value unchanged.
+type ShareAttributes struct {
+	Uid  int
+	Gid  int
+	Mode os.FileMode
 }
 
 type nfsClient struct{
 	remoteInfo          string
 	remoteMount         string
 	version             int
+	mountOptions        MountOptions
+	// logged in with before mounting an export with kerberos security, nil to rely on the host keytab
+	service             *ServiceCredentials
 	useFileUtil         ioutilshim.Ioutil
 	os                  osshim.Os
 	baseLocalMountPoint string
+	// guards mounted and mounting, concurrent provisions must not mount the filesystem twice
+	mountMutex          sync.Mutex
 	mounted             bool
+	// the mount in progress, nil while none is
+	mounting            *mountAttempt
+	// set by the mount supervisor while the export is down
+	mountErrMutex       sync.RWMutex
+	mountErr            error
 	invoker             Invoker
+	mountTable          MountTable
+	quota               QuotaDriver
+	snapshots           SnapshotDriver
+	timeouts            ClientTimeouts
+	pool                *FilesystemPool
 }
 
-func NewNfsClientWithInfokerAndFileUtil(remoteInfo string, remoteMount string,version int, useInvoker Invoker, localMountPoint string, os osshim.Os, useFileUtil ioutilshim.Ioutil) Client{
+func NewNfsClientWithInfokerAndFileUtil(remoteInfo string, remoteMount string,version int, mountOptions MountOptions, service *ServiceCredentials, useInvoker Invoker, localMountPoint string, os osshim.Os, useFileUtil ioutilshim.Ioutil, quota QuotaDriver, snapshots SnapshotDriver, timeouts ClientTimeouts) Client{
 	return &nfsClient{
 		remoteInfo:          remoteInfo,
 		remoteMount:         remoteMount,
 		version:             version,
+		mountOptions:        mountOptions,
+		service:             service,
 		invoker:             useInvoker,
 		useFileUtil:         useFileUtil,
+		mountTable:          NewMountTable(useFileUtil, ProcMountInfo),
 		os         :         os,
 		mounted:             false,
 		baseLocalMountPoint: localMountPoint,
+		quota:               quota,
+		snapshots:           snapshots,
+		timeouts:            timeouts,
+		pool:                NewFilesystemPool(timeouts.FilesystemWorkers),
 	}
 }
 
-func NewNfsClient(remoteInfo string, remoteMount string, version int,localMountPoint string) Client{
+func NewNfsClient(remoteInfo string, remoteMount string, version int, mountOptions MountOptions, service *ServiceCredentials, localMountPoint string, quota QuotaDriver, snapshots SnapshotDriver, timeouts ClientTimeouts) Client{
 	return &nfsClient{
 		remoteInfo:          remoteInfo,
 		remoteMount:         remoteMount,
 		version:             version,
+		mountOptions:        mountOptions,
+		service:             service,
 		useFileUtil:         &ioutilshim.IoutilShim{},
 		os         :         &osshim.OsShim{},
 		mounted:             false,
 		baseLocalMountPoint: localMountPoint,
 		invoker:             NewRealInvoker(),
+		mountTable:          NewMountTable(&ioutilshim.IoutilShim{}, ProcMountInfo),
+		quota:               quota,
+		snapshots:           snapshots,
+		timeouts:            timeouts,
+		pool:                NewFilesystemPool(timeouts.FilesystemWorkers),
 	}
 }
 
@@ -70,78 +176,643 @@ func (n *nfsClient) IsFilesystemMounted(logger lager.Logger) bool {
 	logger = logger.Session("is-filesystem-mounted")
 	logger.Info("start...")
 	defer logger.Info("end...")
+
+	n.mountMutex.Lock()
+	defer n.mountMutex.Unlock()
 	return n.mounted
 }
 
-func (n *nfsClient) MountFileSystem(logger lager.Logger, remoteMountPoint string) (string,error) {
+func (n *nfsClient) MountFileSystem(ctx context.Context, logger lager.Logger, remoteMountPoint string) (string,error) {
 	logger = logger.Session("mount-filesystem")
 	logger.Info("start")
 	defer logger.Info("end")
 
-	err := n.os.MkdirAll(n.baseLocalMountPoint, os.ModePerm)
+	if err := n.mountOnce(ctx, logger, false); err != nil {
+		return "", err
+	}
+	return n.baseLocalMountPoint, nil
+}
+
+// mountAttempt is a mount in progress, err is set once done is closed.
+type mountAttempt struct {
+	done chan struct{}
+	err  error
+}
+
+// mountOnce mounts the export unless it is mounted, a remount first detaches whatever is mounted on the mount
+// point. Callers arriving while an attempt is in progress wait for its outcome instead of mounting the export
+// twice. The mutex is not held during the attempt, so that callers waiting for a hung mount give up at their
+// own deadline.
+func (n *nfsClient) mountOnce(ctx context.Context, logger lager.Logger, remount bool) error {
+	n.mountMutex.Lock()
+	if n.mounted && !remount {
+		n.mountMutex.Unlock()
+		return nil
+	}
+	if attempt := n.mounting; attempt != nil {
+		n.mountMutex.Unlock()
+		left := timeLeft(ctx)
+		select {
+		case <-attempt.done:
+			return attempt.err
+		case <-ctx.Done():
+			return contextError(ctx, "mount", left)
+		}
+	}
+	attempt := &mountAttempt{done: make(chan struct{})}
+	n.mounting, n.mounted = attempt, false
+	n.mountMutex.Unlock()
+
+	if remount {
+		attempt.err = n.remount(ctx, logger)
+	} else {
+		attempt.err = n.mount(ctx, logger)
+	}
+
+	n.mountMutex.Lock()
+	n.mounting, n.mounted = nil, attempt.err == nil
+	n.mountMutex.Unlock()
+	close(attempt.done)
+	return attempt.err
+}
+
+// mount reuses a mount left by an earlier run and replaces a stale one or one of another export.
+func (n *nfsClient) mount(ctx context.Context, logger lager.Logger) error {
+	state, err := n.CheckMount(ctx, logger)
 	if err != nil {
-		logger.Error(fmt.Sprintf("failed to create local director '%s', mount filesystem failed", n.baseLocalMountPoint), err)
-		return "",fmt.Errorf("failed to create local director '%s', mount filesystem failed", n.baseLocalMountPoint)
+		return err
+	}
+	switch state {
+	case MountStateMounted:
+		return nil
+	case MountStateStale, MountStateWrongExport:
+		logger.Info("replacing-mount", lager.Data{"state": state})
+		if err := n.unmount(ctx, logger); err != nil {
+			return err
+		}
 	}
 
-	//Judgement the director mounted. The code and logical must be modify, but now shitty to use it.
-	cmd := exec.Command("mountpoint", n.baseLocalMountPoint)
-	out, err := cmd.Output()
+	err = n.fs(ctx, "mkdir", func() error { return n.os.MkdirAll(n.baseLocalMountPoint, os.ModePerm) })
 	if err != nil {
-		logger.Error(fmt.Sprintf("warning,failed to command mountpoint '%s'", n.baseLocalMountPoint), err)
-		//return "",fmt.Errorf("can't mount the '%s', failed verify the filesystem is mounted", n.baseLocalMountPoint)
+		logger.Error(fmt.Sprintf("failed to create local director '%s', mount filesystem failed", n.baseLocalMountPoint), err)
+		return failure(err, "failed to create local director '%s', mount filesystem failed", n.baseLocalMountPoint)
 	}
-	if strings.EqualFold(strings.Replace(string(out), "\n", "", -1), n.baseLocalMountPoint + " is a mountpoint") {
-		n.mounted = true
-		return n.baseLocalMountPoint, nil
+
+	if n.service != nil && isKerberosSecurity(n.mountOptions) {
+		err := n.withCommandTimeout(ctx, func(ctx context.Context) error {
+			return n.service.login(ctx, logger, n.invoker)
+		})
+		if err != nil {
+			return err
+		}
 	}
 
+	// the broker writes the shares, a read-only export is only read-only for the cells
+	options := n.mountOptions.Without("ro", "rw")
 	var cmdArgs []string
 	switch n.version {
 	case 3:
-		cmdArgs = []string{"-o", DefaultNfsV3 , n.remoteInfo + ":" + n.remoteMount , n.baseLocalMountPoint}
+		defaults, _ := ParseMountOptions(DefaultNfsV3)
+		cmdArgs = []string{"-o", defaults.Merge(options).String() , n.remoteInfo + ":" + n.remoteMount , n.baseLocalMountPoint}
 	default:
 		cmdArgs = []string{"-t","nfs4" , n.remoteInfo + ":" + n.remoteMount ,n.baseLocalMountPoint}
+		if len(options) > 0 {
+			cmdArgs = append([]string{"-o", options.String()}, cmdArgs...)
+		}
 	}
 
-	err = n.invokeNFS(logger, cmdArgs)
+	err = n.invokeNFS(ctx, logger, cmdArgs)
 	if err != nil {
 		logger.Error("nfs-error", err)
+		return err
+	}
+	return nil
+}
+
+// CheckMount inspects the mount table and the mount point, without relying on what the client mounted itself.
+// A mount point which cannot be inspected for another reason than a stale file handle is an error.
+func (n *nfsClient) CheckMount(ctx context.Context, logger lager.Logger) (MountState, error) {
+	logger = logger.Session("check-mount")
+
+	mount, found, err := n.mountTable.Lookup(logger, n.baseLocalMountPoint)
+	if err != nil {
 		return "", err
 	}
-	n.mounted = true
-	return n.baseLocalMountPoint, nil
+	if !found {
+		return MountStateNotMounted, nil
+	}
+	if !strings.HasPrefix(mount.FsType, "nfs") || !sameExport(mount.Source, n.remoteInfo + ":" + n.remoteMount) {
+		logger.Info("mounted-from-other-export", lager.Data{"source": mount.Source, "fstype": mount.FsType})
+		return MountStateWrongExport, nil
+	}
+	err = n.fs(ctx, "stat", func() error {
+		_, err := n.os.Stat(n.baseLocalMountPoint)
+		return err
+	})
+	if isTimeout(err) {
+		logger.Error("mount-not-answering", err)
+		return "", err
+	}
+	if isStaleHandle(err) {
+		logger.Info("stale-mount")
+		return MountStateStale, nil
+	}
+	if err != nil {
+		logger.Error("failed-to-stat-mount-point", err)
+		return "", failure(err, "failed to inspect the mount point '%s'", n.baseLocalMountPoint)
+	}
+	return MountStateMounted, nil
+}
+
+// Remount detaches whatever is mounted on the mount point and mounts the export again.
+func (n *nfsClient) Remount(ctx context.Context, logger lager.Logger) error {
+	logger = logger.Session("remount")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	return n.mountOnce(ctx, logger, true)
 }
 
-func (n *nfsClient) CreateShare(logger lager.Logger, shareName string) (string, error) {
+func (n *nfsClient) remount(ctx context.Context, logger lager.Logger) error {
+	_, found, err := n.mountTable.Lookup(logger, n.baseLocalMountPoint)
+	if err == nil && found {
+		err = n.unmount(ctx, logger)
+	}
+	if err != nil {
+		return err
+	}
+	return n.mount(ctx, logger)
+}
+
+func (n *nfsClient) MountError(logger lager.Logger) error {
+	n.mountErrMutex.RLock()
+	defer n.mountErrMutex.RUnlock()
+
+	if n.mountErr == nil {
+		return nil
+	}
+	return fmt.Errorf("nfs export '%s:%s' is unavailable: %s", n.remoteInfo, n.remoteMount, n.mountErr.Error())
+}
+
+func (n *nfsClient) SetMountError(logger lager.Logger, err error) {
+	n.mountErrMutex.Lock()
+	defer n.mountErrMutex.Unlock()
+
+	n.mountErr = err
+}
+
+// unmount detaches the mount point lazily, a stale mount cannot be unmounted otherwise.
+func (n *nfsClient) unmount(ctx context.Context, logger lager.Logger) error {
+	err := n.invoke(ctx, logger, "umount", []string{"-l", n.baseLocalMountPoint})
+	if err != nil {
+		logger.Error("umount-failed", err)
+		return failure(err, "failed to unmount '%s'", n.baseLocalMountPoint)
+	}
+	return nil
+}
+
+func (n *nfsClient) CreateShare(ctx context.Context, logger lager.Logger, shareName string) (string, error) {
 	logger = logger.Session("create-share")
 	logger.Info("start")
 	defer logger.Info("end")
 	logger.Info("share-name", lager.Data{shareName: shareName})
 	sharePath := filepath.Join(n.baseLocalMountPoint, shareName)
-	err := n.os.MkdirAll(sharePath, os.ModePerm)
+	var err error
+	if creator, ok := n.snapshots.(shareCreator); ok {
+		// the share exists already when the creation of an instance is retried
+		var exists bool
+		if exists, err = n.exists(ctx, sharePath); err == nil && !exists {
+			err = n.withCommandTimeout(ctx, func(ctx context.Context) error {
+				return creator.CreateShare(ctx, logger, sharePath)
+			})
+		}
+	} else {
+		err = n.fs(ctx, "mkdir", func() error { return n.os.MkdirAll(sharePath, os.ModePerm) })
+	}
 	if err != nil {
 		logger.Error(fmt.Sprintf("failed to create share '%s'", sharePath), err)
-		return "", fmt.Errorf("failed to create share '%s'", sharePath)
+		return "", failure(err, "failed to create share '%s'", sharePath)
 	}
 	return sharePath, nil
 }
 
-func (n *nfsClient) DeleteShare(logger lager.Logger, shareName string) error {
+// CloneShare copies the content of a share into another share, keeping ownership, permissions and timestamps.
+func (n *nfsClient) CloneShare(ctx context.Context, logger lager.Logger, sourceShareName string, shareName string) error {
+	logger = logger.Session("clone-share")
+	logger.Info("start", lager.Data{"source": sourceShareName, "share": shareName})
+	defer logger.Info("end")
+
+	sourcePath := filepath.Join(n.baseLocalMountPoint, sourceShareName)
+	if exists, err := n.exists(ctx, sourcePath); err != nil || !exists {
+		return failure(err, "share '%s' does not exist", sourceShareName)
+	}
+	sharePath := filepath.Join(n.baseLocalMountPoint, shareName)
+	// copying the content of the directory also copies the ownership and permissions of the directory itself
+	err := n.invoke(ctx, logger, "cp", []string{"-a", "--reflink=auto", sourcePath + "/.", sharePath})
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to copy share '%s' to '%s'", sourcePath, sharePath), err)
+		return failure(err, "failed to clone share '%s'", sourceShareName)
+	}
+	return nil
+}
+
+func (n *nfsClient) DeleteShare(ctx context.Context, logger lager.Logger, shareName string, projectId uint32) error {
 	logger = logger.Session("delete-share")
 	logger.Info("start")
 	defer logger.Info("end")
 
 	sharePath := filepath.Join(n.baseLocalMountPoint, shareName)
-	err := n.os.Remove(sharePath)
+	err := n.withCommandTimeout(ctx, func(ctx context.Context) error {
+		return n.quota.RemoveQuota(ctx, logger, sharePath, shareProjectId(shareName, projectId))
+	})
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to remove quota of share '%s'", sharePath), err)
+	}
+
+	// the share is only moved into the trash, its data is removed by PurgeTrash once it has expired
+	target, err := n.moveToTrash(ctx, logger, sharePath, shareName)
+	if err != nil {
+		return err
+	}
+	logger.Info("share-moved-to-trash", lager.Data{"share": shareName, "trash": target})
+	return nil
+}
+
+// moveToTrash moves a share into the trash directory of the export and returns its new path.
+func (n *nfsClient) moveToTrash(ctx context.Context, logger lager.Logger, sharePath string, shareName string) (string, error) {
+	trashPath := filepath.Join(n.baseLocalMountPoint, TrashDir)
+	err := n.fs(ctx, "mkdir", func() error { return n.os.MkdirAll(trashPath, 0700) })
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to create trash directory '%s'", trashPath), err)
+		return "", failure(err, "failed to delete share '%s'", sharePath)
+	}
+	target, err := n.asidePath(ctx, trashPath, shareName)
+	if err == nil {
+		err = n.fs(ctx, "rename", func() error { return n.os.Rename(sharePath, target) })
+	}
 	if err != nil {
 		logger.Error(fmt.Sprintf("failed to delete share '%s'", sharePath), err)
-		return fmt.Errorf("failed to delete share '%s'", sharePath)
+		return "", failure(err, "failed to delete share '%s'", sharePath)
+	}
+	return target, nil
+}
+
+func (n *nfsClient) SetShareAttributes(ctx context.Context, logger lager.Logger, shareName string, attributes ShareAttributes) error {
+	logger = logger.Session("set-share-attributes")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	sharePath := filepath.Join(n.baseLocalMountPoint, shareName)
+	if attributes.Uid >= 0 || attributes.Gid >= 0 {
+		err := n.fs(ctx, "chown", func() error { return n.os.Chown(sharePath, attributes.Uid, attributes.Gid) })
+		if err != nil {
+			logger.Error(fmt.Sprintf("failed to change owner of share '%s'", sharePath), err)
+			return failure(err, "failed to change owner of share '%s'", sharePath)
+		}
+	}
+	if attributes.Mode != 0 {
+		err := n.fs(ctx, "chmod", func() error { return n.os.Chmod(sharePath, attributes.Mode) })
+		if err != nil {
+			logger.Error(fmt.Sprintf("failed to change permissions of share '%s'", sharePath), err)
+			return failure(err, "failed to change permissions of share '%s'", sharePath)
+		}
 	}
 	return nil
 }
 
-func (n *nfsClient) GetPathForShare(logger lager.Logger, shareName string) (string, string ,error) {
+// SetShareQuota limits the size of a share, a limit of 0 removes the quota of the share.
+func (n *nfsClient) SetShareQuota(ctx context.Context, logger lager.Logger, shareName string, projectId uint32, limit uint64) error {
+	logger = logger.Session("set-share-quota")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	sharePath := filepath.Join(n.baseLocalMountPoint, shareName)
+	err := n.withCommandTimeout(ctx, func(ctx context.Context) error {
+		if limit == 0 {
+			return n.quota.RemoveQuota(ctx, logger, sharePath, shareProjectId(shareName, projectId))
+		}
+		return n.quota.SetQuota(ctx, logger, sharePath, shareProjectId(shareName, projectId), limit)
+	})
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to set quota of share '%s'", sharePath), err)
+		if err == ErrQuotaNotSupported {
+			return err
+		}
+		return failure(err, "failed to set quota of share '%s'", sharePath)
+	}
+	return nil
+}
+
+// ListShares returns the names of the share directories, hidden directories hold no shares.
+func (n *nfsClient) ListShares(ctx context.Context, logger lager.Logger) ([]string, error) {
+	logger = logger.Session("list-shares")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	files, err := n.readDir(ctx, n.baseLocalMountPoint)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to list shares in '%s'", n.baseLocalMountPoint), err)
+		return nil, failure(err, "failed to list shares in '%s'", n.baseLocalMountPoint)
+	}
+	shares := []string{}
+	for _, file := range files {
+		if file.IsDir() && !strings.HasPrefix(file.Name(), ".") {
+			shares = append(shares, file.Name())
+		}
+	}
+	return shares, nil
+}
+
+// asidePath returns a free path to move a share to, a share can be set aside several times within a second.
+func (n *nfsClient) asidePath(ctx context.Context, dir string, shareName string) (string, error) {
+	at := time.Now()
+	for {
+		target := filepath.Join(dir, asideName(shareName, at))
+		exists, err := n.exists(ctx, target)
+		if err != nil || !exists {
+			return target, err
+		}
+		at = at.Add(time.Second)
+	}
+}
+
+// QuarantineShare moves a share into the quarantine directory of the export and returns its new path.
+func (n *nfsClient) QuarantineShare(ctx context.Context, logger lager.Logger, shareName string) (string, error) {
+	logger = logger.Session("quarantine-share")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	quarantinePath := filepath.Join(n.baseLocalMountPoint, QuarantineDir)
+	err := n.fs(ctx, "mkdir", func() error { return n.os.MkdirAll(quarantinePath, 0700) })
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to create quarantine directory '%s'", quarantinePath), err)
+		return "", failure(err, "failed to create quarantine directory '%s'", quarantinePath)
+	}
+
+	sharePath := filepath.Join(n.baseLocalMountPoint, shareName)
+	target, err := n.asidePath(ctx, quarantinePath, shareName)
+	if err == nil {
+		err = n.fs(ctx, "rename", func() error { return n.os.Rename(sharePath, target) })
+	}
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to quarantine share '%s'", sharePath), err)
+		return "", failure(err, "failed to quarantine share '%s'", sharePath)
+	}
+	return target, nil
+}
+
+// ListTrash returns the deleted shares which have not been purged yet.
+func (n *nfsClient) ListTrash(ctx context.Context, logger lager.Logger) ([]TrashEntry, error) {
+	logger = logger.Session("list-trash")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	trashPath := filepath.Join(n.baseLocalMountPoint, TrashDir)
+	files, err := n.readDir(ctx, trashPath)
+	if os.IsNotExist(err) {
+		return []TrashEntry{}, nil
+	}
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to list trash '%s'", trashPath), err)
+		return nil, failure(err, "failed to list trash '%s'", trashPath)
+	}
+	entries := []TrashEntry{}
+	for _, file := range files {
+		shareName, deletedAt, ok := parseAsideName(file.Name())
+		if !ok {
+			logger.Info("ignoring-unknown-trash-entry", lager.Data{"name": file.Name()})
+			continue
+		}
+		entries = append(entries, TrashEntry{Name: file.Name(), ShareName: shareName, DeletedAt: deletedAt})
+	}
+	return entries, nil
+}
+
+// PurgeTrash removes a deleted share and all of its data.
+func (n *nfsClient) PurgeTrash(ctx context.Context, logger lager.Logger, name string) error {
+	logger = logger.Session("purge-trash")
+	logger.Info("start", lager.Data{"name": name})
+	defer logger.Info("end")
+
+	entryPath, err := n.trashEntryPath(name)
+	if err != nil {
+		return err
+	}
+	// removing a whole tree takes as long as a command
+	err = n.pool.Run(ctx, n.timeouts.Command, "remove", func() error { return n.os.RemoveAll(entryPath) })
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to purge '%s'", entryPath), err)
+		return failure(err, "failed to purge '%s'", entryPath)
+	}
+	return nil
+}
+
+// RestoreTrash moves the data of a deleted share into an empty share.
+func (n *nfsClient) RestoreTrash(ctx context.Context, logger lager.Logger, name string, shareName string) error {
+	logger = logger.Session("restore-trash")
+	logger.Info("start", lager.Data{"name": name, "share": shareName})
+	defer logger.Info("end")
+
+	entryPath, err := n.trashEntryPath(name)
+	if err != nil {
+		return err
+	}
+	if exists, err := n.exists(ctx, entryPath); err != nil || !exists {
+		return failure(err, "trash entry '%s' does not exist", name)
+	}
+
+	// the share is removed only if empty so that no data is lost by restoring over it
+	sharePath := filepath.Join(n.baseLocalMountPoint, shareName)
+	err = n.fs(ctx, "remove", func() error { return n.os.Remove(sharePath) })
+	if err != nil && !os.IsNotExist(err) {
+		logger.Error(fmt.Sprintf("failed to remove share '%s'", sharePath), err)
+		if isTimeout(err) {
+			return failure(err, "failed to remove share '%s'", shareName)
+		}
+		return fmt.Errorf("share '%s' is not empty", shareName)
+	}
+	err = n.fs(ctx, "rename", func() error { return n.os.Rename(entryPath, sharePath) })
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to restore '%s' to '%s'", entryPath, sharePath), err)
+		if mkdirErr := n.fs(ctx, "mkdir", func() error { return n.os.MkdirAll(sharePath, os.ModePerm) }); mkdirErr != nil {
+			logger.Error(fmt.Sprintf("failed to recreate share '%s'", sharePath), mkdirErr)
+		}
+		return failure(err, "failed to restore '%s' to share '%s'", name, shareName)
+	}
+	return nil
+}
+
+func (n *nfsClient) trashEntryPath(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid trash entry '%s'", name)
+	}
+	return filepath.Join(n.baseLocalMountPoint, TrashDir, name), nil
+}
+
+func (n *nfsClient) CreateSnapshot(ctx context.Context, logger lager.Logger, shareName string, snapshotName string) error {
+	logger = logger.Session("create-snapshot")
+	logger.Info("start", lager.Data{"share": shareName, "snapshot": snapshotName})
+	defer logger.Info("end")
+
+	sharePath := filepath.Join(n.baseLocalMountPoint, shareName)
+	if exists, err := n.exists(ctx, sharePath); err != nil || !exists {
+		return failure(err, "share '%s' does not exist", shareName)
+	}
+	return n.withCommandTimeout(ctx, func(ctx context.Context) error {
+		return n.snapshots.CreateSnapshot(ctx, logger, shareName, snapshotName)
+	})
+}
+
+// RestoreSnapshot replaces the share by the content of the snapshot. The share is set aside in the trash while the
+// snapshot is copied and moved back if the copy fails. Clients which have the share mounted would keep using the
+// share set aside, the broker only restores the snapshots of instances without bindings.
+func (n *nfsClient) RestoreSnapshot(ctx context.Context, logger lager.Logger, shareName string, snapshotName string, projectId uint32) error {
+	logger = logger.Session("restore-snapshot")
+	logger.Info("start", lager.Data{"share": shareName, "snapshot": snapshotName})
+	defer logger.Info("end")
+
+	sharePath := filepath.Join(n.baseLocalMountPoint, shareName)
+	aside, err := n.moveToTrash(ctx, logger, sharePath, shareName)
+	if err != nil {
+		return err
+	}
+	err = n.withCommandTimeout(ctx, func(ctx context.Context) error {
+		return n.snapshots.RestoreSnapshot(ctx, logger, shareName, snapshotName, sharePath)
+	})
+	if err != nil {
+		n.restoreAside(ctx, logger, aside, sharePath)
+		return err
+	}
+
+	// the quota of the share is applied to the restored share, the share set aside no longer counts against it
+	err = n.withCommandTimeout(ctx, func(ctx context.Context) error {
+		return n.quota.RemoveQuota(ctx, logger, aside, shareProjectId(shareName, projectId))
+	})
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to remove quota of '%s'", aside), err)
+	}
+	logger.Info("share-moved-to-trash", lager.Data{"share": shareName, "trash": aside})
+	return nil
+}
+
+// restoreAside removes what a failed restore left of a share and moves the share set aside back in its place.
+func (n *nfsClient) restoreAside(ctx context.Context, logger lager.Logger, aside string, sharePath string) {
+	err := n.pool.Run(ctx, n.timeouts.Command, "remove", func() error { return n.os.RemoveAll(sharePath) })
+	if err == nil {
+		err = n.fs(ctx, "rename", func() error { return n.os.Rename(aside, sharePath) })
+	}
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to move '%s' back to share '%s'", aside, sharePath), err)
+		return
+	}
+	logger.Info("share-moved-back", lager.Data{"share": sharePath})
+}
+
+func (n *nfsClient) DeleteSnapshot(ctx context.Context, logger lager.Logger, shareName string, snapshotName string) error {
+	logger = logger.Session("delete-snapshot")
+	logger.Info("start", lager.Data{"share": shareName, "snapshot": snapshotName})
+	defer logger.Info("end")
+
+	return n.withCommandTimeout(ctx, func(ctx context.Context) error {
+		return n.snapshots.DeleteSnapshot(ctx, logger, shareName, snapshotName)
+	})
+}
+
+func (n *nfsClient) FilesystemStats(ctx context.Context, logger lager.Logger) (FilesystemStats, error) {
+	logger = logger.Session("filesystem-stats")
+
+	// the call fills its own struct, an abandoned call must not write into the result
+	var stat syscall.Statfs_t
+	err := n.fs(ctx, "statfs", func() error {
+		var result syscall.Statfs_t
+		if err := syscall.Statfs(n.baseLocalMountPoint, &result); err != nil {
+			return err
+		}
+		stat = result
+		return nil
+	})
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to stat filesystem '%s'", n.baseLocalMountPoint), err)
+		return FilesystemStats{}, failure(err, "failed to stat filesystem '%s'", n.baseLocalMountPoint)
+	}
+	blockSize := uint64(stat.Bsize)
+	return FilesystemStats{
+		Total:     stat.Blocks * blockSize,
+		Free:      stat.Bfree * blockSize,
+		Available: stat.Bavail * blockSize,
+	}, nil
+}
+
+// CheckWritable writes, reads back and removes a canary file in the root of the export. The file name starts
+// with a dot, so that it is not mistaken for a share.
+func (n *nfsClient) CheckWritable(ctx context.Context, logger lager.Logger, canaryName string) error {
+	logger = logger.Session("check-writable")
+
+	canaryPath := filepath.Join(n.baseLocalMountPoint, "."+canaryName)
+	content := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	err := n.fs(ctx, "write", func() error { return n.useFileUtil.WriteFile(canaryPath, content, 0600) })
+	if err != nil {
+		logger.Error("failed-to-write-canary", err)
+		return failure(err, "failed to write to export '%s'", n.baseLocalMountPoint)
+	}
+	defer n.fs(ctx, "remove", func() error { return n.os.Remove(canaryPath) })
+
+	var read []byte
+	err = n.fs(ctx, "read", func() error {
+		data, err := n.useFileUtil.ReadFile(canaryPath)
+		read = data
+		return err
+	})
+	if err != nil || string(read) != string(content) {
+		logger.Error("failed-to-read-canary", err)
+		return failure(err, "failed to read back from export '%s'", n.baseLocalMountPoint)
+	}
+	return nil
+}
+
+// ShareUsage returns the bytes the files of a share take on disk, hardlinked files are counted once.
+func (n *nfsClient) ShareUsage(ctx context.Context, logger lager.Logger, shareName string) (uint64, error) {
+	logger = logger.Session("share-usage", lager.Data{"share": shareName})
+
+	// walking a whole tree takes as long as a command
+	var used uint64
+	err := n.pool.Run(ctx, n.timeouts.Command, "walk", func() error {
+		var err error
+		used, err = n.walkUsage(filepath.Join(n.baseLocalMountPoint, shareName))
+		return err
+	})
+	if err != nil {
+		logger.Error("failed-to-walk-share", err)
+		return 0, failure(err, "failed to determine the usage of share '%s'", shareName)
+	}
+	return used, nil
+}
+
+func (n *nfsClient) walkUsage(sharePath string) (uint64, error) {
+	seen := map[uint64]bool{}
+	var used uint64
+	err := filepath.Walk(sharePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			used += uint64(info.Size())
+			return nil
+		}
+		if stat.Nlink > 1 && !info.IsDir() {
+			if seen[stat.Ino] {
+				return nil
+			}
+			seen[stat.Ino] = true
+		}
+		used += uint64(stat.Blocks) * 512
+		return nil
+	})
+	return used, err
+}
+
+func (n *nfsClient) GetPathForShare(ctx context.Context, logger lager.Logger, shareName string) (string, string ,error) {
 	logger = logger.Session("get-path-for-share")
 	logger.Info("start")
 	defer logger.Info("end")
@@ -149,7 +820,10 @@ func (n *nfsClient) GetPathForShare(logger lager.Logger, shareName string) (stri
 	logger.Info("share-name", lager.Data{shareName: shareName})
 
 	shareLocalPath := filepath.Join(n.baseLocalMountPoint, shareName)
-	exists := utils.Exists(shareLocalPath, n.os)
+	exists, err := n.exists(ctx, shareLocalPath)
+	if err != nil {
+		return "", "", failure(err, "failed to look up share '%s'", shareName)
+	}
 	if exists == false {
 		return "","", fmt.Errorf("share not found, internal error")
 	}
@@ -166,15 +840,75 @@ func (n *nfsClient) GetConfigDetails(lager.Logger) (string, int, error) {
 	return n.remoteInfo, n.version, nil
 }
 
-func (n *nfsClient) invokeNFS(logger lager.Logger, args []string) error {
+func (n *nfsClient) GetMountOptions(lager.Logger) MountOptions {
+	return n.mountOptions
+}
+
+func (n *nfsClient) invokeNFS(ctx context.Context, logger lager.Logger, args []string) error {
 	cmd := "mount"
 	logger.Info("invoke-nfs", lager.Data{"cmd": cmd, "args": args})
 	defer logger.Debug("done-invoking-nfs")
-	return n.invoker.Invoke(logger, cmd, args)
+	return n.invoke(ctx, logger, cmd, args)
+}
+
+// invoke runs a command within the command timeout.
+func (n *nfsClient) invoke(ctx context.Context, logger lager.Logger, executable string, args []string) error {
+	return n.withCommandTimeout(ctx, func(ctx context.Context) error {
+		return n.invoker.Invoke(ctx, logger, executable, args)
+	})
+}
+
+// withCommandTimeout bounds a call running commands, such as a call to the quota or snapshot driver, by the command timeout.
+func (n *nfsClient) withCommandTimeout(ctx context.Context, call func(context.Context) error) error {
+	ctx, cancel, _ := withTimeout(ctx, n.timeouts.Command)
+	defer cancel()
+	return call(ctx)
+}
+
+// fs runs a filesystem call on the pool of the client within the filesystem timeout.
+func (n *nfsClient) fs(ctx context.Context, operation string, call func() error) error {
+	return n.pool.Run(ctx, n.timeouts.Filesystem, operation, call)
 }
 
+func (n *nfsClient) exists(ctx context.Context, path string) (bool, error) {
+	exists := false
+	err := n.fs(ctx, "stat", func() error {
+		exists = utils.Exists(path, n.os)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+func (n *nfsClient) readDir(ctx context.Context, path string) ([]os.FileInfo, error) {
+	var files []os.FileInfo
+	err := n.fs(ctx, "readdir", func() error {
+		var err error
+		files, err = n.useFileUtil.ReadDir(path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// failure is the error of a failed call. A timeout is reported as such, its cause is the export rather
+// than the share, other errors are only logged.
+func failure(err error, format string, args ...interface{}) error {
+	message := fmt.Sprintf(format, args...)
+	if isTimeout(err) {
+		return fmt.Errorf("%s: %s", message, err.Error())
+	}
+	return errors.New(message)
+}
+
+// Invoker runs commands. A command still running when the context is done is killed, the invoker then
+// returns without waiting for it to exit, as a command blocked on a hung export cannot be killed.
 type Invoker interface {
-	Invoke(logger lager.Logger, executable string, args []string) error
+	Invoke(ctx context.Context, logger lager.Logger, executable string, args []string) error
 }
 
 type realInvoker struct {
@@ -189,7 +923,11 @@ func NewRealInvokerWithExec(useExec execshim.Exec) Invoker {
 	return &realInvoker{useExec}
 }
 
-func (r *realInvoker) Invoke(logger lager.Logger, executable string, cmdArgs []string) error {
+func (r *realInvoker) Invoke(ctx context.Context, logger lager.Logger, executable string, cmdArgs []string) error {
+	timeout := timeLeft(ctx)
+	if err := ctx.Err(); err != nil {
+		return contextError(ctx, executable, timeout)
+	}
 	cmdHandle := r.useExec.Command(executable, cmdArgs...)
 
 	_, err := cmdHandle.StdoutPipe()
@@ -203,7 +941,21 @@ func (r *realInvoker) Invoke(logger lager.Logger, executable string, cmdArgs []s
 		return err
 	}
 
-	if err = cmdHandle.Wait(); err != nil {
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmdHandle.Wait()
+	}()
+	select {
+	case err = <-exited:
+	case <-ctx.Done():
+		if cmd, ok := cmdHandle.(*exec.Cmd); ok && cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+		err = contextError(ctx, executable, timeout)
+		logger.Error("command-abandoned", err)
+		return err
+	}
+	if err != nil {
 		logger.Error("command-exited", err)
 		return err
 	}
@@ -0,0 +1,116 @@
+package nfsbroker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var (
+	ErrCloneOnlyOnProvision    = errors.New("clone_from can only be given when provisioning an instance")
+	ErrCloneSourceNotPermitted = errors.New("an instance can only be cloned from an instance of the same organization or space")
+)
+
+// cloneFrom returns the id of the instance given with the clone_from parameter of a new instance, it is empty if
+// nothing is cloned.
+func cloneFrom(rawParameters json.RawMessage) (string, error) {
+	parameters, err := parseRawParameters(rawParameters)
+	if err != nil {
+		return "", err
+	}
+	value, ok := parameters[ParamCloneFrom]
+	if !ok {
+		return "", nil
+	}
+	sourceID, ok := value.(string)
+	if !ok || sourceID == "" {
+		return "", brokerapi.ErrRawParamsInvalid
+	}
+	return sourceID, nil
+}
+
+// holdCloneSource records with the source of a new instance that its share is being copied into the instance
+// and returns the metadata of the source. No operation is started on the source until releaseCloneSource, which
+// keeps other requests from changing or deleting it while its share is copied, its last operation is kept.
+// The source is locked on its own: the lock of the new instance may be the same lock, it must not be held.
+func (b *broker) holdCloneSource(logger lager.Logger, instanceID, sourceID string, context RequestContext) (Metadata, error) {
+	logger = logger.Session("hold-clone-source", lager.Data{"source": sourceID})
+
+	sourceLock := b.locks.forInstance(sourceID)
+	sourceLock.Lock()
+	defer sourceLock.Unlock()
+
+	_, sourceMetadata, err := b.idleInstance(logger, sourceID)
+	if err == brokerapi.ErrInstanceDoesNotExist {
+		return Metadata{}, fmt.Errorf("instance '%s' to clone does not exist", sourceID)
+	}
+	if err != nil {
+		return Metadata{}, err
+	}
+	if !sameTenant(sourceMetadata.Context, context) {
+		logger.Error("clone-not-permitted", ErrCloneSourceNotPermitted)
+		return Metadata{}, ErrCloneSourceNotPermitted
+	}
+	sourceMetadata.CloningInto = append(sourceMetadata.CloningInto, instanceID)
+	if err := b.store.SaveMetadata(logger, sourceID, sourceMetadata); err != nil {
+		logger.Error("failed-to-hold-clone-source", err)
+		return Metadata{}, err
+	}
+	return sourceMetadata, nil
+}
+
+// releaseCloneSource ends the hold holdCloneSource took on the source of an instance, it must not be called
+// with the lock of the instance held. The source itself is unchanged whether or not its share could be copied.
+func (b *broker) releaseCloneSource(logger lager.Logger, instanceID, sourceID string) {
+	if sourceID == "" {
+		return
+	}
+	logger = logger.Session("release-clone-source", lager.Data{"source": sourceID})
+
+	sourceLock := b.locks.forInstance(sourceID)
+	sourceLock.Lock()
+	defer sourceLock.Unlock()
+
+	metadata, err := b.metadata(logger, sourceID)
+	if err != nil {
+		return
+	}
+	held := []string{}
+	for _, id := range metadata.CloningInto {
+		if id != instanceID {
+			held = append(held, id)
+		}
+	}
+	if len(held) == 0 {
+		held = nil
+	}
+	metadata.CloningInto = held
+	if err := b.store.SaveMetadata(logger, sourceID, metadata); err != nil {
+		logger.Error("failed-to-release-clone-source", err)
+	}
+}
+
+// cloneSource records the source instance held by holdCloneSource in the metadata of the new instance and
+// returns the share to copy. The share is copied on the backend of its source.
+func cloneSource(sourceID string, source Metadata, metadata *Metadata) string {
+	metadata.ClonedFrom = sourceID
+	metadata.Backend = source.Backend
+	return source.ShareName
+}
+
+// sameTenant tells whether two instances belong to the same space or organization, or to the same
+// namespace on kubernetes. Instances without a known organization or namespace belong to no one.
+func sameTenant(a, b RequestContext) bool {
+	switch {
+	case a.SpaceGUID != "" && a.SpaceGUID == b.SpaceGUID:
+		return true
+	case a.OrganizationGUID != "" && a.OrganizationGUID == b.OrganizationGUID:
+		return true
+	case a.Namespace != "" && a.Namespace == b.Namespace:
+		return a.Platform == b.Platform
+	}
+	return false
+}
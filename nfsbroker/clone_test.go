@@ -0,0 +1,114 @@
+package nfsbroker
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cloning", func() {
+	var (
+		store   *memoryStore
+		invoker *fakeInvoker
+		tb      testBroker
+	)
+
+	cloneDetails := brokerapi.ProvisionDetails{
+		ServiceID:        "service-id",
+		PlanID:           "plan-id",
+		OrganizationGUID: "org",
+		RawParameters:    json.RawMessage(`{"clone_from": "source"}`),
+	}
+
+	sourceOperation := func() brokerapi.LastOperation {
+		op, err := tb.LastOperation("source", OperationProvision)
+		Expect(err).NotTo(HaveOccurred())
+		return op
+	}
+
+	sourceHolds := func() []string {
+		metadata, err := store.RetrieveMetadata(tb.logger, "source")
+		Expect(err).NotTo(HaveOccurred())
+		return metadata.CloningInto
+	}
+
+	BeforeEach(func() {
+		store = newMemoryStore()
+		invoker = &fakeInvoker{}
+		tb = newTestBroker(store, invoker, testCatalog())
+		_, err := tb.Provision("source", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id", OrganizationGUID: "org"}, false)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		tb.cleanup()
+	})
+
+	It("keeps the source from being deleted while its share is copied without changing its last operation", func() {
+		invoker.InvokeStub = func(executable string, args []string) error {
+			defer GinkgoRecover()
+			Expect(sourceHolds()).To(Equal([]string{"clone"}))
+			_, err := tb.Deprovision("source", brokerapi.DeprovisionDetails{}, false)
+			Expect(err).To(Equal(ErrOperationInProgress))
+			_, err = tb.Update("source", brokerapi.UpdateDetails{Parameters: map[string]interface{}{ParamMode: "0700"}}, false)
+			Expect(err).To(Equal(ErrOperationInProgress))
+			return nil
+		}
+
+		_, err := tb.Provision("clone", cloneDetails, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(invoker.Calls()).To(HaveLen(1))
+		Expect(sourceHolds()).To(BeEmpty())
+		Expect(sourceOperation().State).To(Equal(brokerapi.Succeeded))
+		Expect(sourceOperation().Description).To(Equal("share created"))
+	})
+
+	It("releases the source when the copy fails", func() {
+		invoker.InvokeStub = func(string, []string) error { return errors.New("no space left on device") }
+
+		_, err := tb.Provision("clone", cloneDetails, false)
+		Expect(err).To(HaveOccurred())
+		Expect(sourceHolds()).To(BeEmpty())
+		Expect(sourceOperation().Description).To(Equal("share created"))
+
+		_, err = tb.Deprovision("source", brokerapi.DeprovisionDetails{}, false)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("does not clone a source with an operation in progress", func() {
+		Expect(store.SaveOperation(tb.logger, "source", tb.operation(OperationUpdate, brokerapi.InProgress, "updating share"))).To(Succeed())
+
+		_, err := tb.Provision("clone", cloneDetails, false)
+		Expect(err).To(Equal(ErrOperationInProgress))
+		Expect(sourceHolds()).To(BeEmpty())
+	})
+
+	It("releases the source when the backend of the source does not admit the clone", func() {
+		tb.backends.Default().Limits.MaxInstances = 1
+
+		_, err := tb.Provision("clone", cloneDetails, false)
+		Expect(err).To(Equal(brokerapi.ErrInstanceLimitMet))
+		Expect(invoker.Calls()).To(BeEmpty())
+		Expect(sourceHolds()).To(BeEmpty())
+	})
+
+	It("releases the source of a clone interrupted by a restart", func() {
+		invoker.InvokeStub = func(executable string, args []string) error {
+			defer GinkgoRecover()
+			if executable != "cp" {
+				return nil
+			}
+			Expect(store.SaveOperation(tb.logger, "clone", tb.operation(OperationProvision, brokerapi.InProgress, "cloning"))).To(Succeed())
+			Expect(tb.restoreState()).To(Succeed())
+			Expect(sourceHolds()).To(BeEmpty())
+			return nil
+		}
+
+		_, err := tb.Provision("clone", cloneDetails, false)
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -1,6 +1,8 @@
 package nfsbroker
 
 import (
+	"context"
+
 	"code.cloudfoundry.org/voldriver"
 	"github.com/pivotal-cf/brokerapi"
 	"code.cloudfoundry.org/lager"
@@ -12,9 +14,25 @@ type BindResponse struct {
 	SharedDevice brokerapi.SharedDevice
 }
 
+// ShareOptions are the settings applied to a share when it is created or updated.
+type ShareOptions struct {
+	Attributes ShareAttributes
+	// size limit of the share in bytes, 0 leaves the share unlimited
+	Quota uint64
+	// quota project of the share, 0 for shares whose project id derives from their name
+	ProjectId uint32
+}
+
+// Controller manages the shares of a backend, the context bounds the calls to the export.
 type Controller interface {
-	voldriver.Provisioner
-	Bind(logger lager.Logger, instanceID string) BindResponse
+	Create(ctx context.Context, logger lager.Logger, createRequest voldriver.CreateRequest) voldriver.ErrorResponse
+	Remove(ctx context.Context, logger lager.Logger, removeRequest voldriver.RemoveRequest, projectId uint32) voldriver.ErrorResponse
+	Bind(ctx context.Context, logger lager.Logger, instanceID string) BindResponse
+	Update(ctx context.Context, logger lager.Logger, instanceID string, options ShareOptions) voldriver.ErrorResponse
+	Restore(ctx context.Context, logger lager.Logger, trashName string, shareName string, options ShareOptions) voldriver.ErrorResponse
+	CreateSnapshot(ctx context.Context, logger lager.Logger, shareName string, snapshotName string) voldriver.ErrorResponse
+	RestoreSnapshot(ctx context.Context, logger lager.Logger, shareName string, snapshotName string, options ShareOptions) voldriver.ErrorResponse
+	DeleteSnapshot(ctx context.Context, logger lager.Logger, shareName string, snapshotName string) voldriver.ErrorResponse
 }
 
 type controller struct {
@@ -25,32 +43,165 @@ func NewController(nfsClient Client) Controller{
 	return &controller{nfsClient:nfsClient}
 }
 
-func (c *controller) Create(logger lager.Logger, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
+func (c *controller) Create(ctx context.Context, logger lager.Logger, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
 	logger = logger.Session("provision")
 	logger.Info("start")
 	defer logger.Info("end")
 
+	if err := c.nfsClient.MountError(logger); err != nil {
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+
 	mounted := c.nfsClient.IsFilesystemMounted(logger)
 	if !mounted {
-		_, err := c.nfsClient.MountFileSystem(logger, "/")
+		_, err := c.nfsClient.MountFileSystem(ctx, logger, "/")
 		if err != nil {
 			return voldriver.ErrorResponse{Err: err.Error()}
 		}
 	}
-	mountpoint, err := c.nfsClient.CreateShare(logger, createRequest.Name)
+	mountpoint, err := c.nfsClient.CreateShare(ctx, logger, createRequest.Name)
 	if err != nil {
 		return voldriver.ErrorResponse{Err: err.Error()}
 	}
 	logger.Info("mountpoint-created", lager.Data{mountpoint: mountpoint})
+
+	// the share options are applied after cloning, so that the quota covers the copied files
+	options, hasOptions := createRequest.Opts[shareOptionsOpt].(ShareOptions)
+	if source, ok := createRequest.Opts[cloneFromOpt].(string); ok && source != "" {
+		err = c.nfsClient.CloneShare(ctx, logger, source, createRequest.Name)
+		if err != nil {
+			if deleteErr := c.nfsClient.DeleteShare(ctx, logger, createRequest.Name, options.ProjectId); deleteErr != nil {
+				logger.Error("failed-to-delete-partial-clone", deleteErr)
+			}
+			return voldriver.ErrorResponse{Err: err.Error()}
+		}
+	}
+
+	if hasOptions {
+		err = c.applyShareOptions(ctx, logger, createRequest.Name, options, true)
+		if err != nil {
+			return voldriver.ErrorResponse{Err: err.Error()}
+		}
+	}
+	return voldriver.ErrorResponse{}
+}
+
+func (c *controller) Update(ctx context.Context, logger lager.Logger, instanceID string, options ShareOptions) voldriver.ErrorResponse {
+	logger = logger.Session("update")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if err := c.nfsClient.MountError(logger); err != nil {
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+
+	err := c.applyShareOptions(ctx, logger, instanceID, options, false)
+	if err != nil {
+		logger.Error("Error updating share", err)
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+	return voldriver.ErrorResponse{}
+}
+
+// Restore moves the data of a deleted share into an empty share and applies the options of the share to it.
+func (c *controller) Restore(ctx context.Context, logger lager.Logger, trashName string, shareName string, options ShareOptions) voldriver.ErrorResponse {
+	logger = logger.Session("restore")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if err := c.nfsClient.MountError(logger); err != nil {
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+
+	err := c.nfsClient.RestoreTrash(ctx, logger, trashName, shareName)
+	if err == nil {
+		err = c.applyShareOptions(ctx, logger, shareName, options, false)
+	}
+	if err != nil {
+		logger.Error("Error restoring share", err)
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+	return voldriver.ErrorResponse{}
+}
+
+func (c *controller) CreateSnapshot(ctx context.Context, logger lager.Logger, shareName string, snapshotName string) voldriver.ErrorResponse {
+	logger = logger.Session("create-snapshot")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if err := c.nfsClient.MountError(logger); err != nil {
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+
+	err := c.nfsClient.CreateSnapshot(ctx, logger, shareName, snapshotName)
+	if err != nil {
+		logger.Error("Error creating snapshot", err)
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+	return voldriver.ErrorResponse{}
+}
+
+// RestoreSnapshot replaces the share by the content of a snapshot and applies the options of the share to it.
+func (c *controller) RestoreSnapshot(ctx context.Context, logger lager.Logger, shareName string, snapshotName string, options ShareOptions) voldriver.ErrorResponse {
+	logger = logger.Session("restore-snapshot")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if err := c.nfsClient.MountError(logger); err != nil {
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+
+	err := c.nfsClient.RestoreSnapshot(ctx, logger, shareName, snapshotName, options.ProjectId)
+	if err == nil {
+		err = c.applyShareOptions(ctx, logger, shareName, options, false)
+	}
+	if err != nil {
+		logger.Error("Error restoring snapshot", err)
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+	return voldriver.ErrorResponse{}
+}
+
+func (c *controller) DeleteSnapshot(ctx context.Context, logger lager.Logger, shareName string, snapshotName string) voldriver.ErrorResponse {
+	logger = logger.Session("delete-snapshot")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if err := c.nfsClient.MountError(logger); err != nil {
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+
+	err := c.nfsClient.DeleteSnapshot(ctx, logger, shareName, snapshotName)
+	if err != nil {
+		logger.Error("Error deleting snapshot", err)
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
 	return voldriver.ErrorResponse{}
 }
 
-func (c *controller) Remove(logger lager.Logger, removeRequest voldriver.RemoveRequest) voldriver.ErrorResponse{
+// applyShareOptions sets the attributes and the quota of a share, a quota of 0 removes the quota of an
+// existing share while a new share has no quota to remove.
+func (c *controller) applyShareOptions(ctx context.Context, logger lager.Logger, shareName string, options ShareOptions, newShare bool) error {
+	err := c.nfsClient.SetShareAttributes(ctx, logger, shareName, options.Attributes)
+	if err != nil {
+		return err
+	}
+	if options.Quota > 0 || !newShare {
+		return c.nfsClient.SetShareQuota(ctx, logger, shareName, options.ProjectId, options.Quota)
+	}
+	return nil
+}
+
+func (c *controller) Remove(ctx context.Context, logger lager.Logger, removeRequest voldriver.RemoveRequest, projectId uint32) voldriver.ErrorResponse{
 	logger = logger.Session("remove")
 	logger.Info("start")
 	defer logger.Info("end")
 
-	err := c.nfsClient.DeleteShare(logger, removeRequest.Name)
+	if err := c.nfsClient.MountError(logger); err != nil {
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+
+	err := c.nfsClient.DeleteShare(ctx, logger, removeRequest.Name, projectId)
 	if err != nil {
 		logger.Error("Error deleting share", err)
 		return voldriver.ErrorResponse{Err:err.Error()}
@@ -58,13 +209,18 @@ func (c *controller) Remove(logger lager.Logger, removeRequest voldriver.RemoveR
 	return voldriver.ErrorResponse{}
 }
 
-func (c *controller) Bind(logger lager.Logger, instanceID string) BindResponse{
+func (c *controller) Bind(ctx context.Context, logger lager.Logger, instanceID string) BindResponse{
 	logger = logger.Session("bind-service-instance")
 	logger.Info("start")
 	defer logger.Info("end")
 	response := BindResponse{}
 
-	remoteSharePath, localPath , err := c.nfsClient.GetPathForShare(logger, instanceID)
+	if err := c.nfsClient.MountError(logger); err != nil {
+		response.Err = err.Error()
+		return response
+	}
+
+	remoteSharePath, localPath , err := c.nfsClient.GetPathForShare(ctx, logger, instanceID)
 	if err != nil {
 		logger.Error("failed-getting-paths-for-share",err)
 		response.Err = err.Error()
@@ -76,15 +232,19 @@ func (c *controller) Bind(logger lager.Logger, instanceID string) BindResponse{
 		response.Err = err.Error()
 		return response
 	}
+	mountConfig := map[string]interface{}{
+		"remote_info"       : strings.Split(remoteInfo,":")[0],
+		"version"           : version,
+		"remote_mountpoint" : remoteSharePath,
+		"local_mountpoint"  : localPath,
+	}
+	if options := c.nfsClient.GetMountOptions(logger); len(options) > 0 {
+		mountConfig["mount_options"] = options.String()
+	}
 	return BindResponse{
 		SharedDevice: brokerapi.SharedDevice{
 			VolumeId: instanceID,
-			MountConfig: map[string]interface{}{
-				"remote_info"       : strings.Split(remoteInfo,":")[0],
-				"version"           : version,
-				"remote_mountpoint" : remoteSharePath,
-				"local_mountpoint"  : localPath,
-			},
+			MountConfig: mountConfig,
 		},
 	}
 }
@@ -0,0 +1,371 @@
+package nfsbroker
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"code.cloudfoundry.org/goshims/ioutil"
+	"code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/gomega"
+)
+
+// fakeInvoker records the commands it is asked to run, InvokeStub decides their outcome.
+type fakeInvoker struct {
+	mutex      sync.Mutex
+	calls      [][]string
+	InvokeStub func(executable string, args []string) error
+}
+
+func (f *fakeInvoker) Invoke(ctx context.Context, logger lager.Logger, executable string, args []string) error {
+	f.mutex.Lock()
+	f.calls = append(f.calls, append([]string{executable}, args...))
+	stub := f.InvokeStub
+	f.mutex.Unlock()
+
+	if stub != nil {
+		return stub(executable, args)
+	}
+	return nil
+}
+
+func (f *fakeInvoker) Calls() [][]string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([][]string{}, f.calls...)
+}
+
+// fakeIoutil serves the mount table from MountInfo and reads every other file from the filesystem.
+type fakeIoutil struct {
+	ioutilshim.IoutilShim
+	mutex     sync.Mutex
+	mountInfo string
+}
+
+func (f *fakeIoutil) ReadFile(filename string) ([]byte, error) {
+	if filename != ProcMountInfo {
+		return f.IoutilShim.ReadFile(filename)
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return []byte(f.mountInfo), nil
+}
+
+func (f *fakeIoutil) SetMountInfo(mountInfo string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.mountInfo = mountInfo
+}
+
+// fakeOs fails the stat of the path given to FailStat and passes every other call to the filesystem.
+type fakeOs struct {
+	osshim.OsShim
+	mutex    sync.Mutex
+	statPath string
+	statErr  error
+}
+
+func (f *fakeOs) Stat(name string) (os.FileInfo, error) {
+	f.mutex.Lock()
+	statPath, statErr := f.statPath, f.statErr
+	f.mutex.Unlock()
+	if name == statPath && statErr != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: statErr}
+	}
+	return f.OsShim.Stat(name)
+}
+
+func (f *fakeOs) FailStat(path string, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.statPath, f.statErr = path, err
+}
+
+// memoryStore keeps the state of the broker in maps, with the semantics of the persistent stores.
+type memoryStore struct {
+	mutex      sync.Mutex
+	instances  map[string]brokerapi.ProvisionDetails
+	bindings   map[string]brokerapi.BindDetails
+	operations map[string]OperationRecord
+	metadata   map[string]Metadata
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		instances:  map[string]brokerapi.ProvisionDetails{},
+		bindings:   map[string]brokerapi.BindDetails{},
+		operations: map[string]OperationRecord{},
+		metadata:   map[string]Metadata{},
+	}
+}
+
+func (s *memoryStore) Restore(logger lager.Logger) error {
+	return nil
+}
+
+func (s *memoryStore) CreateInstanceDetails(logger lager.Logger, instanceID string, details brokerapi.ProvisionDetails) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.instances[instanceID]; ok {
+		return brokerapi.ErrInstanceAlreadyExists
+	}
+	s.instances[instanceID] = details
+	return nil
+}
+
+func (s *memoryStore) RetrieveInstanceDetails(logger lager.Logger, instanceID string) (brokerapi.ProvisionDetails, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	details, ok := s.instances[instanceID]
+	if !ok {
+		return brokerapi.ProvisionDetails{}, brokerapi.ErrInstanceDoesNotExist
+	}
+	return details, nil
+}
+
+func (s *memoryStore) UpdateInstanceDetails(logger lager.Logger, instanceID string, details brokerapi.ProvisionDetails) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.instances[instanceID]; !ok {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+	s.instances[instanceID] = details
+	return nil
+}
+
+func (s *memoryStore) DeleteInstanceDetails(logger lager.Logger, instanceID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.instances[instanceID]; !ok {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+	delete(s.instances, instanceID)
+	return nil
+}
+
+func (s *memoryStore) ListInstanceDetails(logger lager.Logger) (map[string]brokerapi.ProvisionDetails, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	instances := map[string]brokerapi.ProvisionDetails{}
+	for id, details := range s.instances {
+		instances[id] = details
+	}
+	return instances, nil
+}
+
+func (s *memoryStore) CreateBindingDetails(logger lager.Logger, bindingID string, details brokerapi.BindDetails) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.bindings[bindingID]; ok {
+		return brokerapi.ErrBindingAlreadyExists
+	}
+	s.bindings[bindingID] = details
+	return nil
+}
+
+func (s *memoryStore) RetrieveBindingDetails(logger lager.Logger, bindingID string) (brokerapi.BindDetails, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	details, ok := s.bindings[bindingID]
+	if !ok {
+		return brokerapi.BindDetails{}, brokerapi.ErrBindingDoesNotExist
+	}
+	return details, nil
+}
+
+func (s *memoryStore) DeleteBindingDetails(logger lager.Logger, bindingID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.bindings[bindingID]; !ok {
+		return brokerapi.ErrBindingDoesNotExist
+	}
+	delete(s.bindings, bindingID)
+	return nil
+}
+
+func (s *memoryStore) ListBindingDetails(logger lager.Logger) (map[string]brokerapi.BindDetails, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	bindings := map[string]brokerapi.BindDetails{}
+	for id, details := range s.bindings {
+		bindings[id] = details
+	}
+	return bindings, nil
+}
+
+func (s *memoryStore) StartOperation(logger lager.Logger, instanceID string, operation OperationRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if existing, ok := s.operations[instanceID]; ok && existing.State == brokerapi.InProgress {
+		return ErrOperationInProgress
+	}
+	s.operations[instanceID] = operation
+	return nil
+}
+
+func (s *memoryStore) SaveOperation(logger lager.Logger, instanceID string, operation OperationRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.operations[instanceID] = operation
+	return nil
+}
+
+func (s *memoryStore) RetrieveOperation(logger lager.Logger, instanceID string) (OperationRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	operation, ok := s.operations[instanceID]
+	if !ok {
+		return OperationRecord{}, ErrOperationDoesNotExist
+	}
+	return operation, nil
+}
+
+func (s *memoryStore) DeleteOperation(logger lager.Logger, instanceID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.operations, instanceID)
+	return nil
+}
+
+func (s *memoryStore) ListOperations(logger lager.Logger) (map[string]OperationRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	operations := map[string]OperationRecord{}
+	for id, operation := range s.operations {
+		operations[id] = operation
+	}
+	return operations, nil
+}
+
+func (s *memoryStore) SaveMetadata(logger lager.Logger, id string, metadata Metadata) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.metadata[id] = metadata
+	return nil
+}
+
+func (s *memoryStore) RetrieveMetadata(logger lager.Logger, id string) (Metadata, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	metadata, ok := s.metadata[id]
+	if !ok {
+		return Metadata{}, ErrMetadataDoesNotExist
+	}
+	return metadata, nil
+}
+
+func (s *memoryStore) DeleteMetadata(logger lager.Logger, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.metadata, id)
+	return nil
+}
+
+func (s *memoryStore) ListMetadata(logger lager.Logger) (map[string]Metadata, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	metadata := map[string]Metadata{}
+	for id, m := range s.metadata {
+		metadata[id] = m
+	}
+	return metadata, nil
+}
+
+// testBroker is a broker whose single backend is a mounted temporary directory, commands go to the invoker.
+type testBroker struct {
+	*broker
+	mountPoint string
+	client     *nfsClient
+}
+
+func newTestBroker(store Store, invoker Invoker, catalog Catalog) testBroker {
+	mountPoint, err := ioutil.TempDir("", "nfsbroker")
+	Expect(err).NotTo(HaveOccurred())
+
+	quota, err := NewQuotaDriver(QuotaBackendXfs, invoker, mountPoint)
+	Expect(err).NotTo(HaveOccurred())
+	client := NewNfsClientWithInfokerAndFileUtil("1.2.3.4", "/export", 3, nil, nil, invoker, mountPoint, &osshim.OsShim{}, &ioutilshim.IoutilShim{}, quota, &noopSnapshotDriver{}, ClientTimeouts{}).(*nfsClient)
+	client.mounted = true
+
+	policy, err := NewPlacementPolicy(PlacementRoundRobin)
+	Expect(err).NotTo(HaveOccurred())
+	backends, err := NewBackends([]*Backend{NewBackend(DefaultBackendName, BackendLimits{HighWaterMark: 100}, client)}, policy)
+	Expect(err).NotTo(HaveOccurred())
+
+	b, err := New(lager.NewLogger("nfsbroker-test"), backends, catalog, store, nil, nil, nil, "broker-0", 0)
+	Expect(err).NotTo(HaveOccurred())
+	return testBroker{broker: b, mountPoint: mountPoint, client: client}
+}
+
+func (t testBroker) cleanup() {
+	os.RemoveAll(t.mountPoint)
+}
+
+// shares lists the share directories on the mounted export.
+func (t testBroker) shares() []string {
+	files, err := ioutil.ReadDir(t.mountPoint)
+	Expect(err).NotTo(HaveOccurred())
+	shares := []string{}
+	for _, file := range files {
+		if file.IsDir() && file.Name()[0] != '.' {
+			shares = append(shares, file.Name())
+		}
+	}
+	return shares
+}
+
+func (t testBroker) trash() []string {
+	files, err := ioutil.ReadDir(filepath.Join(t.mountPoint, TrashDir))
+	if os.IsNotExist(err) {
+		return []string{}
+	}
+	Expect(err).NotTo(HaveOccurred())
+	trash := []string{}
+	for _, file := range files {
+		trash = append(trash, file.Name())
+	}
+	return trash
+}
+
+func testCatalog() Catalog {
+	catalog := NewCatalog("nfs", "service-id", "free", "plan-id", "description", "nfs", "")
+	catalog.Plans = append(catalog.Plans, Plan{Id: "big-plan-id", Name: "big", Settings: PlanSettings{Quota: "10G", UpdatableTo: []string{"plan-id"}}})
+	catalog.Plans[0].Settings.UpdatableTo = []string{"big-plan-id"}
+	return catalog
+}
+
+// fakeSnapshotDriver restores every snapshot as a share holding a data file with the content "snapshot".
+type fakeSnapshotDriver struct {
+	noopSnapshotDriver
+}
+
+func (d *fakeSnapshotDriver) RestoreSnapshot(ctx context.Context, logger lager.Logger, shareName, snapshotName, targetPath string) error {
+	if err := os.Mkdir(targetPath, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(targetPath, "data"), []byte("snapshot"), 0600)
+}
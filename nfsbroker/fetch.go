@@ -0,0 +1,172 @@
+package nfsbroker
+
+import (
+	"net/http"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// InstanceSpec is the body of a fetch instance response.
+type InstanceSpec struct {
+	ServiceID  string                 `json:"service_id"`
+	PlanID     string                 `json:"plan_id"`
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+}
+
+// BindingSpec is the body of a fetch binding response.
+type BindingSpec struct {
+	Credentials  interface{}             `json:"credentials"`
+	VolumeMounts []brokerapi.VolumeMount `json:"volume_mounts"`
+	Parameters   map[string]interface{}  `json:"parameters,omitempty"`
+}
+
+// Fetcher serves the instances and bindings the broker has stored, so that platforms can recover their state.
+type Fetcher interface {
+	GetInstance(instanceID string) (InstanceSpec, error)
+	GetBinding(instanceID, bindingID string) (BindingSpec, error)
+}
+
+func (b *broker) GetInstance(instanceID string) (InstanceSpec, error) {
+	logger := b.logger.Session("get-instance", lager.Data{"instance-id": instanceID})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	instance, err := b.fetchableInstance(logger, instanceID)
+	if err != nil {
+		return InstanceSpec{}, err
+	}
+
+	parameters, err := parseRawParameters(instance.RawParameters)
+	if err != nil {
+		logger.Error("invalid-stored-parameters", err)
+		return InstanceSpec{}, err
+	}
+	return InstanceSpec{
+		ServiceID:  instance.ServiceID,
+		PlanID:     instance.PlanID,
+		Parameters: parameters,
+	}, nil
+}
+
+func (b *broker) GetBinding(instanceID, bindingID string) (BindingSpec, error) {
+	logger := b.logger.Session("get-binding", lager.Data{"instance-id": instanceID, "binding-id": bindingID})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	instanceLock := b.locks.forInstance(instanceID)
+	instanceLock.Lock()
+	defer instanceLock.Unlock()
+
+	instance, err := b.fetchableInstance(logger, instanceID)
+	if err != nil {
+		return BindingSpec{}, err
+	}
+
+	details, err := b.store.RetrieveBindingDetails(logger, bindingID)
+	if err != nil {
+		return BindingSpec{}, err
+	}
+	if owned, err := b.bindingOwnedBy(logger, bindingID, details, instanceID, instance); err != nil || !owned {
+		if err == nil {
+			err = brokerapi.ErrBindingDoesNotExist
+		}
+		return BindingSpec{}, err
+	}
+
+	// bindings stored before passwords were redacted may still hold one
+	details = redactBindDetails(details)
+	volumeMount, err := b.volumeMount(logger, instanceID, instance, details, true)
+	if err != nil {
+		return BindingSpec{}, err
+	}
+	plan, _ := b.catalog.Plan(instance.PlanID)
+	credentials, err := b.kerberosCredentials(logger, plan, principalName(plan, instanceID, bindingID), false)
+	if err != nil {
+		return BindingSpec{}, err
+	}
+	return BindingSpec{
+		Credentials:  credentials,
+		VolumeMounts: []brokerapi.VolumeMount{volumeMount},
+		Parameters:   details.Parameters,
+	}, nil
+}
+
+// fetchableInstance returns an instance which is neither being provisioned, which does not exist
+// yet as far as the platform is concerned, nor being changed by another operation.
+func (b *broker) fetchableInstance(logger lager.Logger, instanceID string) (brokerapi.ProvisionDetails, error) {
+	instance, err := b.store.RetrieveInstanceDetails(logger, instanceID)
+	if err != nil {
+		return brokerapi.ProvisionDetails{}, err
+	}
+
+	op, err := b.store.RetrieveOperation(logger, instanceID)
+	switch {
+	case err == ErrOperationDoesNotExist:
+		return instance, nil
+	case err != nil:
+		logger.Error("failed-to-retrieve-operation", err)
+		return brokerapi.ProvisionDetails{}, err
+	case op.Type == OperationProvision && op.State != brokerapi.Succeeded:
+		return brokerapi.ProvisionDetails{}, brokerapi.ErrInstanceDoesNotExist
+	case op.State == brokerapi.InProgress:
+		return brokerapi.ProvisionDetails{}, ErrOperationInProgress
+	}
+	return instance, nil
+}
+
+// AttachFetchRoutes adds the fetch instance and fetch binding endpoints to the router of the broker api.
+func AttachFetchRoutes(router *mux.Router, fetcher Fetcher, logger lager.Logger) {
+	handler := fetchHandler{fetcher: fetcher, logger: logger}
+	router.HandleFunc("/v2/service_instances/{instance_id}", handler.getInstance).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", handler.getBinding).Methods("GET")
+}
+
+type fetchHandler struct {
+	fetcher Fetcher
+	logger  lager.Logger
+}
+
+func (h fetchHandler) getInstance(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	logger := h.logger.Session("fetch-instance", lager.Data{"instance-id": vars["instance_id"]})
+
+	instance, err := h.fetcher.GetInstance(vars["instance_id"])
+	if err != nil {
+		h.respondError(logger, w, err)
+		return
+	}
+	respond(logger, w, http.StatusOK, instance)
+}
+
+func (h fetchHandler) getBinding(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	logger := h.logger.Session("fetch-binding", lager.Data{"instance-id": vars["instance_id"], "binding-id": vars["binding_id"]})
+
+	binding, err := h.fetcher.GetBinding(vars["instance_id"], vars["binding_id"])
+	if err != nil {
+		h.respondError(logger, w, err)
+		return
+	}
+	respond(logger, w, http.StatusOK, binding)
+}
+
+func (h fetchHandler) respondError(logger lager.Logger, w http.ResponseWriter, err error) {
+	switch err {
+	case brokerapi.ErrInstanceDoesNotExist, brokerapi.ErrBindingDoesNotExist:
+		logger.Info("not-found", lager.Data{"reason": err.Error()})
+		respond(logger, w, http.StatusNotFound, brokerapi.EmptyResponse{})
+	case ErrOperationInProgress:
+		logger.Info("operation-in-progress")
+		respond(logger, w, 422, brokerapi.ErrorResponse{
+			Error:       "ConcurrencyError",
+			Description: err.Error(),
+		})
+	default:
+		logger.Error("unknown-error", err)
+		respond(logger, w, http.StatusInternalServerError, brokerapi.ErrorResponse{
+			Description: err.Error(),
+		})
+	}
+}
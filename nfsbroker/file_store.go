@@ -0,0 +1,472 @@
+package nfsbroker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"code.cloudfoundry.org/goshims/ioutil"
+	"code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// number of journal entries after which the journal is folded into a new snapshot of the state file
+const journalCompactionThreshold = 100
+
+type serviceMap struct {
+	InstanceMap  map[string]brokerapi.ProvisionDetails
+	BindingMap   map[string]brokerapi.BindDetails
+	OperationMap map[string]OperationRecord
+	MetadataMap  map[string]Metadata
+}
+
+func newServiceMap() serviceMap {
+	return serviceMap{
+		InstanceMap:  map[string]brokerapi.ProvisionDetails{},
+		BindingMap:   map[string]brokerapi.BindDetails{},
+		OperationMap: map[string]OperationRecord{},
+		MetadataMap:  map[string]Metadata{},
+	}
+}
+
+func (sm serviceMap) copy() serviceMap {
+	copied := newServiceMap()
+	for id, details := range sm.InstanceMap {
+		copied.InstanceMap[id] = details
+	}
+	for id, details := range sm.BindingMap {
+		copied.BindingMap[id] = details
+	}
+	for id, operation := range sm.OperationMap {
+		copied.OperationMap[id] = operation
+	}
+	for id, metadata := range sm.MetadataMap {
+		copied.MetadataMap[id] = metadata
+	}
+	return copied
+}
+
+const (
+	journalKindInstance  = "instance"
+	journalKindBinding   = "binding"
+	journalKindOperation = "operation"
+	journalKindMetadata  = "metadata"
+)
+
+// journalEntry is a single change of the service map, applying an entry twice has no further effect.
+type journalEntry struct {
+	Kind      string                      `json:"kind"`
+	ID        string                      `json:"id"`
+	Delete    bool                        `json:"delete,omitempty"`
+	Instance  *brokerapi.ProvisionDetails `json:"instance,omitempty"`
+	Binding   *brokerapi.BindDetails      `json:"binding,omitempty"`
+	Operation *OperationRecord            `json:"operation,omitempty"`
+	Metadata  *Metadata                   `json:"metadata,omitempty"`
+}
+
+func (sm serviceMap) apply(entry journalEntry) error {
+	switch {
+	case entry.Kind == journalKindInstance && entry.Delete:
+		delete(sm.InstanceMap, entry.ID)
+	case entry.Kind == journalKindInstance && entry.Instance != nil:
+		sm.InstanceMap[entry.ID] = *entry.Instance
+	case entry.Kind == journalKindBinding && entry.Delete:
+		delete(sm.BindingMap, entry.ID)
+	case entry.Kind == journalKindBinding && entry.Binding != nil:
+		sm.BindingMap[entry.ID] = *entry.Binding
+	case entry.Kind == journalKindOperation && entry.Delete:
+		delete(sm.OperationMap, entry.ID)
+	case entry.Kind == journalKindOperation && entry.Operation != nil:
+		sm.OperationMap[entry.ID] = *entry.Operation
+	case entry.Kind == journalKindMetadata && entry.Delete:
+		delete(sm.MetadataMap, entry.ID)
+	case entry.Kind == journalKindMetadata && entry.Metadata != nil:
+		sm.MetadataMap[entry.ID] = *entry.Metadata
+	default:
+		return fmt.Errorf("invalid journal entry of kind '%s' for '%s'", entry.Kind, entry.ID)
+	}
+	return nil
+}
+
+// fileStore keeps the whole service map in memory. Every change is appended to a journal next to the
+// state file before it is applied, and the journal is regularly folded into a new state file which is
+// written to a temporary file and renamed into place, so a crash never leaves a truncated state file behind.
+type fileStore struct {
+	ioutil         ioutilshim.Ioutil
+	os             osshim.Os
+	stateFile      string
+	journalFile    string
+	mutex          sync.Mutex
+	sm             serviceMap
+	journalEntries int
+}
+
+func NewFileStore(ioutil ioutilshim.Ioutil, os osshim.Os, stateFile string) Store {
+	return &fileStore{
+		ioutil:      ioutil,
+		os:          os,
+		stateFile:   stateFile,
+		journalFile: stateFile + ".journal",
+		sm:          newServiceMap(),
+	}
+}
+
+// Restore loads the state file and replays the journal on top of it. A state file or journal that cannot
+// be read is an error, starting with an empty state would orphan every existing share.
+func (s *fileStore) Restore(logger lager.Logger) error {
+	logger = logger.Session("restore-services")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sm := serviceMap{}
+	serviceData, err := s.ioutil.ReadFile(s.stateFile)
+	switch {
+	case os.IsNotExist(err):
+		logger.Info("no-state-file", lager.Data{"state-file": s.stateFile})
+	case err != nil:
+		logger.Error(fmt.Sprintf("failed-to-read-state-file: %s", s.stateFile), err)
+		return fmt.Errorf("failed to read state file '%s': %s", s.stateFile, err.Error())
+	default:
+		err = json.Unmarshal(serviceData, &sm)
+		if err != nil {
+			logger.Error(fmt.Sprintf("failed-to-unmarshall-state from state-file: %s", s.stateFile), err)
+			return fmt.Errorf("state file '%s' is corrupt: %s", s.stateFile, err.Error())
+		}
+	}
+	// copying also fills in the maps missing from state files written by older brokers
+	sm = sm.copy()
+
+	replayed, torn, err := s.replayJournal(logger, sm)
+	if err != nil {
+		return err
+	}
+	s.sm = sm
+
+	if replayed > 0 || torn {
+		// folding the journal in right away also drops an entry torn by a crash, so that no entry is appended to it
+		if err := s.compact(logger); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("state-restored", lager.Data{"state-file": s.stateFile, "replayed-entries": replayed})
+	return nil
+}
+
+func (s *fileStore) CreateInstanceDetails(logger lager.Logger, instanceID string, details brokerapi.ProvisionDetails) error {
+	return s.update(logger, func(sm serviceMap) error {
+		if _, ok := sm.InstanceMap[instanceID]; ok {
+			return brokerapi.ErrInstanceAlreadyExists
+		}
+		return nil
+	}, journalEntry{Kind: journalKindInstance, ID: instanceID, Instance: &details})
+}
+
+func (s *fileStore) RetrieveInstanceDetails(logger lager.Logger, instanceID string) (brokerapi.ProvisionDetails, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	details, ok := s.sm.InstanceMap[instanceID]
+	if !ok {
+		return brokerapi.ProvisionDetails{}, brokerapi.ErrInstanceDoesNotExist
+	}
+	return details, nil
+}
+
+func (s *fileStore) UpdateInstanceDetails(logger lager.Logger, instanceID string, details brokerapi.ProvisionDetails) error {
+	return s.update(logger, func(sm serviceMap) error {
+		if _, ok := sm.InstanceMap[instanceID]; !ok {
+			return brokerapi.ErrInstanceDoesNotExist
+		}
+		return nil
+	}, journalEntry{Kind: journalKindInstance, ID: instanceID, Instance: &details})
+}
+
+func (s *fileStore) DeleteInstanceDetails(logger lager.Logger, instanceID string) error {
+	return s.update(logger, func(sm serviceMap) error {
+		if _, ok := sm.InstanceMap[instanceID]; !ok {
+			return brokerapi.ErrInstanceDoesNotExist
+		}
+		return nil
+	}, journalEntry{Kind: journalKindInstance, ID: instanceID, Delete: true})
+}
+
+func (s *fileStore) ListInstanceDetails(logger lager.Logger) (map[string]brokerapi.ProvisionDetails, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.sm.copy().InstanceMap, nil
+}
+
+func (s *fileStore) CreateBindingDetails(logger lager.Logger, bindingID string, details brokerapi.BindDetails) error {
+	return s.update(logger, func(sm serviceMap) error {
+		if _, ok := sm.BindingMap[bindingID]; ok {
+			return brokerapi.ErrBindingAlreadyExists
+		}
+		return nil
+	}, journalEntry{Kind: journalKindBinding, ID: bindingID, Binding: &details})
+}
+
+func (s *fileStore) RetrieveBindingDetails(logger lager.Logger, bindingID string) (brokerapi.BindDetails, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	details, ok := s.sm.BindingMap[bindingID]
+	if !ok {
+		return brokerapi.BindDetails{}, brokerapi.ErrBindingDoesNotExist
+	}
+	return details, nil
+}
+
+func (s *fileStore) DeleteBindingDetails(logger lager.Logger, bindingID string) error {
+	return s.update(logger, func(sm serviceMap) error {
+		if _, ok := sm.BindingMap[bindingID]; !ok {
+			return brokerapi.ErrBindingDoesNotExist
+		}
+		return nil
+	}, journalEntry{Kind: journalKindBinding, ID: bindingID, Delete: true})
+}
+
+func (s *fileStore) ListBindingDetails(logger lager.Logger) (map[string]brokerapi.BindDetails, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.sm.copy().BindingMap, nil
+}
+
+func (s *fileStore) StartOperation(logger lager.Logger, instanceID string, operation OperationRecord) error {
+	return s.update(logger, func(sm serviceMap) error {
+		if existing, ok := sm.OperationMap[instanceID]; ok && existing.State == brokerapi.InProgress {
+			return ErrOperationInProgress
+		}
+		return nil
+	}, journalEntry{Kind: journalKindOperation, ID: instanceID, Operation: &operation})
+}
+
+func (s *fileStore) SaveOperation(logger lager.Logger, instanceID string, operation OperationRecord) error {
+	return s.update(logger, nil, journalEntry{Kind: journalKindOperation, ID: instanceID, Operation: &operation})
+}
+
+func (s *fileStore) RetrieveOperation(logger lager.Logger, instanceID string) (OperationRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	operation, ok := s.sm.OperationMap[instanceID]
+	if !ok {
+		return OperationRecord{}, ErrOperationDoesNotExist
+	}
+	return operation, nil
+}
+
+func (s *fileStore) DeleteOperation(logger lager.Logger, instanceID string) error {
+	return s.update(logger, nil, journalEntry{Kind: journalKindOperation, ID: instanceID, Delete: true})
+}
+
+func (s *fileStore) ListOperations(logger lager.Logger) (map[string]OperationRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.sm.copy().OperationMap, nil
+}
+
+func (s *fileStore) SaveMetadata(logger lager.Logger, id string, metadata Metadata) error {
+	return s.update(logger, nil, journalEntry{Kind: journalKindMetadata, ID: id, Metadata: &metadata})
+}
+
+func (s *fileStore) RetrieveMetadata(logger lager.Logger, id string) (Metadata, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	metadata, ok := s.sm.MetadataMap[id]
+	if !ok {
+		return Metadata{}, ErrMetadataDoesNotExist
+	}
+	return metadata, nil
+}
+
+func (s *fileStore) DeleteMetadata(logger lager.Logger, id string) error {
+	return s.update(logger, nil, journalEntry{Kind: journalKindMetadata, ID: id, Delete: true})
+}
+
+func (s *fileStore) ListMetadata(logger lager.Logger) (map[string]Metadata, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.sm.copy().MetadataMap, nil
+}
+
+// update checks a change against the service map, makes it durable in the journal and only then applies it.
+func (s *fileStore) update(logger lager.Logger, check func(serviceMap) error, entry journalEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if check != nil {
+		if err := check(s.sm); err != nil {
+			return err
+		}
+	}
+	if err := s.appendJournal(logger, entry); err != nil {
+		return err
+	}
+	if err := s.sm.apply(entry); err != nil {
+		return err
+	}
+
+	if s.journalEntries >= journalCompactionThreshold {
+		// the change is already durable, a failed compaction is retried with the next change
+		if err := s.compact(logger); err != nil {
+			logger.Error("failed-to-compact-journal", err)
+		}
+	}
+	return nil
+}
+
+// appendJournal appends an entry to the journal. An entry which cannot be written completely is cut off again,
+// so that the entries appended after it do not follow a torn entry.
+func (s *fileStore) appendJournal(logger lager.Logger, entry journalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		logger.Error("failed-to-marshal-journal-entry", err)
+		return err
+	}
+
+	var size int64
+	info, err := s.os.Stat(s.journalFile)
+	switch {
+	case err == nil:
+		size = info.Size()
+	case !os.IsNotExist(err):
+		logger.Error(fmt.Sprintf("failed-to-stat-journal: %s", s.journalFile), err)
+		return fmt.Errorf("failed to write journal '%s'", s.journalFile)
+	}
+	journal, err := s.os.OpenFile(s.journalFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed-to-open-journal: %s", s.journalFile), err)
+		return fmt.Errorf("failed to write journal '%s'", s.journalFile)
+	}
+	_, err = journal.Write(append(data, '\n'))
+	if err == nil {
+		err = journal.Sync()
+	}
+	if closeErr := journal.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed-to-write-journal: %s", s.journalFile), err)
+		if truncateErr := s.os.Truncate(s.journalFile, size); truncateErr != nil {
+			// the torn entry stays the last one as long as nothing is appended, fold the journal in instead
+			logger.Error(fmt.Sprintf("failed-to-truncate-journal: %s", s.journalFile), truncateErr)
+			s.compact(logger)
+		}
+		return fmt.Errorf("failed to write journal '%s'", s.journalFile)
+	}
+	s.journalEntries++
+	return nil
+}
+
+// replayJournal applies the journal to the service map. Only the last entry may be incomplete, it was
+// being written when the broker stopped and the change was never acknowledged.
+func (s *fileStore) replayJournal(logger lager.Logger, sm serviceMap) (int, bool, error) {
+	data, err := s.ioutil.ReadFile(s.journalFile)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed-to-read-journal: %s", s.journalFile), err)
+		return 0, false, fmt.Errorf("failed to read journal '%s': %s", s.journalFile, err.Error())
+	}
+
+	lines := bytes.Split(data, []byte("\n"))
+	replayed := 0
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		entry := journalEntry{}
+		err := json.Unmarshal(line, &entry)
+		if err == nil {
+			err = sm.apply(entry)
+		}
+		if err != nil {
+			if i == len(lines)-1 {
+				logger.Info("dropping-torn-journal-entry", lager.Data{"journal": s.journalFile})
+				return replayed, true, nil
+			}
+			logger.Error(fmt.Sprintf("corrupt-journal: %s", s.journalFile), err, lager.Data{"line": i + 1})
+			return 0, false, fmt.Errorf("journal '%s' is corrupt at line %d: %s", s.journalFile, i+1, err.Error())
+		}
+		replayed++
+	}
+	return replayed, false, nil
+}
+
+// compact writes the service map to the state file and empties the journal. After a crash in between
+// the journal is replayed onto a state file which already contains it, which changes nothing.
+func (s *fileStore) compact(logger lager.Logger) error {
+	if err := s.serialize(logger, s.sm); err != nil {
+		return err
+	}
+	err := s.os.Truncate(s.journalFile, 0)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Error(fmt.Sprintf("failed-to-truncate-journal: %s", s.journalFile), err)
+		return fmt.Errorf("failed to truncate journal '%s'", s.journalFile)
+	}
+	s.journalEntries = 0
+	return nil
+}
+
+func (s *fileStore) serialize(logger lager.Logger, sm serviceMap) error {
+	logger = logger.Session("serialize")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	serviceData, err := json.Marshal(sm)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed-to-marshall-service-file: %s", s.stateFile), err)
+		return err
+	}
+
+	dir := filepath.Dir(s.stateFile)
+	tmp, err := s.ioutil.TempFile(dir, "."+filepath.Base(s.stateFile)+"-")
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed-to-create-temporary-service-file: %s", s.stateFile), err)
+		return fmt.Errorf("failed to write state file '%s'", s.stateFile)
+	}
+	_, err = tmp.Write(serviceData)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = s.os.Rename(tmp.Name(), s.stateFile)
+	}
+	if err == nil {
+		err = s.syncDir(dir)
+	}
+	if err != nil {
+		s.os.Remove(tmp.Name())
+		logger.Error(fmt.Sprintf("failed-to-write-service-file: %s", s.stateFile), err)
+		return fmt.Errorf("failed to write state file '%s'", s.stateFile)
+	}
+	logger.Info("service-file-saved", lager.Data{"service-file": s.stateFile})
+	return nil
+}
+
+// syncDir makes the rename of the state file itself durable.
+func (s *fileStore) syncDir(dir string) error {
+	d, err := s.os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,166 @@
+package nfsbroker
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/goshims/ioutil"
+	"code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("File store", func() {
+	const tornEntry = `{"kind":"instance","id":"torn","instance":{"plan_`
+
+	var (
+		logger    lager.Logger
+		dir       string
+		stateFile string
+		osShim    *failingJournalOs
+		store     Store
+	)
+
+	restore := func() Store {
+		store := NewFileStore(&ioutilshim.IoutilShim{}, osShim, stateFile)
+		Expect(store.Restore(logger)).To(Succeed())
+		return store
+	}
+
+	instanceIDs := func(store Store) []string {
+		instances, err := store.ListInstanceDetails(logger)
+		Expect(err).NotTo(HaveOccurred())
+		ids := []string{}
+		for id := range instances {
+			ids = append(ids, id)
+		}
+		return ids
+	}
+
+	appendToJournal := func(data string) {
+		journal, err := os.OpenFile(stateFile+".journal", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = journal.WriteString(data)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(journal.Close()).To(Succeed())
+	}
+
+	journal := func() string {
+		data, err := ioutil.ReadFile(stateFile + ".journal")
+		Expect(err).NotTo(HaveOccurred())
+		return string(data)
+	}
+
+	BeforeEach(func() {
+		logger = lager.NewLogger("file-store-test")
+		var err error
+		dir, err = ioutil.TempDir("", "file-store")
+		Expect(err).NotTo(HaveOccurred())
+		stateFile = filepath.Join(dir, "state.json")
+		osShim = &failingJournalOs{OsShim: &osshim.OsShim{}}
+
+		store = restore()
+		Expect(store.CreateInstanceDetails(logger, "instance-1", brokerapi.ProvisionDetails{PlanID: "plan-id"})).To(Succeed())
+		Expect(store.CreateInstanceDetails(logger, "instance-2", brokerapi.ProvisionDetails{PlanID: "plan-id"})).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("replays the journal onto the state file", func() {
+		Expect(instanceIDs(restore())).To(ConsistOf("instance-1", "instance-2"))
+	})
+
+	Context("when the broker stopped while appending an entry", func() {
+		BeforeEach(func() {
+			appendToJournal(tornEntry)
+		})
+
+		It("drops the torn entry and keeps the entries appended afterwards", func() {
+			store := restore()
+			Expect(instanceIDs(store)).To(ConsistOf("instance-1", "instance-2"))
+			Expect(journal()).To(BeEmpty())
+
+			Expect(store.CreateInstanceDetails(logger, "instance-3", brokerapi.ProvisionDetails{PlanID: "plan-id"})).To(Succeed())
+			Expect(instanceIDs(restore())).To(ConsistOf("instance-1", "instance-2", "instance-3"))
+		})
+
+		It("drops a torn entry which is the only one of the journal", func() {
+			Expect(instanceIDs(restore())).To(ConsistOf("instance-1", "instance-2"))
+			appendToJournal(tornEntry)
+
+			store := restore()
+			Expect(journal()).To(BeEmpty())
+			Expect(store.CreateInstanceDetails(logger, "instance-3", brokerapi.ProvisionDetails{PlanID: "plan-id"})).To(Succeed())
+			Expect(instanceIDs(restore())).To(ConsistOf("instance-1", "instance-2", "instance-3"))
+		})
+	})
+
+	It("rejects a journal corrupt before its last entry", func() {
+		appendToJournal(tornEntry + "\n")
+		Expect(store.CreateInstanceDetails(logger, "instance-3", brokerapi.ProvisionDetails{PlanID: "plan-id"})).To(Succeed())
+
+		err := NewFileStore(&ioutilshim.IoutilShim{}, osShim, stateFile).Restore(logger)
+		Expect(err).To(MatchError(ContainSubstring("is corrupt at line 3")))
+	})
+
+	Context("when an entry cannot be appended", func() {
+		BeforeEach(func() {
+			osShim.failAppend = true
+		})
+
+		It("cuts the partly written entry off the journal", func() {
+			before := journal()
+			Expect(store.CreateInstanceDetails(logger, "instance-3", brokerapi.ProvisionDetails{PlanID: "plan-id"})).NotTo(Succeed())
+			Expect(journal()).To(Equal(before))
+
+			osShim.failAppend = false
+			Expect(store.CreateInstanceDetails(logger, "instance-4", brokerapi.ProvisionDetails{PlanID: "plan-id"})).To(Succeed())
+			Expect(instanceIDs(restore())).To(ConsistOf("instance-1", "instance-2", "instance-4"))
+		})
+
+		It("folds the journal into the state file when the entry cannot be cut off", func() {
+			osShim.failTruncate = true
+			Expect(store.CreateInstanceDetails(logger, "instance-3", brokerapi.ProvisionDetails{PlanID: "plan-id"})).NotTo(Succeed())
+			Expect(journal()).To(BeEmpty())
+
+			osShim.failAppend = false
+			Expect(store.CreateInstanceDetails(logger, "instance-4", brokerapi.ProvisionDetails{PlanID: "plan-id"})).To(Succeed())
+			Expect(instanceIDs(restore())).To(ConsistOf("instance-1", "instance-2", "instance-4"))
+		})
+	})
+})
+
+// failingJournalOs fails the appends to the journal, the failed append leaves part of its entry behind.
+type failingJournalOs struct {
+	*osshim.OsShim
+	failAppend   bool
+	failTruncate bool
+}
+
+func (o *failingJournalOs) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	if o.failAppend && flag&os.O_APPEND != 0 {
+		journal, err := o.OsShim.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		journal.WriteString(`{"kind":"instance","id":"instance-3","instance":{`)
+		journal.Close()
+		// writing to a read-only file fails
+		return os.Open(name)
+	}
+	return o.OsShim.OpenFile(name, flag, perm)
+}
+
+func (o *failingJournalOs) Truncate(name string, size int64) error {
+	if o.failTruncate && size > 0 {
+		return errors.New("input/output error")
+	}
+	return o.OsShim.Truncate(name, size)
+}
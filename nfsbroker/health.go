@@ -0,0 +1,155 @@
+package nfsbroker
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/gorilla/mux"
+)
+
+var errNotChecked = errors.New("the health checks have not run yet")
+
+// HealthCheck is the outcome of one check. Why a check failed is only logged, the endpoints are reachable
+// without credentials.
+type HealthCheck struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	err    error
+}
+
+type HealthReport struct {
+	Healthy bool          `json:"healthy"`
+	Checks  []HealthCheck `json:"checks"`
+}
+
+func (r *HealthReport) add(name string, err error) {
+	r.Checks = append(r.Checks, HealthCheck{Name: name, Passed: err == nil, err: err})
+	if err != nil {
+		r.Healthy = false
+	}
+}
+
+// HealthChecker tells whether the broker is alive and whether it is ready to serve requests. Both report
+// the checks last run by InspectBackends, they do not touch the store or the backends themselves.
+type HealthChecker interface {
+	// Liveness reports whether the state store could be written, it passes until the first check.
+	Liveness() HealthReport
+	// Readiness reports whether the state store could be written and the export of every backend was
+	// mounted and writable, it fails until the first check.
+	Readiness() HealthReport
+}
+
+// healthChecks are the outcomes of the health checks last run.
+type healthChecks struct {
+	mutex    sync.RWMutex
+	checked  bool
+	store    error
+	backends map[string]error
+}
+
+func newHealthChecks() *healthChecks {
+	return &healthChecks{backends: map[string]error{}}
+}
+
+func (b *broker) Liveness() HealthReport {
+	b.health.mutex.RLock()
+	defer b.health.mutex.RUnlock()
+
+	report := HealthReport{Healthy: true, Checks: []HealthCheck{}}
+	report.add("store", b.health.store)
+	return report
+}
+
+func (b *broker) Readiness() HealthReport {
+	logger := b.logger.Session("readiness")
+
+	b.health.mutex.RLock()
+	defer b.health.mutex.RUnlock()
+
+	report := HealthReport{Healthy: true, Checks: []HealthCheck{}}
+	if !b.health.checked {
+		report.add("store", errNotChecked)
+	} else {
+		report.add("store", b.health.store)
+	}
+	for _, backend := range b.backends.All() {
+		// the mount supervisor reports a failing mount before the next check
+		err := backend.Client.MountError(logger)
+		if err == nil && !b.health.checked {
+			err = errNotChecked
+		} else if err == nil {
+			err = b.health.backends[backend.Name]
+		}
+		report.add(fmt.Sprintf("backend %s", backend.Name), err)
+	}
+	return report
+}
+
+// checkHealth checks that the store and the export of every backend can be written and records the outcome
+// for the health endpoints. It runs after the backends were inspected.
+func (b *broker) checkHealth(logger lager.Logger) {
+	logger = logger.Session("check-health")
+
+	storeErr := b.checkStore(logger)
+	backendErrs := map[string]error{}
+	for _, backend := range b.backends.All() {
+		if _, inspectErr := backend.inspectedFilesystem(logger); inspectErr != "" {
+			backendErrs[backend.Name] = errors.New(inspectErr)
+			continue
+		}
+		ctx, cancel := b.operationContext()
+		backendErrs[backend.Name] = backend.Client.CheckWritable(ctx, logger, b.canaryName())
+		cancel()
+	}
+
+	b.health.mutex.Lock()
+	defer b.health.mutex.Unlock()
+	b.health.checked, b.health.store, b.health.backends = true, storeErr, backendErrs
+}
+
+// checkStore writes and deletes the metadata of a canary record.
+func (b *broker) checkStore(logger lager.Logger) error {
+	id := b.canaryName()
+	if err := b.store.SaveMetadata(logger, id, Metadata{}); err != nil {
+		logger.Error("failed-to-write-store", err)
+		return err
+	}
+	if err := b.store.DeleteMetadata(logger, id); err != nil {
+		logger.Error("failed-to-write-store", err)
+		return err
+	}
+	return nil
+}
+
+// canaryName names the records the health checks write, brokers sharing a store or an export write their own.
+func (b *broker) canaryName() string {
+	return "health-canary-" + b.brokerID
+}
+
+// AttachHealthRoutes adds the liveness and readiness endpoints, failed checks are answered with 503.
+// They are meant to be reachable without the broker credentials.
+func AttachHealthRoutes(router *mux.Router, checker HealthChecker, logger lager.Logger) {
+	logger = logger.Session("health")
+	router.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		respondHealth(logger, w, checker.Liveness())
+	}).Methods("GET")
+	router.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		respondHealth(logger, w, checker.Readiness())
+	}).Methods("GET")
+}
+
+func respondHealth(logger lager.Logger, w http.ResponseWriter, report HealthReport) {
+	if !report.Healthy {
+		for _, check := range report.Checks {
+			if !check.Passed {
+				logger.Info("unhealthy", lager.Data{"check": check.Name, "error": check.err.Error()})
+			}
+		}
+		respond(logger, w, http.StatusServiceUnavailable, report)
+		return
+	}
+	respond(logger, w, http.StatusOK, report)
+}
@@ -0,0 +1,113 @@
+package nfsbroker
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/gorilla/mux"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Health endpoints", func() {
+	var (
+		store  *unwritableStore
+		tb     testBroker
+		router *mux.Router
+	)
+
+	get := func(path string) (int, string) {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		return recorder.Code, recorder.Body.String()
+	}
+
+	BeforeEach(func() {
+		store = &unwritableStore{memoryStore: newMemoryStore()}
+		tb = newTestBroker(store, &fakeInvoker{}, testCatalog())
+		router = mux.NewRouter()
+		AttachHealthRoutes(router, tb.broker, tb.logger)
+	})
+
+	AfterEach(func() {
+		tb.cleanup()
+	})
+
+	It("is alive but not ready before the first checks", func() {
+		code, body := get("/healthz")
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(body).To(MatchJSON(`{"healthy": true, "checks": [{"name": "store", "passed": true}]}`))
+
+		code, body = get("/readyz")
+		Expect(code).To(Equal(http.StatusServiceUnavailable))
+		Expect(body).To(MatchJSON(`{"healthy": false, "checks": [{"name": "store", "passed": false}, {"name": "backend default", "passed": false}]}`))
+	})
+
+	It("reports the checks last run without writing to the store or the export", func() {
+		tb.InspectBackends()
+		writes := store.writes
+
+		for i := 0; i < 3; i++ {
+			code, _ := get("/healthz")
+			Expect(code).To(Equal(http.StatusOK))
+			code, body := get("/readyz")
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(body).To(MatchJSON(`{"healthy": true, "checks": [{"name": "store", "passed": true}, {"name": "backend default", "passed": true}]}`))
+		}
+		Expect(store.writes).To(Equal(writes))
+		Expect(tb.shares()).To(BeEmpty())
+	})
+
+	It("reports a failing store without the reason to the caller", func() {
+		store.err = errors.New("database at 10.0.0.5:5432 refused the connection")
+		tb.InspectBackends()
+
+		for _, path := range []string{"/healthz", "/readyz"} {
+			code, body := get(path)
+			Expect(code).To(Equal(http.StatusServiceUnavailable))
+			Expect(body).To(ContainSubstring(`{"name":"store","passed":false}`))
+			Expect(body).NotTo(ContainSubstring("10.0.0.5"))
+		}
+	})
+
+	It("is not ready as soon as the mount of a backend is known to fail", func() {
+		tb.InspectBackends()
+		tb.client.SetMountError(tb.logger, errors.New("mount.nfs: access denied by server while mounting 1.2.3.4:/export"))
+
+		code, _ := get("/healthz")
+		Expect(code).To(Equal(http.StatusOK))
+		code, body := get("/readyz")
+		Expect(code).To(Equal(http.StatusServiceUnavailable))
+		Expect(body).To(MatchJSON(`{"healthy": false, "checks": [{"name": "store", "passed": true}, {"name": "backend default", "passed": false}]}`))
+
+		tb.client.SetMountError(tb.logger, nil)
+		code, _ = get("/readyz")
+		Expect(code).To(Equal(http.StatusOK))
+	})
+
+	It("is not ready while the export of a backend cannot be written", func() {
+		tb.client.baseLocalMountPoint = "/nonexistent"
+		tb.InspectBackends()
+
+		code, _ := get("/readyz")
+		Expect(code).To(Equal(http.StatusServiceUnavailable))
+	})
+})
+
+// unwritableStore counts the writes of metadata and fails them with err.
+type unwritableStore struct {
+	*memoryStore
+	writes int
+	err    error
+}
+
+func (s *unwritableStore) SaveMetadata(logger lager.Logger, id string, metadata Metadata) error {
+	s.writes++
+	if s.err != nil {
+		return s.err
+	}
+	return s.memoryStore.SaveMetadata(logger, id, metadata)
+}
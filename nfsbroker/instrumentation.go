@@ -0,0 +1,146 @@
+package nfsbroker
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"github.com/gorilla/mux"
+)
+
+type metricsHandler struct {
+	handler http.Handler
+	metrics *Metrics
+}
+
+// NewMetricsHandler counts and times the requests of the handler per broker api operation.
+func NewMetricsHandler(handler http.Handler, metrics *Metrics) http.Handler {
+	return &metricsHandler{handler: handler, metrics: metrics}
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	start := time.Now()
+	h.handler.ServeHTTP(recorder, req)
+
+	operation := operationName(req)
+	h.metrics.AddCounter("nfsbroker_requests_total", "Requests to the broker by operation and status code.", 1,
+		"operation", operation, "code", strconv.Itoa(recorder.status))
+	h.metrics.Observe("nfsbroker_request_duration_seconds", "Time taken to answer requests to the broker by operation.",
+		time.Since(start).Seconds(), DurationBuckets, "operation", operation)
+}
+
+// statusRecorder remembers the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// operationName names the broker api operation of a request, such as provision or bind.
+func operationName(req *http.Request) string {
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "v2" && parts[1] == "catalog":
+		return "catalog"
+	case len(parts) == 3 && parts[0] == "v2" && parts[1] == "service_instances":
+		return methodOperation(req, map[string]string{"PUT": "provision", "PATCH": "update", "DELETE": "deprovision", "GET": "get_instance"})
+	case len(parts) == 4 && parts[0] == "v2" && parts[3] == "last_operation":
+		return "last_operation"
+	case len(parts) == 5 && parts[0] == "v2" && parts[3] == "service_bindings":
+		return methodOperation(req, map[string]string{"PUT": "bind", "DELETE": "unbind", "GET": "get_binding"})
+	case len(parts) > 1 && parts[0] == "admin":
+		return "admin_" + parts[1]
+	case len(parts) == 1 && (parts[0] == "healthz" || parts[0] == "readyz" || parts[0] == "metrics"):
+		return parts[0]
+	}
+	return "other"
+}
+
+func methodOperation(req *http.Request, operations map[string]string) string {
+	if operation, ok := operations[req.Method]; ok {
+		return operation
+	}
+	return "other"
+}
+
+// AttachMetricsRoute adds the endpoint exporting the metrics in the prometheus text format.
+func AttachMetricsRoute(router *mux.Router, metrics *Metrics, logger lager.Logger) {
+	logger = logger.Session("metrics")
+	router.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := metrics.WritePrometheus(w); err != nil {
+			logger.Error("failed-to-write-metrics", err)
+		}
+	}).Methods("GET")
+}
+
+// instrumentedController counts the failed operations of the controller of a backend.
+type instrumentedController struct {
+	Controller
+	metrics *Metrics
+	backend string
+}
+
+func (c *instrumentedController) failed(operation, err string) {
+	if err != "" {
+		c.metrics.AddCounter("nfsbroker_controller_failures_total", "Failed share operations by backend and operation.", 1,
+			"backend", c.backend, "operation", operation)
+	}
+}
+
+func (c *instrumentedController) Create(ctx context.Context, logger lager.Logger, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
+	response := c.Controller.Create(ctx, logger, createRequest)
+	c.failed("create", response.Err)
+	return response
+}
+
+func (c *instrumentedController) Remove(ctx context.Context, logger lager.Logger, removeRequest voldriver.RemoveRequest, projectId uint32) voldriver.ErrorResponse {
+	response := c.Controller.Remove(ctx, logger, removeRequest, projectId)
+	c.failed("remove", response.Err)
+	return response
+}
+
+func (c *instrumentedController) Bind(ctx context.Context, logger lager.Logger, instanceID string) BindResponse {
+	response := c.Controller.Bind(ctx, logger, instanceID)
+	c.failed("bind", response.Err)
+	return response
+}
+
+func (c *instrumentedController) Update(ctx context.Context, logger lager.Logger, instanceID string, options ShareOptions) voldriver.ErrorResponse {
+	response := c.Controller.Update(ctx, logger, instanceID, options)
+	c.failed("update", response.Err)
+	return response
+}
+
+func (c *instrumentedController) Restore(ctx context.Context, logger lager.Logger, trashName string, shareName string, options ShareOptions) voldriver.ErrorResponse {
+	response := c.Controller.Restore(ctx, logger, trashName, shareName, options)
+	c.failed("restore", response.Err)
+	return response
+}
+
+func (c *instrumentedController) CreateSnapshot(ctx context.Context, logger lager.Logger, shareName string, snapshotName string) voldriver.ErrorResponse {
+	response := c.Controller.CreateSnapshot(ctx, logger, shareName, snapshotName)
+	c.failed("create_snapshot", response.Err)
+	return response
+}
+
+func (c *instrumentedController) RestoreSnapshot(ctx context.Context, logger lager.Logger, shareName string, snapshotName string, options ShareOptions) voldriver.ErrorResponse {
+	response := c.Controller.RestoreSnapshot(ctx, logger, shareName, snapshotName, options)
+	c.failed("restore_snapshot", response.Err)
+	return response
+}
+
+func (c *instrumentedController) DeleteSnapshot(ctx context.Context, logger lager.Logger, shareName string, snapshotName string) voldriver.ErrorResponse {
+	response := c.Controller.DeleteSnapshot(ctx, logger, shareName, snapshotName)
+	c.failed("delete_snapshot", response.Err)
+	return response
+}
@@ -0,0 +1,203 @@
+package nfsbroker
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// Inventory is what the broker holds: its instances, its bindings and the mounts of its backends.
+type Inventory struct {
+	Instances []InstanceInventory
+	Bindings  []BindingInventory
+	// whether the broker has the export of a backend mounted, by backend
+	Mounted map[string]bool
+}
+
+type InstanceInventory struct {
+	InstanceID   string
+	Plan         string
+	Organization string
+	Backend      string
+	Quota        uint64
+	// bytes the share takes on disk, when sampled
+	Used       uint64
+	UsageError string
+}
+
+type BindingInventory struct {
+	Plan         string
+	Organization string
+}
+
+// InventoryReporter reports the inventory of the broker, walking every share to sample its usage if asked to.
+type InventoryReporter interface {
+	Inventory(sampleUsage bool) (Inventory, error)
+}
+
+func (b *broker) Inventory(sampleUsage bool) (Inventory, error) {
+	logger := b.logger.Session("inventory")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	instances, err := b.store.ListInstanceDetails(logger)
+	if err != nil {
+		logger.Error("failed-to-list-instances", err)
+		return Inventory{}, err
+	}
+	bindings, err := b.store.ListBindingDetails(logger)
+	if err != nil {
+		logger.Error("failed-to-list-bindings", err)
+		return Inventory{}, err
+	}
+	metadata, err := b.store.ListMetadata(logger)
+	if err != nil {
+		logger.Error("failed-to-list-metadata", err)
+		return Inventory{}, err
+	}
+
+	inventory := Inventory{Instances: []InstanceInventory{}, Bindings: []BindingInventory{}, Mounted: map[string]bool{}}
+	for _, backend := range b.backends.All() {
+		inventory.Mounted[backend.Name] = backend.Client.IsFilesystemMounted(logger)
+	}
+	for instanceID, instance := range instances {
+		entry := InstanceInventory{
+			InstanceID:   instanceID,
+			Plan:         b.planName(instance.PlanID),
+			Organization: instance.OrganizationGUID,
+			Backend:      metadata[instanceID].Backend,
+		}
+		if entry.Backend == "" {
+			entry.Backend = b.backends.Default().Name
+		}
+		if options, err := b.evaluateShareOptions(logger, instance.PlanID, instance.RawParameters); err == nil {
+			entry.Quota = options.Quota
+		}
+		if sampleUsage {
+			if entry.Used, err = b.shareUsage(logger, instanceID, metadata[instanceID]); err != nil {
+				entry.UsageError = err.Error()
+			}
+		}
+		inventory.Instances = append(inventory.Instances, entry)
+	}
+	for bindingID, binding := range bindings {
+		inventory.Bindings = append(inventory.Bindings, BindingInventory{
+			Plan:         b.planName(binding.PlanID),
+			Organization: metadata[bindingID].Context.OrganizationGUID,
+		})
+	}
+	return inventory, nil
+}
+
+func (b *broker) shareUsage(logger lager.Logger, instanceID string, metadata Metadata) (uint64, error) {
+	if metadata.ShareName == "" {
+		metadata.ShareName = instanceID
+	}
+	backend, err := b.backend(logger, metadata)
+	if err != nil {
+		return 0, err
+	}
+	// only bounded by the timeouts of the client, walking a share may take longer than a request
+	ctx := context.Background()
+	if err := ensureMounted(ctx, logger, backend.Client); err != nil {
+		return 0, err
+	}
+	return backend.Client.ShareUsage(ctx, logger, metadata.ShareName)
+}
+
+// planName returns the name of a plan, or its id for plans no longer in the catalog.
+func (b *broker) planName(planID string) string {
+	if plan, ok := b.catalog.Plan(planID); ok {
+		return plan.Name
+	}
+	return planID
+}
+
+// InventoryMonitor periodically exports the inventory of the broker as gauges, sampling the usage of every share.
+type InventoryMonitor struct {
+	logger   lager.Logger
+	reporter InventoryReporter
+	metrics  *Metrics
+	interval time.Duration
+}
+
+func NewInventoryMonitor(logger lager.Logger, reporter InventoryReporter, metrics *Metrics, interval time.Duration) *InventoryMonitor {
+	return &InventoryMonitor{
+		logger:   logger,
+		reporter: reporter,
+		metrics:  metrics,
+		interval: interval,
+	}
+}
+
+func (m *InventoryMonitor) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	close(ready)
+	m.Update()
+	for {
+		select {
+		case <-ticker.C:
+			m.Update()
+		case <-signals:
+			return nil
+		}
+	}
+}
+
+// Update sets the inventory gauges, the gauges of deleted instances are dropped.
+func (m *InventoryMonitor) Update() {
+	logger := m.logger.Session("update-inventory")
+
+	inventory, err := m.reporter.Inventory(true)
+	if err != nil {
+		logger.Error("failed-to-take-inventory", err)
+		return
+	}
+
+	for backend, mounted := range inventory.Mounted {
+		up := 0.0
+		if mounted {
+			up = 1
+		}
+		m.metrics.SetGauge("nfsbroker_backend_mounted", "Whether the broker has the export of the backend mounted.", up, "backend", backend)
+	}
+
+	type tenant struct{ plan, organization string }
+	instances := map[tenant]int{}
+	bindings := map[tenant]int{}
+	for _, instance := range inventory.Instances {
+		instances[tenant{instance.Plan, instance.Organization}]++
+	}
+	for _, binding := range inventory.Bindings {
+		bindings[tenant{binding.Plan, binding.Organization}]++
+	}
+
+	m.metrics.DeleteGauges("nfsbroker_instances")
+	for t, count := range instances {
+		m.metrics.SetGauge("nfsbroker_instances", "Instances by plan and organization.", float64(count), "plan", t.plan, "organization", t.organization)
+	}
+	m.metrics.DeleteGauges("nfsbroker_bindings")
+	for t, count := range bindings {
+		m.metrics.SetGauge("nfsbroker_bindings", "Bindings by plan and organization.", float64(count), "plan", t.plan, "organization", t.organization)
+	}
+
+	m.metrics.DeleteGauges("nfsbroker_share_used_bytes")
+	m.metrics.DeleteGauges("nfsbroker_share_quota_bytes")
+	for _, instance := range inventory.Instances {
+		labels := []string{"instance", instance.InstanceID, "backend", instance.Backend, "plan", instance.Plan}
+		if instance.Quota > 0 {
+			m.metrics.SetGauge("nfsbroker_share_quota_bytes", "Quota of the share of the instance.", float64(instance.Quota), labels...)
+		}
+		if instance.UsageError != "" {
+			logger.Info("share-usage-unavailable", lager.Data{"instance": instance.InstanceID, "error": instance.UsageError})
+			m.metrics.AddCounter("nfsbroker_client_failures_total", "Failed filesystem operations of the broker by backend and operation.", 1,
+				"backend", instance.Backend, "operation", "share_usage")
+			continue
+		}
+		m.metrics.SetGauge("nfsbroker_share_used_bytes", "Bytes the files of the share of the instance take on disk.", float64(instance.Used), labels...)
+	}
+}
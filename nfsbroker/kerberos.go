@@ -0,0 +1,347 @@
+package nfsbroker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	KdcBackendNone = "none"
+	// MIT kerberos, principals are managed with kadmin
+	KdcBackendMit = "mit"
+	// principals kept in memory, for tests and development
+	KdcBackendFake = "fake"
+
+	// plan settings deciding who the principals are issued to
+	KerberosPerInstance = "instance"
+	KerberosPerBinding  = "binding"
+)
+
+var (
+	ErrKerberosNotSupported  = errors.New("kerberos is not enabled on this broker")
+	ErrPrincipalDoesNotExist = errors.New("principal does not exist")
+	ErrInvalidPrincipalName  = errors.New("principal names consist of letters, digits and '-'")
+)
+
+// principal names are passed to kadmin queries and keytab paths, they must not contain spaces, quotes,
+// slashes or realms
+var principalNamePattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+func validatePrincipalName(name string) error {
+	if !principalNamePattern.MatchString(name) {
+		return ErrInvalidPrincipalName
+	}
+	return nil
+}
+
+// Keytab holds the key of a principal.
+type Keytab struct {
+	// fully qualified principal, such as "instance-1234@EXAMPLE.COM"
+	Principal string
+	// where the keytab is kept, for drivers fetching it themselves
+	Ref string
+	// contents of the keytab, empty when only the reference is handed out
+	Data []byte
+}
+
+// KdcAdapter manages the kerberos principals of instances and bindings.
+type KdcAdapter interface {
+	// CreatePrincipal creates a principal with a random key, creating an existing principal returns its keytab.
+	CreatePrincipal(logger lager.Logger, name string) (Keytab, error)
+	// Keytab returns the keytab of an existing principal.
+	Keytab(logger lager.Logger, name string) (Keytab, error)
+	DeletePrincipal(logger lager.Logger, name string) error
+}
+
+// KdcConfig describes the KDC of the broker.
+type KdcConfig struct {
+	Realm string
+	// principal and keytab kadmin authenticates with
+	AdminPrincipal string
+	AdminKeytab    string
+	// directory the keytabs of the principals are written to
+	KeytabDir string
+	// hand out the keytabs in the binding credentials instead of their paths only
+	InlineKeytabs bool
+	// deadline of each kadmin command, 0 for none
+	Timeout time.Duration
+}
+
+func NewKdcAdapter(backend string, invoker Invoker, config KdcConfig) (KdcAdapter, error) {
+	switch backend {
+	case "", KdcBackendNone:
+		return &noopKdcAdapter{}, nil
+	case KdcBackendMit:
+		if config.Realm == "" || config.AdminPrincipal == "" || config.AdminKeytab == "" || config.KeytabDir == "" {
+			return nil, errors.New("the mit kdc backend needs a realm, an admin principal, an admin keytab and a keytab directory")
+		}
+		return &mitKdcAdapter{invoker: invoker, config: config}, nil
+	case KdcBackendFake:
+		if config.Realm == "" {
+			return nil, errors.New("the fake kdc backend needs a realm")
+		}
+		return NewFakeKdcAdapter(config.Realm), nil
+	default:
+		return nil, fmt.Errorf("unknown kdc backend '%s'", backend)
+	}
+}
+
+type noopKdcAdapter struct{}
+
+func (a *noopKdcAdapter) CreatePrincipal(logger lager.Logger, name string) (Keytab, error) {
+	return Keytab{}, ErrKerberosNotSupported
+}
+
+func (a *noopKdcAdapter) Keytab(logger lager.Logger, name string) (Keytab, error) {
+	return Keytab{}, ErrKerberosNotSupported
+}
+
+func (a *noopKdcAdapter) DeletePrincipal(logger lager.Logger, name string) error {
+	return ErrKerberosNotSupported
+}
+
+// mitKdcAdapter runs kadmin and keeps a keytab file per principal, the file tells whether the principal exists.
+type mitKdcAdapter struct {
+	invoker Invoker
+	config  KdcConfig
+}
+
+func (a *mitKdcAdapter) CreatePrincipal(logger lager.Logger, name string) (Keytab, error) {
+	if err := validatePrincipalName(name); err != nil {
+		return Keytab{}, err
+	}
+	logger = logger.Session("mit-create-principal", lager.Data{"principal": a.principal(name)})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if keytab, err := a.Keytab(logger, name); err != ErrPrincipalDoesNotExist {
+		return keytab, err
+	}
+	// the principal may be left over from a failed attempt, ktadd gives it a new key either way
+	if err := a.kadmin(logger, "addprinc -randkey "+a.principal(name)); err != nil {
+		logger.Info("principal-not-added")
+	}
+	if err := a.kadmin(logger, fmt.Sprintf("ktadd -k %s %s", a.keytabPath(name), a.principal(name))); err != nil {
+		return Keytab{}, err
+	}
+	return a.Keytab(logger, name)
+}
+
+func (a *mitKdcAdapter) Keytab(logger lager.Logger, name string) (Keytab, error) {
+	if err := validatePrincipalName(name); err != nil {
+		return Keytab{}, err
+	}
+	keytab := Keytab{Principal: a.principal(name), Ref: a.keytabPath(name)}
+	data, err := ioutil.ReadFile(keytab.Ref)
+	if os.IsNotExist(err) {
+		return Keytab{}, ErrPrincipalDoesNotExist
+	}
+	if err != nil {
+		logger.Error("failed-to-read-keytab", err, lager.Data{"keytab": keytab.Ref})
+		return Keytab{}, fmt.Errorf("failed to read the keytab of '%s'", keytab.Principal)
+	}
+	if a.config.InlineKeytabs {
+		keytab.Data = data
+	}
+	return keytab, nil
+}
+
+func (a *mitKdcAdapter) DeletePrincipal(logger lager.Logger, name string) error {
+	if err := validatePrincipalName(name); err != nil {
+		return err
+	}
+	logger = logger.Session("mit-delete-principal", lager.Data{"principal": a.principal(name)})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if err := a.kadmin(logger, "delprinc -force "+a.principal(name)); err != nil {
+		return err
+	}
+	if err := os.Remove(a.keytabPath(name)); err != nil && !os.IsNotExist(err) {
+		logger.Error("failed-to-remove-keytab", err)
+	}
+	return nil
+}
+
+func (a *mitKdcAdapter) principal(name string) string {
+	return name + "@" + a.config.Realm
+}
+
+func (a *mitKdcAdapter) keytabPath(name string) string {
+	return filepath.Join(a.config.KeytabDir, name+".keytab")
+}
+
+func (a *mitKdcAdapter) kadmin(logger lager.Logger, query string) error {
+	ctx, cancel, _ := withTimeout(context.Background(), a.config.Timeout)
+	defer cancel()
+
+	args := []string{"-r", a.config.Realm, "-p", a.config.AdminPrincipal, "-k", "-t", a.config.AdminKeytab, "-q", query}
+	err := a.invoker.Invoke(ctx, logger, "kadmin", args)
+	if err != nil {
+		logger.Error("kadmin-failed", err, lager.Data{"query": query})
+		return failure(err, "failed to run kadmin '%s'", query)
+	}
+	return nil
+}
+
+// FakeKdcAdapter keeps principals with random keys in memory.
+type FakeKdcAdapter struct {
+	Realm string
+
+	mutex      sync.Mutex
+	principals map[string][]byte
+}
+
+func NewFakeKdcAdapter(realm string) *FakeKdcAdapter {
+	return &FakeKdcAdapter{Realm: realm, principals: map[string][]byte{}}
+}
+
+func (a *FakeKdcAdapter) CreatePrincipal(logger lager.Logger, name string) (Keytab, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if _, ok := a.principals[name]; !ok {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return Keytab{}, err
+		}
+		a.principals[name] = key
+	}
+	return a.keytab(name), nil
+}
+
+func (a *FakeKdcAdapter) Keytab(logger lager.Logger, name string) (Keytab, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if _, ok := a.principals[name]; !ok {
+		return Keytab{}, ErrPrincipalDoesNotExist
+	}
+	return a.keytab(name), nil
+}
+
+func (a *FakeKdcAdapter) DeletePrincipal(logger lager.Logger, name string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if _, ok := a.principals[name]; !ok {
+		return ErrPrincipalDoesNotExist
+	}
+	delete(a.principals, name)
+	return nil
+}
+
+// Principals returns the names of the principals, sorted.
+func (a *FakeKdcAdapter) Principals() []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	names := []string{}
+	for name := range a.principals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (a *FakeKdcAdapter) keytab(name string) Keytab {
+	principal := name + "@" + a.Realm
+	return Keytab{Principal: principal, Ref: "fake://" + principal, Data: a.principals[name]}
+}
+
+// KerberosCredentials are the binding credentials of plans issuing kerberos principals.
+type KerberosCredentials struct {
+	Principal string `json:"principal"`
+	KeytabRef string `json:"keytab_ref,omitempty"`
+	// base64 encoded keytab
+	Keytab string `json:"keytab,omitempty"`
+}
+
+// ServiceCredentials are what the broker logs in with before mounting an export with kerberos security.
+type ServiceCredentials struct {
+	Principal string
+	Keytab    string
+}
+
+func (c *ServiceCredentials) login(ctx context.Context, logger lager.Logger, invoker Invoker) error {
+	err := invoker.Invoke(ctx, logger, "kinit", []string{"-k", "-t", c.Keytab, c.Principal})
+	if err != nil {
+		logger.Error("kinit-failed", err, lager.Data{"principal": c.Principal})
+		return failure(err, "failed to log in as '%s'", c.Principal)
+	}
+	return nil
+}
+
+// principalName names the principal of a binding, bindings of plans with a principal per instance share
+// the principal of their instance.
+func principalName(plan Plan, instanceID, bindingID string) string {
+	if plan.Settings.Kerberos == KerberosPerInstance {
+		return "instance-" + instanceID
+	}
+	return "binding-" + bindingID
+}
+
+// kerberosCredentials returns the credentials of a binding, creating its principal if create is set.
+// Bindings of plans without kerberos have no credentials.
+func (b *broker) kerberosCredentials(logger lager.Logger, plan Plan, principal string, create bool) (interface{}, error) {
+	if plan.Settings.Kerberos == "" {
+		return struct{}{}, nil
+	}
+	if err := validatePrincipalName(principal); err != nil {
+		logger.Error("invalid-principal-name", err, lager.Data{"principal": principal})
+		return nil, err
+	}
+	var keytab Keytab
+	var err error
+	if create {
+		keytab, err = b.kdc.CreatePrincipal(logger, principal)
+	} else {
+		keytab, err = b.kdc.Keytab(logger, principal)
+	}
+	if err != nil {
+		logger.Error("failed-to-get-principal", err, lager.Data{"principal": principal})
+		return nil, err
+	}
+	credentials := KerberosCredentials{Principal: keytab.Principal, KeytabRef: keytab.Ref}
+	if len(keytab.Data) > 0 {
+		credentials.Keytab = base64.StdEncoding.EncodeToString(keytab.Data)
+	}
+	return map[string]interface{}{"kerberos": credentials}, nil
+}
+
+// deletePrincipal deletes the principal recorded in the metadata of an instance or binding.
+func (b *broker) deletePrincipal(logger lager.Logger, metadata Metadata) {
+	if metadata.Principal == "" {
+		return
+	}
+	if err := b.kdc.DeletePrincipal(logger, metadata.Principal); err != nil && err != ErrPrincipalDoesNotExist {
+		logger.Error("failed-to-delete-principal", err, lager.Data{"principal": metadata.Principal})
+	}
+}
+
+// kerberosMountOptions adds the strongest kerberos security to the mount options of plans with
+// principals, unless the options choose a security flavor.
+func kerberosMountOptions(plan Plan, options MountOptions) MountOptions {
+	if _, ok := options.Get("sec"); ok || plan.Settings.Kerberos == "" {
+		return options
+	}
+	return options.Merge(MountOptions{{Name: "sec", Value: "krb5p"}})
+}
+
+func isKerberosSecurity(options MountOptions) bool {
+	sec, _ := options.Get("sec")
+	return strings.HasPrefix(sec, "krb5")
+}
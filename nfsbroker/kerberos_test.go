@@ -0,0 +1,54 @@
+package nfsbroker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MIT kdc adapter", func() {
+	var (
+		logger    lager.Logger
+		invoker   *fakeInvoker
+		keytabDir string
+		kdc       KdcAdapter
+	)
+
+	BeforeEach(func() {
+		logger = lager.NewLogger("kerberos-test")
+		invoker = &fakeInvoker{}
+		var err error
+		keytabDir, err = ioutil.TempDir("", "keytabs")
+		Expect(err).NotTo(HaveOccurred())
+		kdc, err = NewKdcAdapter(KdcBackendMit, invoker, KdcConfig{Realm: "EXAMPLE.COM", AdminPrincipal: "admin/admin", AdminKeytab: "/admin.keytab", KeytabDir: keytabDir})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(keytabDir)
+	})
+
+	It("runs kadmin for a valid principal name", func() {
+		Expect(ioutil.WriteFile(filepath.Join(keytabDir, "binding-1234-abcd.keytab"), []byte("key"), 0600)).To(Succeed())
+		Expect(kdc.DeletePrincipal(logger, "binding-1234-abcd")).To(Succeed())
+		Expect(invoker.Calls()).To(Equal([][]string{
+			{"kadmin", "-r", "EXAMPLE.COM", "-p", "admin/admin", "-k", "-t", "/admin.keytab", "-q", "delprinc -force binding-1234-abcd@EXAMPLE.COM"},
+		}))
+	})
+
+	It("rejects principal names which could change the kadmin query or the keytab path", func() {
+		for _, name := range []string{"", "binding-1 -pw secret", "admin/admin", "binding@OTHER.COM", "../binding", "binding\"", "binding;"} {
+			_, err := kdc.CreatePrincipal(logger, name)
+			Expect(err).To(Equal(ErrInvalidPrincipalName), name)
+			_, err = kdc.Keytab(logger, name)
+			Expect(err).To(Equal(ErrInvalidPrincipalName), name)
+			Expect(kdc.DeletePrincipal(logger, name)).To(Equal(ErrInvalidPrincipalName), name)
+		}
+		Expect(invoker.Calls()).To(BeEmpty())
+	})
+})
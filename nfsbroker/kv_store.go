@@ -0,0 +1,359 @@
+package nfsbroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/goshims/ioutil"
+	"code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	instancesBucket  = "instances"
+	bindingsBucket   = "bindings"
+	operationsBucket = "operations"
+	metadataBucket   = "metadata"
+)
+
+// kvStore is an embedded key/value store keeping one bucket directory per record type
+// and one JSON file per key, so that a change only rewrites the record it touches.
+type kvStore struct {
+	ioutil ioutilshim.Ioutil
+	os     osshim.Os
+	dir    string
+	mutex  sync.Mutex
+}
+
+func NewKVStore(ioutil ioutilshim.Ioutil, os osshim.Os, dir string) Store {
+	return &kvStore{
+		ioutil: ioutil,
+		os:     os,
+		dir:    dir,
+	}
+}
+
+func (s *kvStore) Restore(logger lager.Logger) error {
+	logger = logger.Session("restore-kv-store")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	for _, bucket := range []string{instancesBucket, bindingsBucket, operationsBucket, metadataBucket} {
+		err := s.os.MkdirAll(filepath.Join(s.dir, bucket), 0700)
+		if err != nil {
+			logger.Error("failed-to-create-bucket", err, lager.Data{"bucket": bucket})
+			return fmt.Errorf("failed to create bucket '%s' in '%s'", bucket, s.dir)
+		}
+	}
+	return nil
+}
+
+func (s *kvStore) CreateInstanceDetails(logger lager.Logger, instanceID string, details brokerapi.ProvisionDetails) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.exists(instancesBucket, instanceID) {
+		return brokerapi.ErrInstanceAlreadyExists
+	}
+	return s.put(logger, instancesBucket, instanceID, details)
+}
+
+func (s *kvStore) RetrieveInstanceDetails(logger lager.Logger, instanceID string) (brokerapi.ProvisionDetails, error) {
+	details := brokerapi.ProvisionDetails{}
+	found, err := s.get(logger, instancesBucket, instanceID, &details)
+	if err != nil {
+		return brokerapi.ProvisionDetails{}, err
+	}
+	if !found {
+		return brokerapi.ProvisionDetails{}, brokerapi.ErrInstanceDoesNotExist
+	}
+	return details, nil
+}
+
+func (s *kvStore) UpdateInstanceDetails(logger lager.Logger, instanceID string, details brokerapi.ProvisionDetails) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.exists(instancesBucket, instanceID) {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+	return s.put(logger, instancesBucket, instanceID, details)
+}
+
+func (s *kvStore) DeleteInstanceDetails(logger lager.Logger, instanceID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.exists(instancesBucket, instanceID) {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+	return s.delete(logger, instancesBucket, instanceID)
+}
+
+func (s *kvStore) ListInstanceDetails(logger lager.Logger) (map[string]brokerapi.ProvisionDetails, error) {
+	instances := map[string]brokerapi.ProvisionDetails{}
+	err := s.list(logger, instancesBucket, func(key string, data []byte) error {
+		details := brokerapi.ProvisionDetails{}
+		if err := json.Unmarshal(data, &details); err != nil {
+			return err
+		}
+		instances[key] = details
+		return nil
+	})
+	return instances, err
+}
+
+func (s *kvStore) CreateBindingDetails(logger lager.Logger, bindingID string, details brokerapi.BindDetails) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.exists(bindingsBucket, bindingID) {
+		return brokerapi.ErrBindingAlreadyExists
+	}
+	return s.put(logger, bindingsBucket, bindingID, details)
+}
+
+func (s *kvStore) RetrieveBindingDetails(logger lager.Logger, bindingID string) (brokerapi.BindDetails, error) {
+	details := brokerapi.BindDetails{}
+	found, err := s.get(logger, bindingsBucket, bindingID, &details)
+	if err != nil {
+		return brokerapi.BindDetails{}, err
+	}
+	if !found {
+		return brokerapi.BindDetails{}, brokerapi.ErrBindingDoesNotExist
+	}
+	return details, nil
+}
+
+func (s *kvStore) DeleteBindingDetails(logger lager.Logger, bindingID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.exists(bindingsBucket, bindingID) {
+		return brokerapi.ErrBindingDoesNotExist
+	}
+	return s.delete(logger, bindingsBucket, bindingID)
+}
+
+func (s *kvStore) ListBindingDetails(logger lager.Logger) (map[string]brokerapi.BindDetails, error) {
+	bindings := map[string]brokerapi.BindDetails{}
+	err := s.list(logger, bindingsBucket, func(key string, data []byte) error {
+		details := brokerapi.BindDetails{}
+		if err := json.Unmarshal(data, &details); err != nil {
+			return err
+		}
+		bindings[key] = details
+		return nil
+	})
+	return bindings, err
+}
+
+func (s *kvStore) StartOperation(logger lager.Logger, instanceID string, operation OperationRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	existing := OperationRecord{}
+	found, err := s.get(logger, operationsBucket, instanceID, &existing)
+	if err != nil {
+		return err
+	}
+	if found && existing.State == brokerapi.InProgress {
+		return ErrOperationInProgress
+	}
+	return s.put(logger, operationsBucket, instanceID, operation)
+}
+
+func (s *kvStore) SaveOperation(logger lager.Logger, instanceID string, operation OperationRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.put(logger, operationsBucket, instanceID, operation)
+}
+
+func (s *kvStore) RetrieveOperation(logger lager.Logger, instanceID string) (OperationRecord, error) {
+	operation := OperationRecord{}
+	found, err := s.get(logger, operationsBucket, instanceID, &operation)
+	if err != nil {
+		return OperationRecord{}, err
+	}
+	if !found {
+		return OperationRecord{}, ErrOperationDoesNotExist
+	}
+	return operation, nil
+}
+
+func (s *kvStore) DeleteOperation(logger lager.Logger, instanceID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.delete(logger, operationsBucket, instanceID)
+}
+
+func (s *kvStore) ListOperations(logger lager.Logger) (map[string]OperationRecord, error) {
+	operations := map[string]OperationRecord{}
+	err := s.list(logger, operationsBucket, func(key string, data []byte) error {
+		operation := OperationRecord{}
+		if err := json.Unmarshal(data, &operation); err != nil {
+			return err
+		}
+		operations[key] = operation
+		return nil
+	})
+	return operations, err
+}
+
+func (s *kvStore) SaveMetadata(logger lager.Logger, id string, metadata Metadata) error {
+	return s.put(logger, metadataBucket, id, metadata)
+}
+
+func (s *kvStore) RetrieveMetadata(logger lager.Logger, id string) (Metadata, error) {
+	metadata := Metadata{}
+	found, err := s.get(logger, metadataBucket, id, &metadata)
+	if err != nil {
+		return Metadata{}, err
+	}
+	if !found {
+		return Metadata{}, ErrMetadataDoesNotExist
+	}
+	return metadata, nil
+}
+
+func (s *kvStore) DeleteMetadata(logger lager.Logger, id string) error {
+	return s.delete(logger, metadataBucket, id)
+}
+
+func (s *kvStore) ListMetadata(logger lager.Logger) (map[string]Metadata, error) {
+	metadata := map[string]Metadata{}
+	err := s.list(logger, metadataBucket, func(key string, data []byte) error {
+		record := Metadata{}
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		metadata[key] = record
+		return nil
+	})
+	return metadata, err
+}
+
+func (s *kvStore) keyPath(bucket, key string) string {
+	return filepath.Join(s.dir, bucket, keyFileName(key))
+}
+
+// keyFileName escapes a key into the name of its file, a leading dot is escaped as well so that
+// the file of a key is never taken for a hidden temporary file.
+func keyFileName(key string) string {
+	name := url.PathEscape(key)
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	return name + ".json"
+}
+
+func (s *kvStore) exists(bucket, key string) bool {
+	_, err := s.os.Stat(s.keyPath(bucket, key))
+	return err == nil
+}
+
+// put writes the record to a temporary file of the bucket and renames it over the key,
+// readers see either the old or the new record. The bucket directory is synced so that the rename
+// survives a crash.
+func (s *kvStore) put(logger lager.Logger, bucket, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		logger.Error("failed-to-marshal-record", err, lager.Data{"bucket": bucket, "key": key})
+		return err
+	}
+
+	tmp, err := s.ioutil.TempFile(filepath.Join(s.dir, bucket), ".tmp-")
+	if err != nil {
+		logger.Error("failed-to-create-record-file", err, lager.Data{"bucket": bucket, "key": key})
+		return fmt.Errorf("failed to write record '%s' of bucket '%s'", key, bucket)
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = s.os.Rename(tmp.Name(), s.keyPath(bucket, key))
+	}
+	if err == nil {
+		err = s.syncDir(filepath.Join(s.dir, bucket))
+	}
+	if err != nil {
+		s.os.Remove(tmp.Name())
+		logger.Error("failed-to-write-record", err, lager.Data{"bucket": bucket, "key": key})
+		return fmt.Errorf("failed to write record '%s' of bucket '%s'", key, bucket)
+	}
+	return nil
+}
+
+func (s *kvStore) get(logger lager.Logger, bucket, key string, value interface{}) (bool, error) {
+	data, err := s.ioutil.ReadFile(s.keyPath(bucket, key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		logger.Error("failed-to-read-record", err, lager.Data{"bucket": bucket, "key": key})
+		return false, fmt.Errorf("failed to read record '%s' of bucket '%s'", key, bucket)
+	}
+	if err = json.Unmarshal(data, value); err != nil {
+		logger.Error("failed-to-unmarshal-record", err, lager.Data{"bucket": bucket, "key": key})
+		return false, fmt.Errorf("record '%s' of bucket '%s' is corrupt", key, bucket)
+	}
+	return true, nil
+}
+
+func (s *kvStore) delete(logger lager.Logger, bucket, key string) error {
+	err := s.os.Remove(s.keyPath(bucket, key))
+	if err != nil && !os.IsNotExist(err) {
+		logger.Error("failed-to-delete-record", err, lager.Data{"bucket": bucket, "key": key})
+		return fmt.Errorf("failed to delete record '%s' of bucket '%s'", key, bucket)
+	}
+	return nil
+}
+
+func (s *kvStore) list(logger lager.Logger, bucket string, decode func(key string, data []byte) error) error {
+	files, err := s.ioutil.ReadDir(filepath.Join(s.dir, bucket))
+	if err != nil {
+		logger.Error("failed-to-list-bucket", err, lager.Data{"bucket": bucket})
+		return fmt.Errorf("failed to list bucket '%s'", bucket)
+	}
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		key, err := url.PathUnescape(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			continue
+		}
+		data, err := s.ioutil.ReadFile(filepath.Join(s.dir, bucket, name))
+		if err != nil {
+			logger.Error("failed-to-read-record", err, lager.Data{"bucket": bucket, "key": key})
+			return fmt.Errorf("failed to read record '%s' of bucket '%s'", key, bucket)
+		}
+		if err = decode(key, data); err != nil {
+			logger.Error("failed-to-unmarshal-record", err, lager.Data{"bucket": bucket, "key": key})
+			return fmt.Errorf("record '%s' of bucket '%s' is corrupt", key, bucket)
+		}
+	}
+	return nil
+}
+
+func (s *kvStore) syncDir(dir string) error {
+	d, err := s.os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,69 @@
+package nfsbroker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/goshims/ioutil"
+	"code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("KV store", func() {
+	var (
+		logger lager.Logger
+		dir    string
+		store  Store
+	)
+
+	BeforeEach(func() {
+		logger = lager.NewLogger("kv-store-test")
+		var err error
+		dir, err = ioutil.TempDir("", "kv-store")
+		Expect(err).NotTo(HaveOccurred())
+		store = NewKVStore(&ioutilshim.IoutilShim{}, &osshim.OsShim{}, dir)
+		Expect(store.Restore(logger)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("keeps keys starting with a dot apart from temporary files", func() {
+		keys := []string{".hidden", "..", ".tmp-1", "a/b", "plain"}
+		for _, key := range keys {
+			Expect(store.CreateInstanceDetails(logger, key, brokerapi.ProvisionDetails{PlanID: key})).To(Succeed())
+		}
+		Expect(ioutil.WriteFile(filepath.Join(dir, instancesBucket, ".tmp-2"), []byte("{"), 0600)).To(Succeed())
+
+		instances, err := store.ListInstanceDetails(logger)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(instances).To(HaveLen(len(keys)))
+		for _, key := range keys {
+			Expect(instances[key].PlanID).To(Equal(key))
+			details, err := store.RetrieveInstanceDetails(logger, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(details.PlanID).To(Equal(key))
+		}
+
+		files, err := ioutil.ReadDir(filepath.Join(dir, instancesBucket))
+		Expect(err).NotTo(HaveOccurred())
+		names := []string{}
+		for _, file := range files {
+			names = append(names, file.Name())
+		}
+		Expect(names).To(ConsistOf("%2Ehidden.json", "%2E..json", "%2Etmp-1.json", "a%2Fb.json", "plain.json", ".tmp-2"))
+	})
+
+	It("deletes a key starting with a dot", func() {
+		Expect(store.CreateBindingDetails(logger, ".binding", brokerapi.BindDetails{AppGUID: "app"})).To(Succeed())
+		Expect(store.DeleteBindingDetails(logger, ".binding")).To(Succeed())
+		_, err := store.RetrieveBindingDetails(logger, ".binding")
+		Expect(err).To(Equal(brokerapi.ErrBindingDoesNotExist))
+	})
+})
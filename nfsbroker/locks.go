@@ -0,0 +1,68 @@
+package nfsbroker
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// number of stripes, instances whose ids hash to the same stripe serialize their requests
+const instanceLockStripes = 64
+
+// instanceLocks serializes the requests for a single instance without blocking the other
+// instances while a share is being mounted, created or removed. With a store shared by several
+// brokers the requests of the other brokers are serialized through a lease of the store.
+type instanceLocks struct {
+	stripes [instanceLockStripes]sync.Mutex
+	leaser  Leaser
+	logger  lager.Logger
+}
+
+func newInstanceLocks(store Store, logger lager.Logger) *instanceLocks {
+	leaser, _ := store.(Leaser)
+	return &instanceLocks{leaser: leaser, logger: logger.Session("instance-locks")}
+}
+
+func (l *instanceLocks) forInstance(instanceID string) lock {
+	h := fnv.New32a()
+	h.Write([]byte(instanceID))
+	stripe := &l.stripes[h.Sum32()%instanceLockStripes]
+	if l.leaser == nil {
+		return stripe
+	}
+	return &leasedLock{local: stripe, leaser: l.leaser, name: "instance/" + instanceID, logger: l.logger}
+}
+
+// leasedLock holds a local lock and a lease of the store, a failure to take the lease is retried
+// as the callers of a lock cannot fail.
+type leasedLock struct {
+	local   lock
+	leaser  Leaser
+	name    string
+	logger  lager.Logger
+	release func()
+}
+
+func (l *leasedLock) Lock() {
+	l.local.Lock()
+	l.release = holdLease(l.logger, l.leaser, l.name, nil)
+}
+
+func (l *leasedLock) Unlock() {
+	l.release()
+	l.local.Unlock()
+}
+
+// holdLease takes a lease of the store, retrying until the store can be reached.
+func holdLease(logger lager.Logger, leaser Leaser, name string, value interface{}) func() {
+	for {
+		release, err := leaser.Lease(logger, name, value)
+		if err == nil {
+			return release
+		}
+		logger.Error("failed-to-take-lease", err, lager.Data{"lease": name})
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,139 @@
+package nfsbroker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Instance locks", func() {
+	const (
+		// more instances than lock stripes, so that instances share stripes
+		instances           = 3 * instanceLockStripes
+		bindingsPerInstance = 4
+	)
+
+	var (
+		store *memoryStore
+		tb    testBroker
+	)
+
+	BeforeEach(func() {
+		store = newMemoryStore()
+		tb = newTestBroker(store, &fakeInvoker{}, testCatalog())
+	})
+
+	AfterEach(func() {
+		tb.cleanup()
+	})
+
+	operationState := func(instanceID, operation string) func() brokerapi.LastOperationState {
+		return func() brokerapi.LastOperationState {
+			op, err := tb.LastOperation(instanceID, operation)
+			Expect(err).NotTo(HaveOccurred())
+			return op.State
+		}
+	}
+
+	// runs do concurrently for count ids and waits until all of them are done
+	forEach := func(count int, id func(int) string, do func(id string)) {
+		var wg sync.WaitGroup
+		for i := 0; i < count; i++ {
+			wg.Add(1)
+			go func(id string) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				do(id)
+			}(id(i))
+		}
+		wg.Wait()
+	}
+
+	instanceID := func(i int) string {
+		return fmt.Sprintf("instance-%d", i)
+	}
+
+	It("keeps the state consistent when the instances go through their lifecycle at the same time", func() {
+		details := brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id", OrganizationGUID: "org", SpaceGUID: "space"}
+
+		forEach(instances, instanceID, func(id string) {
+			// repeated provisions of the same instance race with the first one
+			forEach(3, func(int) string { return id }, func(id string) {
+				spec, err := tb.Provision(id, details, true)
+				Expect(err).NotTo(HaveOccurred())
+				if spec.IsAsync {
+					Expect(spec.OperationData).To(Equal(OperationProvision))
+				}
+			})
+			Eventually(operationState(id, OperationProvision), 10*time.Second, 5*time.Millisecond).Should(Equal(brokerapi.Succeeded))
+
+			bindingID := func(j int) string { return fmt.Sprintf("%s-binding-%d", id, j) }
+			forEach(bindingsPerInstance, bindingID, func(bindingID string) {
+				binding, err := tb.Bind(id, bindingID, brokerapi.BindDetails{AppGUID: "app-" + bindingID, PlanID: "plan-id", ServiceID: "service-id"})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts).To(HaveLen(1))
+				Expect(binding.VolumeMounts[0].Device.VolumeId).To(Equal(id))
+			})
+			forEach(bindingsPerInstance, bindingID, func(bindingID string) {
+				Expect(tb.Unbind(id, bindingID, brokerapi.UnbindDetails{})).To(Succeed())
+			})
+
+			spec, err := tb.Deprovision(id, brokerapi.DeprovisionDetails{PlanID: "plan-id", ServiceID: "service-id"}, true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(spec.IsAsync).To(BeTrue())
+			Eventually(func() error {
+				_, err := tb.LastOperation(id, OperationDeprovision)
+				return err
+			}, 10*time.Second, 5*time.Millisecond).Should(Equal(ErrInstanceGone))
+		})
+
+		Expect(store.instances).To(BeEmpty())
+		Expect(store.bindings).To(BeEmpty())
+		Expect(store.metadata).To(BeEmpty())
+		Expect(store.operations).To(BeEmpty())
+		Expect(tb.shares()).To(BeEmpty())
+		Expect(tb.trash()).To(HaveLen(instances))
+	})
+
+	It("creates a binding requested concurrently with the same id once", func() {
+		details := brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id"}
+		_, err := tb.Provision("instance", details, false)
+		Expect(err).NotTo(HaveOccurred())
+
+		var mutex sync.Mutex
+		results := map[error]int{}
+		forEach(16, func(i int) string { return fmt.Sprintf("app-%d", i%2) }, func(app string) {
+			_, err := tb.Bind("instance", "binding", brokerapi.BindDetails{AppGUID: app})
+			mutex.Lock()
+			defer mutex.Unlock()
+			results[err]++
+		})
+
+		Expect(store.bindings).To(HaveLen(1))
+		Expect(results[nil]).To(Equal(8))
+		Expect(results[brokerapi.ErrBindingAlreadyExists]).To(Equal(8))
+	})
+
+	It("rejects requests for an instance while an operation is in progress", func() {
+		details := brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id"}
+		_, err := tb.Provision("instance", details, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store.StartOperation(tb.logger, "instance", tb.operation(OperationUpdate, brokerapi.InProgress, "updating share"))).To(Succeed())
+
+		forEach(instanceLockStripes, instanceID, func(string) {
+			_, err := tb.Bind("instance", "binding", brokerapi.BindDetails{AppGUID: "app"})
+			Expect(err).To(Equal(ErrOperationInProgress))
+			_, err = tb.Deprovision("instance", brokerapi.DeprovisionDetails{}, true)
+			Expect(err).To(Equal(ErrOperationInProgress))
+			_, err = tb.Update("instance", brokerapi.UpdateDetails{PlanID: "big-plan-id"}, true)
+			Expect(err).To(Equal(ErrOperationInProgress))
+		})
+		Expect(store.bindings).To(BeEmpty())
+		Expect(store.operations["instance"].Type).To(Equal(OperationUpdate))
+	})
+})
@@ -0,0 +1,200 @@
+package nfsbroker
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	MetricGauge     = "gauge"
+	MetricCounter   = "counter"
+	MetricHistogram = "histogram"
+)
+
+// DurationBuckets are the upper bounds in seconds of the request duration histograms.
+var DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Sample is the current value of a metric with one set of labels.
+type Sample struct {
+	Name   string
+	Help   string
+	Kind   string
+	Labels []string
+	Value  float64
+}
+
+// Metrics keeps the gauges and counters of the broker in memory. Labels are passed as
+// alternating names and values.
+type Metrics struct {
+	mutex   sync.Mutex
+	samples map[string]*Sample
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{samples: map[string]*Sample{}}
+}
+
+func (m *Metrics) SetGauge(name, help string, value float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.sample(name, help, MetricGauge, labels).Value = value
+}
+
+func (m *Metrics) AddCounter(name, help string, delta float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.sample(name, help, MetricCounter, labels).Value += delta
+}
+
+// Observe adds a value to a histogram, kept as the cumulative _bucket, _sum and _count series of the name.
+func (m *Metrics) Observe(name, help string, value float64, buckets []float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	bounds := append(append([]float64{}, buckets...), math.Inf(1))
+	for _, bound := range bounds {
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		bucket := m.sample(name+"_bucket", help, MetricHistogram, append(append([]string{}, labels...), "le", le))
+		if value <= bound {
+			bucket.Value++
+		}
+	}
+	m.sample(name+"_sum", help, MetricHistogram, labels).Value += value
+	m.sample(name+"_count", help, MetricHistogram, labels).Value++
+}
+
+// DeleteGauges removes the gauges of a name, for gauges whose label values come and go.
+func (m *Metrics) DeleteGauges(name string) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for key, sample := range m.samples {
+		if sample.Name == name && sample.Kind == MetricGauge {
+			delete(m.samples, key)
+		}
+	}
+}
+
+// WritePrometheus writes every sample in the prometheus text exposition format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	samples := m.Samples()
+	sort.SliceStable(samples, func(i, j int) bool {
+		if samples[i].family() != samples[j].family() {
+			return samples[i].family() < samples[j].family()
+		}
+		if samples[i].Name != samples[j].Name {
+			return samples[i].Name < samples[j].Name
+		}
+		// the buckets of a series are ordered by their upper bound
+		series, bound := samples[i].bucket()
+		otherSeries, otherBound := samples[j].bucket()
+		return series < otherSeries || series == otherSeries && bound < otherBound
+	})
+
+	family := ""
+	for _, sample := range samples {
+		if sample.family() != family {
+			family = sample.family()
+			if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family, escapeHelp(sample.Help), family, sample.Kind); err != nil {
+				return err
+			}
+		}
+		labels := []string{}
+		for i := 0; i+1 < len(sample.Labels); i += 2 {
+			labels = append(labels, fmt.Sprintf("%s=\"%s\"", sample.Labels[i], escapeLabelValue(sample.Labels[i+1])))
+		}
+		series := sample.Name
+		if len(labels) > 0 {
+			series += "{" + strings.Join(labels, ",") + "}"
+		}
+		if _, err := fmt.Fprintf(w, "%s %s\n", series, strconv.FormatFloat(sample.Value, 'g', -1, 64)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// family is the name of the metric a sample belongs to, the series of a histogram share the name of the histogram.
+func (s Sample) family() string {
+	if s.Kind != MetricHistogram {
+		return s.Name
+	}
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		if strings.HasSuffix(s.Name, suffix) {
+			return strings.TrimSuffix(s.Name, suffix)
+		}
+	}
+	return s.Name
+}
+
+// bucket returns the labels of a histogram bucket without its upper bound, and the bound.
+func (s Sample) bucket() (string, float64) {
+	if len(s.Labels) < 2 || s.Labels[len(s.Labels)-2] != "le" {
+		return strings.Join(s.Labels, "\x00"), 0
+	}
+	bound, err := strconv.ParseFloat(s.Labels[len(s.Labels)-1], 64)
+	if err != nil {
+		bound = math.Inf(1)
+	}
+	return strings.Join(s.Labels[:len(s.Labels)-2], "\x00"), bound
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
+
+// Samples returns a copy of every sample ordered by name and labels.
+func (m *Metrics) Samples() []Sample {
+	if m == nil {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	keys := make([]string, 0, len(m.samples))
+	for key := range m.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	samples := make([]Sample, 0, len(keys))
+	for _, key := range keys {
+		sample := *m.samples[key]
+		sample.Labels = append([]string{}, sample.Labels...)
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+func (m *Metrics) sample(name, help, kind string, labels []string) *Sample {
+	key := name + "\x00" + strings.Join(labels, "\x00")
+	sample, ok := m.samples[key]
+	if !ok {
+		sample = &Sample{Name: name, Help: help, Kind: kind, Labels: append([]string{}, labels...)}
+		m.samples[key] = sample
+	}
+	return sample
+}
@@ -0,0 +1,177 @@
+package nfsbroker
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	numericOption  = regexp.MustCompile(`^[0-9]+$`)
+	versionOption  = regexp.MustCompile(`^(3|4|4\.[0-2])$`)
+	securityOption = regexp.MustCompile(`^(sys|krb5|krb5i|krb5p)(:(sys|krb5|krb5i|krb5p))*$`)
+	protocolOption = regexp.MustCompile(`^(tcp|udp|rdma)6?$`)
+)
+
+// allowedMountOptions are the nfs mount options plans and backends may set, flags have no value pattern.
+var allowedMountOptions = map[string]*regexp.Regexp{
+	"vers":         versionOption,
+	"nfsvers":      versionOption,
+	"rsize":        numericOption,
+	"wsize":        numericOption,
+	"timeo":        numericOption,
+	"retrans":      numericOption,
+	"actimeo":      numericOption,
+	"acregmin":     numericOption,
+	"acregmax":     numericOption,
+	"acdirmin":     numericOption,
+	"acdirmax":     numericOption,
+	"nconnect":     numericOption,
+	"port":         numericOption,
+	"mountport":    numericOption,
+	"sec":          securityOption,
+	"proto":        protocolOption,
+	"mountproto":   protocolOption,
+	"lookupcache":  regexp.MustCompile(`^(all|none|pos|positive)$`),
+	"local_lock":   regexp.MustCompile(`^(all|flock|posix|none)$`),
+	"hard":         nil,
+	"soft":         nil,
+	"intr":         nil,
+	"nointr":       nil,
+	"ro":           nil,
+	"rw":           nil,
+	"ac":           nil,
+	"noac":         nil,
+	"lock":         nil,
+	"nolock":       nil,
+	"cto":          nil,
+	"nocto":        nil,
+	"sharecache":   nil,
+	"nosharecache": nil,
+}
+
+// mutually exclusive flags, a later flag replaces an earlier one
+var opposedMountOptions = map[string]string{
+	"hard": "soft", "soft": "hard",
+	"intr": "nointr", "nointr": "intr",
+	"ro": "rw", "rw": "ro",
+	"ac": "noac", "noac": "ac",
+	"lock": "nolock", "nolock": "lock",
+	"cto": "nocto", "nocto": "cto",
+	"sharecache": "nosharecache", "nosharecache": "sharecache",
+}
+
+type MountOption struct {
+	Name  string
+	Value string
+}
+
+// MountOptions are nfs mount options in the order they are passed to mount.
+type MountOptions []MountOption
+
+// ParseMountOptions parses and validates comma separated mount options such as "vers=4.1,hard,timeo=600".
+func ParseMountOptions(options string) (MountOptions, error) {
+	parsed := MountOptions{}
+	for _, option := range strings.Split(options, ",") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		name, value := option, ""
+		hasValue := false
+		if i := strings.Index(option, "="); i >= 0 {
+			name, value, hasValue = option[:i], option[i+1:], true
+		}
+		pattern, ok := allowedMountOptions[name]
+		if !ok {
+			return nil, fmt.Errorf("mount option '%s' is not allowed", name)
+		}
+		if (pattern == nil) == hasValue || (pattern != nil && !pattern.MatchString(value)) {
+			return nil, fmt.Errorf("invalid mount option '%s'", option)
+		}
+		parsed = parsed.Merge(MountOptions{{Name: name, Value: value}})
+	}
+	return parsed, nil
+}
+
+// Merge returns the options with the overrides applied, an override replaces the option of the same
+// name and its opposite flag.
+func (o MountOptions) Merge(overrides MountOptions) MountOptions {
+	merged := append(MountOptions{}, o...)
+	for _, override := range overrides {
+		kept := MountOptions{}
+		for _, option := range merged {
+			if option.name() != override.name() && option.Name != opposedMountOptions[override.Name] {
+				kept = append(kept, option)
+			}
+		}
+		merged = append(kept, override)
+	}
+	return merged
+}
+
+// Without returns the options without the named options.
+func (o MountOptions) Without(names ...string) MountOptions {
+	kept := MountOptions{}
+	for _, option := range o {
+		omitted := false
+		for _, name := range names {
+			omitted = omitted || option.Name == name
+		}
+		if !omitted {
+			kept = append(kept, option)
+		}
+	}
+	return kept
+}
+
+// Get returns the value of an option, nfsvers and vers are the same option.
+func (o MountOptions) Get(name string) (string, bool) {
+	for _, option := range o {
+		if option.name() == (MountOption{Name: name}).name() {
+			return option.Value, true
+		}
+	}
+	return "", false
+}
+
+// Has tells whether a flag is set.
+func (o MountOptions) Has(flag string) bool {
+	for _, option := range o {
+		if option.Name == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// MajorVersion returns the nfs version set by the options, 0 if none is set.
+func (o MountOptions) MajorVersion() int {
+	version, ok := o.Get("vers")
+	if !ok {
+		return 0
+	}
+	if strings.HasPrefix(version, "4") {
+		return 4
+	}
+	return 3
+}
+
+func (o MountOptions) String() string {
+	options := []string{}
+	for _, option := range o {
+		if option.Value == "" {
+			options = append(options, option.Name)
+		} else {
+			options = append(options, option.Name+"="+option.Value)
+		}
+	}
+	return strings.Join(options, ",")
+}
+
+func (o MountOption) name() string {
+	if o.Name == "nfsvers" {
+		return "vers"
+	}
+	return o.Name
+}
@@ -0,0 +1,148 @@
+package nfsbroker
+
+import (
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Mount options", func() {
+	Describe("ParseMountOptions", func() {
+		It("accepts the allowed options in their order", func() {
+			options, err := ParseMountOptions(" vers=4.1, hard,timeo=600,,sec=krb5:krb5i,proto=tcp6,lookupcache=pos")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(options.String()).To(Equal("vers=4.1,hard,timeo=600,sec=krb5:krb5i,proto=tcp6,lookupcache=pos"))
+			Expect(options.MajorVersion()).To(Equal(4))
+		})
+
+		It("accepts no options", func() {
+			options, err := ParseMountOptions("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(options).To(BeEmpty())
+			Expect(options.MajorVersion()).To(BeZero())
+		})
+
+		It("rejects options which are not on the allowlist", func() {
+			for _, option := range []string{"exec", "suid", "dev", "fsc", "context=system_u:object_r:nfs_t", "addr=10.0.0.1", "clientaddr=10.0.0.1", "upperdir=/tmp"} {
+				_, err := ParseMountOptions("vers=4.1," + option)
+				Expect(err).To(MatchError(ContainSubstring("is not allowed")), option)
+			}
+		})
+
+		It("rejects values which do not match the pattern of their option", func() {
+			for _, option := range []string{"vers=5", "vers=4.3", "nfsvers=4.1.1", "timeo=-1", "timeo=600s", "rsize=", "sec=none", "sec=krb5 krb5i", "sec=krb5;id", "proto=sctp", "lookupcache=some", "local_lock=everything"} {
+				_, err := ParseMountOptions(option)
+				Expect(err).To(MatchError("invalid mount option '"+option+"'"), option)
+			}
+		})
+
+		It("rejects flags with a value and options without one", func() {
+			for _, option := range []string{"hard=1", "ro=", "nolock=true", "vers", "timeo"} {
+				_, err := ParseMountOptions(option)
+				Expect(err).To(MatchError("invalid mount option '"+option+"'"), option)
+			}
+		})
+
+		It("keeps the last of repeated and opposed options", func() {
+			options, err := ParseMountOptions("vers=3,hard,ro,timeo=10,nfsvers=4.2,soft,rw,timeo=600")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(options.String()).To(Equal("nfsvers=4.2,soft,rw,timeo=600"))
+			version, ok := options.Get("vers")
+			Expect(ok).To(BeTrue())
+			Expect(version).To(Equal("4.2"))
+		})
+	})
+
+	Describe("MountOptions", func() {
+		It("replaces the options of the same name and the opposed flags when merging", func() {
+			backend, err := ParseMountOptions("nfsvers=4.1,hard,nolock,timeo=600")
+			Expect(err).NotTo(HaveOccurred())
+			plan, err := ParseMountOptions("vers=4.2,soft,ro")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(backend.Merge(plan).String()).To(Equal("nolock,timeo=600,vers=4.2,soft,ro"))
+			Expect(backend.String()).To(Equal("nfsvers=4.1,hard,nolock,timeo=600"))
+		})
+
+		It("drops the named options", func() {
+			options, err := ParseMountOptions("vers=3,ro,timeo=600")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(options.Without("ro", "rw").String()).To(Equal("vers=3,timeo=600"))
+			Expect(options.Has("ro")).To(BeTrue())
+			Expect(options.Without("vers").MajorVersion()).To(BeZero())
+		})
+	})
+
+	Describe("validation", func() {
+		It("rejects a catalog with a plan whose mount options are not allowed", func() {
+			catalog := testCatalog()
+			catalog.Plans[1].Settings.MountOptions = "vers=4.1,exec"
+			Expect(catalog.Validate()).To(MatchError("plan 'big' has invalid mount options: mount option 'exec' is not allowed"))
+		})
+
+		It("rejects a plan whose mount options choose another nfs version than the plan", func() {
+			catalog := testCatalog()
+			catalog.Plans[1].Settings.NfsVersion = 3
+			catalog.Plans[1].Settings.MountOptions = "vers=4.1"
+			Expect(catalog.Validate()).To(MatchError("plan 'big' has mount options for nfs version 4 instead of 3"))
+
+			catalog.Plans[1].Settings.MountOptions = "vers=3,timeo=600"
+			Expect(catalog.Validate()).To(Succeed())
+		})
+
+		It("rejects a backend whose mount options are invalid or choose another nfs version", func() {
+			config := BackendConfig{Name: "backend-1", Version: 4, MountOptions: "vers=4.1,hard"}
+			Expect(config.ParsedMountOptions()).To(Equal(MountOptions{{Name: "vers", Value: "4.1"}, {Name: "hard"}}))
+
+			config.MountOptions = "vers=3"
+			_, err := config.ParsedMountOptions()
+			Expect(err).To(MatchError("backend 'backend-1' has mount options for nfs version 3 instead of 4"))
+
+			config.MountOptions = "vers=4.1,nosuid"
+			_, err = config.ParsedMountOptions()
+			Expect(err).To(MatchError("backend 'backend-1' has invalid mount options: mount option 'nosuid' is not allowed"))
+		})
+	})
+
+	Describe("bindings", func() {
+		var tb testBroker
+
+		bind := func(planID string) map[string]interface{} {
+			_, err := tb.Provision("instance-"+planID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID}, false)
+			Expect(err).NotTo(HaveOccurred())
+			binding, err := tb.Bind("instance-"+planID, "binding-"+planID, brokerapi.BindDetails{AppGUID: "app", ServiceID: "service-id", PlanID: planID})
+			Expect(err).NotTo(HaveOccurred())
+			return binding.VolumeMounts[0].Device.MountConfig
+		}
+
+		BeforeEach(func() {
+			catalog := testCatalog()
+			catalog.Plans[1].Settings.MountOptions = "soft,ro,timeo=100"
+			tb = newTestBroker(newMemoryStore(), &fakeInvoker{}, catalog)
+			tb.client.mountOptions = MountOptions{{Name: "hard"}, {Name: "timeo", Value: "600"}, {Name: "nolock"}}
+		})
+
+		AfterEach(func() {
+			tb.cleanup()
+		})
+
+		It("gives the cells the options of the backend", func() {
+			mountConfig := bind("plan-id")
+			Expect(mountConfig["mount_options"]).To(Equal("hard,timeo=600,nolock"))
+		})
+
+		It("gives the cells the options of the backend overridden by those of the plan", func() {
+			mountConfig := bind("big-plan-id")
+			Expect(mountConfig["mount_options"]).To(Equal("nolock,soft,ro,timeo=100"))
+		})
+
+		It("mounts the shares read-only for a plan with the ro option", func() {
+			_, err := tb.Provision("instance", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "big-plan-id"}, false)
+			Expect(err).NotTo(HaveOccurred())
+			binding, err := tb.Bind("instance", "binding", brokerapi.BindDetails{AppGUID: "app", ServiceID: "service-id", PlanID: "big-plan-id"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(binding.VolumeMounts[0].Mode).To(Equal("r"))
+		})
+	})
+})
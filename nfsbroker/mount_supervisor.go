@@ -0,0 +1,148 @@
+package nfsbroker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// MountSupervisor periodically probes the mount of every backend. A mount which is stale, not mounted or
+// whose probe does not return in time is lazily unmounted and mounted again, backing off after failed attempts.
+// While a mount is down its client reports the error, so that requests fail fast instead of hanging on it.
+type MountSupervisor struct {
+	logger       lager.Logger
+	backends     *Backends
+	metrics      *Metrics
+	interval     time.Duration
+	probeTimeout time.Duration
+	maxBackoff   time.Duration
+	mounts       map[string]*supervisedMount
+}
+
+type supervisedMount struct {
+	// remount attempts failed in a row
+	failures    int
+	nextAttempt time.Time
+}
+
+func NewMountSupervisor(logger lager.Logger, backends *Backends, metrics *Metrics, interval, probeTimeout, maxBackoff time.Duration) *MountSupervisor {
+	mounts := map[string]*supervisedMount{}
+	for _, backend := range backends.All() {
+		mounts[backend.Name] = &supervisedMount{}
+	}
+	return &MountSupervisor{
+		logger:       logger,
+		backends:     backends,
+		metrics:      metrics,
+		interval:     interval,
+		probeTimeout: probeTimeout,
+		maxBackoff:   maxBackoff,
+		mounts:       mounts,
+	}
+}
+
+func (s *MountSupervisor) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	close(ready)
+	s.Update()
+	for {
+		select {
+		case <-ticker.C:
+			s.Update()
+		case <-signals:
+			return nil
+		}
+	}
+}
+
+// Update probes the mounts of all backends and repairs those which are down.
+func (s *MountSupervisor) Update() {
+	logger := s.logger.Session("supervise-mounts")
+
+	wg := sync.WaitGroup{}
+	for _, backend := range s.backends.All() {
+		wg.Add(1)
+		go func(backend *Backend) {
+			defer wg.Done()
+			s.supervise(logger.Session("backend", lager.Data{"backend": backend.Name}), backend, s.mounts[backend.Name])
+		}(backend)
+	}
+	wg.Wait()
+}
+
+func (s *MountSupervisor) supervise(logger lager.Logger, backend *Backend, mount *supervisedMount) {
+	state, err := s.probe(logger, backend.Client)
+	if err == nil && state == MountStateMounted {
+		if mount.failures > 0 || backend.Client.MountError(logger) != nil {
+			logger.Info("mount-recovered")
+		}
+		s.healthy(logger, backend, mount)
+		return
+	}
+	if err == nil {
+		err = fmt.Errorf("the export is %s", state)
+	}
+	logger.Info("mount-down", lager.Data{"state": state, "error": err.Error()})
+
+	if time.Now().Before(mount.nextAttempt) {
+		s.unhealthy(logger, backend, err)
+		return
+	}
+	// bounded by the timeouts of the client
+	if err := backend.Client.Remount(context.Background(), logger); err != nil {
+		mount.failures++
+		backoff := s.backoff(mount.failures)
+		mount.nextAttempt = time.Now().Add(backoff)
+		logger.Error("failed-to-remount", err, lager.Data{"failures": mount.failures, "retry-in": backoff.String()})
+		s.metrics.AddCounter("nfsbroker_backend_remounts_total", "Attempts to mount the export of a backend again, by result.", 1,
+			"backend", backend.Name, "result", "failure")
+		s.unhealthy(logger, backend, err)
+		return
+	}
+	logger.Info("remounted")
+	s.metrics.AddCounter("nfsbroker_backend_remounts_total", "Attempts to mount the export of a backend again, by result.", 1,
+		"backend", backend.Name, "result", "success")
+	s.healthy(logger, backend, mount)
+}
+
+// probe inspects the mount, a probe hanging on the export is abandoned after the probe timeout.
+func (s *MountSupervisor) probe(logger lager.Logger, client Client) (MountState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.probeTimeout)
+	defer cancel()
+
+	state, err := client.CheckMount(ctx, logger)
+	if isTimeout(err) {
+		logger.Info("probe-timed-out", lager.Data{"timeout": s.probeTimeout.String()})
+	}
+	return state, err
+}
+
+func (s *MountSupervisor) healthy(logger lager.Logger, backend *Backend, mount *supervisedMount) {
+	mount.failures = 0
+	mount.nextAttempt = time.Time{}
+	backend.Client.SetMountError(logger, nil)
+	s.metrics.SetGauge("nfsbroker_backend_mount_healthy", "Whether the export of the backend is mounted and answering.", 1, "backend", backend.Name)
+}
+
+func (s *MountSupervisor) unhealthy(logger lager.Logger, backend *Backend, err error) {
+	backend.Client.SetMountError(logger, err)
+	s.metrics.SetGauge("nfsbroker_backend_mount_healthy", "Whether the export of the backend is mounted and answering.", 0, "backend", backend.Name)
+}
+
+// backoff doubles the probe interval with every failed attempt, up to the maximum backoff.
+func (s *MountSupervisor) backoff(failures int) time.Duration {
+	backoff := s.interval
+	for i := 1; i < failures && backoff < s.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > s.maxBackoff {
+		return s.maxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,195 @@
+package nfsbroker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Mount supervisor", func() {
+	var (
+		tb         testBroker
+		invoker    *fakeInvoker
+		files      *fakeIoutil
+		fs         *fakeOs
+		metrics    *Metrics
+		supervisor *MountSupervisor
+
+		// fails the mount command while set
+		mutex    sync.Mutex
+		mountErr error
+	)
+
+	mounted := func(source string) string {
+		return fmt.Sprintf("36 35 0:42 / %s rw,relatime - nfs %s rw,vers=3", tb.mountPoint, source)
+	}
+
+	commands := func() []string {
+		names := []string{}
+		for _, call := range invoker.Calls() {
+			names = append(names, call[0])
+		}
+		return names
+	}
+
+	sample := func(name string, labels ...string) float64 {
+		for _, sample := range metrics.Samples() {
+			if sample.Name == name && strings.Join(sample.Labels, ",") == strings.Join(labels, ",") {
+				return sample.Value
+			}
+		}
+		return -1
+	}
+
+	failMount := func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		mountErr = err
+	}
+
+	BeforeEach(func() {
+		files = &fakeIoutil{}
+		fs = &fakeOs{}
+		// the commands change the fake mount table as the kernel would
+		invoker = &fakeInvoker{InvokeStub: func(executable string, args []string) error {
+			switch executable {
+			case "umount":
+				files.SetMountInfo("")
+				fs.FailStat("", nil)
+			case "mount":
+				mutex.Lock()
+				defer mutex.Unlock()
+				if mountErr != nil {
+					return mountErr
+				}
+				files.SetMountInfo(mounted("1.2.3.4:/export"))
+			}
+			return nil
+		}}
+		failMount(nil)
+		tb = newTestBroker(newMemoryStore(), invoker, testCatalog())
+		tb.client.mountTable = NewMountTable(files, ProcMountInfo)
+		tb.client.os = fs
+		files.SetMountInfo(mounted("1.2.3.4:/export"))
+
+		metrics = NewMetrics()
+		supervisor = NewMountSupervisor(tb.logger, tb.backends, metrics, time.Minute, time.Second, 10*time.Minute)
+	})
+
+	AfterEach(func() {
+		tb.cleanup()
+	})
+
+	It("leaves a healthy mount alone", func() {
+		supervisor.Update()
+
+		Expect(invoker.Calls()).To(BeEmpty())
+		Expect(tb.client.MountError(tb.logger)).NotTo(HaveOccurred())
+		Expect(sample("nfsbroker_backend_mount_healthy", "backend", DefaultBackendName)).To(Equal(1.0))
+	})
+
+	It("lazily unmounts a stale mount and mounts the export again", func() {
+		fs.FailStat(tb.mountPoint, syscall.ESTALE)
+
+		supervisor.Update()
+
+		Expect(invoker.Calls()).To(Equal([][]string{
+			{"umount", "-l", tb.mountPoint},
+			{"mount", "-o", DefaultNfsV3, "1.2.3.4:/export", tb.mountPoint},
+		}))
+		Expect(tb.client.MountError(tb.logger)).NotTo(HaveOccurred())
+		Expect(sample("nfsbroker_backend_remounts_total", "backend", DefaultBackendName, "result", "success")).To(Equal(1.0))
+		Expect(sample("nfsbroker_backend_mount_healthy", "backend", DefaultBackendName)).To(Equal(1.0))
+	})
+
+	It("replaces the mount of another export", func() {
+		files.SetMountInfo(mounted("10.0.0.9:/other"))
+
+		supervisor.Update()
+
+		Expect(commands()).To(Equal([]string{"umount", "mount"}))
+		Expect(tb.client.CheckMount(context.Background(), tb.logger)).To(Equal(MountStateMounted))
+	})
+
+	It("mounts an export which is not mounted", func() {
+		files.SetMountInfo("")
+
+		supervisor.Update()
+
+		Expect(commands()).To(Equal([]string{"mount"}))
+		Expect(tb.client.IsFilesystemMounted(tb.logger)).To(BeTrue())
+	})
+
+	It("remounts an export whose mount point cannot be inspected", func() {
+		fs.FailStat(tb.mountPoint, syscall.EIO)
+
+		supervisor.Update()
+
+		Expect(commands()).To(Equal([]string{"umount", "mount"}))
+		Expect(tb.client.MountError(tb.logger)).NotTo(HaveOccurred())
+	})
+
+	Context("when the export cannot be mounted", func() {
+		BeforeEach(func() {
+			files.SetMountInfo("")
+			failMount(errors.New("mount.nfs: Connection timed out"))
+			supervisor.Update()
+		})
+
+		It("makes requests fail fast instead of mounting the export again", func() {
+			Expect(commands()).To(Equal([]string{"mount"}))
+			Expect(tb.client.MountError(tb.logger)).To(MatchError("nfs export '1.2.3.4:/export' is unavailable: mount.nfs: Connection timed out"))
+			Expect(sample("nfsbroker_backend_remounts_total", "backend", DefaultBackendName, "result", "failure")).To(Equal(1.0))
+			Expect(sample("nfsbroker_backend_mount_healthy", "backend", DefaultBackendName)).To(Equal(0.0))
+
+			Expect(ensureMounted(context.Background(), tb.logger, tb.client)).To(MatchError(ContainSubstring("is unavailable")))
+			_, err := tb.Provision("instance", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id"}, false)
+			Expect(err).To(Equal(brokerapi.ErrInstanceLimitMet))
+			Expect(commands()).To(Equal([]string{"mount"}))
+		})
+
+		It("backs off before the next attempt", func() {
+			supervisor.Update()
+			Expect(commands()).To(Equal([]string{"mount"}))
+			Expect(supervisor.mounts[DefaultBackendName].failures).To(Equal(1))
+			Expect(supervisor.mounts[DefaultBackendName].nextAttempt).To(BeTemporally("~", time.Now().Add(time.Minute), time.Second))
+
+			supervisor.mounts[DefaultBackendName].nextAttempt = time.Time{}
+			supervisor.Update()
+			Expect(commands()).To(Equal([]string{"mount", "mount"}))
+			Expect(supervisor.mounts[DefaultBackendName].failures).To(Equal(2))
+			Expect(supervisor.mounts[DefaultBackendName].nextAttempt).To(BeTemporally("~", time.Now().Add(2*time.Minute), time.Second))
+		})
+
+		It("lets requests through again once the export is mounted", func() {
+			failMount(nil)
+			supervisor.mounts[DefaultBackendName].nextAttempt = time.Time{}
+			supervisor.Update()
+
+			Expect(supervisor.mounts[DefaultBackendName].failures).To(BeZero())
+			Expect(tb.client.MountError(tb.logger)).NotTo(HaveOccurred())
+			Expect(sample("nfsbroker_backend_mount_healthy", "backend", DefaultBackendName)).To(Equal(1.0))
+			tb.InspectBackends()
+			_, err := tb.Provision("instance", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id"}, false)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	It("doubles the backoff with every failed attempt up to the maximum", func() {
+		supervisor = NewMountSupervisor(tb.logger, tb.backends, metrics, time.Second, time.Second, 5*time.Second)
+		backoffs := []time.Duration{}
+		for failures := 1; failures <= 5; failures++ {
+			backoffs = append(backoffs, supervisor.backoff(failures))
+		}
+		Expect(backoffs).To(Equal([]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}))
+	})
+})
@@ -0,0 +1,164 @@
+package nfsbroker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"code.cloudfoundry.org/goshims/ioutil"
+	"code.cloudfoundry.org/lager"
+)
+
+// ProcMountInfo is the mount table of the mount namespace of the broker.
+const ProcMountInfo = "/proc/self/mountinfo"
+
+// MountState is what the mount table says about the mount point of an export.
+type MountState string
+
+const (
+	MountStateMounted    MountState = "mounted"
+	MountStateNotMounted MountState = "not-mounted"
+	// something else is mounted on the mount point
+	MountStateWrongExport MountState = "wrong-export"
+	// the export is mounted but its file handle is no longer valid, typically after a server failover
+	MountStateStale MountState = "stale"
+)
+
+// MountInfo is an entry of the mount table.
+type MountInfo struct {
+	MountPoint string
+	// such as "10.0.0.1:/export" for nfs
+	Source string
+	FsType string
+	// options of the mount point followed by those of the filesystem
+	Options []string
+}
+
+// MountTable reads the mounts of the broker.
+type MountTable interface {
+	Mounts(logger lager.Logger) ([]MountInfo, error)
+	// Lookup returns the topmost mount on a mount point.
+	Lookup(logger lager.Logger, mountPoint string) (MountInfo, bool, error)
+}
+
+type mountTable struct {
+	ioutil ioutilshim.Ioutil
+	path   string
+}
+
+// NewMountTable reads the mount table from a mountinfo file such as ProcMountInfo.
+func NewMountTable(ioutil ioutilshim.Ioutil, mountInfoPath string) MountTable {
+	return &mountTable{ioutil: ioutil, path: mountInfoPath}
+}
+
+func (t *mountTable) Mounts(logger lager.Logger) ([]MountInfo, error) {
+	data, err := t.ioutil.ReadFile(t.path)
+	if err != nil {
+		logger.Error("failed-to-read-mount-table", err, lager.Data{"path": t.path})
+		return nil, fmt.Errorf("failed to read the mount table '%s'", t.path)
+	}
+	mounts, err := ParseMountInfo(string(data))
+	if err != nil {
+		logger.Error("failed-to-parse-mount-table", err, lager.Data{"path": t.path})
+		return nil, err
+	}
+	return mounts, nil
+}
+
+func (t *mountTable) Lookup(logger lager.Logger, mountPoint string) (MountInfo, bool, error) {
+	mounts, err := t.Mounts(logger)
+	if err != nil {
+		return MountInfo{}, false, err
+	}
+	mountPoint = filepath.Clean(mountPoint)
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if mounts[i].MountPoint == mountPoint {
+			return mounts[i], true, nil
+		}
+	}
+	return MountInfo{}, false, nil
+}
+
+// ParseMountInfo parses the lines of a mountinfo file, described in proc(5):
+// "36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue".
+func ParseMountInfo(mountInfo string) ([]MountInfo, error) {
+	mounts := []MountInfo{}
+	for i, line := range strings.Split(mountInfo, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		separator := -1
+		for j := 6; j < len(fields); j++ {
+			if fields[j] == "-" {
+				separator = j
+				break
+			}
+		}
+		if separator < 0 || len(fields) < separator+3 {
+			return nil, fmt.Errorf("invalid mountinfo line %d", i+1)
+		}
+		mount := MountInfo{
+			MountPoint: unescapeMountInfo(fields[4]),
+			FsType:     fields[separator+1],
+			Source:     unescapeMountInfo(fields[separator+2]),
+			Options:    strings.Split(fields[5], ","),
+		}
+		if len(fields) > separator+3 {
+			mount.Options = append(mount.Options, strings.Split(fields[separator+3], ",")...)
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+// unescapeMountInfo decodes the octal escapes of spaces, tabs, newlines and backslashes in mountinfo fields.
+func unescapeMountInfo(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	unescaped := []byte{}
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+4 <= len(field) {
+			if value, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				unescaped = append(unescaped, byte(value))
+				i += 3
+				continue
+			}
+		}
+		unescaped = append(unescaped, field[i])
+	}
+	return string(unescaped)
+}
+
+// Option returns the value of a mount option, such as the vers option of an nfs mount.
+func (m MountInfo) Option(name string) (string, bool) {
+	for _, option := range m.Options {
+		if option == name {
+			return "", true
+		}
+		if strings.HasPrefix(option, name+"=") {
+			return strings.TrimPrefix(option, name+"="), true
+		}
+	}
+	return "", false
+}
+
+// sameExport compares nfs sources such as "10.0.0.1:/export", ignoring trailing slashes of the path.
+func sameExport(source, export string) bool {
+	i, j := strings.Index(source, ":/"), strings.Index(export, ":/")
+	if i < 0 || j < 0 {
+		return source == export
+	}
+	return source[:i] == export[:j] && filepath.Clean(source[i+1:]) == filepath.Clean(export[j+1:])
+}
+
+func isStaleHandle(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+	return err == syscall.ESTALE
+}
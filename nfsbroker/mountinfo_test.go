@@ -0,0 +1,234 @@
+package nfsbroker
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+
+	"code.cloudfoundry.org/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Mount table", func() {
+	var logger lager.Logger
+
+	BeforeEach(func() {
+		logger = lager.NewLogger("mountinfo-test")
+	})
+
+	Describe("ParseMountInfo", func() {
+		It("parses the entries of a mountinfo file", func() {
+			for _, entry := range []struct {
+				line  string
+				mount MountInfo
+			}{
+				{
+					line:  "36 35 0:42 / /var/vcap/data/nfsbroker rw,relatime shared:1 - nfs4 10.0.0.1:/export rw,vers=4.1,addr=10.0.0.1",
+					mount: MountInfo{MountPoint: "/var/vcap/data/nfsbroker", Source: "10.0.0.1:/export", FsType: "nfs4", Options: []string{"rw", "relatime", "rw", "vers=4.1", "addr=10.0.0.1"}},
+				},
+				{
+					line:  "36 35 0:42 / /mnt ro - nfs 10.0.0.1:/export rw",
+					mount: MountInfo{MountPoint: "/mnt", Source: "10.0.0.1:/export", FsType: "nfs", Options: []string{"ro", "rw"}},
+				},
+				{
+					line:  "36 35 0:42 / /mnt rw shared:1 master:2 propagate_from:3 - tmpfs tmpfs",
+					mount: MountInfo{MountPoint: "/mnt", Source: "tmpfs", FsType: "tmpfs", Options: []string{"rw"}},
+				},
+				{
+					line:  `36 35 0:42 / /mnt/my\040share\011tab rw - nfs 10.0.0.1:/export\040one\134two rw`,
+					mount: MountInfo{MountPoint: "/mnt/my share\ttab", Source: `10.0.0.1:/export one\two`, FsType: "nfs", Options: []string{"rw", "rw"}},
+				},
+				{
+					line:  `36 35 0:42 / /mnt/new\012line\x\04 rw - nfs 10.0.0.1:/export rw`,
+					mount: MountInfo{MountPoint: "/mnt/new\nline\\x\\04", Source: "10.0.0.1:/export", FsType: "nfs", Options: []string{"rw", "rw"}},
+				},
+			} {
+				mounts, err := ParseMountInfo(entry.line + "\n")
+				Expect(err).NotTo(HaveOccurred(), entry.line)
+				Expect(mounts).To(Equal([]MountInfo{entry.mount}), entry.line)
+			}
+		})
+
+		It("skips blank lines", func() {
+			mounts, err := ParseMountInfo("\n36 35 0:42 / /a rw - nfs 10.0.0.1:/a rw\n  \n37 35 0:43 / /b rw - nfs 10.0.0.1:/b rw\n")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mounts).To(HaveLen(2))
+			Expect(mounts[1].MountPoint).To(Equal("/b"))
+		})
+
+		It("rejects lines without a filesystem type and source", func() {
+			for _, line := range []string{
+				"36 35 0:42 / /mnt rw nfs 10.0.0.1:/export rw",
+				"36 35 0:42 / /mnt rw -",
+				"36 35 0:42 / /mnt rw - nfs",
+				"36 35 0:42 - /mnt rw nfs 10.0.0.1:/export",
+			} {
+				_, err := ParseMountInfo("36 35 0:42 / /ok rw - nfs 10.0.0.1:/ok rw\n" + line)
+				Expect(err).To(MatchError("invalid mountinfo line 2"), line)
+			}
+		})
+
+		It("looks up values and flags of the options", func() {
+			mount := MountInfo{Options: []string{"rw", "vers=4.1", "addr=10.0.0.1"}}
+			for _, option := range []struct {
+				name  string
+				value string
+				found bool
+			}{
+				{"vers", "4.1", true},
+				{"rw", "", true},
+				{"ver", "", false},
+				{"ro", "", false},
+			} {
+				value, found := mount.Option(option.name)
+				Expect(value).To(Equal(option.value), option.name)
+				Expect(found).To(Equal(option.found), option.name)
+			}
+		})
+	})
+
+	Describe("Lookup", func() {
+		var (
+			files *fakeIoutil
+			table MountTable
+		)
+
+		BeforeEach(func() {
+			files = &fakeIoutil{}
+			table = NewMountTable(files, ProcMountInfo)
+		})
+
+		It("returns the topmost of stacked mounts", func() {
+			files.SetMountInfo(strings.Join([]string{
+				"36 35 0:42 / /mnt rw - nfs4 10.0.0.1:/export rw",
+				"37 35 0:43 / /other rw - nfs4 10.0.0.1:/other rw",
+				"38 36 0:44 / /mnt rw - tmpfs tmpfs rw",
+			}, "\n"))
+
+			mount, found, err := table.Lookup(logger, "/mnt")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(BeTrue())
+			Expect(mount.FsType).To(Equal("tmpfs"))
+		})
+
+		It("finds a mount point given with a trailing slash", func() {
+			files.SetMountInfo("36 35 0:42 / /var/vcap/data/nfsbroker rw - nfs4 10.0.0.1:/export rw")
+
+			for _, mountPoint := range []string{"/var/vcap/data/nfsbroker/", "/var/vcap/data//nfsbroker"} {
+				_, found, err := table.Lookup(logger, mountPoint)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(found).To(BeTrue(), mountPoint)
+			}
+			_, found, err := table.Lookup(logger, "/var/vcap/data")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(BeFalse())
+		})
+
+		It("fails on a mount table which cannot be parsed", func() {
+			files.SetMountInfo("36 35 0:42 / /mnt rw")
+			_, _, err := table.Lookup(logger, "/mnt")
+			Expect(err).To(MatchError("invalid mountinfo line 1"))
+		})
+	})
+
+	Describe("sameExport", func() {
+		It("ignores trailing slashes of the export path only", func() {
+			for _, export := range []struct {
+				source string
+				same   bool
+			}{
+				{"10.0.0.1:/export", true},
+				{"10.0.0.1:/export/", true},
+				{"10.0.0.1://export//", true},
+				{"[fe80::1]:/export", false},
+				{"10.0.0.2:/export", false},
+				{"10.0.0.1:/export/share", false},
+				{"10.0.0.1:/exports", false},
+				{"10.0.0.1", false},
+			} {
+				Expect(sameExport(export.source, "10.0.0.1:/export/")).To(Equal(export.same), export.source)
+			}
+			Expect(sameExport("[fe80::1]:/export/", "[fe80::1]:/export")).To(BeTrue())
+		})
+	})
+
+	Describe("CheckMount", func() {
+		var (
+			files      *fakeIoutil
+			fs         *fakeOs
+			invoker    *fakeInvoker
+			mountPoint string
+			client     Client
+		)
+
+		mountInfo := func(fsType, source string) string {
+			escaped := strings.Replace(mountPoint, " ", `\040`, -1)
+			return fmt.Sprintf("36 35 0:42 / %s rw,relatime - %s %s rw", escaped, fsType, source)
+		}
+
+		BeforeEach(func() {
+			var err error
+			// mountinfo escapes the space in the mount point
+			mountPoint, err = ioutil.TempDir("", "nfs broker")
+			Expect(err).NotTo(HaveOccurred())
+			files = &fakeIoutil{}
+			fs = &fakeOs{}
+			invoker = &fakeInvoker{}
+			client = NewNfsClientWithInfokerAndFileUtil("10.0.0.1", "/export", 4, nil, nil, invoker, mountPoint, fs, files, nil, &noopSnapshotDriver{}, ClientTimeouts{})
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(mountPoint)
+		})
+
+		It("tells the state of the mount point from the mount table", func() {
+			for _, entry := range []struct {
+				mountInfo string
+				state     MountState
+			}{
+				{"", MountStateNotMounted},
+				{mountInfo("nfs4", "10.0.0.1:/export"), MountStateMounted},
+				{mountInfo("nfs", "10.0.0.1:/export/"), MountStateMounted},
+				{mountInfo("nfs4", "10.0.0.2:/export"), MountStateWrongExport},
+				{mountInfo("nfs4", "10.0.0.1:/other"), MountStateWrongExport},
+				{mountInfo("ext4", "/dev/sda1"), MountStateWrongExport},
+				{mountInfo("nfs4", "10.0.0.1:/export") + "\n" + mountInfo("tmpfs", "tmpfs"), MountStateWrongExport},
+				{mountInfo("tmpfs", "tmpfs") + "\n" + mountInfo("nfs4", "10.0.0.1:/export"), MountStateMounted},
+			} {
+				files.SetMountInfo(entry.mountInfo)
+				state, err := client.CheckMount(context.Background(), logger)
+				Expect(err).NotTo(HaveOccurred(), entry.mountInfo)
+				Expect(state).To(Equal(entry.state), entry.mountInfo)
+			}
+		})
+
+		It("reports a mount point with a stale file handle as stale", func() {
+			files.SetMountInfo(mountInfo("nfs4", "10.0.0.1:/export"))
+			fs.FailStat(mountPoint, syscall.ESTALE)
+
+			state, err := client.CheckMount(context.Background(), logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state).To(Equal(MountStateStale))
+		})
+
+		It("fails when the mount point cannot be inspected for another reason", func() {
+			files.SetMountInfo(mountInfo("nfs4", "10.0.0.1:/export"))
+			for _, statErr := range []error{syscall.EIO, syscall.EACCES} {
+				fs.FailStat(mountPoint, statErr)
+
+				_, err := client.CheckMount(context.Background(), logger)
+				Expect(err).To(MatchError(fmt.Sprintf("failed to inspect the mount point '%s'", mountPoint)), statErr.Error())
+			}
+
+			_, err := client.MountFileSystem(context.Background(), logger, "/")
+			Expect(err).To(HaveOccurred())
+			Expect(client.IsFilesystemMounted(logger)).To(BeFalse())
+			Expect(invoker.Calls()).To(BeEmpty())
+		})
+	})
+})
@@ -1,23 +1,41 @@
 package nfsbroker
 
 import (
+	"context"
 	"github.com/pivotal-cf/brokerapi"
 	"code.cloudfoundry.org/lager"
-	"code.cloudfoundry.org/goshims/ioutil"
-	"sync"
-	"path/filepath"
 	"fmt"
 	"encoding/json"
-	"os"
 	"reflect"
 	"code.cloudfoundry.org/voldriver"
 	"errors"
+	"net/http"
 	"path"
+	"sync"
+	"time"
 )
 
 const (
 	DefaultContainerDir = "/var/vcap/data"
 	PermissionVolumeMount = brokerapi.RequiredPermission("volume_mount")
+
+	OperationProvision   = "provision"
+	OperationDeprovision = "deprovision"
+	OperationUpdate      = "update"
+)
+
+var (
+	// the platform is told to retry a request which conflicts with an operation in progress
+	ErrOperationInProgress error = brokerapi.NewFailureResponseBuilder(errors.New("an operation for this instance is still in progress"),
+		http.StatusUnprocessableEntity, "operation-in-progress").WithErrorKey("ConcurrencyError").Build()
+	// the platform polls for an operation which was superseded by a later operation of the instance
+	ErrOperationSuperseded error = brokerapi.NewFailureResponse(errors.New("the requested operation is not the last operation of this instance"),
+		http.StatusBadRequest, "operation-superseded")
+	// the platform polls for a deprovision which finished, the instance and its operation are gone
+	ErrInstanceGone error = brokerapi.NewFailureResponseBuilder(brokerapi.ErrInstanceDoesNotExist,
+		http.StatusGone, "instance-gone").WithEmptyResponse().Build()
+	// another broker sharing the store allocated the same quota project id at the same time
+	ErrProjectIdInUse = errors.New("the quota project id allocated to the instance is in use by another instance, retry the request")
 )
 
 type lock interface {
@@ -25,55 +43,72 @@ type lock interface {
 	Unlock()
 }
 
-type serviceMetadata struct{
-	DisplayName         string `json:"displayName,omitempty"`
-	ImageUrl            string `json:"imageUrl,omitempty"`
-	LongDescription     string `json:"longDescription,omitempty"`
-	ProviderDisplayName string `json:"providerDisplayName,omitempty"`
-	DocumentationUrl    string `json:"documentationUrl,omitempty"`
-	SupportUrl          string `json:"supportUrl,omitempty"`
-}
-
-type serviceDetails struct {
-	ServiceName string     `json:"ServiceName"`
-	ServiceId   string     `json:"ServiceId"`
-	PlanName    string     `json:"PlanName"`
-	PlanId      string     `json:"PlanId"`
-	PlanDesc    string     `json:"PlanDesc"`
-}
-
-type serviceMap struct {
-	InstanceMap map[string]brokerapi.ProvisionDetails
-	BindingMap map[string]brokerapi.BindDetails
-}
-
 type broker struct {
 	logger          lager.Logger
-	controller      Controller
-	dataDir         string
-	ioutil          ioutilshim.Ioutil
-	mutex           lock
-	sd              serviceDetails
-	sm              serviceMap
-	sMetadata       serviceMetadata
+	backends        *Backends
+	store           Store
+	// serializes the requests of an instance, also across brokers sharing a store, the store guards its own records
+	locks           *instanceLocks
+	catalog         Catalog
+	shareNamer      *ShareNamer
+	tenantLimits    *TenantLimits
+	reservations    *tenantReservations
+	placements      *placements
+	// outcomes of the health checks last run, served by the health endpoints
+	health          *healthChecks
+	kdc             KdcAdapter
+	requests        *requestContexts
+	// serializes the allocation of quota project ids within this broker, brokers sharing a store hold a lease
+	projectIds      sync.Mutex
+	brokerID        string
+	// deadline of the calls to the backends made for a request or an asynchronous operation
+	operationTimeout time.Duration
 }
 
-func New(logger lager.Logger, controller Controller, serviceName,serviceId,planName,planId,planDesc,displayName,imageUrl,dataDir string,ioutil ioutilshim.Ioutil) *broker {
+// New creates the service broker, brokerID identifies this broker among the brokers sharing a store.
+// Without tenantLimits organizations and spaces are not limited, without kdc no kerberos principals are issued.
+// The calls to the backends made for a request or an asynchronous operation fail once operationTimeout has passed, 0 leaves them
+// bounded by the timeouts of the clients only.
+// It fails when a plan is pinned to an unknown backend, when a plan needs a missing kdc or when the persisted state cannot be restored.
+func New(logger lager.Logger, backends *Backends, catalog Catalog, store Store, shareNamer *ShareNamer, tenantLimits *TenantLimits, kdc KdcAdapter, brokerID string, operationTimeout time.Duration) (*broker, error) {
+	if kdc == nil {
+		kdc = &noopKdcAdapter{}
+	}
+	_, kerberosDisabled := kdc.(*noopKdcAdapter)
+	for _, plan := range catalog.Plans {
+		if _, err := backends.Get(plan.Settings.Backend); err != nil {
+			return nil, fmt.Errorf("plan '%s' is pinned to unknown backend '%s'", plan.Name, plan.Settings.Backend)
+		}
+		if plan.Settings.Kerberos != "" && kerberosDisabled {
+			return nil, fmt.Errorf("plan '%s' issues kerberos principals but no kdc is configured", plan.Name)
+		}
+	}
 	selfBroker := broker{
 		logger:      logger,
-		controller:  controller,
-		dataDir:     dataDir,
-		ioutil:      ioutil,
-		mutex:       &sync.Mutex{},
-		sd:          serviceDetails{serviceName,serviceId,planName,planId,planDesc},
-		sm:          serviceMap{
-			InstanceMap: map[string]brokerapi.ProvisionDetails{},
-			BindingMap : map[string]brokerapi.BindDetails{},
-		},
-		sMetadata: serviceMetadata{displayName, imageUrl, "This is storage volume service to mount application and shared", displayName, "https://github.com/cloudfoundry-incubator/volman", "https://github.com/cloudfoundry-incubator/volman"},
+		backends:    backends,
+		store:       store,
+		locks:       newInstanceLocks(store, logger),
+		catalog:     catalog,
+		shareNamer:  shareNamer,
+		tenantLimits: tenantLimits,
+		reservations: newTenantReservations(),
+		placements:  newPlacements(),
+		health:      newHealthChecks(),
+		kdc:         kdc,
+		requests:    newRequestContexts(),
+		brokerID:    brokerID,
+		operationTimeout: operationTimeout,
 	}
-	selfBroker.restoreServiceMap()
-	return &selfBroker
+	if err := selfBroker.restoreState(); err != nil {
+		return nil, err
+	}
+	return &selfBroker, nil
+}
+
+// operationContext bounds the calls to the backends made for a request or an asynchronous operation.
+func (b *broker) operationContext() (context.Context, context.CancelFunc) {
+	ctx, cancel, _ := withTimeout(context.Background(), b.operationTimeout)
+	return ctx, cancel
 }
 
 //https://github.com/pivotal-cf/brokerapi/blob/master/catalog.go
@@ -82,59 +117,166 @@ func (b *broker) Services() []brokerapi.Service {
 	logger.Info("start")
 	defer logger.Info("end")
 
+	plans := []brokerapi.ServicePlan{}
+	for _, plan := range b.catalog.Plans {
+		plans = append(plans, brokerapi.ServicePlan{
+			ID:          plan.Id,
+			Name:        plan.Name,
+			Description: plan.Description,
+			Free:        plan.Free,
+			Metadata:    plan.Metadata,
+		})
+	}
+
+	metadata := brokerapi.ServiceMetadata(b.catalog.Metadata)
 	return []brokerapi.Service{{
-		ID:            b.sd.ServiceId,
-		Name:          b.sd.ServiceName,
-		Description:   fmt.Sprintf("%s service docs: https://github.com/cloudfoundry-incubator/volman", b.sd.ServiceName, b.sd.ServiceName),
+		ID:            b.catalog.ServiceId,
+		Name:          b.catalog.ServiceName,
+		Description:   b.catalog.description(),
 		Bindable:      true,
-		Tags:          []string{b.sd.ServiceName},
-		PlanUpdatable: false,
-		Plans:         []brokerapi.ServicePlan{{
-			ID:          b.sd.PlanId,
-			Name:        b.sd.PlanName,
-			Description: b.sd.PlanDesc,
-			Free:        new(bool), //not is true,is new(bool)
-		}},
+		Tags:          b.catalog.tags(),
+		PlanUpdatable: b.catalog.planUpdatable(),
+		Plans:         plans,
 		Requires:      []brokerapi.RequiredPermission{PermissionVolumeMount},
-		Metadata:      &brokerapi.ServiceMetadata{
-			DisplayName:         b.sMetadata.DisplayName,
-			ImageUrl:            b.sMetadata.ImageUrl,
-			LongDescription:     b.sMetadata.LongDescription,
-			ProviderDisplayName: b.sMetadata.ProviderDisplayName,
-			DocumentationUrl:    b.sMetadata.DocumentationUrl,
-			SupportUrl:          b.sMetadata.SupportUrl,
-		},
+		Metadata:      &metadata,
 	}}
 }
+
 //https://github.com/pivotal-cf/brokerapi/blob/0ea2a3913c148837e8615a1ef8bde757151934c3/api.go#L77
 func (b *broker) Provision(instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
 	logger := b.logger.Session("privision")
 	logger.Info("start")
 	defer logger.Info("end")
 
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	if _, ok := b.catalog.Plan(details.PlanID); !ok {
+		logger.Error("plan-does-not-exist", ErrPlanDoesNotExist, lager.Data{"plan-id": details.PlanID})
+		return brokerapi.ProvisionedServiceSpec{}, ErrPlanDoesNotExist
+	}
 
-	defer b.serialize(b.sm)
+	requestContext := b.requests.get(instanceID)
+	if requestContext.OrganizationGUID == "" && requestContext.SpaceGUID == "" {
+		requestContext.OrganizationGUID = details.OrganizationGUID
+		requestContext.SpaceGUID = details.SpaceGUID
+	}
 
-	if b.instanceConflicts(details, instanceID) {
-		logger.Error("instance-already-exists", brokerapi.ErrInstanceAlreadyExists)
-		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceAlreadyExists
+	// the source of a clone is held before the instance is locked, the hold is released here unless the share
+	// is being copied, which releases it once done
+	sourceID, err := cloneFrom(details.RawParameters)
+	if err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
 	}
+	var source Metadata
+	held := ""
+	if sourceID != "" {
+		if _, err := b.store.RetrieveInstanceDetails(logger, instanceID); err == brokerapi.ErrInstanceDoesNotExist {
+			source, err = b.holdCloneSource(logger, instanceID, sourceID, requestContext)
+			if err != nil {
+				return brokerapi.ProvisionedServiceSpec{}, err
+			}
+			held = sourceID
+		}
+	}
+	defer func() { b.releaseCloneSource(logger, instanceID, held) }()
 
-	//create service instances
-	errResp := b.controller.Create(logger, voldriver.CreateRequest{
-		Name:    instanceID,
-		Opts:    map[string]interface{}{"volume_id": instanceID} ,
-	})
+	instanceLock := b.locks.forInstance(instanceID)
+	instanceLock.Lock()
 
-	if errResp.Err != "" {
-		err := errors.New(errResp.Err)
-		logger.Error("provision-create-failed", err)
+	existing, err := b.store.RetrieveInstanceDetails(logger, instanceID)
+	if err == nil {
+		op, opErr := b.store.RetrieveOperation(logger, instanceID)
+		instanceLock.Unlock()
+		if !reflect.DeepEqual(details, existing) {
+			logger.Error("instance-already-exists", brokerapi.ErrInstanceAlreadyExists)
+			return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceAlreadyExists
+		}
+		if opErr == nil && op.State == brokerapi.InProgress {
+			if op.Type == OperationProvision && asyncAllowed {
+				return brokerapi.ProvisionedServiceSpec{IsAsync: true, OperationData: OperationProvision}, nil
+			}
+			return brokerapi.ProvisionedServiceSpec{}, ErrOperationInProgress
+		}
+		return brokerapi.ProvisionedServiceSpec{}, nil
+	}
+	if err != brokerapi.ErrInstanceDoesNotExist {
+		instanceLock.Unlock()
+		logger.Error("failed-to-retrieve-instance", err)
 		return brokerapi.ProvisionedServiceSpec{}, err
 	}
 
-	b.sm.InstanceMap[instanceID] = details
+	options, err := b.evaluateShareOptions(logger, details.PlanID, details.RawParameters)
+	if err != nil {
+		instanceLock.Unlock()
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+	if err := b.reserveTenantLimits(logger, instanceID, details, options.Quota, true); err != nil {
+		instanceLock.Unlock()
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+
+	metadata := Metadata{Context: requestContext}
+	metadata.ShareName, err = b.shareNamer.Name(instanceID, metadata.Context)
+	if err != nil {
+		instanceLock.Unlock()
+		b.releaseTenantReservation(instanceID)
+		logger.Error("failed-to-name-share", err)
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+	sourceShareName := ""
+	if sourceID != "" {
+		// the instance was deleted after it was found to exist, the source is not held
+		if held == "" {
+			instanceLock.Unlock()
+			b.releaseTenantReservation(instanceID)
+			return brokerapi.ProvisionedServiceSpec{}, ErrOperationInProgress
+		}
+		sourceShareName = cloneSource(sourceID, source, &metadata)
+	}
+	backend, err := b.placeInstance(logger, instanceID, details, &metadata, options.Quota)
+	if err != nil {
+		instanceLock.Unlock()
+		b.releaseTenantReservation(instanceID)
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+	// once the instance and its metadata are stored they count towards its backend
+	defer b.placements.release(instanceID)
+	description := "creating share"
+	if metadata.ClonedFrom != "" {
+		description = fmt.Sprintf("cloning share of instance '%s'", metadata.ClonedFrom)
+	}
+
+	// reserve the instance so that concurrent requests see it while the share is being created
+	err = b.store.CreateInstanceDetails(logger, instanceID, details)
+	if err != nil {
+		instanceLock.Unlock()
+		b.releaseTenantReservation(instanceID)
+		logger.Error("failed-to-store-instance", err)
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+	err = b.saveNewInstanceMetadata(logger, instanceID, &metadata)
+	if err == nil {
+		err = b.store.StartOperation(logger, instanceID, b.operation(OperationProvision, brokerapi.InProgress, description))
+	}
+	if err != nil {
+		b.releaseInstance(logger, instanceID)
+		instanceLock.Unlock()
+		b.releaseTenantReservation(instanceID)
+		logger.Error("failed-to-store-operation", err)
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+	instanceLock.Unlock()
+	b.audit("provision", instanceID, metadata)
+	options.ProjectId = metadata.ProjectId
+
+	held = ""
+
+	if asyncAllowed {
+		go b.provision(logger, instanceID, backend, metadata.ShareName, metadata.ClonedFrom, sourceShareName, options)
+		return brokerapi.ProvisionedServiceSpec{IsAsync: true, OperationData: OperationProvision}, nil
+	}
+
+	if err := b.provision(logger, instanceID, backend, metadata.ShareName, metadata.ClonedFrom, sourceShareName, options); err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
 	return brokerapi.ProvisionedServiceSpec{}, nil
 }
 
@@ -144,28 +286,110 @@ func (b *broker) Deprovision(instanceID string, details brokerapi.DeprovisionDet
 	logger.Info("start")
 	defer logger.Info("end")
 
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	instanceLock := b.locks.forInstance(instanceID)
+	instanceLock.Lock()
 
-	defer b.serialize(b.sm)
+	if _, err := b.store.RetrieveInstanceDetails(logger, instanceID); err != nil {
+		instanceLock.Unlock()
+		return brokerapi.DeprovisionServiceSpec{}, err
+	}
+	metadata, err := b.metadata(logger, instanceID)
+	if err != nil {
+		instanceLock.Unlock()
+		return brokerapi.DeprovisionServiceSpec{}, err
+	}
+	backend, err := b.backend(logger, metadata)
+	if err != nil {
+		instanceLock.Unlock()
+		return brokerapi.DeprovisionServiceSpec{}, err
+	}
+
+	err = b.startOperation(logger, instanceID, b.operation(OperationDeprovision, brokerapi.InProgress, "deleting share"))
+	instanceLock.Unlock()
+	if err != nil {
+		logger.Error("failed-to-store-operation", err)
+		return brokerapi.DeprovisionServiceSpec{}, err
+	}
+	b.audit("deprovision", instanceID, b.withRequestIdentity(instanceID, metadata))
+
+	if asyncAllowed {
+		go b.deprovision(logger, instanceID, backend, metadata.ShareName, metadata.ProjectId)
+		return brokerapi.DeprovisionServiceSpec{IsAsync: true, OperationData: OperationDeprovision}, nil
+	}
 
-	if _,ok := b.sm.InstanceMap[instanceID];!ok {
-		return brokerapi.DeprovisionServiceSpec{},brokerapi.ErrInstanceDoesNotExist
+	if err := b.deprovision(logger, instanceID, backend, metadata.ShareName, metadata.ProjectId); err != nil {
+		return brokerapi.DeprovisionServiceSpec{}, err
 	}
+	return brokerapi.DeprovisionServiceSpec{}, nil
+}
 
-	errResp := b.controller.Remove(logger, voldriver.RemoveRequest{
-		Name:  instanceID,
+// provision creates the share for a reserved instance, as a copy of the share of the source instance when it
+// is cloned, without holding the instance lock and records the outcome of the operation.
+func (b *broker) provision(logger lager.Logger, instanceID string, backend *Backend, shareName, sourceID, sourceShareName string, options ShareOptions) error {
+	ctx, cancel := b.operationContext()
+	defer cancel()
+	defer b.releaseTenantReservation(instanceID)
+
+	errResp := backend.Controller.Create(ctx, logger, voldriver.CreateRequest{
+		Name:    shareName,
+		Opts:    map[string]interface{}{"volume_id": instanceID, shareOptionsOpt: options, cloneFromOpt: sourceShareName} ,
 	})
+	b.releaseCloneSource(logger, instanceID, sourceID)
+
+	instanceLock := b.locks.forInstance(instanceID)
+	instanceLock.Lock()
+	defer instanceLock.Unlock()
 
 	if errResp.Err != "" {
 		err := errors.New(errResp.Err)
-		logger.Error("provision-remove-failed", err)
-		return brokerapi.DeprovisionServiceSpec{}, err
+		logger.Error("provision-create-failed", err)
+		b.releaseInstance(logger, instanceID)
+		b.finishOperation(logger, instanceID, b.operation(OperationProvision, brokerapi.Failed, errResp.Err))
+		return err
 	}
 
-	delete(b.sm.InstanceMap, instanceID)
+	return b.finishOperation(logger, instanceID, b.operation(OperationProvision, brokerapi.Succeeded, "share created"))
+}
 
-	return brokerapi.DeprovisionServiceSpec{}, nil
+// deprovision removes the share of an instance without holding the instance lock
+// and records the outcome of the operation.
+func (b *broker) deprovision(logger lager.Logger, instanceID string, backend *Backend, shareName string, projectId uint32) error {
+	ctx, cancel := b.operationContext()
+	defer cancel()
+
+	errResp := backend.Controller.Remove(ctx, logger, voldriver.RemoveRequest{
+		Name:  shareName,
+	}, projectId)
+
+	instanceLock := b.locks.forInstance(instanceID)
+	instanceLock.Lock()
+	defer instanceLock.Unlock()
+
+	if errResp.Err != "" {
+		err := errors.New(errResp.Err)
+		logger.Error("provision-remove-failed", err)
+		b.finishOperation(logger, instanceID, b.operation(OperationDeprovision, brokerapi.Failed, errResp.Err))
+		return err
+	}
+
+	if err := b.store.DeleteInstanceDetails(logger, instanceID); err != nil {
+		logger.Error("failed-to-delete-instance", err)
+		b.finishOperation(logger, instanceID, b.operation(OperationDeprovision, brokerapi.Failed, err.Error()))
+		return err
+	}
+	b.deleteSnapshots(ctx, logger, instanceID, backend, shareName)
+	if metadata, err := b.store.RetrieveMetadata(logger, instanceID); err == nil {
+		b.deletePrincipal(logger, metadata)
+	}
+	if err := b.store.DeleteMetadata(logger, instanceID); err != nil {
+		logger.Error("failed-to-delete-metadata", err)
+	}
+	// a deleted instance has no last operation, polling the deprovision reports the instance as gone
+	if err := b.store.DeleteOperation(logger, instanceID); err != nil {
+		logger.Error("failed-to-delete-operation", err)
+		return b.finishOperation(logger, instanceID, b.operation(OperationDeprovision, brokerapi.Succeeded, "share deleted"))
+	}
+	return nil
 }
 
 //https://github.com/pivotal-cf/brokerapi/blob/0ea2a3913c148837e8615a1ef8bde757151934c3/api.go#L235
@@ -174,46 +398,178 @@ func (b *broker) Bind(instanceID string, bindId string, details brokerapi.BindDe
 	logger.Info("start")
 	defer logger.Info("end")
 
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	instanceLock := b.locks.forInstance(instanceID)
+	instanceLock.Lock()
+	defer instanceLock.Unlock()
 
-	defer b.serialize(b.sm)
+	instance, err := b.store.RetrieveInstanceDetails(logger, instanceID)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
 
-	if _,ok := b.sm.InstanceMap[instanceID]; !ok {
-		return brokerapi.Binding{}, brokerapi.ErrInstanceDoesNotExist
+	if err := b.checkNoOperationInProgress(logger, instanceID); err != nil {
+		return brokerapi.Binding{}, err
 	}
 
 	if details.AppGUID == "" {
 		return brokerapi.Binding{}, brokerapi.ErrAppGuidNotProvided
 	}
 
+	bindingExists := false
+	existing, err := b.store.RetrieveBindingDetails(logger, bindId)
+	switch err {
+	case nil:
+		owned, err := b.bindingOwnedBy(logger, bindId, existing, instanceID, instance)
+		if err != nil {
+			return brokerapi.Binding{}, err
+		}
+		if !owned || !reflect.DeepEqual(redactBindDetails(details), redactBindDetails(existing)) {
+			return brokerapi.Binding{}, brokerapi.ErrBindingAlreadyExists
+		}
+		bindingExists = true
+	case brokerapi.ErrBindingDoesNotExist:
+	default:
+		logger.Error("failed-to-retrieve-binding", err)
+		return brokerapi.Binding{}, err
+	}
+
+	volumeMount, err := b.volumeMount(logger, instanceID, instance, details, false)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	plan, _ := b.catalog.Plan(instance.PlanID)
+	principal := principalName(plan, instanceID, bindId)
+	credentials, err := b.kerberosCredentials(logger, plan, principal, !bindingExists)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	if !bindingExists {
+		metadata := Metadata{Context: b.requests.get(bindId), InstanceID: instanceID}
+		switch plan.Settings.Kerberos {
+		case KerberosPerBinding:
+			metadata.Principal = principal
+		case KerberosPerInstance:
+			if err := b.recordInstancePrincipal(logger, instanceID, principal); err != nil {
+				return brokerapi.Binding{}, err
+			}
+		}
+		if err := b.store.SaveMetadata(logger, bindId, metadata); err != nil {
+			logger.Error("failed-to-store-binding-metadata", err)
+			b.deletePrincipal(logger, metadata)
+			return brokerapi.Binding{}, err
+		}
+		if err := b.store.CreateBindingDetails(logger, bindId, redactBindDetails(details)); err != nil {
+			logger.Error("failed-to-store-binding", err)
+			b.deletePrincipal(logger, metadata)
+			return brokerapi.Binding{}, err
+		}
+		b.audit("bind", bindId, metadata)
+	}
+
+	return brokerapi.Binding{
+		Credentials:      credentials,
+		VolumeMounts:     []brokerapi.VolumeMount{volumeMount},
+	}, nil
+}
+
+// bindingOwnedBy reports whether a binding belongs to an instance. Bindings created before their instance was
+// recorded are only known to belong to an instance of the same service.
+func (b *broker) bindingOwnedBy(logger lager.Logger, bindingID string, details brokerapi.BindDetails, instanceID string, instance brokerapi.ProvisionDetails) (bool, error) {
+	metadata, err := b.store.RetrieveMetadata(logger, bindingID)
+	if err != nil && err != ErrMetadataDoesNotExist {
+		logger.Error("failed-to-retrieve-binding-metadata", err)
+		return false, err
+	}
+	owned := metadata.InstanceID == instanceID
+	if metadata.InstanceID == "" {
+		owned = details.ServiceID == instance.ServiceID
+	}
+	if !owned {
+		logger.Info("binding-of-other-instance", lager.Data{"binding-id": bindingID, "instance-id": metadata.InstanceID})
+	}
+	return owned, nil
+}
+
+// recordInstancePrincipal records the principal shared by the bindings of an instance, it lives as long as the instance.
+func (b *broker) recordInstancePrincipal(logger lager.Logger, instanceID, principal string) error {
+	metadata, err := b.metadata(logger, instanceID)
+	if err != nil {
+		return err
+	}
+	if metadata.Principal == principal {
+		return nil
+	}
+	metadata.Principal = principal
+	if err := b.store.SaveMetadata(logger, instanceID, metadata); err != nil {
+		logger.Error("failed-to-store-metadata", err)
+		return err
+	}
+	return nil
+}
+
+// volumeMount mounts the share of an instance through the controller and describes it for a binding.
+// The details of a binding as stored lack its password, passwordRedacted leaves it out of the mount config.
+func (b *broker) volumeMount(logger lager.Logger, instanceID string, instance brokerapi.ProvisionDetails, details brokerapi.BindDetails, passwordRedacted bool) (brokerapi.VolumeMount, error) {
 	mode, err := evaluateMode(details.Parameters)
 	if err != nil {
-		return brokerapi.Binding{},err
+		return brokerapi.VolumeMount{}, err
 	}
 
-	if b.bindingConflicts(bindId, details) {
-		return brokerapi.Binding{}, brokerapi.ErrBindingAlreadyExists
+	plan, _ := b.catalog.Plan(instance.PlanID)
+	identity, err := evaluateBindIdentity(details.Parameters, plan, passwordRedacted)
+	if err != nil {
+		logger.Error("invalid-bind-identity", err)
+		return brokerapi.VolumeMount{}, err
 	}
 
-	resp := b.controller.Bind(logger, instanceID)
+	shareMetadata, err := b.metadata(logger, instanceID)
+	if err != nil {
+		return brokerapi.VolumeMount{}, err
+	}
+	backend, err := b.backend(logger, shareMetadata)
+	if err != nil {
+		return brokerapi.VolumeMount{}, err
+	}
+	ctx, cancel := b.operationContext()
+	defer cancel()
+	resp := backend.Controller.Bind(ctx, logger, shareMetadata.ShareName)
 	if resp.Err != "" {
 		err := errors.New(resp.Err)
 		logger.Error("binding-service-failed", err)
-		return brokerapi.Binding{}, err
+		return brokerapi.VolumeMount{}, err
+	}
+	// the mount options of the plan override those of the backend, a plan version drops the backend's minor version
+	mountOptions := backend.Client.GetMountOptions(logger)
+	planOptions := plan.Settings.mountOptions()
+	if plan.Settings.NfsVersion != 0 {
+		resp.SharedDevice.MountConfig["version"] = plan.Settings.NfsVersion
+		if mountOptions.MajorVersion() != plan.Settings.NfsVersion {
+			mountOptions = mountOptions.Without("vers", "nfsvers")
+		}
+	}
+	mountOptions = kerberosMountOptions(plan, mountOptions.Merge(planOptions))
+	if len(mountOptions) > 0 {
+		resp.SharedDevice.MountConfig["mount_options"] = mountOptions.String()
+	}
+	if version := mountOptions.MajorVersion(); version != 0 {
+		resp.SharedDevice.MountConfig["version"] = version
+	}
+	identity.mountConfig(resp.SharedDevice.MountConfig)
+	if plan.Settings.ReadOnly || mountOptions.Has("ro") {
+		mode = readOnlyToMode(true)
+	}
+	if options, err := b.evaluateShareOptions(logger, instance.PlanID, instance.RawParameters); err == nil && options.Quota > 0 {
+		resp.SharedDevice.MountConfig["quota"] = options.Quota
 	}
 
-	b.sm.BindingMap[bindId] = details
-
-	return brokerapi.Binding{
-		Credentials:      struct {}{},
-		VolumeMounts:     []brokerapi.VolumeMount{{
-			Driver:         fmt.Sprintf("%sdriver",b.sd.ServiceName),
-			ContainerDir:   evaluateContainerDir(details.Parameters, instanceID),
-			Mode:           mode,
-			DeviceType:     "shared",
-			Device:         resp.SharedDevice,
-		}},
+	return brokerapi.VolumeMount{
+		Driver:         fmt.Sprintf("%sdriver",b.catalog.ServiceName),
+		ContainerDir:   evaluateContainerDir(details.Parameters, instanceID),
+		Mode:           mode,
+		DeviceType:     "shared",
+		Device:         resp.SharedDevice,
 	}, nil
 }
 
@@ -223,47 +579,377 @@ func (b *broker) Unbind(instanceID ,bindingID string, details brokerapi.UnbindDe
 	logger.Info("start")
 	defer logger.Info("end")
 
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	instanceLock := b.locks.forInstance(instanceID)
+	instanceLock.Lock()
+	defer instanceLock.Unlock()
 
-	defer b.serialize(b.sm)
-
-	if _,ok := b.sm.InstanceMap[instanceID]; !ok {
-		return brokerapi.ErrInstanceDoesNotExist
+	instance, err := b.store.RetrieveInstanceDetails(logger, instanceID)
+	if err != nil {
+		return err
 	}
 
-	if _,ok := b.sm.BindingMap[bindingID]; !ok {
-		return brokerapi.ErrBindingDoesNotExist
+	binding, err := b.store.RetrieveBindingDetails(logger, bindingID)
+	if err != nil {
+		return err
+	}
+	if owned, err := b.bindingOwnedBy(logger, bindingID, binding, instanceID, instance); err != nil || !owned {
+		if err == nil {
+			err = brokerapi.ErrBindingDoesNotExist
+		}
+		return err
 	}
 
-	delete(b.sm.BindingMap, bindingID)
+	if err := b.store.DeleteBindingDetails(logger, bindingID); err != nil {
+		logger.Error("failed-to-delete-binding", err)
+		return err
+	}
+	if metadata, err := b.store.RetrieveMetadata(logger, bindingID); err == nil {
+		b.audit("unbind", bindingID, b.withRequestIdentity(bindingID, metadata))
+		b.deletePrincipal(logger, metadata)
+	}
+	if err := b.store.DeleteMetadata(logger, bindingID); err != nil {
+		logger.Error("failed-to-delete-binding-metadata", err)
+	}
 	return nil
 }
 
+//https://github.com/pivotal-cf/brokerapi/blob/0ea2a3913c148837e8615a1ef8bde757151934c3/api.go#L137
 func (b *broker) Update(instanceID string, details brokerapi.UpdateDetails, asyncAllowd bool) (brokerapi.UpdateServiceSpec, error) {
-	panic("not implemented")
-}
+	logger := b.logger.Session("update")
+	logger.Info("start")
+	defer logger.Info("end")
 
-func (b *broker) LastOperation(instanceID,operationData string) (brokerapi.LastOperation, error) {
-	panic("not implemented")
+	if _, ok := details.Parameters[ParamCloneFrom]; ok {
+		logger.Error("invalid-parameters", ErrCloneOnlyOnProvision)
+		return brokerapi.UpdateServiceSpec{}, ErrCloneOnlyOnProvision
+	}
+	if snapshotName, ok := details.Parameters[ParamSnapshot]; ok {
+		return b.updateSnapshot(logger, instanceID, details, snapshotName, asyncAllowd)
+	}
+	if snapshotName, ok := details.Parameters[ParamRestoreSnapshot]; ok {
+		return b.updateRestoreSnapshot(logger, instanceID, details, snapshotName, asyncAllowd)
+	}
+
+	instanceLock := b.locks.forInstance(instanceID)
+	instanceLock.Lock()
+
+	existing, err := b.store.RetrieveInstanceDetails(logger, instanceID)
+	if err != nil {
+		instanceLock.Unlock()
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	updated := existing
+	if details.PlanID != "" && details.PlanID != existing.PlanID {
+		if !b.planChangeAllowed(existing.PlanID, details.PlanID) {
+			instanceLock.Unlock()
+			logger.Error("plan-change-not-supported", brokerapi.ErrPlanChangeNotSupported, lager.Data{"from": existing.PlanID, "to": details.PlanID})
+			return brokerapi.UpdateServiceSpec{}, brokerapi.ErrPlanChangeNotSupported
+		}
+		updated.PlanID = details.PlanID
+	}
+
+	updated.RawParameters, err = mergeParameters(existing.RawParameters, details.Parameters)
+	if err != nil {
+		instanceLock.Unlock()
+		logger.Error("invalid-parameters", err)
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	options, err := b.evaluateShareOptions(logger, updated.PlanID, updated.RawParameters)
+	if err != nil {
+		instanceLock.Unlock()
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	current, err := b.evaluateShareOptions(logger, existing.PlanID, existing.RawParameters)
+	if err != nil || updated.PlanID != existing.PlanID || options.Quota != current.Quota {
+		if err := b.reserveTenantLimits(logger, instanceID, updated, options.Quota, false); err != nil {
+			instanceLock.Unlock()
+			return brokerapi.UpdateServiceSpec{}, err
+		}
+	}
+	metadata, err := b.metadata(logger, instanceID)
+	if err != nil {
+		instanceLock.Unlock()
+		b.releaseTenantReservation(instanceID)
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	backend, err := b.backend(logger, metadata)
+	if err != nil {
+		instanceLock.Unlock()
+		b.releaseTenantReservation(instanceID)
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	err = b.startOperation(logger, instanceID, b.operation(OperationUpdate, brokerapi.InProgress, "updating share"))
+	instanceLock.Unlock()
+	if err != nil {
+		b.releaseTenantReservation(instanceID)
+		logger.Error("failed-to-store-operation", err)
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	b.audit("update", instanceID, b.withRequestIdentity(instanceID, metadata))
+	options.ProjectId = metadata.ProjectId
+
+	if asyncAllowd {
+		go b.update(logger, instanceID, backend, metadata.ShareName, updated, options)
+		return brokerapi.UpdateServiceSpec{IsAsync: true, OperationData: OperationUpdate}, nil
+	}
+
+	if err := b.update(logger, instanceID, backend, metadata.ShareName, updated, options); err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	return brokerapi.UpdateServiceSpec{}, nil
 }
 
-func evaluateContainerDir(parameters map[string]interface{}, volID string) string {
-	if containerDir, ok := parameters["mount"];ok  && containerDir != "" {
-		return containerDir.(string)
+// update applies new share attributes without holding the instance lock and stores the
+// updated details of the instance once the share reflects them.
+func (b *broker) update(logger lager.Logger, instanceID string, backend *Backend, shareName string, details brokerapi.ProvisionDetails, options ShareOptions) error {
+	ctx, cancel := b.operationContext()
+	defer cancel()
+	defer b.releaseTenantReservation(instanceID)
+
+	errResp := backend.Controller.Update(ctx, logger, shareName, options)
+
+	instanceLock := b.locks.forInstance(instanceID)
+	instanceLock.Lock()
+	defer instanceLock.Unlock()
+
+	if errResp.Err != "" {
+		err := errors.New(errResp.Err)
+		logger.Error("update-share-failed", err)
+		b.finishOperation(logger, instanceID, b.operation(OperationUpdate, brokerapi.Failed, errResp.Err))
+		return err
 	}
-	return path.Join(DefaultContainerDir, volID)
+
+	if err := b.store.UpdateInstanceDetails(logger, instanceID, details); err != nil {
+		logger.Error("failed-to-update-instance", err)
+		b.finishOperation(logger, instanceID, b.operation(OperationUpdate, brokerapi.Failed, err.Error()))
+		return err
+	}
+	return b.finishOperation(logger, instanceID, b.operation(OperationUpdate, brokerapi.Succeeded, "share updated"))
 }
 
-func (b *broker) bindingConflicts(bindingID string, details brokerapi.BindDetails) bool {
-	if existed, ok := b.sm.BindingMap[bindingID]; ok {
-		if !reflect.DeepEqual(details, existed){
+// planChangeAllowed reports whether an instance may move between two plans of the catalog.
+func (b *broker) planChangeAllowed(fromPlanID, toPlanID string) bool {
+	from, ok := b.catalog.Plan(fromPlanID)
+	if !ok {
+		return false
+	}
+	if _, ok := b.catalog.Plan(toPlanID); !ok {
+		return false
+	}
+	for _, planID := range from.Settings.UpdatableTo {
+		if planID == toPlanID {
 			return true
 		}
 	}
 	return false
 }
 
+func (b *broker) LastOperation(instanceID,operationData string) (brokerapi.LastOperation, error) {
+	logger := b.logger.Session("last-operation")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	op, err := b.store.RetrieveOperation(logger, instanceID)
+	if err == ErrOperationDoesNotExist {
+		// the operation of an instance is deleted along with the instance once it is deprovisioned
+		if operationData == OperationDeprovision {
+			return brokerapi.LastOperation{}, ErrInstanceGone
+		}
+		return brokerapi.LastOperation{}, brokerapi.ErrInstanceDoesNotExist
+	}
+	if err != nil {
+		logger.Error("failed-to-retrieve-operation", err)
+		return brokerapi.LastOperation{}, err
+	}
+	// not gone: a deprovision would be taken for done while the instance still exists
+	if operationData != "" && op.Type != operationData {
+		logger.Info("operation-superseded", lager.Data{"requested": operationData, "type": op.Type})
+		return brokerapi.LastOperation{}, ErrOperationSuperseded
+	}
+	logger.Info("operation-found", lager.Data{"type": op.Type, "state": op.State})
+
+	return brokerapi.LastOperation{
+		State:       op.State,
+		Description: op.Description,
+	}, nil
+}
+
+func (b *broker) evaluateShareOptions(logger lager.Logger, planID string, rawParameters json.RawMessage) (ShareOptions, error) {
+	parameters, err := parseRawParameters(rawParameters)
+	if err != nil {
+		logger.Error("invalid-parameters", err)
+		return ShareOptions{}, err
+	}
+	plan, _ := b.catalog.Plan(planID)
+	attributes, err := evaluateShareAttributesOfPlan(parameters, plan)
+	if err != nil {
+		logger.Error("invalid-parameters", err)
+		return ShareOptions{}, err
+	}
+	quota, err := evaluateQuota(parameters, plan)
+	if err != nil {
+		logger.Error("invalid-size", err)
+		return ShareOptions{}, err
+	}
+	return ShareOptions{Attributes: attributes, Quota: quota}, nil
+}
+
+// startOperation starts an operation of an instance unless another operation is in progress or the share of the
+// instance is being copied into a new instance. The lock of the instance is held.
+func (b *broker) startOperation(logger lager.Logger, instanceID string, operation OperationRecord) error {
+	metadata, err := b.store.RetrieveMetadata(logger, instanceID)
+	if err != nil && err != ErrMetadataDoesNotExist {
+		logger.Error("failed-to-retrieve-metadata", err)
+		return err
+	}
+	if len(metadata.CloningInto) > 0 {
+		logger.Info("instance-being-cloned", lager.Data{"clones": metadata.CloningInto})
+		return ErrOperationInProgress
+	}
+	return b.store.StartOperation(logger, instanceID, operation)
+}
+
+func (b *broker) checkNoOperationInProgress(logger lager.Logger, instanceID string) error {
+	op, err := b.store.RetrieveOperation(logger, instanceID)
+	if err == ErrOperationDoesNotExist {
+		return nil
+	}
+	if err != nil {
+		logger.Error("failed-to-retrieve-operation", err)
+		return err
+	}
+	if op.State == brokerapi.InProgress {
+		return ErrOperationInProgress
+	}
+	return nil
+}
+
+// metadata returns the metadata of an instance, instances created before metadata was recorded
+// have a share named after the instance on the default backend.
+func (b *broker) metadata(logger lager.Logger, instanceID string) (Metadata, error) {
+	metadata, err := b.store.RetrieveMetadata(logger, instanceID)
+	if err != nil && err != ErrMetadataDoesNotExist {
+		logger.Error("failed-to-retrieve-metadata", err)
+		return Metadata{}, err
+	}
+	if metadata.ShareName == "" {
+		metadata.ShareName = instanceID
+	}
+	if metadata.Backend == "" {
+		metadata.Backend = b.backends.Default().Name
+	}
+	return metadata, nil
+}
+
+// backend returns the backend holding the share of an instance.
+func (b *broker) backend(logger lager.Logger, metadata Metadata) (*Backend, error) {
+	backend, err := b.backends.Get(metadata.Backend)
+	if err != nil {
+		logger.Error("backend-not-configured", err, lager.Data{"backend": metadata.Backend})
+		return nil, fmt.Errorf("backend '%s' of the instance is not configured", metadata.Backend)
+	}
+	return backend, nil
+}
+
+// withRequestIdentity replaces the identity recorded with the metadata by the identity of the current request.
+func (b *broker) withRequestIdentity(id string, metadata Metadata) Metadata {
+	metadata.Context.Identity = b.requests.get(id).Identity
+	return metadata
+}
+
+// saveNewInstanceMetadata stores the metadata of a new instance with the lowest quota project id not in use
+// by another instance. Brokers sharing a store allocate ids under a lease of the store, an id found in use
+// once the metadata is stored nevertheless is given up.
+func (b *broker) saveNewInstanceMetadata(logger lager.Logger, instanceID string, metadata *Metadata) error {
+	b.projectIds.Lock()
+	defer b.projectIds.Unlock()
+	if leaser, ok := b.store.(Leaser); ok {
+		defer holdLease(logger, leaser, "project-ids", nil)()
+	}
+
+	used, err := b.usedProjectIds(logger, instanceID)
+	if err != nil {
+		return err
+	}
+	metadata.ProjectId = 1
+	for used[metadata.ProjectId] {
+		metadata.ProjectId++
+	}
+	if err := b.store.SaveMetadata(logger, instanceID, *metadata); err != nil {
+		return err
+	}
+
+	used, err = b.usedProjectIds(logger, instanceID)
+	if err != nil {
+		return err
+	}
+	if used[metadata.ProjectId] {
+		logger.Error("project-id-in-use", ErrProjectIdInUse, lager.Data{"project-id": metadata.ProjectId})
+		return ErrProjectIdInUse
+	}
+	return nil
+}
+
+// usedProjectIds returns the quota project ids of the instances other than instanceID, including the ids
+// derived from the share names of instances created before project ids were allocated.
+func (b *broker) usedProjectIds(logger lager.Logger, instanceID string) (map[uint32]bool, error) {
+	instances, err := b.store.ListInstanceDetails(logger)
+	if err != nil {
+		logger.Error("failed-to-list-instances", err)
+		return nil, err
+	}
+	metadata, err := b.store.ListMetadata(logger)
+	if err != nil {
+		logger.Error("failed-to-list-metadata", err)
+		return nil, err
+	}
+	used := map[uint32]bool{}
+	for id := range instances {
+		if id == instanceID {
+			continue
+		}
+		shareName := metadata[id].ShareName
+		if shareName == "" {
+			shareName = id
+		}
+		used[shareProjectId(shareName, metadata[id].ProjectId)] = true
+	}
+	return used, nil
+}
+
+// releaseInstance forgets an instance whose share could not be created.
+func (b *broker) releaseInstance(logger lager.Logger, instanceID string) {
+	if err := b.store.DeleteInstanceDetails(logger, instanceID); err != nil && err != brokerapi.ErrInstanceDoesNotExist {
+		logger.Error("failed-to-release-instance", err)
+	}
+	if err := b.store.DeleteMetadata(logger, instanceID); err != nil {
+		logger.Error("failed-to-release-metadata", err)
+	}
+}
+
+func (b *broker) operation(operationType string, state brokerapi.LastOperationState, description string) OperationRecord {
+	return OperationRecord{Type: operationType, State: state, Description: description, Owner: b.brokerID}
+}
+
+// finishOperation records the outcome of an operation, a failure to do so leaves the operation
+// in progress until the broker restarts and is logged as it cannot be reported to the caller.
+func (b *broker) finishOperation(logger lager.Logger, instanceID string, op OperationRecord) error {
+	err := b.store.SaveOperation(logger, instanceID, op)
+	if err != nil {
+		logger.Error("failed-to-store-operation", err, lager.Data{"type": op.Type, "state": op.State})
+	}
+	return err
+}
+
+func evaluateContainerDir(parameters map[string]interface{}, volID string) string {
+	if containerDir, ok := parameters["mount"];ok  && containerDir != "" {
+		return containerDir.(string)
+	}
+	return path.Join(DefaultContainerDir, volID)
+}
+
 func evaluateMode(parameters map[string]interface{}) (string, error) {
 	if ro, ok := parameters["readonly"]; ok {
 		switch ro := ro.(type) {
@@ -283,51 +969,68 @@ func readOnlyToMode(ro bool) string {
 	return "rw"
 }
 
-func (b *broker) instanceConflicts(details brokerapi.ProvisionDetails, instanceID string) bool {
-	if existing, ok := b.sm.InstanceMap[instanceID]; ok {
-		if !reflect.DeepEqual(details,existing) {
-			return true
-		}
-	}
-	return false
-}
-
-func (b *broker) serialize(serviceMode interface{}) {
-	logger := b.logger.Session("serialize")
+// restoreState loads the persisted state and fails the operations of this broker that were interrupted
+// by a restart, the controller will never report back on them. The shares of interrupted provisions are moved
+// into the trash and the sources of interrupted clones are released.
+func (b *broker) restoreState() error {
+	logger := b.logger.Session("restore-state")
 	logger.Info("start")
 	defer logger.Info("end")
 
-	serviceFile := filepath.Join(b.dataDir, fmt.Sprintf("%s-services.json", b.sd.ServiceName))
-	serviceData, err := json.Marshal(serviceMode)
+	err := b.store.Restore(logger)
 	if err != nil {
-		b.logger.Error(fmt.Sprintf("failed-to-marshall-service-file: %s", serviceFile), err)
-		return
+		logger.Error("failed-to-restore-state", err)
+		return err
 	}
-	err = b.ioutil.WriteFile(serviceFile, serviceData, os.ModePerm)
+
+	operations, err := b.store.ListOperations(logger)
 	if err != nil {
-		b.logger.Error(fmt.Sprintf("failed-to-write-service-file: %s", serviceFile), err)
-		return
+		logger.Error("failed-to-list-operations", err)
+		return err
 	}
-	logger.Info("service-file-saved", lager.Data{"service-file" : serviceFile})
+	for instanceID, op := range operations {
+		if op.State != brokerapi.InProgress || (op.Owner != "" && op.Owner != b.brokerID) {
+			continue
+		}
+		logger.Info("interrupted-operation", lager.Data{"instance-id": instanceID, "type": op.Type})
+		if op.Type == OperationProvision {
+			if metadata, err := b.metadata(logger, instanceID); err == nil {
+				b.trashInterruptedShare(logger, instanceID, metadata)
+				b.releaseCloneSource(logger, instanceID, metadata.ClonedFrom)
+			}
+			b.releaseInstance(logger, instanceID)
+		}
+		b.finishOperation(logger, instanceID, b.operation(op.Type, brokerapi.Failed, "operation interrupted by broker restart"))
+	}
+	return nil
 }
 
-func (b *broker) restoreServiceMap() {
-	logger := b.logger.Session("restore-services")
-	logger.Info("start")
-	defer logger.Info("end")
+// trashInterruptedShare moves the share of an interrupted provision into the trash, the share may be
+// half-created or not have been created at all.
+func (b *broker) trashInterruptedShare(logger lager.Logger, instanceID string, metadata Metadata) {
+	logger = logger.Session("trash-interrupted-share", lager.Data{"instance-id": instanceID, "share": metadata.ShareName})
 
-	detailsFile := filepath.Join(b.dataDir, fmt.Sprintf("%s-services.json", b.sd.ServiceName))
-	serviceData, err := b.ioutil.ReadFile(detailsFile)
+	backend, err := b.backend(logger, metadata)
 	if err != nil {
-		b.logger.Error(fmt.Sprintf("failed-to-read-state-file: %s", detailsFile), err)
 		return
 	}
-	serviceMap := serviceMap{}
-	err = json.Unmarshal(serviceData, &serviceMap)
+	ctx, cancel := b.operationContext()
+	defer cancel()
+
+	if err := ensureMounted(ctx, logger, backend.Client); err != nil {
+		logger.Error("failed-to-mount-backend", err)
+		return
+	}
+	shares, err := backend.Client.ListShares(ctx, logger)
 	if err != nil {
-		b.logger.Error(fmt.Sprintf("failed-to-unmarshall-state from state-file: %s", detailsFile), err)
 		return
 	}
-	logger.Info("state-restored", lager.Data{"details-file":detailsFile})
-	b.sm = serviceMap
+	for _, share := range shares {
+		if share == metadata.ShareName {
+			if err := backend.Client.DeleteShare(ctx, logger, share, metadata.ProjectId); err != nil {
+				logger.Error("failed-to-trash-share", err)
+			}
+			return
+		}
+	}
 }
@@ -0,0 +1,13 @@
+package nfsbroker
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestNfsbroker(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Nfsbroker Suite")
+}
@@ -0,0 +1,421 @@
+package nfsbroker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Broker", func() {
+	var (
+		store *memoryStore
+		tb    testBroker
+	)
+
+	BeforeEach(func() {
+		store = newMemoryStore()
+		tb = newTestBroker(store, &fakeInvoker{}, testCatalog())
+	})
+
+	AfterEach(func() {
+		tb.cleanup()
+	})
+
+	Describe("LastOperation", func() {
+		BeforeEach(func() {
+			_, err := tb.Provision("instance", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id"}, false)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("reports the last operation of the instance", func() {
+			op, err := tb.LastOperation("instance", OperationProvision)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(op.State).To(Equal(brokerapi.Succeeded))
+		})
+
+		It("does not report an instance whose last operation is another one as gone", func() {
+			_, err := tb.LastOperation("instance", OperationDeprovision)
+			Expect(err).To(Equal(ErrOperationSuperseded))
+		})
+
+		It("reports an instance without operations as gone", func() {
+			_, err := tb.LastOperation("other-instance", OperationDeprovision)
+			Expect(err).To(Equal(ErrInstanceGone))
+			_, err = tb.LastOperation("other-instance", OperationProvision)
+			Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
+		})
+
+		It("forgets the operation of a deprovisioned instance", func() {
+			_, err := tb.Deprovision("instance", brokerapi.DeprovisionDetails{}, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(store.operations).To(BeEmpty())
+		})
+	})
+
+	Describe("broker api responses", func() {
+		var handler http.Handler
+
+		request := func(method, path string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+			return recorder
+		}
+
+		BeforeEach(func() {
+			router := mux.NewRouter()
+			brokerapi.AttachRoutes(router, tb.broker, tb.logger)
+			handler = router
+			_, err := tb.Provision("instance", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id"}, false)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("answers a deprovision during another operation with a concurrency error", func() {
+			Expect(store.SaveOperation(tb.logger, "instance", tb.operation(OperationUpdate, brokerapi.InProgress, "updating share"))).To(Succeed())
+
+			response := request("DELETE", "/v2/service_instances/instance?accepts_incomplete=true")
+			Expect(response.Code).To(Equal(http.StatusUnprocessableEntity))
+			Expect(response.Body.String()).To(MatchJSON(`{"error": "ConcurrencyError", "description": "an operation for this instance is still in progress"}`))
+		})
+
+		It("reports a finished deprovision as gone", func() {
+			Expect(request("DELETE", "/v2/service_instances/instance").Code).To(Equal(http.StatusOK))
+
+			response := request("GET", "/v2/service_instances/instance/last_operation?operation=deprovision")
+			Expect(response.Code).To(Equal(http.StatusGone))
+			Expect(response.Body.String()).To(MatchJSON(`{}`))
+		})
+
+		It("rejects polling for a superseded operation", func() {
+			response := request("GET", "/v2/service_instances/instance/last_operation?operation=update")
+			Expect(response.Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Describe("updates", func() {
+		var invoker *fakeInvoker
+
+		quotaLimits := func() []string {
+			limits := []string{}
+			for _, call := range invoker.Calls() {
+				if command := call[3]; strings.HasPrefix(command, "limit") {
+					limits = append(limits, command)
+				}
+			}
+			return limits
+		}
+
+		instance := func() brokerapi.ProvisionDetails {
+			details, err := store.RetrieveInstanceDetails(tb.logger, "instance")
+			Expect(err).NotTo(HaveOccurred())
+			return details
+		}
+
+		BeforeEach(func() {
+			invoker = &fakeInvoker{}
+			tb.cleanup()
+			tb = newTestBroker(store, invoker, testCatalog())
+			_, err := tb.Provision("instance", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id", RawParameters: json.RawMessage(`{"uid": "1000"}`)}, false)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("moves the instance to a plan it is updatable to and applies the quota of the plan", func() {
+			_, err := tb.Update("instance", brokerapi.UpdateDetails{PlanID: "big-plan-id"}, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(instance().PlanID).To(Equal("big-plan-id"))
+			Expect(quotaLimits()).To(Equal([]string{"limit -p bhard=10737418240 1"}))
+		})
+
+		It("rejects a plan the instance is not updatable to and leaves the instance alone", func() {
+			_, err := tb.Update("instance", brokerapi.UpdateDetails{PlanID: "unknown-plan-id"}, false)
+			Expect(err).To(Equal(brokerapi.ErrPlanChangeNotSupported))
+			Expect(instance().PlanID).To(Equal("plan-id"))
+			Expect(store.operations["instance"].Type).To(Equal(OperationProvision))
+		})
+
+		It("merges the parameters into those the instance was provisioned with", func() {
+			_, err := tb.Update("instance", brokerapi.UpdateDetails{Parameters: map[string]interface{}{"mode": "0750"}}, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(instance().RawParameters).To(MatchJSON(`{"uid": "1000", "mode": "0750"}`))
+
+			info, err := os.Stat(filepath.Join(tb.mountPoint, "instance"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0750)))
+		})
+
+		It("changes the quota of the share to the requested size", func() {
+			_, err := tb.Update("instance", brokerapi.UpdateDetails{Parameters: map[string]interface{}{"size": "2G"}}, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(quotaLimits()).To(Equal([]string{"limit -p bhard=2147483648 1"}))
+			Expect(instance().RawParameters).To(MatchJSON(`{"uid": "1000", "size": "2G"}`))
+		})
+
+		It("rejects invalid parameters and keeps those of the instance", func() {
+			_, err := tb.Update("instance", brokerapi.UpdateDetails{Parameters: map[string]interface{}{"size": "lots"}}, false)
+			Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
+			Expect(instance().RawParameters).To(MatchJSON(`{"uid": "1000"}`))
+			Expect(invoker.Calls()).To(BeEmpty())
+		})
+	})
+
+	Describe("restoring the state", func() {
+		BeforeEach(func() {
+			details := brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id"}
+			Expect(store.CreateInstanceDetails(tb.logger, "instance", details)).To(Succeed())
+			Expect(store.SaveMetadata(tb.logger, "instance", Metadata{ShareName: "instance-share"})).To(Succeed())
+			Expect(store.StartOperation(tb.logger, "instance", tb.operation(OperationProvision, brokerapi.InProgress, "creating share"))).To(Succeed())
+		})
+
+		It("fails an interrupted provision and moves its half-created share into the trash", func() {
+			Expect(os.Mkdir(filepath.Join(tb.mountPoint, "instance-share"), 0700)).To(Succeed())
+
+			Expect(tb.restoreState()).To(Succeed())
+
+			Expect(store.instances).To(BeEmpty())
+			Expect(store.metadata).To(BeEmpty())
+			Expect(store.operations["instance"].State).To(Equal(brokerapi.Failed))
+			Expect(tb.shares()).To(BeEmpty())
+			Expect(tb.trash()).To(HaveLen(1))
+		})
+
+		It("fails an interrupted provision which did not create its share yet", func() {
+			Expect(tb.restoreState()).To(Succeed())
+
+			Expect(store.instances).To(BeEmpty())
+			Expect(store.operations["instance"].State).To(Equal(brokerapi.Failed))
+			Expect(tb.trash()).To(BeEmpty())
+		})
+
+		It("leaves the operations of other brokers alone", func() {
+			op := tb.operation(OperationProvision, brokerapi.InProgress, "creating share")
+			op.Owner = "broker-1"
+			Expect(store.SaveOperation(tb.logger, "instance", op)).To(Succeed())
+			Expect(os.Mkdir(filepath.Join(tb.mountPoint, "instance-share"), 0700)).To(Succeed())
+
+			Expect(tb.restoreState()).To(Succeed())
+
+			Expect(store.instances).To(HaveKey("instance"))
+			Expect(store.operations["instance"].State).To(Equal(brokerapi.InProgress))
+			Expect(tb.shares()).To(ConsistOf("instance-share"))
+		})
+	})
+
+	Describe("bindings", func() {
+		bindDetails := brokerapi.BindDetails{AppGUID: "app", ServiceID: "service-id", PlanID: "plan-id"}
+
+		BeforeEach(func() {
+			for _, id := range []string{"instance", "other-instance"} {
+				_, err := tb.Provision(id, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id"}, false)
+				Expect(err).NotTo(HaveOccurred())
+			}
+			_, err := tb.Bind("instance", "binding", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("records the instance of a binding", func() {
+			Expect(store.metadata["binding"].InstanceID).To(Equal("instance"))
+		})
+
+		It("finds a binding after the plan of its instance changed", func() {
+			_, err := tb.Update("instance", brokerapi.UpdateDetails{PlanID: "big-plan-id"}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			binding, err := tb.GetBinding("instance", "binding")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(binding.VolumeMounts[0].Device.VolumeId).To(Equal("instance"))
+		})
+
+		It("does not show a binding through another instance", func() {
+			_, err := tb.GetBinding("other-instance", "binding")
+			Expect(err).To(Equal(brokerapi.ErrBindingDoesNotExist))
+		})
+
+		It("does not delete a binding through another instance", func() {
+			Expect(tb.Unbind("other-instance", "binding", brokerapi.UnbindDetails{})).To(Equal(brokerapi.ErrBindingDoesNotExist))
+			Expect(store.bindings).To(HaveKey("binding"))
+
+			Expect(tb.Unbind("instance", "binding", brokerapi.UnbindDetails{})).To(Succeed())
+			Expect(store.bindings).To(BeEmpty())
+		})
+
+		It("does not take a binding of another instance for a repeated request", func() {
+			_, err := tb.Bind("other-instance", "binding", bindDetails)
+			Expect(err).To(Equal(brokerapi.ErrBindingAlreadyExists))
+		})
+
+		Context("with a username and password", func() {
+			ldapDetails := brokerapi.BindDetails{AppGUID: "app", ServiceID: "service-id", PlanID: "plan-id",
+				Parameters: map[string]interface{}{"username": "user", "password": "secret"}}
+
+			BeforeEach(func() {
+				binding, err := tb.Bind("instance", "ldap-binding", ldapDetails)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Device.MountConfig).To(HaveKeyWithValue("password", "secret"))
+			})
+
+			It("does not store the password", func() {
+				Expect(store.bindings["ldap-binding"].Parameters).To(Equal(map[string]interface{}{"username": "user"}))
+			})
+
+			It("rebuilds the mount config without the password", func() {
+				binding, err := tb.GetBinding("instance", "ldap-binding")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Device.MountConfig).To(HaveKeyWithValue("username", "user"))
+				Expect(binding.VolumeMounts[0].Device.MountConfig).NotTo(HaveKey("password"))
+			})
+
+			It("takes a repeated request for the binding", func() {
+				_, err := tb.Bind("instance", "ldap-binding", ldapDetails)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("redacts the password of a binding stored before passwords were redacted", func() {
+				Expect(store.DeleteBindingDetails(tb.logger, "ldap-binding")).To(Succeed())
+				Expect(store.CreateBindingDetails(tb.logger, "ldap-binding", ldapDetails)).To(Succeed())
+
+				binding, err := tb.GetBinding("instance", "ldap-binding")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Device.MountConfig).NotTo(HaveKey("password"))
+				Expect(binding.Parameters).NotTo(HaveKey("password"))
+			})
+		})
+
+		It("matches bindings created before their instance was recorded by their service", func() {
+			Expect(store.SaveMetadata(tb.logger, "binding", Metadata{})).To(Succeed())
+
+			_, err := tb.GetBinding("other-instance", "binding")
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("restores", func() {
+		provision := func(instanceID string) {
+			_, err := tb.Provision(instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id"}, false)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		updateState := func(instanceID string) func() brokerapi.LastOperationState {
+			return func() brokerapi.LastOperationState {
+				op, err := tb.LastOperation(instanceID, OperationUpdate)
+				Expect(err).NotTo(HaveOccurred())
+				return op.State
+			}
+		}
+
+		It("restores a deleted share as an update operation of the instance", func() {
+			provision("deleted")
+			Expect(ioutil.WriteFile(filepath.Join(tb.mountPoint, "deleted", "data"), []byte("data"), 0600)).To(Succeed())
+			_, err := tb.Deprovision("deleted", brokerapi.DeprovisionDetails{}, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tb.trash()).To(HaveLen(1))
+			provision("instance")
+
+			Expect(tb.RestoreTrash(tb.trash()[0], "instance")).To(Succeed())
+
+			Eventually(updateState("instance")).Should(Equal(brokerapi.Succeeded))
+			Expect(ioutil.ReadFile(filepath.Join(tb.mountPoint, "instance", "data"))).To(Equal([]byte("data")))
+		})
+
+		It("reports a failed restore of a deleted share through the operation", func() {
+			provision("instance")
+
+			Expect(tb.RestoreTrash("missing", "instance")).To(Succeed())
+
+			Eventually(updateState("instance")).Should(Equal(brokerapi.Failed))
+		})
+
+		addSnapshot := func(instanceID string) {
+			metadata, err := store.RetrieveMetadata(tb.logger, instanceID)
+			Expect(err).NotTo(HaveOccurred())
+			metadata.Snapshots = []Snapshot{{Name: "snapshot"}}
+			Expect(store.SaveMetadata(tb.logger, instanceID, metadata)).To(Succeed())
+		}
+
+		It("restores a snapshot and keeps the previous content in the trash", func() {
+			tb.client.snapshots = &fakeSnapshotDriver{}
+			provision("instance")
+			addSnapshot("instance")
+			Expect(ioutil.WriteFile(filepath.Join(tb.mountPoint, "instance", "data"), []byte("data"), 0600)).To(Succeed())
+
+			Expect(tb.RestoreSnapshot("instance", "snapshot")).To(Succeed())
+
+			Eventually(updateState("instance")).Should(Equal(brokerapi.Succeeded))
+			Expect(ioutil.ReadFile(filepath.Join(tb.mountPoint, "instance", "data"))).To(Equal([]byte("snapshot")))
+			Expect(tb.trash()).To(HaveLen(1))
+			Expect(ioutil.ReadFile(filepath.Join(tb.mountPoint, TrashDir, tb.trash()[0], "data"))).To(Equal([]byte("data")))
+		})
+
+		It("moves the share back when the restore of a snapshot fails and reports it through the operation", func() {
+			provision("instance")
+			addSnapshot("instance")
+			Expect(ioutil.WriteFile(filepath.Join(tb.mountPoint, "instance", "data"), []byte("data"), 0600)).To(Succeed())
+
+			Expect(tb.RestoreSnapshot("instance", "snapshot")).To(Succeed())
+
+			Eventually(updateState("instance")).Should(Equal(brokerapi.Failed))
+			op, err := tb.LastOperation("instance", OperationUpdate)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(op.Description).To(Equal(ErrSnapshotsNotSupported.Error()))
+			Expect(ioutil.ReadFile(filepath.Join(tb.mountPoint, "instance", "data"))).To(Equal([]byte("data")))
+			Expect(tb.trash()).To(BeEmpty())
+		})
+
+		It("restores a snapshot requested with the restore_snapshot parameter of an update", func() {
+			tb.client.snapshots = &fakeSnapshotDriver{}
+			provision("instance")
+			addSnapshot("instance")
+
+			spec, err := tb.Update("instance", brokerapi.UpdateDetails{Parameters: map[string]interface{}{ParamRestoreSnapshot: "snapshot"}}, true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(spec.IsAsync).To(BeTrue())
+
+			Eventually(updateState("instance")).Should(Equal(brokerapi.Succeeded))
+			Expect(ioutil.ReadFile(filepath.Join(tb.mountPoint, "instance", "data"))).To(Equal([]byte("snapshot")))
+		})
+
+		It("rejects the restore of a snapshot combined with other changes", func() {
+			provision("instance")
+			addSnapshot("instance")
+
+			_, err := tb.Update("instance", brokerapi.UpdateDetails{Parameters: map[string]interface{}{ParamRestoreSnapshot: "snapshot", ParamMode: "0700"}}, true)
+			Expect(err).To(MatchError("a snapshot cannot be combined with other changes of the instance"))
+			Expect(store.operations["instance"].Type).To(Equal(OperationProvision))
+		})
+
+		It("rejects the restore of a snapshot while the instance has bindings", func() {
+			provision("instance")
+			addSnapshot("instance")
+			_, err := tb.Bind("instance", "binding", brokerapi.BindDetails{AppGUID: "app", PlanID: "plan-id", ServiceID: "service-id"})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(tb.RestoreSnapshot("instance", "snapshot")).To(Equal(ErrInstanceHasBindings))
+			_, err = tb.Update("instance", brokerapi.UpdateDetails{Parameters: map[string]interface{}{ParamRestoreSnapshot: "snapshot"}}, true)
+			Expect(err).To(Equal(ErrInstanceHasBindings))
+
+			Expect(tb.Unbind("instance", "binding", brokerapi.UnbindDetails{})).To(Succeed())
+			Expect(tb.RestoreSnapshot("instance", "snapshot")).To(Succeed())
+			Eventually(updateState("instance")).Should(Equal(brokerapi.Failed))
+		})
+
+		It("rejects a restore while an operation is in progress", func() {
+			provision("instance")
+			Expect(store.SaveOperation(tb.logger, "instance", tb.operation(OperationUpdate, brokerapi.InProgress, "restoring"))).To(Succeed())
+
+			Expect(tb.RestoreTrash("missing", "instance")).To(Equal(ErrOperationInProgress))
+		})
+
+		It("rejects the restore of an unknown snapshot right away", func() {
+			provision("instance")
+			Expect(tb.RestoreSnapshot("instance", "snapshot")).To(Equal(ErrSnapshotDoesNotExist))
+		})
+	})
+})
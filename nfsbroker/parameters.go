@@ -0,0 +1,299 @@
+package nfsbroker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var (
+	ErrBindIdentityRequired     = errors.New("the plan requires bindings to give a uid and gid or a username and password")
+	ErrBindIdentityNotPermitted = errors.New("the plan does not permit bindings to give a uid, gid, username or password")
+	ErrBindIdentityInvalid      = errors.New("a binding gives either a uid and gid or a username and password")
+	ErrShareAttributesFixed     = errors.New("the plan does not permit the uid, gid and mode of the share to be given")
+)
+
+// instance parameters accepted by provision and update
+const (
+	ParamUid  = "uid"
+	ParamGid  = "gid"
+	ParamMode = "mode"
+	ParamSize = "size"
+
+	// provision only, the id of an instance whose content is copied into the new share
+	ParamCloneFrom = "clone_from"
+	// provision only, the name of the backend to place the share on
+	ParamBackend = "backend"
+	// update only, takes a snapshot of the share instead of changing the instance
+	ParamSnapshot = "snapshot"
+	// update only, replaces the content of the share by a snapshot instead of changing the instance
+	ParamRestoreSnapshot = "restore_snapshot"
+)
+
+// binding parameters in addition to uid, gid and mode
+const (
+	// the driver resolves the uid and gid of a username on the cell through LDAP
+	ParamUsername = "username"
+	ParamPassword = "password"
+)
+
+// plan settings deciding whether bindings give an identity
+const (
+	BindIdentityOptional = "optional"
+	BindIdentityRequired = "required"
+	BindIdentityNone     = "none"
+)
+
+const (
+	shareOptionsOpt = "share_options"
+	cloneFromOpt    = "clone_from"
+)
+
+func parseRawParameters(raw json.RawMessage) (map[string]interface{}, error) {
+	parameters := map[string]interface{}{}
+	if len(raw) == 0 {
+		return parameters, nil
+	}
+	if err := json.Unmarshal(raw, &parameters); err != nil {
+		return nil, brokerapi.ErrRawParamsInvalid
+	}
+	return parameters, nil
+}
+
+// mergeParameters applies updated parameters on top of the raw parameters an instance was provisioned with.
+func mergeParameters(raw json.RawMessage, updates map[string]interface{}) (json.RawMessage, error) {
+	parameters, err := parseRawParameters(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(updates) == 0 {
+		return raw, nil
+	}
+	for key, value := range updates {
+		parameters[key] = value
+	}
+	return json.Marshal(parameters)
+}
+
+func evaluateShareAttributes(parameters map[string]interface{}) (ShareAttributes, error) {
+	attributes := ShareAttributes{Uid: -1, Gid: -1}
+
+	var err error
+	if uid, ok := parameters[ParamUid]; ok {
+		if attributes.Uid, err = evaluateId(uid); err != nil {
+			return ShareAttributes{}, err
+		}
+	}
+	if gid, ok := parameters[ParamGid]; ok {
+		if attributes.Gid, err = evaluateId(gid); err != nil {
+			return ShareAttributes{}, err
+		}
+	}
+	if mode, ok := parameters[ParamMode]; ok {
+		if attributes.Mode, err = evaluatePermissions(mode); err != nil {
+			return ShareAttributes{}, err
+		}
+	}
+	return attributes, nil
+}
+
+// evaluateShareAttributesOfPlan returns the share attributes given by the parameters over the default
+// attributes of the plan.
+func evaluateShareAttributesOfPlan(parameters map[string]interface{}, plan Plan) (ShareAttributes, error) {
+	attributes, err := evaluateShareAttributes(parameters)
+	if err != nil {
+		return ShareAttributes{}, err
+	}
+	if plan.Settings.FixedShareAttributes && (attributes.Uid >= 0 || attributes.Gid >= 0 || attributes.Mode != 0) {
+		return ShareAttributes{}, ErrShareAttributesFixed
+	}
+	if attributes.Uid < 0 && plan.Settings.ShareUid != nil {
+		attributes.Uid = *plan.Settings.ShareUid
+	}
+	if attributes.Gid < 0 && plan.Settings.ShareGid != nil {
+		attributes.Gid = *plan.Settings.ShareGid
+	}
+	if attributes.Mode == 0 && plan.Settings.ShareMode != "" {
+		attributes.Mode, _ = evaluatePermissions(plan.Settings.ShareMode)
+	}
+	return attributes, nil
+}
+
+// BindIdentity is the user a binding accesses the share as.
+type BindIdentity struct {
+	// -1 when not given
+	Uid int
+	Gid int
+	// resolved into a uid and gid by the driver
+	Username string
+	Password string
+	// permissions of the files the binding creates, 0 when not given
+	Mode os.FileMode
+}
+
+// evaluateBindIdentity validates the identity given by the parameters of a binding against the policy of the plan.
+// The stored parameters of a binding keep its username but not its password, passwordRedacted accepts them.
+func evaluateBindIdentity(parameters map[string]interface{}, plan Plan, passwordRedacted bool) (BindIdentity, error) {
+	attributes, err := evaluateShareAttributes(parameters)
+	if err != nil {
+		return BindIdentity{}, err
+	}
+	identity := BindIdentity{Uid: attributes.Uid, Gid: attributes.Gid, Mode: attributes.Mode}
+	for key, value := range map[string]*string{ParamUsername: &identity.Username, ParamPassword: &identity.Password} {
+		if given, ok := parameters[key]; ok {
+			if *value, ok = given.(string); !ok || *value == "" {
+				return BindIdentity{}, brokerapi.ErrRawParamsInvalid
+			}
+		}
+	}
+
+	hasIds := identity.Uid >= 0 || identity.Gid >= 0
+	hasUser := identity.Username != "" || identity.Password != ""
+	switch {
+	case hasIds && hasUser:
+		return BindIdentity{}, ErrBindIdentityInvalid
+	case hasIds && (identity.Uid < 0 || identity.Gid < 0):
+		return BindIdentity{}, ErrBindIdentityInvalid
+	case hasUser && (identity.Username == "" || (identity.Password == "" && !passwordRedacted)):
+		return BindIdentity{}, ErrBindIdentityInvalid
+	}
+
+	switch plan.Settings.BindIdentity {
+	case BindIdentityRequired:
+		if !hasIds && !hasUser {
+			return BindIdentity{}, ErrBindIdentityRequired
+		}
+	case BindIdentityNone:
+		if hasIds || hasUser {
+			return BindIdentity{}, ErrBindIdentityNotPermitted
+		}
+	}
+	return identity, nil
+}
+
+// mountConfig adds the identity to the mount config of a binding, the password only when it is known.
+func (i BindIdentity) mountConfig(mountConfig map[string]interface{}) {
+	if i.Uid >= 0 {
+		mountConfig[ParamUid] = strconv.Itoa(i.Uid)
+		mountConfig[ParamGid] = strconv.Itoa(i.Gid)
+	}
+	if i.Username != "" {
+		mountConfig[ParamUsername] = i.Username
+	}
+	if i.Password != "" {
+		mountConfig[ParamPassword] = i.Password
+	}
+	if i.Mode != 0 {
+		mountConfig[ParamMode] = fmt.Sprintf("%04o", uint32(i.Mode))
+	}
+}
+
+// redactParameters returns binding parameters without the password.
+func redactParameters(parameters map[string]interface{}) map[string]interface{} {
+	if _, ok := parameters[ParamPassword]; !ok {
+		return parameters
+	}
+	redacted := map[string]interface{}{}
+	for key, value := range parameters {
+		if key != ParamPassword {
+			redacted[key] = value
+		}
+	}
+	return redacted
+}
+
+// redactBindDetails returns binding details without the password, as they are stored. The password only
+// reaches the platform in the response to the bind request.
+func redactBindDetails(details brokerapi.BindDetails) brokerapi.BindDetails {
+	details.Parameters = redactParameters(details.Parameters)
+	return details
+}
+
+// evaluateQuota returns the size limit requested by the parameters or the default quota of the plan.
+func evaluateQuota(parameters map[string]interface{}, plan Plan) (uint64, error) {
+	size, ok := parameters[ParamSize]
+	if !ok {
+		if plan.Settings.Quota == "" {
+			return 0, nil
+		}
+		return parseSize(plan.Settings.Quota)
+	}
+	switch size := size.(type) {
+	case float64:
+		if size < 1 || size != math.Trunc(size) {
+			return 0, brokerapi.ErrRawParamsInvalid
+		}
+		return uint64(size), nil
+	case string:
+		quota, err := parseSize(size)
+		if err != nil {
+			return 0, brokerapi.ErrRawParamsInvalid
+		}
+		return quota, nil
+	default:
+		return 0, brokerapi.ErrRawParamsInvalid
+	}
+}
+
+func evaluateId(id interface{}) (int, error) {
+	switch id := id.(type) {
+	case float64:
+		if id < 0 || id > math.MaxInt32 || id != math.Trunc(id) {
+			return 0, brokerapi.ErrRawParamsInvalid
+		}
+		return int(id), nil
+	case string:
+		value, err := strconv.ParseUint(id, 10, 31)
+		if err != nil {
+			return 0, brokerapi.ErrRawParamsInvalid
+		}
+		return int(value), nil
+	default:
+		return 0, brokerapi.ErrRawParamsInvalid
+	}
+}
+
+// evaluatePermissions accepts an octal permission string such as "0775" or "775".
+func evaluatePermissions(mode interface{}) (os.FileMode, error) {
+	modeString, ok := mode.(string)
+	if !ok {
+		return 0, brokerapi.ErrRawParamsInvalid
+	}
+	value, err := strconv.ParseUint(modeString, 8, 32)
+	if err != nil || value == 0 || value > 0777 {
+		return 0, brokerapi.ErrRawParamsInvalid
+	}
+	return os.FileMode(value), nil
+}
+
+var sizeUnits = map[string]uint64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// parseSize converts a size such as "512M" or "10G" into bytes.
+func parseSize(sizeString string) (uint64, error) {
+	size := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(sizeString)), "B")
+	i := strings.IndexFunc(size, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(size)
+	}
+	unit, ok := sizeUnits[strings.TrimSuffix(size[i:], "I")]
+	if !ok || i == 0 {
+		return 0, fmt.Errorf("invalid size '%s'", sizeString)
+	}
+	value, err := strconv.ParseUint(size[:i], 10, 64)
+	if err != nil || value == 0 || value > math.MaxUint64/unit {
+		return 0, fmt.Errorf("invalid size '%s'", sizeString)
+	}
+	return value * unit, nil
+}
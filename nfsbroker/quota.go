@@ -0,0 +1,148 @@
+package nfsbroker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	QuotaBackendNone = "none"
+	QuotaBackendXfs  = "xfs"
+	QuotaBackendExt4 = "ext4"
+)
+
+var ErrQuotaNotSupported = errors.New("disk quotas are not enabled on this broker")
+
+// QuotaDriver enforces a size limit on a share directory through filesystem project quotas.
+type QuotaDriver interface {
+	SetQuota(ctx context.Context, logger lager.Logger, sharePath string, projectId uint32, limit uint64) error
+	RemoveQuota(ctx context.Context, logger lager.Logger, sharePath string, projectId uint32) error
+}
+
+func NewQuotaDriver(backend string, invoker Invoker, mountPoint string) (QuotaDriver, error) {
+	switch backend {
+	case "", QuotaBackendNone:
+		return &noopQuotaDriver{}, nil
+	case QuotaBackendXfs:
+		return &xfsQuotaDriver{invoker: invoker, mountPoint: mountPoint}, nil
+	case QuotaBackendExt4:
+		return &ext4QuotaDriver{invoker: invoker, mountPoint: mountPoint}, nil
+	default:
+		return nil, fmt.Errorf("unknown quota backend '%s'", backend)
+	}
+}
+
+// shareProjectId is the quota project id of a share, the broker allocates the project ids of its instances.
+// Shares created before project ids were allocated, given 0, keep the project id derived from their name.
+func shareProjectId(shareName string, projectId uint32) uint32 {
+	if projectId != 0 {
+		return projectId
+	}
+	return legacyShareProjectId(shareName)
+}
+
+// legacyShareProjectId derives the quota project id of a share from its name, 0 is reserved
+// by the filesystems for files without a project.
+func legacyShareProjectId(shareName string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(shareName))
+	return h.Sum32()&0x7fffffff | 1
+}
+
+type noopQuotaDriver struct{}
+
+func (d *noopQuotaDriver) SetQuota(ctx context.Context, logger lager.Logger, sharePath string, projectId uint32, limit uint64) error {
+	if limit > 0 {
+		return ErrQuotaNotSupported
+	}
+	return nil
+}
+
+func (d *noopQuotaDriver) RemoveQuota(ctx context.Context, logger lager.Logger, sharePath string, projectId uint32) error {
+	return nil
+}
+
+// xfsQuotaDriver uses xfs_quota, the export must be mounted with the prjquota option.
+type xfsQuotaDriver struct {
+	invoker    Invoker
+	mountPoint string
+}
+
+func (d *xfsQuotaDriver) SetQuota(ctx context.Context, logger lager.Logger, sharePath string, projectId uint32, limit uint64) error {
+	logger = logger.Session("xfs-set-quota")
+	logger.Info("start", lager.Data{"share-path": sharePath, "project-id": projectId, "limit": limit})
+	defer logger.Info("end")
+
+	id := strconv.FormatUint(uint64(projectId), 10)
+	err := d.xfsQuota(ctx, logger, fmt.Sprintf("project -s -p %s %s", sharePath, id))
+	if err != nil {
+		return err
+	}
+	return d.xfsQuota(ctx, logger, fmt.Sprintf("limit -p bhard=%d %s", limit, id))
+}
+
+func (d *xfsQuotaDriver) RemoveQuota(ctx context.Context, logger lager.Logger, sharePath string, projectId uint32) error {
+	logger = logger.Session("xfs-remove-quota")
+	logger.Info("start", lager.Data{"share-path": sharePath, "project-id": projectId})
+	defer logger.Info("end")
+
+	id := strconv.FormatUint(uint64(projectId), 10)
+	err := d.xfsQuota(ctx, logger, fmt.Sprintf("limit -p bhard=0 %s", id))
+	if err != nil {
+		return err
+	}
+	return d.xfsQuota(ctx, logger, fmt.Sprintf("project -C -p %s %s", sharePath, id))
+}
+
+func (d *xfsQuotaDriver) xfsQuota(ctx context.Context, logger lager.Logger, command string) error {
+	err := d.invoker.Invoke(ctx, logger, "xfs_quota", []string{"-x", "-c", command, d.mountPoint})
+	if err != nil {
+		logger.Error("xfs-quota-failed", err, lager.Data{"command": command})
+		return failure(err, "failed to run xfs_quota '%s'", command)
+	}
+	return nil
+}
+
+// ext4QuotaDriver uses chattr and setquota, the export must be mounted with the prjquota option.
+type ext4QuotaDriver struct {
+	invoker    Invoker
+	mountPoint string
+}
+
+func (d *ext4QuotaDriver) SetQuota(ctx context.Context, logger lager.Logger, sharePath string, projectId uint32, limit uint64) error {
+	logger = logger.Session("ext4-set-quota")
+	logger.Info("start", lager.Data{"share-path": sharePath, "project-id": projectId, "limit": limit})
+	defer logger.Info("end")
+
+	id := strconv.FormatUint(uint64(projectId), 10)
+	err := d.invoke(ctx, logger, "chattr", []string{"-R", "+P", "-p", id, sharePath})
+	if err != nil {
+		return err
+	}
+	// setquota takes block limits in KiB
+	blocks := strconv.FormatUint((limit+1023)/1024, 10)
+	return d.invoke(ctx, logger, "setquota", []string{"-P", id, "0", blocks, "0", "0", d.mountPoint})
+}
+
+func (d *ext4QuotaDriver) RemoveQuota(ctx context.Context, logger lager.Logger, sharePath string, projectId uint32) error {
+	logger = logger.Session("ext4-remove-quota")
+	logger.Info("start", lager.Data{"share-path": sharePath, "project-id": projectId})
+	defer logger.Info("end")
+
+	id := strconv.FormatUint(uint64(projectId), 10)
+	return d.invoke(ctx, logger, "setquota", []string{"-P", id, "0", "0", "0", "0", d.mountPoint})
+}
+
+func (d *ext4QuotaDriver) invoke(ctx context.Context, logger lager.Logger, executable string, args []string) error {
+	err := d.invoker.Invoke(ctx, logger, executable, args)
+	if err != nil {
+		logger.Error("quota-command-failed", err, lager.Data{"cmd": executable, "args": args})
+		return failure(err, "failed to run %s", executable)
+	}
+	return nil
+}
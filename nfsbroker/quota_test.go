@@ -0,0 +1,213 @@
+package nfsbroker
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Quota drivers", func() {
+	var (
+		ctx     context.Context
+		logger  lager.Logger
+		invoker *fakeInvoker
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		logger = lager.NewLogger("quota-test")
+		invoker = &fakeInvoker{}
+	})
+
+	Describe("xfs", func() {
+		var driver QuotaDriver
+
+		BeforeEach(func() {
+			var err error
+			driver, err = NewQuotaDriver(QuotaBackendXfs, invoker, "/mnt/export")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("assigns the share to its project and limits the project", func() {
+			Expect(driver.SetQuota(ctx, logger, "/mnt/export/share", 7, 1<<30)).To(Succeed())
+			Expect(invoker.Calls()).To(Equal([][]string{
+				{"xfs_quota", "-x", "-c", "project -s -p /mnt/export/share 7", "/mnt/export"},
+				{"xfs_quota", "-x", "-c", "limit -p bhard=1073741824 7", "/mnt/export"},
+			}))
+		})
+
+		It("lifts the limit of the project and clears the project of the share", func() {
+			Expect(driver.RemoveQuota(ctx, logger, "/mnt/export/share", 7)).To(Succeed())
+			Expect(invoker.Calls()).To(Equal([][]string{
+				{"xfs_quota", "-x", "-c", "limit -p bhard=0 7", "/mnt/export"},
+				{"xfs_quota", "-x", "-c", "project -C -p /mnt/export/share 7", "/mnt/export"},
+			}))
+		})
+
+		It("stops at the first failing command", func() {
+			invoker.InvokeStub = func(string, []string) error { return errors.New("not mounted with prjquota") }
+			err := driver.SetQuota(ctx, logger, "/mnt/export/share", 7, 1<<30)
+			Expect(err).To(MatchError(ContainSubstring("failed to run xfs_quota 'project -s -p /mnt/export/share 7'")))
+			Expect(invoker.Calls()).To(HaveLen(1))
+		})
+	})
+
+	Describe("ext4", func() {
+		var driver QuotaDriver
+
+		BeforeEach(func() {
+			var err error
+			driver, err = NewQuotaDriver(QuotaBackendExt4, invoker, "/mnt/export")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("assigns the share to its project and limits the project in KiB, rounded up", func() {
+			Expect(driver.SetQuota(ctx, logger, "/mnt/export/share", 7, 1025)).To(Succeed())
+			Expect(invoker.Calls()).To(Equal([][]string{
+				{"chattr", "-R", "+P", "-p", "7", "/mnt/export/share"},
+				{"setquota", "-P", "7", "0", "2", "0", "0", "/mnt/export"},
+			}))
+		})
+
+		It("lifts the limit of the project", func() {
+			Expect(driver.RemoveQuota(ctx, logger, "/mnt/export/share", 7)).To(Succeed())
+			Expect(invoker.Calls()).To(Equal([][]string{
+				{"setquota", "-P", "7", "0", "0", "0", "0", "/mnt/export"},
+			}))
+		})
+
+		It("reports a failing command", func() {
+			invoker.InvokeStub = func(string, []string) error { return errors.New("quotas are off") }
+			Expect(driver.RemoveQuota(ctx, logger, "/mnt/export/share", 7)).To(MatchError(ContainSubstring("failed to run setquota")))
+		})
+	})
+
+	It("rejects limits without a quota backend", func() {
+		driver, err := NewQuotaDriver(QuotaBackendNone, invoker, "/mnt/export")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(driver.SetQuota(ctx, logger, "/mnt/export/share", 7, 1)).To(Equal(ErrQuotaNotSupported))
+		Expect(driver.SetQuota(ctx, logger, "/mnt/export/share", 7, 0)).To(Succeed())
+		Expect(invoker.Calls()).To(BeEmpty())
+	})
+
+	It("rejects an unknown quota backend", func() {
+		_, err := NewQuotaDriver("btrfs", invoker, "/mnt/export")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("derives the project id of shares without an allocated one from their name", func() {
+		Expect(shareProjectId("share", 7)).To(Equal(uint32(7)))
+		Expect(shareProjectId("share", 0)).To(Equal(legacyShareProjectId("share")))
+		Expect(legacyShareProjectId("share")).NotTo(BeZero())
+	})
+})
+
+var _ = Describe("Quota project ids", func() {
+	var (
+		store   *memoryStore
+		invoker *fakeInvoker
+		tb      testBroker
+	)
+
+	BeforeEach(func() {
+		store = newMemoryStore()
+		invoker = &fakeInvoker{}
+		tb = newTestBroker(store, invoker, testCatalog())
+	})
+
+	AfterEach(func() {
+		tb.cleanup()
+	})
+
+	provision := func(instanceID, planID string) error {
+		_, err := tb.Provision(instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID}, false)
+		return err
+	}
+
+	projectId := func(instanceID string) uint32 {
+		metadata, err := store.RetrieveMetadata(tb.logger, instanceID)
+		Expect(err).NotTo(HaveOccurred())
+		return metadata.ProjectId
+	}
+
+	quotaCommands := func() []string {
+		commands := []string{}
+		for _, call := range invoker.Calls() {
+			commands = append(commands, call[3])
+		}
+		return commands
+	}
+
+	It("allocates the lowest project id not in use and persists it", func() {
+		Expect(provision("instance-1", "big-plan-id")).To(Succeed())
+		Expect(provision("instance-2", "big-plan-id")).To(Succeed())
+		Expect(provision("instance-3", "big-plan-id")).To(Succeed())
+		Expect([]uint32{projectId("instance-1"), projectId("instance-2"), projectId("instance-3")}).To(Equal([]uint32{1, 2, 3}))
+
+		_, err := tb.Deprovision("instance-2", brokerapi.DeprovisionDetails{}, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(provision("instance-4", "big-plan-id")).To(Succeed())
+		Expect(projectId("instance-4")).To(Equal(uint32(2)))
+
+		share := filepath.Join(tb.mountPoint, "instance-2")
+		Expect(quotaCommands()).To(ContainElement("project -s -p " + share + " 2"))
+		Expect(quotaCommands()).To(ContainElement("project -C -p " + share + " 2"))
+	})
+
+	It("skips the project ids derived from the share names of older instances", func() {
+		Expect(store.CreateInstanceDetails(tb.logger, "legacy", brokerapi.ProvisionDetails{PlanID: "plan-id"})).To(Succeed())
+		Expect(store.CreateInstanceDetails(tb.logger, "recorded", brokerapi.ProvisionDetails{PlanID: "plan-id"})).To(Succeed())
+		Expect(store.SaveMetadata(tb.logger, "recorded", Metadata{ShareName: "recorded", ProjectId: 1})).To(Succeed())
+
+		used, err := tb.usedProjectIds(tb.logger, "new")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(used).To(Equal(map[uint32]bool{legacyShareProjectId("legacy"): true, 1: true}))
+
+		Expect(provision("new", "plan-id")).To(Succeed())
+		Expect(projectId("new")).To(Equal(uint32(2)))
+	})
+
+	It("gives up a project id allocated to another instance at the same time", func() {
+		racing := &racingStore{memoryStore: store}
+		tb.store = racing
+
+		Expect(provision("instance", "plan-id")).To(Equal(ErrProjectIdInUse))
+		Expect(store.instances).NotTo(HaveKey("instance"))
+		Expect(store.metadata).NotTo(HaveKey("instance"))
+	})
+
+	It("removes the quota when an update leaves the share unlimited", func() {
+		Expect(provision("instance", "big-plan-id")).To(Succeed())
+		share := filepath.Join(tb.mountPoint, "instance")
+		Expect(quotaCommands()).To(Equal([]string{"project -s -p " + share + " 1", "limit -p bhard=10737418240 1"}))
+
+		_, err := tb.Update("instance", brokerapi.UpdateDetails{PlanID: "plan-id"}, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(quotaCommands()[2:]).To(Equal([]string{"limit -p bhard=0 1", "project -C -p " + share + " 1"}))
+	})
+
+	It("sets no quota on a new share without one", func() {
+		Expect(provision("instance", "plan-id")).To(Succeed())
+		Expect(invoker.Calls()).To(BeEmpty())
+	})
+})
+
+// racingStore stores the metadata of another instance with the same project id along with the metadata of
+// an instance, as a broker sharing the store would.
+type racingStore struct {
+	*memoryStore
+}
+
+func (s *racingStore) SaveMetadata(logger lager.Logger, id string, metadata Metadata) error {
+	if metadata.ProjectId != 0 && id != "other" {
+		s.memoryStore.CreateInstanceDetails(logger, "other", brokerapi.ProvisionDetails{})
+		s.memoryStore.SaveMetadata(logger, "other", Metadata{ShareName: "other", ProjectId: metadata.ProjectId})
+	}
+	return s.memoryStore.SaveMetadata(logger, id, metadata)
+}
@@ -0,0 +1,216 @@
+package nfsbroker
+
+import (
+	"context"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// ReconcileReport lists the differences between the share directories of a backend and its instances.
+type ReconcileReport struct {
+	Backend string    `json:"backend"`
+	Time    time.Time `json:"time"`
+	// share directories without an instance
+	Orphans []string `json:"orphans"`
+	// instances without a share directory
+	Dangling []string `json:"dangling"`
+	// orphans moved into the quarantine directory, by share name
+	Quarantined map[string]string `json:"quarantined,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// Reconciler periodically compares the share directories of each backend with the instances of the store.
+// With quarantine enabled, shares found orphaned by two runs in a row are moved aside.
+type Reconciler struct {
+	logger     lager.Logger
+	backends   *Backends
+	store      Store
+	metrics    *Metrics
+	interval   time.Duration
+	quarantine bool
+
+	mutex sync.Mutex
+	last  []ReconcileReport
+	// orphans found by the last run, by backend
+	orphans map[string]map[string]bool
+}
+
+func NewReconciler(logger lager.Logger, backends *Backends, store Store, metrics *Metrics, interval time.Duration, quarantine bool) *Reconciler {
+	return &Reconciler{
+		logger:     logger,
+		backends:   backends,
+		store:      store,
+		metrics:    metrics,
+		interval:   interval,
+		quarantine: quarantine,
+		last:       []ReconcileReport{},
+		orphans:    map[string]map[string]bool{},
+	}
+}
+
+func (r *Reconciler) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	close(ready)
+	for {
+		select {
+		case <-ticker.C:
+			r.Reconcile()
+		case <-signals:
+			return nil
+		}
+	}
+}
+
+// LastReport returns the reports of the last run, one per backend.
+func (r *Reconciler) LastReport() []ReconcileReport {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.last
+}
+
+// Reconcile compares the share directories of each backend with its instances and reports the differences.
+func (r *Reconciler) Reconcile() []ReconcileReport {
+	logger := r.logger.Session("reconcile")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// the calls to the exports are only bounded by the timeouts of the clients
+	ctx := context.Background()
+
+	// shares are listed before the instances, a share created in between then belongs to a listed instance
+	reports := []ReconcileReport{}
+	shares := map[string][]string{}
+	for _, backend := range r.backends.All() {
+		report := ReconcileReport{Backend: backend.Name, Time: time.Now(), Orphans: []string{}, Dangling: []string{}}
+		var err error
+		if shares[backend.Name], err = listShares(ctx, logger, backend); err != nil {
+			report.Error = err.Error()
+		}
+		reports = append(reports, report)
+	}
+	instances, err := r.instanceShares(logger)
+
+	for i, backend := range r.backends.All() {
+		report := &reports[i]
+		if err != nil && report.Error == "" {
+			report.Error = err.Error()
+		}
+		if report.Error != "" {
+			r.metrics.AddCounter("nfsbroker_reconcile_failures_total", "Reconciler runs that failed.", 1, "backend", backend.Name)
+			continue
+		}
+		compare(shares[backend.Name], instances[backend.Name], report)
+		r.quarantineOrphans(ctx, logger, backend, report)
+		r.metrics.SetGauge("nfsbroker_orphaned_shares", "Share directories without an instance.", float64(len(report.Orphans)-len(report.Quarantined)), "backend", backend.Name)
+		r.metrics.SetGauge("nfsbroker_dangling_instances", "Instances without a share directory.", float64(len(report.Dangling)), "backend", backend.Name)
+		logger.Info("reconciled", lager.Data{"backend": backend.Name, "orphans": report.Orphans, "dangling": report.Dangling, "quarantined": report.Quarantined})
+	}
+	r.metrics.AddCounter("nfsbroker_reconcile_runs_total", "Reconciler runs.", 1)
+
+	r.last = reports
+	return reports
+}
+
+// instanceShare is the share an instance expects on its backend.
+type instanceShare struct {
+	instanceID string
+	shareName  string
+	// the share of an instance being provisioned or deprovisioned may legitimately be missing
+	inProgress bool
+}
+
+// instanceShares returns the shares of the instances by backend.
+func (r *Reconciler) instanceShares(logger lager.Logger) (map[string][]instanceShare, error) {
+	instances, err := r.store.ListInstanceDetails(logger)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := r.store.ListMetadata(logger)
+	if err != nil {
+		return nil, err
+	}
+	operations, err := r.store.ListOperations(logger)
+	if err != nil {
+		return nil, err
+	}
+
+	shares := map[string][]instanceShare{}
+	for instanceID := range instances {
+		shareName := metadata[instanceID].ShareName
+		if shareName == "" {
+			shareName = instanceID
+		}
+		backend := metadata[instanceID].Backend
+		if backend == "" {
+			backend = r.backends.Default().Name
+		}
+		op, ok := operations[instanceID]
+		shares[backend] = append(shares[backend], instanceShare{
+			instanceID: instanceID,
+			shareName:  shareName,
+			inProgress: ok && op.State == brokerapi.InProgress,
+		})
+	}
+	return shares, nil
+}
+
+func listShares(ctx context.Context, logger lager.Logger, backend *Backend) ([]string, error) {
+	if err := ensureMounted(ctx, logger, backend.Client); err != nil {
+		return nil, err
+	}
+	return backend.Client.ListShares(ctx, logger)
+}
+
+// compare reports the share directories of a backend without an instance and the instances without a share.
+func compare(shares []string, instances []instanceShare, report *ReconcileReport) {
+	existing := map[string]bool{}
+	for _, share := range shares {
+		existing[share] = true
+	}
+	expected := map[string]bool{}
+	for _, instance := range instances {
+		expected[instance.shareName] = true
+		if !instance.inProgress && !existing[instance.shareName] {
+			report.Dangling = append(report.Dangling, instance.instanceID)
+		}
+	}
+	for _, share := range shares {
+		if !expected[share] {
+			report.Orphans = append(report.Orphans, share)
+		}
+	}
+	sort.Strings(report.Orphans)
+	sort.Strings(report.Dangling)
+}
+
+func (r *Reconciler) quarantineOrphans(ctx context.Context, logger lager.Logger, backend *Backend, report *ReconcileReport) {
+	orphans := map[string]bool{}
+	for _, share := range report.Orphans {
+		orphans[share] = true
+		if !r.quarantine || !r.orphans[backend.Name][share] {
+			continue
+		}
+		target, err := backend.Client.QuarantineShare(ctx, logger, share)
+		if err != nil {
+			continue
+		}
+		if report.Quarantined == nil {
+			report.Quarantined = map[string]string{}
+		}
+		report.Quarantined[share] = target
+		delete(orphans, share)
+		r.metrics.AddCounter("nfsbroker_quarantined_shares_total", "Orphaned shares moved into quarantine.", 1, "backend", backend.Name)
+	}
+	r.orphans[backend.Name] = orphans
+}
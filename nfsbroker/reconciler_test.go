@@ -0,0 +1,118 @@
+package nfsbroker
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reconciler", func() {
+	var (
+		store      *memoryStore
+		tb         testBroker
+		metrics    *Metrics
+		reconciler *Reconciler
+	)
+
+	sample := func(name string) float64 {
+		for _, sample := range metrics.Samples() {
+			if sample.Name == name {
+				return sample.Value
+			}
+		}
+		return 0
+	}
+
+	provision := func(instanceID string) {
+		_, err := tb.Provision(instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id"}, false)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		store = newMemoryStore()
+		tb = newTestBroker(store, &fakeInvoker{}, testCatalog())
+		metrics = NewMetrics()
+		reconciler = NewReconciler(tb.logger, tb.backends, store, metrics, 0, false)
+	})
+
+	AfterEach(func() {
+		tb.cleanup()
+	})
+
+	It("reports the shares without an instance and the instances without a share", func() {
+		provision("instance-1")
+		provision("instance-2")
+		Expect(os.Mkdir(filepath.Join(tb.mountPoint, "orphan"), 0700)).To(Succeed())
+		Expect(os.Remove(filepath.Join(tb.mountPoint, "instance-2"))).To(Succeed())
+
+		reports := reconciler.Reconcile()
+		Expect(reports).To(HaveLen(1))
+		Expect(reports[0].Backend).To(Equal(DefaultBackendName))
+		Expect(reports[0].Orphans).To(Equal([]string{"orphan"}))
+		Expect(reports[0].Dangling).To(Equal([]string{"instance-2"}))
+		Expect(reports[0].Error).To(BeEmpty())
+		Expect(reconciler.LastReport()).To(Equal(reports))
+		Expect(sample("nfsbroker_orphaned_shares")).To(Equal(1.0))
+		Expect(sample("nfsbroker_dangling_instances")).To(Equal(1.0))
+	})
+
+	It("does not report the missing share of an instance with an operation in progress", func() {
+		Expect(store.CreateInstanceDetails(tb.logger, "instance", brokerapi.ProvisionDetails{PlanID: "plan-id"})).To(Succeed())
+		Expect(store.StartOperation(tb.logger, "instance", tb.operation(OperationProvision, brokerapi.InProgress, "creating share"))).To(Succeed())
+
+		reports := reconciler.Reconcile()
+		Expect(reports[0].Dangling).To(BeEmpty())
+	})
+
+	It("leaves the trash and the quarantine out", func() {
+		provision("instance")
+		_, err := tb.Deprovision("instance", brokerapi.DeprovisionDetails{}, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tb.trash()).To(HaveLen(1))
+
+		reports := reconciler.Reconcile()
+		Expect(reports[0].Orphans).To(BeEmpty())
+	})
+
+	It("quarantines a share found orphaned by two runs in a row", func() {
+		reconciler = NewReconciler(tb.logger, tb.backends, store, metrics, 0, true)
+		Expect(os.Mkdir(filepath.Join(tb.mountPoint, "orphan"), 0700)).To(Succeed())
+
+		reports := reconciler.Reconcile()
+		Expect(reports[0].Quarantined).To(BeEmpty())
+		Expect(tb.shares()).To(ConsistOf("orphan"))
+
+		reports = reconciler.Reconcile()
+		Expect(reports[0].Quarantined).To(HaveKey("orphan"))
+		Expect(reports[0].Quarantined["orphan"]).To(HavePrefix(filepath.Join(tb.mountPoint, QuarantineDir)))
+		Expect(tb.shares()).To(BeEmpty())
+		Expect(sample("nfsbroker_orphaned_shares")).To(Equal(0.0))
+		Expect(sample("nfsbroker_quarantined_shares_total")).To(Equal(1.0))
+	})
+
+	It("does not quarantine a share which got an instance between two runs", func() {
+		reconciler = NewReconciler(tb.logger, tb.backends, store, metrics, 0, true)
+		Expect(os.Mkdir(filepath.Join(tb.mountPoint, "instance"), 0700)).To(Succeed())
+		Expect(reconciler.Reconcile()[0].Orphans).To(Equal([]string{"instance"}))
+
+		Expect(store.CreateInstanceDetails(tb.logger, "instance", brokerapi.ProvisionDetails{PlanID: "plan-id"})).To(Succeed())
+		reports := reconciler.Reconcile()
+		Expect(reports[0].Orphans).To(BeEmpty())
+		Expect(reports[0].Quarantined).To(BeEmpty())
+		Expect(tb.shares()).To(ConsistOf("instance"))
+	})
+
+	It("reports a backend which cannot be listed as failed", func() {
+		tb.client.SetMountError(tb.logger, errors.New("connection refused"))
+
+		reports := reconciler.Reconcile()
+		Expect(reports[0].Error).NotTo(BeEmpty())
+		Expect(sample("nfsbroker_reconcile_failures_total")).To(Equal(1.0))
+		Expect(sample("nfsbroker_reconcile_runs_total")).To(Equal(1.0))
+	})
+})
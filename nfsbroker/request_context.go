@@ -0,0 +1,195 @@
+package nfsbroker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const OriginatingIdentityHeader = "X-Broker-API-Originating-Identity"
+
+// maxRequestBodySize limits the bodies of the requests read to find their context
+const maxRequestBodySize = 1 << 20
+
+// RequestContext describes where an instance or binding comes from, as sent by the platform
+// in the context object of the request and the originating identity header.
+type RequestContext struct {
+	Platform         string               `json:"platform,omitempty"`
+	OrganizationGUID string               `json:"organization_guid,omitempty"`
+	SpaceGUID        string               `json:"space_guid,omitempty"`
+	Namespace        string               `json:"namespace,omitempty"`
+	InstanceName     string               `json:"instance_name,omitempty"`
+	Identity         *OriginatingIdentity `json:"originating_identity,omitempty"`
+}
+
+// OriginatingIdentity is the user of the platform on whose behalf a request was made.
+type OriginatingIdentity struct {
+	Platform string                 `json:"platform"`
+	Value    map[string]interface{} `json:"value"`
+}
+
+// User returns the id of the user, cloudfoundry sends a user_id and kubernetes a username.
+func (i *OriginatingIdentity) User() string {
+	if i == nil {
+		return ""
+	}
+	for _, key := range []string{"user_id", "username"} {
+		if user, ok := i.Value[key].(string); ok {
+			return user
+		}
+	}
+	return ""
+}
+
+// parseOriginatingIdentity parses the '<platform> <base64 encoded json>' header value.
+func parseOriginatingIdentity(header string) (*OriginatingIdentity, bool) {
+	parts := strings.Fields(header)
+	if len(parts) != 2 {
+		return nil, false
+	}
+	data, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, false
+	}
+	identity := &OriginatingIdentity{Platform: parts[0]}
+	if err := json.Unmarshal(data, &identity.Value); err != nil {
+		return nil, false
+	}
+	return identity, true
+}
+
+// requestContexts hands the context of a request received by the api to the broker, the broker api
+// only passes the decoded details on. Contexts are keyed by the instance or binding id of the request.
+type requestContexts struct {
+	mutex    sync.Mutex
+	contexts map[string]*RequestContext
+}
+
+func newRequestContexts() *requestContexts {
+	return &requestContexts{contexts: map[string]*RequestContext{}}
+}
+
+// track makes the context available until the returned function is called.
+func (r *requestContexts) track(id string, context RequestContext) func() {
+	tracked := &context
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.contexts[id] = tracked
+
+	return func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if r.contexts[id] == tracked {
+			delete(r.contexts, id)
+		}
+	}
+}
+
+func (r *requestContexts) get(id string) RequestContext {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if context, ok := r.contexts[id]; ok {
+		return *context
+	}
+	return RequestContext{}
+}
+
+// RequestContextTracker receives the contexts of the requests for instances and bindings.
+type RequestContextTracker interface {
+	TrackRequestContext(id string, context RequestContext) func()
+}
+
+func (b *broker) TrackRequestContext(id string, context RequestContext) func() {
+	return b.requests.track(id, context)
+}
+
+// NewRequestContextHandler parses the context object and originating identity header of the requests
+// for instances and bindings and tracks them while the request is handled.
+func NewRequestContextHandler(handler http.Handler, tracker RequestContextTracker, logger lager.Logger) http.Handler {
+	return &requestContextHandler{handler: handler, tracker: tracker, logger: logger}
+}
+
+type requestContextHandler struct {
+	handler http.Handler
+	tracker RequestContextTracker
+	logger  lager.Logger
+}
+
+func (h *requestContextHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	id, ok := requestResourceID(req.URL.Path)
+	if !ok {
+		h.handler.ServeHTTP(w, req)
+		return
+	}
+
+	context := RequestContext{}
+	if header := req.Header.Get(OriginatingIdentityHeader); header != "" {
+		identity, ok := parseOriginatingIdentity(header)
+		if !ok {
+			h.logger.Info("invalid-originating-identity", lager.Data{"header": header})
+		}
+		context.Identity = identity
+	}
+
+	if req.Method == "PUT" || req.Method == "PATCH" {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxRequestBodySize))
+		req.Body.Close()
+		if err != nil {
+			h.logger.Error("failed-to-read-request", err)
+			if _, ok := err.(*http.MaxBytesError); ok {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		// an invalid body is rejected by the broker api, the context is only taken when it can be read
+		var request struct {
+			Context RequestContext `json:"context"`
+		}
+		if json.Unmarshal(body, &request) == nil {
+			request.Context.Identity = context.Identity
+			context = request.Context
+		}
+	}
+
+	defer h.tracker.TrackRequestContext(id, context)()
+	h.handler.ServeHTTP(w, req)
+}
+
+// requestResourceID returns the binding id of binding requests and the instance id of instance requests.
+func requestResourceID(path string) (string, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) == 3 && parts[0] == "v2" && parts[1] == "service_instances":
+		return parts[2], true
+	case len(parts) == 5 && parts[0] == "v2" && parts[1] == "service_instances" && parts[3] == "service_bindings":
+		return parts[4], true
+	}
+	return "", false
+}
+
+// audit records who changed an instance or binding.
+func (b *broker) audit(action, id string, metadata Metadata) {
+	context := metadata.Context
+	b.logger.Session("audit").Info(action, lager.Data{
+		"id":                id,
+		"share":             metadata.ShareName,
+		"platform":          context.Platform,
+		"organization-guid": context.OrganizationGUID,
+		"space-guid":        context.SpaceGUID,
+		"namespace":         context.Namespace,
+		"instance-name":     context.InstanceName,
+		"user":              context.Identity.User(),
+	})
+}
@@ -0,0 +1,123 @@
+package nfsbroker
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Request contexts", func() {
+	var (
+		store   *memoryStore
+		tb      testBroker
+		handler http.Handler
+	)
+
+	identity := func(platform, value string) string {
+		return platform + " " + base64.StdEncoding.EncodeToString([]byte(value))
+	}
+
+	request := func(method, path, body, identityHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if identityHeader != "" {
+			req.Header.Set(OriginatingIdentityHeader, identityHeader)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	BeforeEach(func() {
+		store = newMemoryStore()
+		tb = newTestBroker(store, &fakeInvoker{}, testCatalog())
+		router := mux.NewRouter()
+		brokerapi.AttachRoutes(router, tb.broker, tb.logger)
+		handler = NewRequestContextHandler(router, tb.broker, tb.logger)
+	})
+
+	AfterEach(func() {
+		tb.cleanup()
+	})
+
+	It("records the context object and the originating identity of a provision", func() {
+		response := request("PUT", "/v2/service_instances/instance", `{
+			"service_id": "service-id", "plan_id": "plan-id", "organization_guid": "org", "space_guid": "space",
+			"context": {"platform": "cloudfoundry", "organization_guid": "org", "space_guid": "space", "instance_name": "db"}
+		}`, identity("cloudfoundry", `{"user_id": "user"}`))
+		Expect(response.Code).To(Equal(http.StatusCreated))
+
+		context := store.metadata["instance"].Context
+		Expect(context.Platform).To(Equal("cloudfoundry"))
+		Expect(context.OrganizationGUID).To(Equal("org"))
+		Expect(context.SpaceGUID).To(Equal("space"))
+		Expect(context.InstanceName).To(Equal("db"))
+		Expect(context.Identity.User()).To(Equal("user"))
+		Expect(tb.requests.get("instance")).To(Equal(RequestContext{}))
+	})
+
+	It("falls back to the organization and space of the details without a context object", func() {
+		response := request("PUT", "/v2/service_instances/instance", `{"service_id": "service-id", "plan_id": "plan-id", "organization_guid": "org", "space_guid": "space"}`, "")
+		Expect(response.Code).To(Equal(http.StatusCreated))
+		Expect(store.metadata["instance"].Context).To(Equal(RequestContext{OrganizationGUID: "org", SpaceGUID: "space"}))
+	})
+
+	It("records the context of a binding under the binding id", func() {
+		Expect(request("PUT", "/v2/service_instances/instance", `{"service_id": "service-id", "plan_id": "plan-id"}`, "").Code).To(Equal(http.StatusCreated))
+
+		response := request("PUT", "/v2/service_instances/instance/service_bindings/binding", `{
+			"service_id": "service-id", "plan_id": "plan-id", "app_guid": "app", "context": {"platform": "kubernetes", "namespace": "apps"}
+		}`, identity("kubernetes", `{"username": "admin"}`))
+		Expect(response.Code).To(Equal(http.StatusCreated))
+
+		context := store.metadata["binding"].Context
+		Expect(context.Namespace).To(Equal("apps"))
+		Expect(context.Identity.User()).To(Equal("admin"))
+	})
+
+	It("handles a request with an invalid originating identity without it", func() {
+		response := request("PUT", "/v2/service_instances/instance", `{"service_id": "service-id", "plan_id": "plan-id", "context": {"platform": "cloudfoundry"}}`, "cloudfoundry not-base64")
+		Expect(response.Code).To(Equal(http.StatusCreated))
+		Expect(store.metadata["instance"].Context.Platform).To(Equal("cloudfoundry"))
+		Expect(store.metadata["instance"].Context.Identity).To(BeNil())
+	})
+
+	It("rejects a request body over the size limit", func() {
+		body := `{"service_id": "service-id", "plan_id": "plan-id", "parameters": {"padding": "` + strings.Repeat("x", maxRequestBodySize) + `"}}`
+		Expect(request("PUT", "/v2/service_instances/instance", body, "").Code).To(Equal(http.StatusRequestEntityTooLarge))
+		Expect(request("PATCH", "/v2/service_instances/instance", body, "").Code).To(Equal(http.StatusRequestEntityTooLarge))
+		Expect(store.instances).To(BeEmpty())
+	})
+
+	It("parses the originating identity header", func() {
+		parsed, ok := parseOriginatingIdentity(identity("cloudfoundry", `{"user_id": "user"}`))
+		Expect(ok).To(BeTrue())
+		Expect(parsed.Platform).To(Equal("cloudfoundry"))
+		Expect(parsed.User()).To(Equal("user"))
+
+		for _, header := range []string{"", "cloudfoundry", identity("cloudfoundry", "not json"), "cloudfoundry !!! extra"} {
+			_, ok := parseOriginatingIdentity(header)
+			Expect(ok).To(BeFalse(), header)
+		}
+	})
+
+	It("finds the instance or binding of a request", func() {
+		for path, expected := range map[string]string{
+			"/v2/service_instances/instance":                          "instance",
+			"/v2/service_instances/instance/service_bindings/binding": "binding",
+			"/v2/service_instances/instance/last_operation":           "",
+			"/v2/catalog":               "",
+			"/admin/snapshots/instance": "",
+		} {
+			id, ok := requestResourceID(path)
+			Expect(ok).To(Equal(expected != ""), path)
+			Expect(id).To(Equal(expected), path)
+		}
+	})
+})
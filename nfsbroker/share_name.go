@@ -0,0 +1,69 @@
+package nfsbroker
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// shareNameFields are available to share name templates, e.g. '{{.Namespace}}-{{.InstanceID}}'.
+type shareNameFields struct {
+	InstanceID       string
+	Platform         string
+	OrganizationGUID string
+	SpaceGUID        string
+	Namespace        string
+	InstanceName     string
+}
+
+var invalidShareNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// ShareNamer names the directory of the share of a new instance.
+type ShareNamer struct {
+	template *template.Template
+}
+
+// NewShareNamer parses a share name template, an empty template names shares after their instance id.
+// The template has to use the instance id so that share names are unique.
+func NewShareNamer(nameTemplate string) (*ShareNamer, error) {
+	if nameTemplate == "" {
+		return &ShareNamer{}, nil
+	}
+	parsed, err := template.New("share-name").Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid share name template '%s': %s", nameTemplate, err.Error())
+	}
+	namer := &ShareNamer{template: parsed}
+
+	name, err := namer.Name("instance-id-placeholder", RequestContext{})
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(name, "instance-id-placeholder") {
+		return nil, fmt.Errorf("share name template '%s' does not use {{.InstanceID}}", nameTemplate)
+	}
+	return namer, nil
+}
+
+// Name renders the share name, characters that are not safe in a directory name are replaced by dashes.
+func (n *ShareNamer) Name(instanceID string, context RequestContext) (string, error) {
+	if n == nil || n.template == nil {
+		return instanceID, nil
+	}
+
+	buffer := &bytes.Buffer{}
+	err := n.template.Execute(buffer, shareNameFields{
+		InstanceID:       instanceID,
+		Platform:         context.Platform,
+		OrganizationGUID: context.OrganizationGUID,
+		SpaceGUID:        context.SpaceGUID,
+		Namespace:        context.Namespace,
+		InstanceName:     context.InstanceName,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to name share of instance '%s': %s", instanceID, err.Error())
+	}
+	return strings.Trim(invalidShareNameChars.ReplaceAllString(buffer.String(), "-"), "-."), nil
+}
@@ -0,0 +1,368 @@
+package nfsbroker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var (
+	ErrSnapshotDoesNotExist  = errors.New("snapshot does not exist")
+	ErrSnapshotAlreadyExists = errors.New("snapshot already exists")
+	ErrInvalidSnapshotName   = errors.New("snapshot names consist of up to 64 letters, digits, '.', '_' and '-'")
+	// the applications bound to an instance would keep using the share replaced by the snapshot
+	ErrInstanceHasBindings error = brokerapi.NewFailureResponse(errors.New("a snapshot cannot be restored while the instance has bindings, unbind the applications first"),
+		http.StatusUnprocessableEntity, "instance-has-bindings")
+)
+
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// SnapshotManager manages the snapshots of the shares of instances.
+type SnapshotManager interface {
+	ListSnapshots(instanceID string) ([]Snapshot, error)
+	CreateSnapshot(instanceID, snapshotName string) (Snapshot, error)
+	RestoreSnapshot(instanceID, snapshotName string) error
+	DeleteSnapshot(instanceID, snapshotName string) error
+}
+
+// updateSnapshot takes a snapshot of the share as requested with the snapshot parameter of an update.
+func (b *broker) updateSnapshot(logger lager.Logger, instanceID string, details brokerapi.UpdateDetails, snapshotName interface{}, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
+	name, err := b.snapshotUpdate(logger, instanceID, details, snapshotName)
+	if err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	backend, shareName, err := b.startSnapshot(logger, instanceID, name)
+	if err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	if asyncAllowed {
+		go b.snapshot(logger, instanceID, backend, shareName, name)
+		return brokerapi.UpdateServiceSpec{IsAsync: true, OperationData: OperationUpdate}, nil
+	}
+
+	if _, err := b.snapshot(logger, instanceID, backend, shareName, name); err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	return brokerapi.UpdateServiceSpec{}, nil
+}
+
+// updateRestoreSnapshot restores a snapshot of the share as requested with the restore_snapshot parameter of an update.
+func (b *broker) updateRestoreSnapshot(logger lager.Logger, instanceID string, details brokerapi.UpdateDetails, snapshotName interface{}, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
+	name, err := b.snapshotUpdate(logger, instanceID, details, snapshotName)
+	if err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	backend, shareName, options, err := b.startRestoreSnapshot(logger, instanceID, name)
+	if err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	if asyncAllowed {
+		go b.restoreSnapshot(logger, instanceID, backend, shareName, name, options)
+		return brokerapi.UpdateServiceSpec{IsAsync: true, OperationData: OperationUpdate}, nil
+	}
+
+	if err := b.restoreSnapshot(logger, instanceID, backend, shareName, name, options); err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	return brokerapi.UpdateServiceSpec{}, nil
+}
+
+// snapshotUpdate returns the snapshot name of an update which takes or restores a snapshot, such an update
+// cannot change anything else.
+func (b *broker) snapshotUpdate(logger lager.Logger, instanceID string, details brokerapi.UpdateDetails, snapshotName interface{}) (string, error) {
+	name, ok := snapshotName.(string)
+	if !ok {
+		return "", ErrInvalidSnapshotName
+	}
+	existing, err := b.store.RetrieveInstanceDetails(logger, instanceID)
+	if err != nil {
+		return "", err
+	}
+	if len(details.Parameters) > 1 || (details.PlanID != "" && details.PlanID != existing.PlanID) {
+		return "", fmt.Errorf("a snapshot cannot be combined with other changes of the instance")
+	}
+	return name, nil
+}
+
+// startSnapshot records the snapshot as an update operation of the instance and returns the share to snapshot
+// and its backend.
+func (b *broker) startSnapshot(logger lager.Logger, instanceID, snapshotName string) (*Backend, string, error) {
+	if !snapshotNamePattern.MatchString(snapshotName) {
+		return nil, "", ErrInvalidSnapshotName
+	}
+
+	instanceLock := b.locks.forInstance(instanceID)
+	instanceLock.Lock()
+	defer instanceLock.Unlock()
+
+	if _, err := b.store.RetrieveInstanceDetails(logger, instanceID); err != nil {
+		return nil, "", err
+	}
+	metadata, err := b.metadata(logger, instanceID)
+	if err != nil {
+		return nil, "", err
+	}
+	backend, err := b.backend(logger, metadata)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, ok := findSnapshot(metadata.Snapshots, snapshotName); ok {
+		return nil, "", ErrSnapshotAlreadyExists
+	}
+
+	err = b.startOperation(logger, instanceID, b.operation(OperationUpdate, brokerapi.InProgress, fmt.Sprintf("creating snapshot '%s'", snapshotName)))
+	if err != nil {
+		logger.Error("failed-to-store-operation", err)
+		return nil, "", err
+	}
+	b.audit("snapshot", instanceID, b.withRequestIdentity(instanceID, metadata))
+	return backend, metadata.ShareName, nil
+}
+
+// snapshot takes the snapshot without holding the instance lock and records it with the instance.
+func (b *broker) snapshot(logger lager.Logger, instanceID string, backend *Backend, shareName, snapshotName string) (Snapshot, error) {
+	ctx, cancel := b.operationContext()
+	defer cancel()
+
+	errResp := backend.Controller.CreateSnapshot(ctx, logger, shareName, snapshotName)
+
+	instanceLock := b.locks.forInstance(instanceID)
+	instanceLock.Lock()
+	defer instanceLock.Unlock()
+
+	if errResp.Err != "" {
+		err := snapshotError(errResp)
+		logger.Error("create-snapshot-failed", err)
+		b.finishOperation(logger, instanceID, b.operation(OperationUpdate, brokerapi.Failed, errResp.Err))
+		return Snapshot{}, err
+	}
+
+	snapshot := Snapshot{Name: snapshotName, CreatedAt: time.Now().UTC()}
+	metadata, err := b.metadata(logger, instanceID)
+	if err == nil {
+		metadata.Snapshots = append(metadata.Snapshots, snapshot)
+		err = b.store.SaveMetadata(logger, instanceID, metadata)
+	}
+	if err != nil {
+		logger.Error("failed-to-record-snapshot", err)
+		b.finishOperation(logger, instanceID, b.operation(OperationUpdate, brokerapi.Failed, err.Error()))
+		return Snapshot{}, err
+	}
+	return snapshot, b.finishOperation(logger, instanceID, b.operation(OperationUpdate, brokerapi.Succeeded, fmt.Sprintf("snapshot '%s' created", snapshotName)))
+}
+
+func (b *broker) ListSnapshots(instanceID string) ([]Snapshot, error) {
+	logger := b.logger.Session("list-snapshots", lager.Data{"instance-id": instanceID})
+
+	if _, err := b.store.RetrieveInstanceDetails(logger, instanceID); err != nil {
+		return nil, err
+	}
+	metadata, err := b.metadata(logger, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.Snapshots == nil {
+		return []Snapshot{}, nil
+	}
+	return metadata.Snapshots, nil
+}
+
+func (b *broker) CreateSnapshot(instanceID, snapshotName string) (Snapshot, error) {
+	logger := b.logger.Session("create-snapshot", lager.Data{"instance-id": instanceID, "snapshot": snapshotName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	backend, shareName, err := b.startSnapshot(logger, instanceID, snapshotName)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return b.snapshot(logger, instanceID, backend, shareName, snapshotName)
+}
+
+// RestoreSnapshot starts replacing the content of the share by the snapshot as an update operation of the
+// instance, the previous content is moved into the trash. The outcome is reported by LastOperation.
+func (b *broker) RestoreSnapshot(instanceID, snapshotName string) error {
+	logger := b.logger.Session("restore-snapshot", lager.Data{"instance-id": instanceID, "snapshot": snapshotName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	backend, shareName, options, err := b.startRestoreSnapshot(logger, instanceID, snapshotName)
+	if err != nil {
+		return err
+	}
+	go b.restoreSnapshot(logger, instanceID, backend, shareName, snapshotName, options)
+	return nil
+}
+
+// startRestoreSnapshot records the restore as an update operation of the instance and returns the share to
+// restore, its backend and its options. Instances with bindings are not restored.
+func (b *broker) startRestoreSnapshot(logger lager.Logger, instanceID, snapshotName string) (*Backend, string, ShareOptions, error) {
+	instanceLock := b.locks.forInstance(instanceID)
+	instanceLock.Lock()
+	defer instanceLock.Unlock()
+
+	instance, metadata, err := b.idleInstance(logger, instanceID)
+	if err != nil {
+		return nil, "", ShareOptions{}, err
+	}
+	if _, ok := findSnapshot(metadata.Snapshots, snapshotName); !ok {
+		return nil, "", ShareOptions{}, ErrSnapshotDoesNotExist
+	}
+	bound, err := b.hasBindings(logger, instanceID, instance)
+	if err != nil {
+		return nil, "", ShareOptions{}, err
+	}
+	if bound {
+		return nil, "", ShareOptions{}, ErrInstanceHasBindings
+	}
+	options, err := b.evaluateShareOptions(logger, instance.PlanID, instance.RawParameters)
+	if err != nil {
+		return nil, "", ShareOptions{}, err
+	}
+	options.ProjectId = metadata.ProjectId
+	backend, err := b.backend(logger, metadata)
+	if err != nil {
+		return nil, "", ShareOptions{}, err
+	}
+
+	err = b.startOperation(logger, instanceID, b.operation(OperationUpdate, brokerapi.InProgress, fmt.Sprintf("restoring snapshot '%s'", snapshotName)))
+	if err != nil {
+		logger.Error("failed-to-store-operation", err)
+		return nil, "", ShareOptions{}, err
+	}
+	b.audit("restore-snapshot", instanceID, b.withRequestIdentity(instanceID, metadata))
+	return backend, metadata.ShareName, options, nil
+}
+
+// restoreSnapshot restores the snapshot without holding the instance lock and finishes the operation.
+func (b *broker) restoreSnapshot(logger lager.Logger, instanceID string, backend *Backend, shareName, snapshotName string, options ShareOptions) error {
+	ctx, cancel := b.operationContext()
+	defer cancel()
+
+	errResp := backend.Controller.RestoreSnapshot(ctx, logger, shareName, snapshotName, options)
+
+	instanceLock := b.locks.forInstance(instanceID)
+	instanceLock.Lock()
+	defer instanceLock.Unlock()
+
+	if errResp.Err != "" {
+		err := snapshotError(errResp)
+		logger.Error("restore-snapshot-failed", err)
+		b.finishOperation(logger, instanceID, b.operation(OperationUpdate, brokerapi.Failed, errResp.Err))
+		return err
+	}
+	return b.finishOperation(logger, instanceID, b.operation(OperationUpdate, brokerapi.Succeeded, fmt.Sprintf("snapshot '%s' restored", snapshotName)))
+}
+
+// hasBindings reports whether an instance has bindings, bindings which are not known to belong to another
+// instance count as bindings of the instance.
+func (b *broker) hasBindings(logger lager.Logger, instanceID string, instance brokerapi.ProvisionDetails) (bool, error) {
+	bindings, err := b.store.ListBindingDetails(logger)
+	if err != nil {
+		logger.Error("failed-to-list-bindings", err)
+		return false, err
+	}
+	for bindingID, binding := range bindings {
+		owned, err := b.bindingOwnedBy(logger, bindingID, binding, instanceID, instance)
+		if err != nil {
+			return false, err
+		}
+		if owned {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (b *broker) DeleteSnapshot(instanceID, snapshotName string) error {
+	logger := b.logger.Session("delete-snapshot", lager.Data{"instance-id": instanceID, "snapshot": snapshotName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	instanceLock := b.locks.forInstance(instanceID)
+	instanceLock.Lock()
+	defer instanceLock.Unlock()
+
+	_, metadata, err := b.idleInstance(logger, instanceID)
+	if err != nil {
+		return err
+	}
+	i, ok := findSnapshot(metadata.Snapshots, snapshotName)
+	if !ok {
+		return ErrSnapshotDoesNotExist
+	}
+
+	backend, err := b.backend(logger, metadata)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := b.operationContext()
+	defer cancel()
+	errResp := backend.Controller.DeleteSnapshot(ctx, logger, metadata.ShareName, snapshotName)
+	if errResp.Err != "" {
+		return snapshotError(errResp)
+	}
+	metadata.Snapshots = append(metadata.Snapshots[:i], metadata.Snapshots[i+1:]...)
+	if err := b.store.SaveMetadata(logger, instanceID, metadata); err != nil {
+		logger.Error("failed-to-forget-snapshot", err)
+		return err
+	}
+	return nil
+}
+
+// deleteSnapshots removes the snapshots of a deleted instance, failures only leave unused snapshots behind.
+func (b *broker) deleteSnapshots(ctx context.Context, logger lager.Logger, instanceID string, backend *Backend, shareName string) {
+	metadata, err := b.metadata(logger, instanceID)
+	if err != nil {
+		return
+	}
+	for _, snapshot := range metadata.Snapshots {
+		if errResp := backend.Controller.DeleteSnapshot(ctx, logger, shareName, snapshot.Name); errResp.Err != "" {
+			logger.Info("snapshot-left-behind", lager.Data{"snapshot": snapshot.Name, "reason": errResp.Err})
+		}
+	}
+}
+
+// idleInstance returns an instance without an operation in progress together with its metadata.
+func (b *broker) idleInstance(logger lager.Logger, instanceID string) (brokerapi.ProvisionDetails, Metadata, error) {
+	instance, err := b.store.RetrieveInstanceDetails(logger, instanceID)
+	if err != nil {
+		return brokerapi.ProvisionDetails{}, Metadata{}, err
+	}
+	if err := b.checkNoOperationInProgress(logger, instanceID); err != nil {
+		return brokerapi.ProvisionDetails{}, Metadata{}, err
+	}
+	metadata, err := b.metadata(logger, instanceID)
+	if err != nil {
+		return brokerapi.ProvisionDetails{}, Metadata{}, err
+	}
+	return instance, metadata, nil
+}
+
+// snapshotError restores ErrSnapshotsNotSupported from the error response of the controller.
+func snapshotError(errResp voldriver.ErrorResponse) error {
+	if errResp.Err == ErrSnapshotsNotSupported.Error() {
+		return ErrSnapshotsNotSupported
+	}
+	return errors.New(errResp.Err)
+}
+
+func findSnapshot(snapshots []Snapshot, snapshotName string) (int, bool) {
+	for i, snapshot := range snapshots {
+		if snapshot.Name == snapshotName {
+			return i, true
+		}
+	}
+	return -1, false
+}
@@ -0,0 +1,288 @@
+package nfsbroker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	SnapshotBackendNone     = "none"
+	SnapshotBackendCopy     = "copy"
+	SnapshotBackendHardlink = "hardlink"
+	SnapshotBackendBtrfs    = "btrfs"
+	SnapshotBackendZfs      = "zfs"
+
+	// directory of the export holding the snapshots of the copy, hardlink and btrfs drivers
+	SnapshotDir = ".snapshots"
+
+	btrfsSuperMagic = 0x9123683e
+	zfsSuperMagic   = 0x2fc12fc1
+	// inode number of the root directory of a btrfs subvolume
+	btrfsSubvolumeInode = 256
+)
+
+var ErrSnapshotsNotSupported = errors.New("snapshots are not enabled on this broker")
+
+// SnapshotDriver takes point-in-time copies of share directories.
+type SnapshotDriver interface {
+	CreateSnapshot(ctx context.Context, logger lager.Logger, shareName, snapshotName string) error
+	// RestoreSnapshot copies the share as it was in the snapshot to targetPath, which must not exist.
+	RestoreSnapshot(ctx context.Context, logger lager.Logger, shareName, snapshotName, targetPath string) error
+	DeleteSnapshot(ctx context.Context, logger lager.Logger, shareName, snapshotName string) error
+}
+
+// shareCreator is implemented by the snapshot drivers which can only snapshot shares they created themselves.
+type shareCreator interface {
+	CreateShare(ctx context.Context, logger lager.Logger, sharePath string) error
+}
+
+// NewSnapshotDriver creates the driver of a backend. The copy and hardlink backends work on the export as mounted
+// by the broker on mountPoint. The btrfs and zfs backends run their commands on the filesystem of the export and
+// need the broker to run on the nfs server: exportPath is the local path of the export, which must be the root of
+// a btrfs subvolume or of the zfs dataset zfsDataset. The btrfs backend creates each share as a subvolume of its
+// own, shares created before it was enabled cannot be snapshotted.
+func NewSnapshotDriver(backend string, invoker Invoker, mountPoint, exportPath, zfsDataset string) (SnapshotDriver, error) {
+	switch backend {
+	case "", SnapshotBackendNone:
+		return &noopSnapshotDriver{}, nil
+	case SnapshotBackendCopy:
+		return &copySnapshotDriver{invoker: invoker, mountPoint: mountPoint, copyArgs: []string{"-a", "--reflink=auto"}}, nil
+	case SnapshotBackendHardlink:
+		return &copySnapshotDriver{invoker: invoker, mountPoint: mountPoint, copyArgs: []string{"-al"}}, nil
+	case SnapshotBackendBtrfs:
+		if err := checkLocalExport(exportPath, "btrfs", btrfsSuperMagic); err != nil {
+			return nil, err
+		}
+		root, err := os.Stat(exportPath)
+		if err != nil {
+			return nil, err
+		}
+		if stat, ok := root.Sys().(*syscall.Stat_t); ok && stat.Ino != btrfsSubvolumeInode {
+			return nil, fmt.Errorf("the export '%s' is not the root of a btrfs subvolume", exportPath)
+		}
+		return &btrfsSnapshotDriver{invoker: invoker, mountPoint: mountPoint, exportPath: exportPath}, nil
+	case SnapshotBackendZfs:
+		if zfsDataset == "" {
+			return nil, fmt.Errorf("the zfs snapshot backend needs the dataset of the export")
+		}
+		if err := checkLocalExport(exportPath, "zfs", zfsSuperMagic); err != nil {
+			return nil, err
+		}
+		// restores copy the shares out of the snapshot directory, which zfs provides even with snapdir=hidden
+		if _, err := os.Stat(filepath.Join(exportPath, ".zfs", "snapshot")); err != nil {
+			return nil, fmt.Errorf("the export '%s' is not the root of a zfs dataset: %s", exportPath, err.Error())
+		}
+		return &zfsSnapshotDriver{invoker: invoker, mountPoint: mountPoint, exportPath: exportPath, dataset: zfsDataset}, nil
+	default:
+		return nil, fmt.Errorf("unknown snapshot backend '%s'", backend)
+	}
+}
+
+// checkLocalExport makes sure the export path is on a local filesystem of the given type, rather than on the nfs
+// mount of the broker.
+func checkLocalExport(exportPath, filesystem string, magic int64) error {
+	if exportPath == "" {
+		return fmt.Errorf("the %s snapshot backend needs the local path of the export, the broker has to run on the nfs server", filesystem)
+	}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(exportPath, &stat); err != nil {
+		return fmt.Errorf("failed to stat the export '%s': %s", exportPath, err.Error())
+	}
+	if int64(stat.Type) != magic {
+		return fmt.Errorf("the export '%s' is not on a local %s filesystem", exportPath, filesystem)
+	}
+	return nil
+}
+
+// exportTarget maps a path below the mount point of the broker to the same path below the local export.
+func exportTarget(mountPoint, exportPath, targetPath string) (string, error) {
+	rel, err := filepath.Rel(mountPoint, targetPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("'%s' is not below the mount point '%s'", targetPath, mountPoint)
+	}
+	return filepath.Join(exportPath, rel), nil
+}
+
+func invokeSnapshotCommand(ctx context.Context, logger lager.Logger, invoker Invoker, executable string, args []string) error {
+	err := invoker.Invoke(ctx, logger, executable, args)
+	if err != nil {
+		logger.Error("snapshot-command-failed", err, lager.Data{"cmd": executable, "args": args})
+		return failure(err, "failed to run %s", executable)
+	}
+	return nil
+}
+
+type noopSnapshotDriver struct{}
+
+func (d *noopSnapshotDriver) CreateSnapshot(ctx context.Context, logger lager.Logger, shareName, snapshotName string) error {
+	return ErrSnapshotsNotSupported
+}
+
+func (d *noopSnapshotDriver) RestoreSnapshot(ctx context.Context, logger lager.Logger, shareName, snapshotName, targetPath string) error {
+	return ErrSnapshotsNotSupported
+}
+
+func (d *noopSnapshotDriver) DeleteSnapshot(ctx context.Context, logger lager.Logger, shareName, snapshotName string) error {
+	return ErrSnapshotsNotSupported
+}
+
+// copySnapshotDriver copies the share with cp, as reflinks where the filesystem supports them or as hardlinks.
+// Hardlinked snapshots share their files with the share, they only protect against files being deleted or
+// replaced, not against files being changed in place.
+type copySnapshotDriver struct {
+	invoker    Invoker
+	mountPoint string
+	copyArgs   []string
+}
+
+func (d *copySnapshotDriver) snapshotPath(shareName, snapshotName string) string {
+	return filepath.Join(d.mountPoint, SnapshotDir, shareName, snapshotName)
+}
+
+func (d *copySnapshotDriver) CreateSnapshot(ctx context.Context, logger lager.Logger, shareName, snapshotName string) error {
+	logger = logger.Session("copy-create-snapshot")
+	logger.Info("start", lager.Data{"share": shareName, "snapshot": snapshotName})
+	defer logger.Info("end")
+
+	snapshotPath := d.snapshotPath(shareName, snapshotName)
+	err := invokeSnapshotCommand(ctx, logger, d.invoker, "mkdir", []string{"-p", filepath.Dir(snapshotPath)})
+	if err != nil {
+		return err
+	}
+	args := append(append([]string{}, d.copyArgs...), filepath.Join(d.mountPoint, shareName), snapshotPath)
+	return invokeSnapshotCommand(ctx, logger, d.invoker, "cp", args)
+}
+
+func (d *copySnapshotDriver) RestoreSnapshot(ctx context.Context, logger lager.Logger, shareName, snapshotName, targetPath string) error {
+	logger = logger.Session("copy-restore-snapshot")
+	logger.Info("start", lager.Data{"share": shareName, "snapshot": snapshotName})
+	defer logger.Info("end")
+
+	// always a full copy, the restored share must not share its files with the snapshot
+	return invokeSnapshotCommand(ctx, logger, d.invoker, "cp", []string{"-a", "--reflink=auto", d.snapshotPath(shareName, snapshotName), targetPath})
+}
+
+func (d *copySnapshotDriver) DeleteSnapshot(ctx context.Context, logger lager.Logger, shareName, snapshotName string) error {
+	logger = logger.Session("copy-delete-snapshot")
+	logger.Info("start", lager.Data{"share": shareName, "snapshot": snapshotName})
+	defer logger.Info("end")
+
+	return invokeSnapshotCommand(ctx, logger, d.invoker, "rm", []string{"-rf", d.snapshotPath(shareName, snapshotName)})
+}
+
+// btrfsSnapshotDriver creates the shares as subvolumes of the export, which must be a local btrfs subvolume, takes
+// read-only snapshots of the subvolume of a share and restores a share as a writable snapshot of its snapshot.
+// Snapshotting the share rather than the export keeps the data of the other shares out of the snapshots, a share
+// which is not a subvolume cannot be snapshotted. Deleted shares are removed like directories, which removes empty
+// subvolumes on Linux 4.18 and later.
+type btrfsSnapshotDriver struct {
+	invoker    Invoker
+	mountPoint string
+	exportPath string
+}
+
+func (d *btrfsSnapshotDriver) snapshotPath(shareName, snapshotName string) string {
+	return filepath.Join(d.exportPath, SnapshotDir, shareName, snapshotName)
+}
+
+func (d *btrfsSnapshotDriver) CreateShare(ctx context.Context, logger lager.Logger, sharePath string) error {
+	logger = logger.Session("btrfs-create-share")
+	logger.Info("start", lager.Data{"share-path": sharePath})
+	defer logger.Info("end")
+
+	target, err := exportTarget(d.mountPoint, d.exportPath, sharePath)
+	if err != nil {
+		return err
+	}
+	return invokeSnapshotCommand(ctx, logger, d.invoker, "btrfs", []string{"subvolume", "create", target})
+}
+
+func (d *btrfsSnapshotDriver) CreateSnapshot(ctx context.Context, logger lager.Logger, shareName, snapshotName string) error {
+	logger = logger.Session("btrfs-create-snapshot")
+	logger.Info("start", lager.Data{"share": shareName, "snapshot": snapshotName})
+	defer logger.Info("end")
+
+	snapshotPath := d.snapshotPath(shareName, snapshotName)
+	err := invokeSnapshotCommand(ctx, logger, d.invoker, "mkdir", []string{"-p", filepath.Dir(snapshotPath)})
+	if err != nil {
+		return err
+	}
+	// btrfs refuses to snapshot a directory which is not a subvolume
+	args := []string{"subvolume", "snapshot", "-r", filepath.Join(d.exportPath, shareName), snapshotPath}
+	err = d.invoker.Invoke(ctx, logger, "btrfs", args)
+	if err != nil {
+		logger.Error("snapshot-command-failed", err, lager.Data{"cmd": "btrfs", "args": args})
+		return failure(err, "failed to snapshot share '%s', only shares created as btrfs subvolumes can be snapshotted", shareName)
+	}
+	return nil
+}
+
+func (d *btrfsSnapshotDriver) RestoreSnapshot(ctx context.Context, logger lager.Logger, shareName, snapshotName, targetPath string) error {
+	logger = logger.Session("btrfs-restore-snapshot")
+	logger.Info("start", lager.Data{"share": shareName, "snapshot": snapshotName})
+	defer logger.Info("end")
+
+	target, err := exportTarget(d.mountPoint, d.exportPath, targetPath)
+	if err != nil {
+		return err
+	}
+	return invokeSnapshotCommand(ctx, logger, d.invoker, "btrfs", []string{"subvolume", "snapshot", d.snapshotPath(shareName, snapshotName), target})
+}
+
+func (d *btrfsSnapshotDriver) DeleteSnapshot(ctx context.Context, logger lager.Logger, shareName, snapshotName string) error {
+	logger = logger.Session("btrfs-delete-snapshot")
+	logger.Info("start", lager.Data{"share": shareName, "snapshot": snapshotName})
+	defer logger.Info("end")
+
+	return invokeSnapshotCommand(ctx, logger, d.invoker, "btrfs", []string{"subvolume", "delete", d.snapshotPath(shareName, snapshotName)})
+}
+
+// zfsSnapshotDriver snapshots the dataset of the export and restores a share by copying it out of
+// the .zfs/snapshot directory of the local dataset.
+type zfsSnapshotDriver struct {
+	invoker    Invoker
+	mountPoint string
+	exportPath string
+	dataset    string
+}
+
+// snapshotName names the snapshot of the dataset, share names never contain colons.
+func (d *zfsSnapshotDriver) snapshotName(shareName, snapshotName string) string {
+	return shareName + ":" + snapshotName
+}
+
+func (d *zfsSnapshotDriver) CreateSnapshot(ctx context.Context, logger lager.Logger, shareName, snapshotName string) error {
+	logger = logger.Session("zfs-create-snapshot")
+	logger.Info("start", lager.Data{"share": shareName, "snapshot": snapshotName})
+	defer logger.Info("end")
+
+	return invokeSnapshotCommand(ctx, logger, d.invoker, "zfs", []string{"snapshot", d.dataset + "@" + d.snapshotName(shareName, snapshotName)})
+}
+
+func (d *zfsSnapshotDriver) RestoreSnapshot(ctx context.Context, logger lager.Logger, shareName, snapshotName, targetPath string) error {
+	logger = logger.Session("zfs-restore-snapshot")
+	logger.Info("start", lager.Data{"share": shareName, "snapshot": snapshotName})
+	defer logger.Info("end")
+
+	target, err := exportTarget(d.mountPoint, d.exportPath, targetPath)
+	if err != nil {
+		return err
+	}
+	source := filepath.Join(d.exportPath, ".zfs", "snapshot", d.snapshotName(shareName, snapshotName), shareName)
+	return invokeSnapshotCommand(ctx, logger, d.invoker, "cp", []string{"-a", source, target})
+}
+
+func (d *zfsSnapshotDriver) DeleteSnapshot(ctx context.Context, logger lager.Logger, shareName, snapshotName string) error {
+	logger = logger.Session("zfs-delete-snapshot")
+	logger.Info("start", lager.Data{"share": shareName, "snapshot": snapshotName})
+	defer logger.Info("end")
+
+	return invokeSnapshotCommand(ctx, logger, d.invoker, "zfs", []string{"destroy", d.dataset + "@" + d.snapshotName(shareName, snapshotName)})
+}
@@ -0,0 +1,102 @@
+package nfsbroker
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"code.cloudfoundry.org/goshims/ioutil"
+	"code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Snapshot drivers", func() {
+	var (
+		ctx     context.Context
+		logger  lager.Logger
+		invoker *fakeInvoker
+		dir     string
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		logger = lager.NewLogger("snapshot-driver-test")
+		invoker = &fakeInvoker{}
+		var err error
+		dir, err = ioutil.TempDir("", "snapshot-driver")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("needs the local path of the export for btrfs and zfs", func() {
+		_, err := NewSnapshotDriver(SnapshotBackendBtrfs, invoker, "/mnt/export", "", "")
+		Expect(err).To(MatchError(ContainSubstring("needs the local path of the export")))
+		_, err = NewSnapshotDriver(SnapshotBackendZfs, invoker, "/mnt/export", "", "pool/export")
+		Expect(err).To(MatchError(ContainSubstring("needs the local path of the export")))
+	})
+
+	It("rejects an export which is not on a btrfs or zfs filesystem", func() {
+		_, err := NewSnapshotDriver(SnapshotBackendBtrfs, invoker, "/mnt/export", dir, "")
+		Expect(err).To(MatchError(ContainSubstring("is not on a local btrfs filesystem")))
+		_, err = NewSnapshotDriver(SnapshotBackendZfs, invoker, "/mnt/export", dir, "pool/export")
+		Expect(err).To(MatchError(ContainSubstring("is not on a local zfs filesystem")))
+	})
+
+	It("creates each share as a btrfs subvolume and snapshots and restores the subvolume of the share", func() {
+		driver := &btrfsSnapshotDriver{invoker: invoker, mountPoint: "/mnt/export", exportPath: "/srv/export"}
+		Expect(driver.CreateShare(ctx, logger, "/mnt/export/share")).To(Succeed())
+		Expect(driver.CreateSnapshot(ctx, logger, "share", "snap")).To(Succeed())
+		Expect(driver.RestoreSnapshot(ctx, logger, "share", "snap", "/mnt/export/share")).To(Succeed())
+		Expect(invoker.Calls()).To(Equal([][]string{
+			{"btrfs", "subvolume", "create", "/srv/export/share"},
+			{"mkdir", "-p", "/srv/export/.snapshots/share"},
+			{"btrfs", "subvolume", "snapshot", "-r", "/srv/export/share", "/srv/export/.snapshots/share/snap"},
+			{"btrfs", "subvolume", "snapshot", "/srv/export/.snapshots/share/snap", "/srv/export/share"},
+		}))
+	})
+
+	It("refuses to snapshot a share which is not a btrfs subvolume", func() {
+		driver := &btrfsSnapshotDriver{invoker: invoker, mountPoint: "/mnt/export", exportPath: "/srv/export"}
+		invoker.InvokeStub = func(executable string, args []string) error {
+			if executable == "btrfs" {
+				return errors.New("exit status 1")
+			}
+			return nil
+		}
+		err := driver.CreateSnapshot(ctx, logger, "share", "snap")
+		Expect(err).To(MatchError("failed to snapshot share 'share', only shares created as btrfs subvolumes can be snapshotted"))
+	})
+
+	It("creates the shares of the btrfs backend through the driver", func() {
+		mountPoint, err := ioutil.TempDir("", "snapshot-driver-mount")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(mountPoint)
+		driver := &btrfsSnapshotDriver{invoker: invoker, mountPoint: mountPoint, exportPath: "/srv/export"}
+		client := NewNfsClientWithInfokerAndFileUtil("1.2.3.4", "/export", 3, nil, nil, invoker, mountPoint, &osshim.OsShim{}, &ioutilshim.IoutilShim{}, &noopQuotaDriver{}, driver, ClientTimeouts{})
+
+		_, err = client.CreateShare(ctx, logger, "share")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(invoker.Calls()).To(Equal([][]string{{"btrfs", "subvolume", "create", "/srv/export/share"}}))
+	})
+
+	It("restores a zfs snapshot from the snapshot directory of the local dataset", func() {
+		driver := &zfsSnapshotDriver{invoker: invoker, mountPoint: "/mnt/export", exportPath: "/srv/export", dataset: "pool/export"}
+		Expect(driver.RestoreSnapshot(ctx, logger, "share", "snap", "/mnt/export/share")).To(Succeed())
+		Expect(invoker.Calls()).To(Equal([][]string{
+			{"cp", "-a", "/srv/export/.zfs/snapshot/share:snap/share", "/srv/export/share"},
+		}))
+	})
+
+	It("does not restore outside of the export", func() {
+		driver := &zfsSnapshotDriver{invoker: invoker, mountPoint: "/mnt/export", exportPath: "/srv/export", dataset: "pool/export"}
+		Expect(driver.RestoreSnapshot(ctx, logger, "share", "snap", "/mnt/other/share")).NotTo(Succeed())
+		Expect(invoker.Calls()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,585 @@
+package nfsbroker
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	DialectSqlite   = "sqlite3"
+	DialectMysql    = "mysql"
+	DialectPostgres = "postgres"
+)
+
+const (
+	instancesTable  = "service_instances"
+	bindingsTable   = "service_bindings"
+	operationsTable = "service_operations"
+	metadataTable   = "service_metadata"
+	leasesTable     = "service_leases"
+)
+
+const (
+	// a lease of a broker which stopped renewing it expires after leaseDuration, the clocks of the brokers
+	// have to agree within a fraction of it
+	leaseDuration      = 30 * time.Second
+	leaseRenewInterval = leaseDuration / 3
+	// pause between the attempts to take a lease held by another broker
+	leaseRetryInterval = 20 * time.Millisecond
+)
+
+// ErrConcurrentUpdate is returned for a record changed by another broker between reading and writing it.
+var ErrConcurrentUpdate = errors.New("the record was changed by another broker, retry the request")
+
+// migrations are applied in order, each one exactly once, the statements must be valid for every dialect.
+var migrations = [][]string{
+	{
+		"CREATE TABLE IF NOT EXISTS service_instances (id VARCHAR(255) NOT NULL PRIMARY KEY, data TEXT NOT NULL, version INTEGER NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS service_bindings (id VARCHAR(255) NOT NULL PRIMARY KEY, data TEXT NOT NULL, version INTEGER NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS service_operations (id VARCHAR(255) NOT NULL PRIMARY KEY, data TEXT NOT NULL, version INTEGER NOT NULL)",
+	},
+	{
+		"CREATE TABLE IF NOT EXISTS service_metadata (id VARCHAR(255) NOT NULL PRIMARY KEY, data TEXT NOT NULL, version INTEGER NOT NULL)",
+	},
+	{
+		"CREATE TABLE IF NOT EXISTS service_leases (id VARCHAR(255) NOT NULL PRIMARY KEY, data TEXT NOT NULL, version INTEGER NOT NULL)",
+	},
+}
+
+// sqlStore keeps the state in a database shared by several brokers, every row carries a version
+// that is checked on update so that concurrent writers from different brokers are detected.
+// The brokers serialize their requests through the leases of the store.
+type sqlStore struct {
+	db      *sql.DB
+	dialect string
+	// owner of the leases taken through this store
+	owner string
+}
+
+// lease is the row of a lease, expires is a unix time in nanoseconds.
+type lease struct {
+	Owner   string          `json:"owner"`
+	Expires int64           `json:"expires"`
+	Value   json.RawMessage `json:"value,omitempty"`
+}
+
+// NewSqlStore opens a database through a database/sql driver registered under one of the dialect names,
+// the driver has to be linked into the broker.
+func NewSqlStore(driverName, dataSourceName string) (Store, error) {
+	switch driverName {
+	case DialectSqlite, DialectMysql, DialectPostgres:
+	default:
+		return nil, fmt.Errorf("unsupported sql driver '%s'", driverName)
+	}
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if driverName == DialectSqlite {
+		// sqlite only supports a single writer
+		db.SetMaxOpenConns(1)
+	}
+	owner := make([]byte, 16)
+	if _, err := rand.Read(owner); err != nil {
+		return nil, err
+	}
+	return &sqlStore{db: db, dialect: driverName, owner: hex.EncodeToString(owner)}, nil
+}
+
+func (s *sqlStore) Restore(logger lager.Logger) error {
+	logger = logger.Session("migrate-sql-store")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if err := s.db.Ping(); err != nil {
+		logger.Error("failed-to-connect", err)
+		return err
+	}
+	if _, err := s.db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL PRIMARY KEY)"); err != nil {
+		logger.Error("failed-to-create-migrations-table", err)
+		return err
+	}
+
+	var current sql.NullInt64
+	if err := s.db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&current); err != nil {
+		logger.Error("failed-to-read-schema-version", err)
+		return err
+	}
+	for i := int(current.Int64); i < len(migrations); i++ {
+		version := i + 1
+		logger.Info("applying-migration", lager.Data{"version": version})
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, statement := range migrations[i] {
+			if _, err = tx.Exec(statement); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			_, err = tx.Exec(s.rebind("INSERT INTO schema_migrations (version) VALUES (?)"), version)
+		}
+		if err != nil {
+			tx.Rollback()
+			// brokers starting at the same time race to apply a migration, the primary key lets only one of them record it
+			if s.db.QueryRow(s.rebind("SELECT version FROM schema_migrations WHERE version = ?"), version).Scan(&current) == nil {
+				logger.Info("migration-applied-by-another-broker", lager.Data{"version": version})
+				continue
+			}
+			logger.Error("failed-to-apply-migration", err, lager.Data{"version": version})
+			return fmt.Errorf("failed to apply schema migration %d: %s", version, err.Error())
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) CreateInstanceDetails(logger lager.Logger, instanceID string, details brokerapi.ProvisionDetails) error {
+	created, err := s.insert(logger, instancesTable, instanceID, details)
+	if err == nil && !created {
+		return brokerapi.ErrInstanceAlreadyExists
+	}
+	return err
+}
+
+func (s *sqlStore) RetrieveInstanceDetails(logger lager.Logger, instanceID string) (brokerapi.ProvisionDetails, error) {
+	details := brokerapi.ProvisionDetails{}
+	_, found, err := s.get(logger, instancesTable, instanceID, &details)
+	if err != nil {
+		return brokerapi.ProvisionDetails{}, err
+	}
+	if !found {
+		return brokerapi.ProvisionDetails{}, brokerapi.ErrInstanceDoesNotExist
+	}
+	return details, nil
+}
+
+func (s *sqlStore) UpdateInstanceDetails(logger lager.Logger, instanceID string, details brokerapi.ProvisionDetails) error {
+	version, found, err := s.get(logger, instancesTable, instanceID, &brokerapi.ProvisionDetails{})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+	return s.update(logger, instancesTable, instanceID, version, details)
+}
+
+func (s *sqlStore) DeleteInstanceDetails(logger lager.Logger, instanceID string) error {
+	deleted, err := s.delete(logger, instancesTable, instanceID)
+	if err == nil && !deleted {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+	return err
+}
+
+func (s *sqlStore) ListInstanceDetails(logger lager.Logger) (map[string]brokerapi.ProvisionDetails, error) {
+	instances := map[string]brokerapi.ProvisionDetails{}
+	err := s.list(logger, instancesTable, func(id string, data []byte) error {
+		details := brokerapi.ProvisionDetails{}
+		if err := json.Unmarshal(data, &details); err != nil {
+			return err
+		}
+		instances[id] = details
+		return nil
+	})
+	return instances, err
+}
+
+func (s *sqlStore) CreateBindingDetails(logger lager.Logger, bindingID string, details brokerapi.BindDetails) error {
+	created, err := s.insert(logger, bindingsTable, bindingID, details)
+	if err == nil && !created {
+		return brokerapi.ErrBindingAlreadyExists
+	}
+	return err
+}
+
+func (s *sqlStore) RetrieveBindingDetails(logger lager.Logger, bindingID string) (brokerapi.BindDetails, error) {
+	details := brokerapi.BindDetails{}
+	_, found, err := s.get(logger, bindingsTable, bindingID, &details)
+	if err != nil {
+		return brokerapi.BindDetails{}, err
+	}
+	if !found {
+		return brokerapi.BindDetails{}, brokerapi.ErrBindingDoesNotExist
+	}
+	return details, nil
+}
+
+func (s *sqlStore) DeleteBindingDetails(logger lager.Logger, bindingID string) error {
+	deleted, err := s.delete(logger, bindingsTable, bindingID)
+	if err == nil && !deleted {
+		return brokerapi.ErrBindingDoesNotExist
+	}
+	return err
+}
+
+func (s *sqlStore) ListBindingDetails(logger lager.Logger) (map[string]brokerapi.BindDetails, error) {
+	bindings := map[string]brokerapi.BindDetails{}
+	err := s.list(logger, bindingsTable, func(id string, data []byte) error {
+		details := brokerapi.BindDetails{}
+		if err := json.Unmarshal(data, &details); err != nil {
+			return err
+		}
+		bindings[id] = details
+		return nil
+	})
+	return bindings, err
+}
+
+func (s *sqlStore) StartOperation(logger lager.Logger, instanceID string, operation OperationRecord) error {
+	existing := OperationRecord{}
+	version, found, err := s.get(logger, operationsTable, instanceID, &existing)
+	if err != nil {
+		return err
+	}
+	if !found {
+		created, err := s.insert(logger, operationsTable, instanceID, operation)
+		if err == nil && !created {
+			return ErrOperationInProgress
+		}
+		return err
+	}
+	if existing.State == brokerapi.InProgress {
+		return ErrOperationInProgress
+	}
+	err = s.update(logger, operationsTable, instanceID, version, operation)
+	if err == ErrConcurrentUpdate {
+		return ErrOperationInProgress
+	}
+	return err
+}
+
+func (s *sqlStore) SaveOperation(logger lager.Logger, instanceID string, operation OperationRecord) error {
+	for {
+		version, found, err := s.get(logger, operationsTable, instanceID, &OperationRecord{})
+		if err != nil {
+			return err
+		}
+		if !found {
+			created, err := s.insert(logger, operationsTable, instanceID, operation)
+			if err != nil || created {
+				return err
+			}
+			continue
+		}
+		err = s.update(logger, operationsTable, instanceID, version, operation)
+		if err != ErrConcurrentUpdate {
+			return err
+		}
+	}
+}
+
+func (s *sqlStore) RetrieveOperation(logger lager.Logger, instanceID string) (OperationRecord, error) {
+	operation := OperationRecord{}
+	_, found, err := s.get(logger, operationsTable, instanceID, &operation)
+	if err != nil {
+		return OperationRecord{}, err
+	}
+	if !found {
+		return OperationRecord{}, ErrOperationDoesNotExist
+	}
+	return operation, nil
+}
+
+func (s *sqlStore) DeleteOperation(logger lager.Logger, instanceID string) error {
+	_, err := s.delete(logger, operationsTable, instanceID)
+	return err
+}
+
+func (s *sqlStore) ListOperations(logger lager.Logger) (map[string]OperationRecord, error) {
+	operations := map[string]OperationRecord{}
+	err := s.list(logger, operationsTable, func(id string, data []byte) error {
+		operation := OperationRecord{}
+		if err := json.Unmarshal(data, &operation); err != nil {
+			return err
+		}
+		operations[id] = operation
+		return nil
+	})
+	return operations, err
+}
+
+func (s *sqlStore) SaveMetadata(logger lager.Logger, id string, metadata Metadata) error {
+	for {
+		version, found, err := s.get(logger, metadataTable, id, &Metadata{})
+		if err != nil {
+			return err
+		}
+		if !found {
+			created, err := s.insert(logger, metadataTable, id, metadata)
+			if err != nil || created {
+				return err
+			}
+			continue
+		}
+		err = s.update(logger, metadataTable, id, version, metadata)
+		if err != ErrConcurrentUpdate {
+			return err
+		}
+	}
+}
+
+func (s *sqlStore) RetrieveMetadata(logger lager.Logger, id string) (Metadata, error) {
+	metadata := Metadata{}
+	_, found, err := s.get(logger, metadataTable, id, &metadata)
+	if err != nil {
+		return Metadata{}, err
+	}
+	if !found {
+		return Metadata{}, ErrMetadataDoesNotExist
+	}
+	return metadata, nil
+}
+
+func (s *sqlStore) DeleteMetadata(logger lager.Logger, id string) error {
+	_, err := s.delete(logger, metadataTable, id)
+	return err
+}
+
+func (s *sqlStore) ListMetadata(logger lager.Logger) (map[string]Metadata, error) {
+	metadata := map[string]Metadata{}
+	err := s.list(logger, metadataTable, func(id string, data []byte) error {
+		record := Metadata{}
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		metadata[id] = record
+		return nil
+	})
+	return metadata, err
+}
+
+func (s *sqlStore) Lease(logger lager.Logger, name string, value interface{}) (func(), error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		acquired, err := s.acquireLease(logger, name, data)
+		if err != nil {
+			return nil, err
+		}
+		if acquired {
+			break
+		}
+		time.Sleep(leaseRetryInterval)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(leaseRenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := s.renewLease(logger, name, data); err != nil {
+					logger.Error("failed-to-renew-lease", err, lager.Data{"lease": name})
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+		if err := s.releaseLease(logger, name); err != nil {
+			logger.Error("failed-to-release-lease", err, lager.Data{"lease": name})
+		}
+	}, nil
+}
+
+func (s *sqlStore) Leases(logger lager.Logger, prefix string) (map[string]json.RawMessage, error) {
+	now := time.Now().UnixNano()
+	leases := map[string]json.RawMessage{}
+	err := s.list(logger, leasesTable, func(id string, data []byte) error {
+		if !strings.HasPrefix(id, prefix) {
+			return nil
+		}
+		record := lease{}
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		if record.Expires > now {
+			leases[id] = record.Value
+		}
+		return nil
+	})
+	return leases, err
+}
+
+// acquireLease takes a lease which is free or expired, it reports false for a lease which is held.
+func (s *sqlStore) acquireLease(logger lager.Logger, name string, value json.RawMessage) (bool, error) {
+	record := lease{Owner: s.owner, Expires: time.Now().Add(leaseDuration).UnixNano(), Value: value}
+	existing := lease{}
+	version, found, err := s.get(logger, leasesTable, name, &existing)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		return s.insert(logger, leasesTable, name, record)
+	}
+	if existing.Expires > time.Now().UnixNano() {
+		return false, nil
+	}
+	logger.Info("taking-expired-lease", lager.Data{"lease": name, "owner": existing.Owner})
+	err = s.update(logger, leasesTable, name, version, record)
+	if err == ErrConcurrentUpdate {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *sqlStore) renewLease(logger lager.Logger, name string, value json.RawMessage) error {
+	existing := lease{}
+	version, found, err := s.get(logger, leasesTable, name, &existing)
+	if err != nil {
+		return err
+	}
+	if !found || existing.Owner != s.owner {
+		return fmt.Errorf("lease '%s' was taken over by another broker", name)
+	}
+	return s.update(logger, leasesTable, name, version, lease{Owner: s.owner, Expires: time.Now().Add(leaseDuration).UnixNano(), Value: value})
+}
+
+// releaseLease deletes a lease unless another broker took it over after it expired.
+func (s *sqlStore) releaseLease(logger lager.Logger, name string) error {
+	existing := lease{}
+	version, found, err := s.get(logger, leasesTable, name, &existing)
+	if err != nil || !found || existing.Owner != s.owner {
+		return err
+	}
+	_, err = s.db.Exec(s.rebind("DELETE FROM "+leasesTable+" WHERE id = ? AND version = ?"), name, version)
+	if err != nil {
+		logger.Error("failed-to-delete-row", err, lager.Data{"table": leasesTable, "id": name})
+		return fmt.Errorf("failed to delete '%s' from '%s'", name, leasesTable)
+	}
+	return nil
+}
+
+// rebind converts the ? placeholders of a query to the placeholders of the dialect.
+func (s *sqlStore) rebind(query string) string {
+	if s.dialect != DialectPostgres {
+		return query
+	}
+	rebound := ""
+	for i, part := range strings.Split(query, "?") {
+		if i > 0 {
+			rebound += "$" + strconv.Itoa(i)
+		}
+		rebound += part
+	}
+	return rebound
+}
+
+func (s *sqlStore) get(logger lager.Logger, table, id string, value interface{}) (int64, bool, error) {
+	var data string
+	var version int64
+	err := s.db.QueryRow(s.rebind("SELECT data, version FROM "+table+" WHERE id = ?"), id).Scan(&data, &version)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		logger.Error("failed-to-read-row", err, lager.Data{"table": table, "id": id})
+		return 0, false, fmt.Errorf("failed to read '%s' from '%s'", id, table)
+	}
+	if err = json.Unmarshal([]byte(data), value); err != nil {
+		logger.Error("failed-to-unmarshal-row", err, lager.Data{"table": table, "id": id})
+		return 0, false, fmt.Errorf("row '%s' of '%s' is corrupt", id, table)
+	}
+	return version, true, nil
+}
+
+// insert creates a row and reports false when a row with the same id already exists.
+func (s *sqlStore) insert(logger lager.Logger, table, id string, value interface{}) (bool, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+	_, err = s.db.Exec(s.rebind("INSERT INTO "+table+" (id, data, version) VALUES (?, ?, 1)"), id, string(data))
+	if err != nil {
+		// the primary key violation is reported differently by every driver, check whether the row is there instead
+		var version int64
+		if s.db.QueryRow(s.rebind("SELECT version FROM "+table+" WHERE id = ?"), id).Scan(&version) == nil {
+			return false, nil
+		}
+		logger.Error("failed-to-insert-row", err, lager.Data{"table": table, "id": id})
+		return false, fmt.Errorf("failed to write '%s' to '%s'", id, table)
+	}
+	return true, nil
+}
+
+// update replaces a row only if it still has the version it was read with.
+func (s *sqlStore) update(logger lager.Logger, table, id string, version int64, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	result, err := s.db.Exec(s.rebind("UPDATE "+table+" SET data = ?, version = version + 1 WHERE id = ? AND version = ?"), string(data), id, version)
+	if err != nil {
+		logger.Error("failed-to-update-row", err, lager.Data{"table": table, "id": id})
+		return fmt.Errorf("failed to write '%s' to '%s'", id, table)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		logger.Info("concurrent-update", lager.Data{"table": table, "id": id, "version": version})
+		return ErrConcurrentUpdate
+	}
+	return nil
+}
+
+func (s *sqlStore) delete(logger lager.Logger, table, id string) (bool, error) {
+	result, err := s.db.Exec(s.rebind("DELETE FROM "+table+" WHERE id = ?"), id)
+	if err != nil {
+		logger.Error("failed-to-delete-row", err, lager.Data{"table": table, "id": id})
+		return false, fmt.Errorf("failed to delete '%s' from '%s'", id, table)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+func (s *sqlStore) list(logger lager.Logger, table string, decode func(id string, data []byte) error) error {
+	rows, err := s.db.Query("SELECT id, data FROM " + table)
+	if err != nil {
+		logger.Error("failed-to-list-rows", err, lager.Data{"table": table})
+		return fmt.Errorf("failed to list '%s'", table)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return err
+		}
+		if err := decode(id, []byte(data)); err != nil {
+			logger.Error("failed-to-unmarshal-row", err, lager.Data{"table": table, "id": id})
+			return fmt.Errorf("row '%s' of '%s' is corrupt", id, table)
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,166 @@
+package nfsbroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SQL store", func() {
+	var (
+		logger lager.Logger
+		dir    string
+		// two brokers sharing a database
+		brokers []*sqlStore
+	)
+
+	open := func() *sqlStore {
+		store, err := NewSqlStore(DialectSqlite, "file:"+filepath.Join(dir, "state.db")+"?_busy_timeout=10000")
+		Expect(err).NotTo(HaveOccurred())
+		return store.(*sqlStore)
+	}
+
+	// runs do concurrently count times on each broker and waits until all of them are done
+	onBrokers := func(count int, do func(store *sqlStore, i int)) {
+		var wg sync.WaitGroup
+		for _, store := range brokers {
+			for i := 0; i < count; i++ {
+				wg.Add(1)
+				go func(store *sqlStore, i int) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					do(store, i)
+				}(store, i)
+			}
+		}
+		wg.Wait()
+	}
+
+	BeforeEach(func() {
+		logger = lager.NewLogger("sql-store-test")
+		var err error
+		dir, err = ioutil.TempDir("", "sql-store")
+		Expect(err).NotTo(HaveOccurred())
+		brokers = []*sqlStore{open(), open()}
+		onBrokers(1, func(store *sqlStore, _ int) {
+			Expect(store.Restore(logger)).To(Succeed())
+		})
+	})
+
+	AfterEach(func() {
+		for _, store := range brokers {
+			store.db.Close()
+		}
+		os.RemoveAll(dir)
+	})
+
+	It("records each migration once", func() {
+		var count, versions int
+		Expect(brokers[0].db.QueryRow("SELECT COUNT(*), COUNT(DISTINCT version) FROM schema_migrations").Scan(&count, &versions)).To(Succeed())
+		Expect(count).To(Equal(len(migrations)))
+		Expect(versions).To(Equal(len(migrations)))
+
+		_, err := brokers[0].db.Exec("INSERT INTO schema_migrations (version) VALUES (1)")
+		Expect(err).To(HaveOccurred())
+		Expect(brokers[1].Restore(logger)).To(Succeed())
+	})
+
+	It("rejects an update of a record changed since it was read", func() {
+		store := brokers[0]
+		Expect(store.CreateInstanceDetails(logger, "instance", brokerapi.ProvisionDetails{PlanID: "plan-1"})).To(Succeed())
+		version, found, err := store.get(logger, instancesTable, "instance", &brokerapi.ProvisionDetails{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+
+		Expect(brokers[1].UpdateInstanceDetails(logger, "instance", brokerapi.ProvisionDetails{PlanID: "plan-2"})).To(Succeed())
+		err = store.update(logger, instancesTable, "instance", version, brokerapi.ProvisionDetails{PlanID: "plan-3"})
+		Expect(err).To(Equal(ErrConcurrentUpdate))
+
+		details, err := store.RetrieveInstanceDetails(logger, "instance")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(details.PlanID).To(Equal("plan-2"))
+	})
+
+	It("starts one of the operations requested at the same time by several brokers", func() {
+		var mutex sync.Mutex
+		started := 0
+		onBrokers(8, func(store *sqlStore, i int) {
+			err := store.StartOperation(logger, "instance", OperationRecord{Type: OperationProvision, State: brokerapi.InProgress, Owner: fmt.Sprint(i)})
+			if err == ErrOperationInProgress {
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			mutex.Lock()
+			started++
+			mutex.Unlock()
+		})
+		Expect(started).To(Equal(1))
+
+		Expect(brokers[1].SaveOperation(logger, "instance", OperationRecord{Type: OperationProvision, State: brokerapi.Succeeded})).To(Succeed())
+		started = 0
+		onBrokers(8, func(store *sqlStore, i int) {
+			err := store.StartOperation(logger, "instance", OperationRecord{Type: OperationUpdate, State: brokerapi.InProgress})
+			if err == ErrOperationInProgress {
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			mutex.Lock()
+			started++
+			mutex.Unlock()
+		})
+		Expect(started).To(Equal(1))
+	})
+
+	It("holds a lease for one broker at a time", func() {
+		release, err := brokers[0].Lease(logger, "instance/instance", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		acquired := make(chan func())
+		go func() {
+			defer GinkgoRecover()
+			release, err := brokers[1].Lease(logger, "instance/instance", nil)
+			Expect(err).NotTo(HaveOccurred())
+			acquired <- release
+		}()
+		Consistently(acquired, 100*time.Millisecond).ShouldNot(Receive())
+
+		release()
+		Eventually(acquired).Should(Receive(&release))
+		release()
+		Expect(brokers[0].Leases(logger, "instance/")).To(BeEmpty())
+	})
+
+	It("takes over a lease which was not renewed", func() {
+		_, err := brokers[0].Lease(logger, "instance/instance", nil)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = brokers[0].db.Exec("UPDATE service_leases SET data = ?", `{"owner": "gone", "expires": 0}`)
+		Expect(err).NotTo(HaveOccurred())
+
+		release, err := brokers[1].Lease(logger, "instance/instance", "taken over")
+		Expect(err).NotTo(HaveOccurred())
+		defer release()
+		Expect(brokers[0].Leases(logger, "instance/")).To(Equal(map[string]json.RawMessage{"instance/instance": json.RawMessage(`"taken over"`)}))
+	})
+
+	It("retries saves racing with other brokers until they are stored", func() {
+		onBrokers(8, func(store *sqlStore, i int) {
+			Expect(store.SaveMetadata(logger, "instance", Metadata{ShareName: fmt.Sprintf("share-%d", i)})).To(Succeed())
+		})
+
+		var version int64
+		Expect(brokers[0].db.QueryRow("SELECT version FROM service_metadata WHERE id = 'instance'").Scan(&version)).To(Succeed())
+		Expect(version).To(Equal(int64(2 * 8)))
+	})
+})
@@ -0,0 +1,120 @@
+package nfsbroker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutil"
+	"code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	StoreTypeFile = "file"
+	StoreTypeKV   = "kv"
+	StoreTypeSql  = "sql"
+)
+
+var (
+	ErrOperationDoesNotExist = errors.New("operation does not exist")
+	ErrMetadataDoesNotExist  = errors.New("metadata does not exist")
+)
+
+type OperationRecord struct {
+	Type        string                       `json:"type"`
+	State       brokerapi.LastOperationState `json:"state"`
+	Description string                       `json:"description"`
+	// id of the broker running the operation
+	Owner string `json:"owner,omitempty"`
+}
+
+// Metadata is what the broker records about an instance or binding besides the details sent by the platform.
+type Metadata struct {
+	Context RequestContext `json:"context"`
+	// directory of the share of an instance, empty for instances created before shares were named
+	ShareName string `json:"share_name,omitempty"`
+	// backend holding the share of an instance, empty for instances of the default backend created
+	// before backends were recorded
+	Backend string `json:"backend,omitempty"`
+	// id of the instance the share of an instance was cloned from
+	ClonedFrom string `json:"cloned_from,omitempty"`
+	// snapshots of the share of an instance, oldest first
+	Snapshots []Snapshot `json:"snapshots,omitempty"`
+	// kerberos principal of an instance or binding, without the realm
+	Principal string `json:"principal,omitempty"`
+	// quota project of the share of an instance, 0 for instances created before project ids were allocated
+	ProjectId uint32 `json:"project_id,omitempty"`
+	// instance a binding belongs to, empty for bindings created before it was recorded
+	InstanceID string `json:"instance_id,omitempty"`
+	// instances the share of an instance is being copied into, no operation of the instance is started until
+	// the copies are done
+	CloningInto []string `json:"cloning_into,omitempty"`
+}
+
+type Snapshot struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Store persists the instances, bindings and last operations of the broker.
+// Retrieving, updating or deleting a missing record returns brokerapi.ErrInstanceDoesNotExist,
+// brokerapi.ErrBindingDoesNotExist or ErrOperationDoesNotExist, creating an existing record
+// returns brokerapi.ErrInstanceAlreadyExists or brokerapi.ErrBindingAlreadyExists.
+type Store interface {
+	Restore(logger lager.Logger) error
+
+	CreateInstanceDetails(logger lager.Logger, instanceID string, details brokerapi.ProvisionDetails) error
+	RetrieveInstanceDetails(logger lager.Logger, instanceID string) (brokerapi.ProvisionDetails, error)
+	UpdateInstanceDetails(logger lager.Logger, instanceID string, details brokerapi.ProvisionDetails) error
+	DeleteInstanceDetails(logger lager.Logger, instanceID string) error
+	ListInstanceDetails(logger lager.Logger) (map[string]brokerapi.ProvisionDetails, error)
+
+	CreateBindingDetails(logger lager.Logger, bindingID string, details brokerapi.BindDetails) error
+	RetrieveBindingDetails(logger lager.Logger, bindingID string) (brokerapi.BindDetails, error)
+	DeleteBindingDetails(logger lager.Logger, bindingID string) error
+	ListBindingDetails(logger lager.Logger) (map[string]brokerapi.BindDetails, error)
+
+	// StartOperation saves the operation unless another operation of the instance is in progress,
+	// in which case ErrOperationInProgress is returned.
+	StartOperation(logger lager.Logger, instanceID string, operation OperationRecord) error
+	SaveOperation(logger lager.Logger, instanceID string, operation OperationRecord) error
+	RetrieveOperation(logger lager.Logger, instanceID string) (OperationRecord, error)
+	// DeleteOperation forgets the last operation of a deleted instance, deleting a missing operation is not an error.
+	DeleteOperation(logger lager.Logger, instanceID string) error
+	ListOperations(logger lager.Logger) (map[string]OperationRecord, error)
+
+	// metadata is keyed by the id of its instance or binding, deleting missing metadata is not an error.
+	SaveMetadata(logger lager.Logger, id string, metadata Metadata) error
+	RetrieveMetadata(logger lager.Logger, id string) (Metadata, error)
+	DeleteMetadata(logger lager.Logger, id string) error
+	ListMetadata(logger lager.Logger) (map[string]Metadata, error)
+}
+
+// Leaser is implemented by stores shared by several brokers, the brokers hold leases of the store while they
+// change state which the store cannot guard on its own. Stores kept by a single broker do not implement it.
+type Leaser interface {
+	// Lease waits until no other broker holds the named lease and holds it with a value until the returned
+	// function is called. A lease of a broker which stopped renewing it expires.
+	Lease(logger lager.Logger, name string, value interface{}) (func(), error)
+	// Leases returns the values of the held leases whose names start with prefix.
+	Leases(logger lager.Logger, prefix string) (map[string]json.RawMessage, error)
+}
+
+// NewStore creates a store of the given type, the file and kv stores keep their files in dataDir and
+// the sql store connects to the database sqlDataSource through the driver sqlDriver.
+func NewStore(storeType, dataDir, serviceName, sqlDriver, sqlDataSource string) (Store, error) {
+	switch storeType {
+	case "", StoreTypeFile:
+		return NewFileStore(&ioutilshim.IoutilShim{}, &osshim.OsShim{}, filepath.Join(dataDir, fmt.Sprintf("%s-services.json", serviceName))), nil
+	case StoreTypeKV:
+		return NewKVStore(&ioutilshim.IoutilShim{}, &osshim.OsShim{}, filepath.Join(dataDir, fmt.Sprintf("%s-state", serviceName))), nil
+	case StoreTypeSql:
+		return NewSqlStore(sqlDriver, sqlDataSource)
+	default:
+		return nil, fmt.Errorf("unknown state store '%s'", storeType)
+	}
+}
@@ -0,0 +1,299 @@
+package nfsbroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/goshims/ioutil"
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// TenantLimit restricts the instances of an organization or space.
+type TenantLimit struct {
+	// number of instances, 0 for no limit
+	MaxInstances int `json:"max_instances,omitempty"`
+	// size, such as "500G", the quotas of the instances may add up to, empty for no limit
+	MaxReserved string `json:"max_reserved,omitempty"`
+	// ids or names of the plans instances may be created with, empty for all plans
+	AllowedPlans []string `json:"allowed_plans,omitempty"`
+
+	maxReserved uint64
+}
+
+// TenantLimits are the limits of organizations and spaces, by guid.
+type TenantLimits struct {
+	Organizations map[string]*TenantLimit `json:"organizations"`
+	Spaces        map[string]*TenantLimit `json:"spaces"`
+}
+
+// LoadTenantLimits reads a JSON file with the limits of organizations and spaces.
+func LoadTenantLimits(ioutil ioutilshim.Ioutil, limitsPath string) (*TenantLimits, error) {
+	data, err := ioutil.ReadFile(limitsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenant limits file '%s': %s", limitsPath, err.Error())
+	}
+	limits := &TenantLimits{}
+	if err = json.Unmarshal(data, limits); err != nil {
+		return nil, fmt.Errorf("failed to parse tenant limits file '%s': %s", limitsPath, err.Error())
+	}
+	for _, tenants := range []map[string]*TenantLimit{limits.Organizations, limits.Spaces} {
+		for guid, limit := range tenants {
+			if limit.MaxInstances < 0 {
+				return nil, fmt.Errorf("invalid tenant limits file '%s': negative max_instances of '%s'", limitsPath, guid)
+			}
+			if limit.MaxReserved != "" {
+				if limit.maxReserved, err = parseSize(limit.MaxReserved); err != nil {
+					return nil, fmt.Errorf("invalid tenant limits file '%s': invalid max_reserved '%s' of '%s'", limitsPath, limit.MaxReserved, guid)
+				}
+			}
+		}
+	}
+	return limits, nil
+}
+
+// prefix of the leases holding the reservations of the brokers sharing a store
+const reservationLeasePrefix = "reservation/"
+
+// tenantReservations are the instances being provisioned or updated, with the details they get. They count
+// towards the limits of their organization and space until their operation is finished. With a store shared by
+// several brokers a reservation is also held as a lease of the store, releasing it releases the lease.
+type tenantReservations struct {
+	mutex     sync.Mutex
+	instances map[string]brokerapi.ProvisionDetails
+	leases    map[string]func()
+}
+
+func newTenantReservations() *tenantReservations {
+	return &tenantReservations{instances: map[string]brokerapi.ProvisionDetails{}, leases: map[string]func(){}}
+}
+
+func (r *tenantReservations) list() map[string]brokerapi.ProvisionDetails {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	instances := map[string]brokerapi.ProvisionDetails{}
+	for instanceID, details := range r.instances {
+		instances[instanceID] = details
+	}
+	return instances
+}
+
+func (r *tenantReservations) release(instanceID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.instances, instanceID)
+	if release, ok := r.leases[instanceID]; ok {
+		release()
+		delete(r.leases, instanceID)
+	}
+}
+
+// TenantConsumption is what the instances of an organization or space take.
+type TenantConsumption struct {
+	Instances int `json:"instances"`
+	// sum of the quotas of the instances in bytes
+	Reserved uint64       `json:"reserved"`
+	Limit    *TenantLimit `json:"limit,omitempty"`
+}
+
+// Consumption is the consumption of organizations and spaces, by guid.
+type Consumption struct {
+	Organizations map[string]*TenantConsumption `json:"organizations"`
+	Spaces        map[string]*TenantConsumption `json:"spaces"`
+}
+
+// ConsumptionReporter reports what organizations and spaces consume.
+type ConsumptionReporter interface {
+	Consumption() (Consumption, error)
+}
+
+// Consumption returns the consumption of every organization and space with instances or limits, including the
+// instances being provisioned or updated.
+func (b *broker) Consumption() (Consumption, error) {
+	logger := b.logger.Session("consumption")
+	reserved, err := b.reservedInstances(logger, b.reservations.list())
+	if err != nil {
+		return Consumption{}, err
+	}
+	return b.consumption(logger, "", reserved)
+}
+
+// reservedInstances adds the instances reserved by the other brokers sharing the store to the reservations of this broker.
+func (b *broker) reservedInstances(logger lager.Logger, own map[string]brokerapi.ProvisionDetails) (map[string]brokerapi.ProvisionDetails, error) {
+	leaser, ok := b.store.(Leaser)
+	if !ok {
+		return own, nil
+	}
+	leases, err := leaser.Leases(logger, reservationLeasePrefix)
+	if err != nil {
+		logger.Error("failed-to-list-reservations", err)
+		return nil, err
+	}
+	reserved := map[string]brokerapi.ProvisionDetails{}
+	for name, value := range leases {
+		details := brokerapi.ProvisionDetails{}
+		if err := json.Unmarshal(value, &details); err != nil {
+			logger.Error("invalid-reservation", err, lager.Data{"lease": name})
+			continue
+		}
+		reserved[strings.TrimPrefix(name, reservationLeasePrefix)] = details
+	}
+	for instanceID, details := range own {
+		reserved[instanceID] = details
+	}
+	return reserved, nil
+}
+
+// consumption sums up the instances of organizations and spaces, except for the instance exceptID. The reserved
+// instances count with the details they get.
+func (b *broker) consumption(logger lager.Logger, exceptID string, reserved map[string]brokerapi.ProvisionDetails) (Consumption, error) {
+	consumption := Consumption{Organizations: map[string]*TenantConsumption{}, Spaces: map[string]*TenantConsumption{}}
+	if b.tenantLimits != nil {
+		for guid, limit := range b.tenantLimits.Organizations {
+			consumption.Organizations[guid] = &TenantConsumption{Limit: limit}
+		}
+		for guid, limit := range b.tenantLimits.Spaces {
+			consumption.Spaces[guid] = &TenantConsumption{Limit: limit}
+		}
+	}
+
+	instances, err := b.store.ListInstanceDetails(logger)
+	if err != nil {
+		logger.Error("failed-to-list-instances", err)
+		return Consumption{}, err
+	}
+	counted := map[string]brokerapi.ProvisionDetails{}
+	for instanceID, instance := range instances {
+		counted[instanceID] = instance
+	}
+	for instanceID, instance := range reserved {
+		counted[instanceID] = instance
+	}
+	for instanceID, instance := range counted {
+		if instanceID == exceptID {
+			continue
+		}
+		var reserved uint64
+		if options, err := b.evaluateShareOptions(logger, instance.PlanID, instance.RawParameters); err == nil {
+			reserved = options.Quota
+		}
+		tenants := []struct {
+			consumption map[string]*TenantConsumption
+			guid        string
+		}{{consumption.Organizations, instance.OrganizationGUID}, {consumption.Spaces, instance.SpaceGUID}}
+		for _, tenant := range tenants {
+			if tenant.guid == "" {
+				continue
+			}
+			if tenant.consumption[tenant.guid] == nil {
+				tenant.consumption[tenant.guid] = &TenantConsumption{}
+			}
+			tenant.consumption[tenant.guid].Instances++
+			tenant.consumption[tenant.guid].Reserved += reserved
+		}
+	}
+	return consumption, nil
+}
+
+// reserveTenantLimits checks that the organization and space of an instance have room for it with the plan
+// and quota it is provisioned or updated to, the instance count is only checked for new instances. The instance
+// is reserved with these details until releaseTenantReservation, so that concurrent requests of this broker and of
+// the brokers sharing its store account for each other. A failure response describing the limit is returned when a
+// limit is met or the plan is not allowed, ErrOperationInProgress when the instance is already reserved by another
+// operation.
+func (b *broker) reserveTenantLimits(logger lager.Logger, instanceID string, details brokerapi.ProvisionDetails, quota uint64, newInstance bool) error {
+	if b.tenantLimits == nil {
+		return nil
+	}
+	b.reservations.mutex.Lock()
+	defer b.reservations.mutex.Unlock()
+
+	leaser, shared := b.store.(Leaser)
+	if shared {
+		defer holdLease(logger, leaser, "tenant-limits", nil)()
+	}
+	reserved, err := b.reservedInstances(logger, b.reservations.instances)
+	if err != nil {
+		return err
+	}
+	if _, ok := reserved[instanceID]; ok {
+		logger.Error("instance-already-reserved", ErrOperationInProgress)
+		return ErrOperationInProgress
+	}
+	consumption, err := b.consumption(logger, instanceID, reserved)
+	if err != nil {
+		return err
+	}
+	tenants := []struct {
+		kind        string
+		guid        string
+		consumption *TenantConsumption
+	}{
+		{"organization", details.OrganizationGUID, consumption.Organizations[details.OrganizationGUID]},
+		{"space", details.SpaceGUID, consumption.Spaces[details.SpaceGUID]},
+	}
+	for _, tenant := range tenants {
+		if tenant.guid == "" || tenant.consumption == nil || tenant.consumption.Limit == nil {
+			continue
+		}
+		if err := b.checkTenantLimit(tenant.kind, tenant.guid, tenant.consumption, details.PlanID, quota, newInstance); err != nil {
+			logger.Error("tenant-limit-met", err, lager.Data{tenant.kind: tenant.guid})
+			return err
+		}
+	}
+	if shared {
+		release, err := leaser.Lease(logger, reservationLeasePrefix+instanceID, details)
+		if err != nil {
+			logger.Error("failed-to-reserve", err)
+			return err
+		}
+		b.reservations.leases[instanceID] = release
+	}
+	b.reservations.instances[instanceID] = details
+	return nil
+}
+
+// releaseTenantReservation ends the reservation of an instance once its operation is finished or was not started.
+func (b *broker) releaseTenantReservation(instanceID string) {
+	b.reservations.release(instanceID)
+}
+
+// checkTenantLimit returns a failure response whose description the platform shows to the user, with 403 for a plan
+// which is not allowed and 422 for a limit which is met.
+func (b *broker) checkTenantLimit(kind, guid string, consumption *TenantConsumption, planID string, quota uint64, newInstance bool) error {
+	limit := consumption.Limit
+	if len(limit.AllowedPlans) > 0 {
+		plan, _ := b.catalog.Plan(planID)
+		allowed := false
+		for _, allowedPlan := range limit.AllowedPlans {
+			if allowedPlan == plan.Id || allowedPlan == plan.Name {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return brokerapi.NewFailureResponse(fmt.Errorf("plan '%s' is not available to %s '%s'", plan.Name, kind, guid),
+				http.StatusForbidden, "plan-not-allowed")
+		}
+	}
+	if newInstance && limit.MaxInstances > 0 && consumption.Instances >= limit.MaxInstances {
+		return tenantLimitMet("%s '%s' has reached its limit of %d instances", kind, guid, limit.MaxInstances)
+	}
+	if limit.maxReserved > 0 {
+		if quota == 0 {
+			return tenantLimitMet("instances of %s '%s' need a size, its storage is limited", kind, guid)
+		}
+		if quota > limit.maxReserved || consumption.Reserved > limit.maxReserved-quota {
+			return tenantLimitMet("%s '%s' has reserved %d of its %d bytes of storage, the instance needs %d", kind, guid, consumption.Reserved, limit.maxReserved, quota)
+		}
+	}
+	return nil
+}
+
+func tenantLimitMet(format string, args ...interface{}) error {
+	return brokerapi.NewFailureResponse(fmt.Errorf(format, args...), http.StatusUnprocessableEntity, "instance-limit-met")
+}
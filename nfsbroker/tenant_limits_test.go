@@ -0,0 +1,188 @@
+package nfsbroker
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tenant limits", func() {
+	var (
+		store *memoryStore
+		tb    testBroker
+	)
+
+	provision := func(instanceID, planID string, async bool) error {
+		_, err := tb.Provision(instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID, OrganizationGUID: "org"}, async)
+		return err
+	}
+
+	BeforeEach(func() {
+		store = newMemoryStore()
+		tb = newTestBroker(store, &fakeInvoker{}, testCatalog())
+		tb.tenantLimits = &TenantLimits{Organizations: map[string]*TenantLimit{"org": {MaxInstances: 2}}}
+	})
+
+	AfterEach(func() {
+		tb.cleanup()
+	})
+
+	It("rejects an instance over the limit with a description the platform shows", func() {
+		Expect(provision("instance-1", "plan-id", false)).To(Succeed())
+		Expect(provision("instance-2", "plan-id", false)).To(Succeed())
+
+		router := mux.NewRouter()
+		brokerapi.AttachRoutes(router, tb.broker, tb.logger)
+		recorder := httptest.NewRecorder()
+		body := `{"service_id": "service-id", "plan_id": "plan-id", "organization_guid": "org", "space_guid": "space"}`
+		router.ServeHTTP(recorder, httptest.NewRequest("PUT", "/v2/service_instances/instance-3", strings.NewReader(body)))
+		Expect(recorder.Code).To(Equal(http.StatusUnprocessableEntity))
+		Expect(recorder.Body.String()).To(MatchJSON(`{"description": "organization 'org' has reached its limit of 2 instances"}`))
+	})
+
+	It("rejects a plan which is not allowed with its own description", func() {
+		tb.tenantLimits.Organizations["org"].AllowedPlans = []string{"big"}
+
+		err := provision("instance-1", "plan-id", false)
+		Expect(err).To(MatchError("plan 'free' is not available to organization 'org'"))
+		Expect(err.(*brokerapi.FailureResponse).ValidatedStatusCode(tb.logger)).To(Equal(http.StatusForbidden))
+		Expect(provision("instance-1", "big-plan-id", false)).To(Succeed())
+	})
+
+	It("rejects an instance whose quota exceeds the storage of its organization", func() {
+		tb.tenantLimits.Organizations["org"].maxReserved = 15 << 30
+		Expect(provision("instance-1", "big-plan-id", false)).To(Succeed())
+		Expect(provision("instance-2", "big-plan-id", false)).To(MatchError(fmt.Sprintf("organization 'org' has reserved %d of its %d bytes of storage, the instance needs %d", 10<<30, 15<<30, 10<<30)))
+		Expect(provision("instance-2", "plan-id", false)).To(MatchError("instances of organization 'org' need a size, its storage is limited"))
+	})
+
+	It("accounts concurrent provisions for each other", func() {
+		tb.store = &slowStore{memoryStore: store}
+		var (
+			wg       sync.WaitGroup
+			mutex    sync.Mutex
+			accepted int
+		)
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				err := provision(fmt.Sprintf("instance-%d", i), "plan-id", false)
+				if _, ok := err.(*brokerapi.FailureResponse); ok {
+					return
+				}
+				Expect(err).NotTo(HaveOccurred())
+				mutex.Lock()
+				accepted++
+				mutex.Unlock()
+			}(i)
+		}
+		wg.Wait()
+		Expect(accepted).To(Equal(2))
+	})
+
+	It("counts an instance being provisioned until its provision is finished", func() {
+		tb.tenantLimits.Organizations["org"].MaxInstances = 1
+		Expect(tb.reserveTenantLimits(tb.logger, "instance-1", brokerapi.ProvisionDetails{PlanID: "plan-id", OrganizationGUID: "org"}, 0, true)).To(Succeed())
+
+		consumption, err := tb.Consumption()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(consumption.Organizations["org"].Instances).To(Equal(1))
+		Expect(provision("instance-2", "plan-id", false)).To(MatchError("organization 'org' has reached its limit of 1 instances"))
+
+		tb.releaseTenantReservation("instance-1")
+		Expect(provision("instance-2", "plan-id", false)).To(Succeed())
+	})
+
+	It("does not reserve an instance twice", func() {
+		details := brokerapi.ProvisionDetails{PlanID: "plan-id", OrganizationGUID: "org"}
+		Expect(tb.reserveTenantLimits(tb.logger, "instance-1", details, 0, true)).To(Succeed())
+		Expect(tb.reserveTenantLimits(tb.logger, "instance-1", details, 0, false)).To(Equal(ErrOperationInProgress))
+		Expect(tb.reservations.list()).To(HaveKey("instance-1"))
+	})
+
+	It("accounts the provisions of brokers sharing a store for each other", func() {
+		dir, err := ioutil.TempDir("", "shared-store")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		var (
+			wg       sync.WaitGroup
+			mutex    sync.Mutex
+			accepted int
+		)
+		for b := 0; b < 2; b++ {
+			shared, err := NewSqlStore(DialectSqlite, "file:"+filepath.Join(dir, "state.db")+"?_busy_timeout=10000")
+			Expect(err).NotTo(HaveOccurred())
+			defer shared.(*sqlStore).db.Close()
+			Expect(shared.Restore(tb.logger)).To(Succeed())
+			broker := newTestBroker(&slowSqlStore{sqlStore: shared.(*sqlStore)}, &fakeInvoker{}, testCatalog())
+			defer broker.cleanup()
+			broker.tenantLimits = tb.tenantLimits
+
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func(instanceID string) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					_, err := broker.Provision(instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id", OrganizationGUID: "org"}, false)
+					if _, ok := err.(*brokerapi.FailureResponse); ok {
+						return
+					}
+					Expect(err).NotTo(HaveOccurred())
+					mutex.Lock()
+					accepted++
+					mutex.Unlock()
+				}(fmt.Sprintf("instance-%d-%d", b, i))
+			}
+		}
+		wg.Wait()
+		Expect(accepted).To(Equal(2))
+	})
+
+	It("releases the reservation of a provision which was not started", func() {
+		tb.client.SetMountError(tb.logger, errors.New("connection refused"))
+		Expect(provision("instance-1", "plan-id", false)).To(Equal(brokerapi.ErrInstanceLimitMet))
+		Expect(tb.reservations.list()).To(BeEmpty())
+
+		tb.client.SetMountError(tb.logger, nil)
+		tb.InspectBackends()
+		Expect(provision("instance-1", "plan-id", false)).To(Succeed())
+		Expect(tb.reservations.list()).To(BeEmpty())
+	})
+})
+
+// slowStore takes its time to store new instances, as a store on a busy database would.
+type slowStore struct {
+	*memoryStore
+}
+
+func (s *slowStore) CreateInstanceDetails(logger lager.Logger, instanceID string, details brokerapi.ProvisionDetails) error {
+	time.Sleep(10 * time.Millisecond)
+	return s.memoryStore.CreateInstanceDetails(logger, instanceID, details)
+}
+
+type slowSqlStore struct {
+	*sqlStore
+}
+
+func (s *slowSqlStore) CreateInstanceDetails(logger lager.Logger, instanceID string, details brokerapi.ProvisionDetails) error {
+	time.Sleep(50 * time.Millisecond)
+	return s.sqlStore.CreateInstanceDetails(logger, instanceID, details)
+}
@@ -0,0 +1,103 @@
+package nfsbroker
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// default number of filesystem calls a client runs at once
+const DefaultFilesystemWorkers = 16
+
+// ClientTimeouts bounds the calls of a client to its export, a zero timeout leaves the calls unbounded.
+type ClientTimeouts struct {
+	// commands such as mount, cp and the quota tools, and walks of whole directory trees
+	Command time.Duration
+	// single filesystem calls such as mkdir, stat or rename
+	Filesystem time.Duration
+	// filesystem calls running at once, an abandoned call keeps its worker until it returns
+	FilesystemWorkers int
+}
+
+// TimeoutError is returned for a call abandoned at its deadline, the call itself may still be blocked
+// on a hung export.
+type TimeoutError struct {
+	Operation string
+	Timeout   time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s did not complete within %s", e.Operation, e.Timeout)
+}
+
+func isTimeout(err error) bool {
+	_, ok := err.(*TimeoutError)
+	return ok
+}
+
+// withTimeout bounds a context by a timeout and returns the time left until the resulting deadline.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc, time.Duration) {
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	return ctx, cancel, timeLeft(ctx)
+}
+
+// timeLeft is the time left until the deadline of a context, 0 for a context without deadline.
+func timeLeft(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return time.Until(deadline)
+	}
+	return 0
+}
+
+// contextError is the error of a call abandoned because its context is done.
+func contextError(ctx context.Context, operation string, timeout time.Duration) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{Operation: operation, Timeout: timeout.Round(time.Millisecond)}
+	}
+	return fmt.Errorf("%s was cancelled", operation)
+}
+
+// FilesystemPool runs filesystem calls on a bounded number of goroutines. A call which blocks on a hung
+// export past its deadline is abandoned: the caller gets a TimeoutError while the call keeps its worker
+// until the kernel lets it return, so that a hung export cannot pile up blocked goroutines.
+type FilesystemPool struct {
+	workers chan struct{}
+}
+
+func NewFilesystemPool(workers int) *FilesystemPool {
+	if workers <= 0 {
+		workers = DefaultFilesystemWorkers
+	}
+	return &FilesystemPool{workers: make(chan struct{}, workers)}
+}
+
+// Run runs a call within the deadline of the context and the timeout, waiting for a free worker counts
+// towards the deadline.
+func (p *FilesystemPool) Run(ctx context.Context, timeout time.Duration, operation string, call func() error) error {
+	ctx, cancel, left := withTimeout(ctx, timeout)
+	defer cancel()
+
+	select {
+	case p.workers <- struct{}{}:
+	case <-ctx.Done():
+		return contextError(ctx, operation, left)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() { <-p.workers }()
+		done <- call()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return contextError(ctx, operation, left)
+	}
+}
@@ -0,0 +1,247 @@
+package nfsbroker
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/goshims/execshim"
+	"code.cloudfoundry.org/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Timeouts", func() {
+	var logger lager.Logger
+
+	BeforeEach(func() {
+		logger = lager.NewLogger("timeouts-test")
+	})
+
+	Describe("FilesystemPool", func() {
+		var (
+			pool *FilesystemPool
+			// releases the hung calls
+			hung chan struct{}
+			hang func() error
+		)
+
+		BeforeEach(func() {
+			pool = NewFilesystemPool(1)
+			// calls abandoned by earlier specs keep blocking on their own channel
+			released := make(chan struct{})
+			hung = released
+			hang = func() error {
+				<-released
+				return nil
+			}
+		})
+
+		AfterEach(func() {
+			close(hung)
+		})
+
+		It("returns the outcome of a call which completes in time", func() {
+			Expect(pool.Run(context.Background(), time.Second, "stat", func() error { return nil })).To(Succeed())
+			Expect(pool.Run(context.Background(), 0, "stat", func() error { return syscall.ENOENT })).To(Equal(syscall.ENOENT))
+		})
+
+		It("abandons a hung call at its timeout", func() {
+			started := time.Now()
+			err := pool.Run(context.Background(), 50*time.Millisecond, "stat", hang)
+			Expect(err).To(BeAssignableToTypeOf(&TimeoutError{}))
+			Expect(err.(*TimeoutError).Operation).To(Equal("stat"))
+			Expect(err.(*TimeoutError).Timeout).To(BeNumerically("~", 50*time.Millisecond, 5*time.Millisecond))
+			Expect(time.Since(started)).To(BeNumerically("<", time.Second))
+		})
+
+		It("abandons a hung call at the deadline of its context when it comes first", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			started := time.Now()
+			Expect(isTimeout(pool.Run(ctx, time.Minute, "rename", hang))).To(BeTrue())
+			Expect(time.Since(started)).To(BeNumerically("<", time.Second))
+		})
+
+		It("abandons a call whose context is cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				cancel()
+			}()
+			Expect(pool.Run(ctx, 0, "mkdir", hang)).To(MatchError("mkdir was cancelled"))
+		})
+
+		It("keeps the worker of an abandoned call until the call returns", func() {
+			Expect(isTimeout(pool.Run(context.Background(), 10*time.Millisecond, "stat", hang))).To(BeTrue())
+
+			ran := false
+			err := pool.Run(context.Background(), 50*time.Millisecond, "stat", func() error {
+				ran = true
+				return nil
+			})
+			Expect(isTimeout(err)).To(BeTrue())
+			Expect(ran).To(BeFalse())
+
+			hung <- struct{}{}
+			Expect(pool.Run(context.Background(), time.Second, "stat", func() error {
+				ran = true
+				return nil
+			})).To(Succeed())
+			Expect(ran).To(BeTrue())
+		})
+
+		It("runs as many calls at once as it has workers", func() {
+			pool = NewFilesystemPool(3)
+			wg := sync.WaitGroup{}
+			for i := 0; i < 3; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					pool.Run(context.Background(), 20*time.Millisecond, "stat", hang)
+				}()
+			}
+			wg.Wait()
+
+			Expect(isTimeout(pool.Run(context.Background(), 20*time.Millisecond, "stat", func() error { return nil }))).To(BeTrue())
+		})
+
+		It("has the default number of workers without a number", func() {
+			Expect(cap(NewFilesystemPool(0).workers)).To(Equal(DefaultFilesystemWorkers))
+		})
+	})
+
+	Describe("realInvoker", func() {
+		var (
+			commands *recordingExec
+			invoker  Invoker
+		)
+
+		BeforeEach(func() {
+			commands = &recordingExec{}
+			invoker = NewRealInvokerWithExec(commands)
+		})
+
+		It("returns the error of a command which fails", func() {
+			Expect(invoker.Invoke(context.Background(), logger, "true", nil)).To(Succeed())
+			Expect(invoker.Invoke(context.Background(), logger, "false", nil)).To(MatchError("exit status 1"))
+		})
+
+		It("kills a command still running at the deadline of its context", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			started := time.Now()
+			err := invoker.Invoke(ctx, logger, "sleep", []string{"60"})
+			Expect(isTimeout(err)).To(BeTrue())
+			Expect(err.(*TimeoutError).Operation).To(Equal("sleep"))
+			Expect(time.Since(started)).To(BeNumerically("<", time.Second))
+
+			process := commands.Last().Process
+			Eventually(func() error { return syscall.Kill(process.Pid, 0) }).Should(Equal(syscall.ESRCH))
+		})
+
+		It("kills a command whose context is cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				cancel()
+			}()
+
+			Expect(invoker.Invoke(ctx, logger, "sleep", []string{"60"})).To(MatchError("sleep was cancelled"))
+			process := commands.Last().Process
+			Eventually(func() error { return syscall.Kill(process.Pid, 0) }).Should(Equal(syscall.ESRCH))
+		})
+
+		It("does not start a command whose context is already done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			Expect(invoker.Invoke(ctx, logger, "true", nil)).To(MatchError("true was cancelled"))
+			Expect(commands.Last()).To(BeNil())
+		})
+	})
+
+	Describe("mounting the export", func() {
+		var (
+			tb      testBroker
+			invoker *fakeInvoker
+			files   *fakeIoutil
+			// releases the hung mount command
+			hung chan struct{}
+		)
+
+		BeforeEach(func() {
+			hung = make(chan struct{})
+			files = &fakeIoutil{}
+			invoker = &fakeInvoker{InvokeStub: func(executable string, args []string) error {
+				if executable == "mount" {
+					<-hung
+					return errors.New("mount.nfs: Connection timed out")
+				}
+				return nil
+			}}
+			tb = newTestBroker(newMemoryStore(), invoker, testCatalog())
+			tb.client.mountTable = NewMountTable(files, ProcMountInfo)
+			tb.client.mounted = false
+		})
+
+		AfterEach(func() {
+			tb.cleanup()
+		})
+
+		It("does not block other callers on a hung mount and mounts the export once", func() {
+			mounted := make(chan error, 1)
+			go func() {
+				_, err := tb.client.MountFileSystem(context.Background(), tb.logger, "/")
+				mounted <- err
+			}()
+			Eventually(invoker.Calls).Should(HaveLen(1))
+
+			Expect(tb.client.IsFilesystemMounted(tb.logger)).To(BeFalse())
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			started := time.Now()
+			_, err := tb.client.MountFileSystem(ctx, tb.logger, "/")
+			Expect(isTimeout(err)).To(BeTrue())
+			Expect(time.Since(started)).To(BeNumerically("<", time.Second))
+
+			waiting := make(chan error, 1)
+			go func() {
+				_, err := tb.client.MountFileSystem(context.Background(), tb.logger, "/")
+				waiting <- err
+			}()
+			Consistently(waiting).ShouldNot(Receive())
+
+			close(hung)
+			Eventually(mounted).Should(Receive(MatchError("mount.nfs: Connection timed out")))
+			Eventually(waiting).Should(Receive(MatchError("mount.nfs: Connection timed out")))
+			Expect(invoker.Calls()).To(HaveLen(1))
+		})
+	})
+})
+
+// recordingExec runs commands and keeps the last one it started.
+type recordingExec struct {
+	execshim.ExecShim
+	mutex sync.Mutex
+	last  *exec.Cmd
+}
+
+func (e *recordingExec) Command(name string, arg ...string) execshim.Cmd {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.last = exec.Command(name, arg...)
+	return e.last
+}
+
+func (e *recordingExec) Last() *exec.Cmd {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.last
+}
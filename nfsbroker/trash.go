@@ -0,0 +1,180 @@
+package nfsbroker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// Purger periodically removes the deleted shares of all backends whose retention period has expired.
+type Purger struct {
+	logger    lager.Logger
+	backends  *Backends
+	interval  time.Duration
+	retention time.Duration
+}
+
+func NewPurger(logger lager.Logger, backends *Backends, interval, retention time.Duration) *Purger {
+	return &Purger{
+		logger:    logger,
+		backends:  backends,
+		interval:  interval,
+		retention: retention,
+	}
+}
+
+func (p *Purger) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	close(ready)
+	for {
+		select {
+		case <-ticker.C:
+			p.PurgeExpired()
+		case <-signals:
+			return nil
+		}
+	}
+}
+
+// List returns the deleted shares of all backends together with the time they will be purged.
+func (p *Purger) List() ([]TrashEntry, error) {
+	logger := p.logger.Session("list-trash")
+	ctx := context.Background()
+	all := []TrashEntry{}
+	for _, backend := range p.backends.All() {
+		if err := ensureMounted(ctx, logger, backend.Client); err != nil {
+			return nil, err
+		}
+		entries, err := backend.Client.ListTrash(ctx, logger)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			entry.Backend = backend.Name
+			entry.PurgeAt = entry.DeletedAt.Add(p.retention)
+			all = append(all, entry)
+		}
+	}
+	return all, nil
+}
+
+// Purge removes a deleted share of a backend right away, the empty backend name is the default backend.
+func (p *Purger) Purge(backendName, name string) error {
+	logger := p.logger.Session("purge")
+	backend, err := p.backends.Get(backendName)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if err := ensureMounted(ctx, logger, backend.Client); err != nil {
+		return err
+	}
+	return backend.Client.PurgeTrash(ctx, logger, name)
+}
+
+// PurgeExpired removes the deleted shares that have been in the trash for longer than the retention period.
+func (p *Purger) PurgeExpired() {
+	logger := p.logger.Session("purge-expired")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	entries, err := p.List()
+	if err != nil {
+		logger.Error("failed-to-list-trash", err)
+		return
+	}
+	for _, entry := range entries {
+		if time.Now().Before(entry.PurgeAt) {
+			continue
+		}
+		backend, err := p.backends.Get(entry.Backend)
+		if err != nil {
+			continue
+		}
+		if err := backend.Client.PurgeTrash(context.Background(), logger, entry.Name); err != nil {
+			continue
+		}
+		logger.Info("purged", lager.Data{"name": entry.Name, "deleted-at": entry.DeletedAt})
+	}
+}
+
+func ensureMounted(ctx context.Context, logger lager.Logger, client Client) error {
+	if err := client.MountError(logger); err != nil {
+		return err
+	}
+	if client.IsFilesystemMounted(logger) {
+		return nil
+	}
+	_, err := client.MountFileSystem(ctx, logger, "/")
+	return err
+}
+
+// TrashRestorer restores the data of a deleted share into the share of an instance.
+type TrashRestorer interface {
+	RestoreTrash(trashName, instanceID string) error
+}
+
+// RestoreTrash starts moving the data of a deleted share into the empty share of an existing instance,
+// typically an instance provisioned to replace one that was deleted by mistake. The deleted share
+// has to be in the trash of the backend of the instance. The move is an update operation of the
+// instance, its outcome is reported by LastOperation.
+func (b *broker) RestoreTrash(trashName, instanceID string) error {
+	logger := b.logger.Session("restore-trash", lager.Data{"trash": trashName, "instance-id": instanceID})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	instanceLock := b.locks.forInstance(instanceID)
+	instanceLock.Lock()
+	defer instanceLock.Unlock()
+
+	instance, metadata, err := b.idleInstance(logger, instanceID)
+	if err != nil {
+		return err
+	}
+	options, err := b.evaluateShareOptions(logger, instance.PlanID, instance.RawParameters)
+	if err != nil {
+		return err
+	}
+	options.ProjectId = metadata.ProjectId
+
+	backend, err := b.backend(logger, metadata)
+	if err != nil {
+		return err
+	}
+
+	err = b.startOperation(logger, instanceID, b.operation(OperationUpdate, brokerapi.InProgress, fmt.Sprintf("restoring deleted share '%s'", trashName)))
+	if err != nil {
+		logger.Error("failed-to-store-operation", err)
+		return err
+	}
+	b.audit("restore", instanceID, b.withRequestIdentity(instanceID, metadata))
+
+	go b.restoreTrash(logger, instanceID, backend, trashName, metadata.ShareName, options)
+	return nil
+}
+
+// restoreTrash moves the deleted share without holding the instance lock and finishes the operation.
+func (b *broker) restoreTrash(logger lager.Logger, instanceID string, backend *Backend, trashName, shareName string, options ShareOptions) {
+	ctx, cancel := b.operationContext()
+	defer cancel()
+
+	errResp := backend.Controller.Restore(ctx, logger, trashName, shareName, options)
+
+	instanceLock := b.locks.forInstance(instanceID)
+	instanceLock.Lock()
+	defer instanceLock.Unlock()
+
+	if errResp.Err != "" {
+		logger.Error("restore-failed", errors.New(errResp.Err))
+		b.finishOperation(logger, instanceID, b.operation(OperationUpdate, brokerapi.Failed, errResp.Err))
+		return
+	}
+	b.finishOperation(logger, instanceID, b.operation(OperationUpdate, brokerapi.Succeeded, fmt.Sprintf("deleted share '%s' restored", trashName)))
+}
@@ -0,0 +1,84 @@
+package nfsbroker
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Purger", func() {
+	var (
+		tb     testBroker
+		purger *Purger
+	)
+
+	deleteShare := func(shareName string, deletedAt time.Time) string {
+		name := asideName(shareName, deletedAt)
+		Expect(os.MkdirAll(filepath.Join(tb.mountPoint, TrashDir, name, "data"), 0700)).To(Succeed())
+		return name
+	}
+
+	BeforeEach(func() {
+		tb = newTestBroker(newMemoryStore(), &fakeInvoker{}, testCatalog())
+		purger = NewPurger(tb.logger, tb.backends, 0, time.Hour)
+	})
+
+	AfterEach(func() {
+		tb.cleanup()
+	})
+
+	It("moves the share of a deprovisioned instance into the trash", func() {
+		_, err := tb.Provision("instance", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id"}, false)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = tb.Deprovision("instance", brokerapi.DeprovisionDetails{}, false)
+		Expect(err).NotTo(HaveOccurred())
+
+		entries, err := purger.List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].ShareName).To(Equal("instance"))
+		Expect(entries[0].Backend).To(Equal(DefaultBackendName))
+		Expect(entries[0].DeletedAt).To(BeTemporally("~", time.Now(), 2*time.Second))
+		Expect(entries[0].PurgeAt).To(Equal(entries[0].DeletedAt.Add(time.Hour)))
+		Expect(tb.shares()).To(BeEmpty())
+	})
+
+	It("purges the deleted shares kept for longer than the retention period", func() {
+		expired := deleteShare("expired", time.Now().Add(-2*time.Hour))
+		kept := deleteShare("kept", time.Now().Add(-30*time.Minute))
+
+		purger.PurgeExpired()
+		Expect(tb.trash()).To(Equal([]string{kept}))
+		Expect(filepath.Join(tb.mountPoint, TrashDir, expired)).NotTo(BeADirectory())
+	})
+
+	It("ignores the entries of the trash it did not put there", func() {
+		Expect(os.MkdirAll(filepath.Join(tb.mountPoint, TrashDir, "unknown"), 0700)).To(Succeed())
+
+		entries, err := purger.List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+		purger.PurgeExpired()
+		Expect(tb.trash()).To(Equal([]string{"unknown"}))
+	})
+
+	It("purges a deleted share right away on request", func() {
+		name := deleteShare("share", time.Now())
+
+		Expect(purger.Purge("", name)).To(Succeed())
+		Expect(tb.trash()).To(BeEmpty())
+		Expect(purger.Purge("unknown-backend", name)).To(Equal(ErrBackendDoesNotExist))
+	})
+
+	It("does not purge outside of the trash", func() {
+		Expect(os.Mkdir(filepath.Join(tb.mountPoint, "instance"), 0700)).To(Succeed())
+
+		Expect(purger.Purge("", "../instance")).NotTo(Succeed())
+		Expect(tb.shares()).To(ConsistOf("instance"))
+	})
+})